@@ -5,8 +5,10 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"veritaserum/src/certs"
 	"veritaserum/src/dbs"
 	proxy "veritaserum/src/http"
 	"veritaserum/src/messaging"
@@ -17,9 +19,20 @@ import (
 var distFiles embed.FS
 
 func main() {
-	replay  := flag.Bool("replay", false, "headless replay mode — loads suite JSON, no UI")
-	suite   := flag.String("suite", "", "path to suite JSON file (required with --replay)")
+	replay := flag.Bool("replay", false, "headless replay mode — loads suite JSON, no UI")
+	suite := flag.String("suite", "", "path to suite JSON file (required with --replay)")
 	timeout := flag.Duration("timeout", 0, "auto-exit after duration, e.g. 120s (replay mode only)")
+	record := flag.Bool("record", false, "forward unknown HTTP/DynamoDB requests upstream and record the real responses")
+	pgTLS := flag.Bool("pg-tls", false, "accept SSLRequest on the Postgres mock and upgrade to TLS with a certificate signed by the Veritaserum CA")
+	mysqlUser := flag.String("mysql-user", "", "only accept this MySQL user (with --mysql-password); any login is accepted when empty")
+	mysqlPass := flag.String("mysql-password", "", "password for --mysql-user")
+	mysqlAuth := flag.String("mysql-auth-plugin", "caching_sha2_password", "MySQL account auth plugin: caching_sha2_password or mysql_native_password")
+	captureHK := flag.Bool("capture-housekeeping", false, "register driver housekeeping statements (SET NAMES, SELECT @@version, SHOW …) as pending instead of auto-answering them")
+	redisState := flag.Bool("redis-stateful", false, "run Redis commands without a configured stub on an in-memory keyspace instead of leaving them pending")
+	redisNodes := flag.Int("redis-cluster", 0, "present the Redis mock as a cluster of N nodes on ports 6380, 6381, … with MOVED/ASK redirects (1: single-node cluster)")
+	sentinelPort := flag.String("redis-sentinel-port", "", "serve a Redis Sentinel endpoint on this port that reports the mock as master, e.g. 26379")
+	announceHost := flag.String("redis-announce-host", "", "host advertised in Redis cluster and Sentinel replies; defaults to the address the client connected to")
+	matchHeaders := flag.String("match-headers", "", "comma-separated request headers that take part in HTTP matching, e.g. Accept,X-Tenant-Id")
 	flag.Parse()
 
 	if *replay {
@@ -34,6 +47,21 @@ func main() {
 		store.LoadState()
 	}
 
+	if *matchHeaders != "" {
+		store.SetMatchHeaders(strings.Split(*matchHeaders, ","))
+	}
+
+	if *record {
+		for _, p := range store.Recordable {
+			store.SetRecording(p, true)
+		}
+		log.Printf("Record mode: unknown requests are forwarded upstream")
+	}
+
+	if err := certs.LoadOrCreateCA(); err != nil {
+		log.Printf("warn: HTTPS interception disabled: %v", err)
+	}
+
 	go func() {
 		log.Println("Proxy      listening on :9999")
 		if err := http.ListenAndServe(":9999", http.HandlerFunc(proxy.Handler)); err != nil {
@@ -41,9 +69,9 @@ func main() {
 		}
 	}()
 
-	go dbs.StartPostgresMock("54320")
-	go dbs.StartMySQLMock("33060")
-	go dbs.StartRedisMock("6380")
+	go dbs.StartPostgresMock("54320", dbs.PostgresOptions{TLS: *pgTLS, CaptureHousekeeping: *captureHK})
+	go dbs.StartMySQLMock("33060", dbs.MySQLOptions{User: *mysqlUser, Password: *mysqlPass, AuthPlugin: *mysqlAuth, CaptureHousekeeping: *captureHK})
+	go dbs.StartRedisMock("6380", dbs.RedisOptions{Stateful: *redisState, ClusterNodes: *redisNodes, SentinelPort: *sentinelPort, AnnounceHost: *announceHost})
 
 	if *replay && *timeout > 0 {
 		go func() {
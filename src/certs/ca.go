@@ -0,0 +1,183 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The CA is persisted next to veritaserum.json so that containers only need
+// to trust it once, not after every restart.
+const (
+	CACertFileName = "veritaserum-ca.pem"
+	CAKeyFileName  = "veritaserum-ca-key.pem"
+)
+
+var (
+	mu     sync.Mutex
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caPEM  []byte
+	leaves = map[string]*tls.Certificate{}
+)
+
+// LoadOrCreateCA loads the Veritaserum CA from disk, generating and saving a
+// new one when none exists yet.
+func LoadOrCreateCA() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	certPEM, certErr := os.ReadFile(CACertFileName)
+	keyPEM, keyErr := os.ReadFile(CAKeyFileName)
+	if certErr == nil && keyErr == nil {
+		if err := parseCA(certPEM, keyPEM); err != nil {
+			return fmt.Errorf("load CA: %w", err)
+		}
+		log.Printf("CA loaded from %s", CACertFileName)
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate CA key: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "Veritaserum Local CA", Organization: []string{"Veritaserum"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("create CA cert: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal CA key: %w", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := parseCA(certPEM, keyPEM); err != nil {
+		return err
+	}
+	if err := os.WriteFile(CACertFileName, certPEM, 0644); err != nil {
+		return fmt.Errorf("write CA cert: %w", err)
+	}
+	if err := os.WriteFile(CAKeyFileName, keyPEM, 0600); err != nil {
+		return fmt.Errorf("write CA key: %w", err)
+	}
+	log.Printf("CA generated and saved to %s", CACertFileName)
+	return nil
+}
+
+func parseCA(certPEM, keyPEM []byte) error {
+	cb, _ := pem.Decode(certPEM)
+	if cb == nil {
+		return fmt.Errorf("no PEM data in %s", CACertFileName)
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return err
+	}
+	kb, _ := pem.Decode(keyPEM)
+	if kb == nil {
+		return fmt.Errorf("no PEM data in %s", CAKeyFileName)
+	}
+	key, err := x509.ParseECPrivateKey(kb.Bytes)
+	if err != nil {
+		return err
+	}
+	caCert, caKey, caPEM = cert, key, certPEM
+	leaves = map[string]*tls.Certificate{}
+	return nil
+}
+
+// CACertPEM returns the PEM-encoded CA certificate clients should trust.
+func CACertPEM() []byte {
+	mu.Lock()
+	defer mu.Unlock()
+	return caPEM
+}
+
+// LeafCertificate returns a certificate for host signed by the CA, minting
+// and caching one on first use.
+func LeafCertificate(host string) (*tls.Certificate, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if caCert == nil {
+		return nil, fmt.Errorf("CA not initialised")
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if c, ok := leaves[host]; ok {
+		return c, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host, Organization: []string{"Veritaserum"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{
+		Certificate: [][]byte{der, caCert.Raw},
+		PrivateKey:  key,
+	}
+	leaves[host] = c
+	return c, nil
+}
+
+// ServerTLSConfig returns a TLS config that presents a CA-signed leaf for
+// whatever SNI name the client asks for, falling back to defaultHost.
+func ServerTLSConfig(defaultHost string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = defaultHost
+			}
+			return LeafCertificate(name)
+		},
+	}
+}
+
+func randomSerial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return n
+}
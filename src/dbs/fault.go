@@ -0,0 +1,103 @@
+package dbs
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"veritaserum/src/store"
+)
+
+type faultAction int
+
+const (
+	faultNone     faultAction = iota // write the response to the returned conn
+	faultError                       // send f.Error instead of the response
+	faultReset                       // connection was aborted, stop serving it
+	faultCanceled                    // the client canceled the query while it waited
+)
+
+// applyFault waits out the response latency and the fault's latency, then
+// decides how the response goes out. Drop and trickle faults are applied by
+// returning a wrapped conn that the response must be written to. Closing
+// cancel cuts the wait short; protocols without query cancellation pass nil.
+func applyFault(conn net.Conn, protocol string, resp *store.InteractionResponse, cancel <-chan struct{}) (net.Conn, *store.Fault, faultAction) {
+	f := store.FaultFor(protocol, resp)
+	delay := f.Delay()
+	if resp != nil && resp.LatencyMs > 0 {
+		delay += time.Duration(resp.LatencyMs) * time.Millisecond
+	}
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-cancel:
+			t.Stop()
+			return conn, nil, faultCanceled
+		}
+	}
+	if !f.Fires() {
+		return conn, nil, faultNone
+	}
+	switch {
+	case f.Reset:
+		resetConn(conn)
+		return conn, f, faultReset
+	case f.Error != nil:
+		return conn, f, faultError
+	case f.DropAfterBytes > 0 || f.TrickleBytes > 0:
+		return &faultConn{Conn: conn, fault: f}, f, faultNone
+	}
+	return conn, nil, faultNone
+}
+
+// resetConn closes conn with SO_LINGER 0 so the peer sees a RST rather than
+// an orderly FIN.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// faultConn cuts the connection after DropAfterBytes and/or writes in
+// TrickleBytes chunks separated by TrickleDelayMs.
+type faultConn struct {
+	net.Conn
+	fault   *store.Fault
+	written int
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if c.fault.TrickleBytes > 0 && len(chunk) > c.fault.TrickleBytes {
+			chunk = chunk[:c.fault.TrickleBytes]
+		}
+		if c.fault.DropAfterBytes > 0 {
+			left := c.fault.DropAfterBytes - c.written
+			if left <= 0 {
+				c.Conn.Close()
+				return total, net.ErrClosed
+			}
+			if len(chunk) > left {
+				chunk = chunk[:left]
+			}
+		}
+		if c.written > 0 && c.fault.TrickleBytes > 0 {
+			time.Sleep(time.Duration(c.fault.TrickleDelayMs) * time.Millisecond)
+		}
+		n, err := c.Conn.Write(chunk)
+		c.written += n
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
@@ -0,0 +1,110 @@
+package dbs
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ---- Driver housekeeping (shared by the SQL mocks) -----------------------
+
+// housekeepingResult is the canned answer to a statement that drivers and
+// connection pools send on their own (SET NAMES, SELECT @@version, SHOW …).
+// Statements without a result set have no cols.
+type housekeepingResult struct {
+	cols []string
+	rows []map[string]interface{}
+	tag  string // Postgres command tag
+}
+
+// singleRow builds a one-row result from parallel names and values.
+func singleRow(names []string, values []interface{}) *housekeepingResult {
+	row := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		row[name] = values[i]
+	}
+	return &housekeepingResult{cols: names, rows: []map[string]interface{}{row}, tag: "SELECT 1"}
+}
+
+var leadingCommentRe = regexp.MustCompile(`^\s*(?:/\*.*?\*/|--[^\n]*(?:\n|$)|#[^\n]*(?:\n|$))`)
+
+// housekeepingStatement strips leading comments (connectors prefix their own
+// queries with /* mysql-connector-java … */), surrounding whitespace and a
+// trailing semicolon.
+func housekeepingStatement(sql string) string {
+	for {
+		loc := leadingCommentRe.FindStringIndex(sql)
+		if loc == nil {
+			break
+		}
+		sql = sql[loc[1]:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+}
+
+// firstWord returns the lower-cased leading keyword of a statement.
+func firstWord(stmt string) string {
+	if i := strings.IndexFunc(stmt, func(r rune) bool { return r == ' ' || r == '\t' || r == '\n' || r == '\r' }); i != -1 {
+		stmt = stmt[:i]
+	}
+	return strings.ToLower(stmt)
+}
+
+var fromClauseRe = regexp.MustCompile(`(?i)\bfrom\b`)
+
+// selectsNoTable reports whether stmt is a SELECT that reads no table, the
+// only kind the catalogs evaluate.
+func selectsNoTable(stmt string) bool {
+	return firstWord(stmt) == "select" && !fromClauseRe.MatchString(stmt)
+}
+
+// sqlUnquote removes one level of '…', "…" or `…` quoting.
+func sqlUnquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 {
+		switch q := s[0]; q {
+		case '\'', '"', '`':
+			if s[len(s)-1] == q {
+				return strings.ReplaceAll(s[1:len(s)-1], string(q)+string(q), string(q))
+			}
+		}
+	}
+	return s
+}
+
+var intLiteralRe = regexp.MustCompile(`^-?\d+$`)
+
+// literalValue evaluates an integer or quoted string literal.
+func literalValue(expr string) (interface{}, bool) {
+	if intLiteralRe.MatchString(expr) {
+		n, err := strconv.ParseFloat(expr, 64)
+		return n, err == nil
+	}
+	if len(expr) >= 2 && expr[0] == '\'' && expr[len(expr)-1] == '\'' {
+		return sqlUnquote(expr), true
+	}
+	return nil, false
+}
+
+// sqlLike matches s against a LIKE pattern case-insensitively: % is any run
+// of characters, _ any single one, and a backslash escapes either.
+func sqlLike(pattern, s string) bool {
+	var re strings.Builder
+	re.WriteString("(?is)^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '%':
+			re.WriteString(".*")
+		case c == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	ok, _ := regexp.MatchString(re.String(), s)
+	return ok
+}
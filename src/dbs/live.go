@@ -0,0 +1,126 @@
+package dbs
+
+import (
+	"log"
+
+	"veritaserum/src/store"
+)
+
+// ---- Live tables ---------------------------------------------------------
+
+// liveUndo collects how to revert the live-table writes of the open
+// transaction, so that ROLLBACK and ROLLBACK TO SAVEPOINT undo them.
+type liveUndo struct {
+	undos      []func()
+	savepoints []liveSavepoint
+}
+
+type liveSavepoint struct {
+	name string
+	at   int // len(undos) when the savepoint was set
+}
+
+// add keeps a write's undo while a transaction is open; outside one the
+// write is already final.
+func (u *liveUndo) add(inTx bool, undo func()) {
+	if inTx && undo != nil {
+		u.undos = append(u.undos, undo)
+	}
+}
+
+func (u *liveUndo) savepoint(name string) {
+	u.savepoints = append(u.savepoints, liveSavepoint{name: name, at: len(u.undos)})
+}
+
+func (u *liveUndo) release(name string) {
+	if n := u.find(name); n != -1 {
+		u.savepoints = u.savepoints[:n]
+	}
+}
+
+// rollbackTo reverts the writes made since a savepoint, which stays set.
+func (u *liveUndo) rollbackTo(name string) {
+	n := u.find(name)
+	if n == -1 {
+		return
+	}
+	at := u.savepoints[n].at
+	u.revert(at)
+	u.savepoints = u.savepoints[:n+1]
+}
+
+// end closes the transaction, reverting its writes unless it committed.
+func (u *liveUndo) end(committed bool) {
+	if !committed {
+		u.revert(0)
+	}
+	u.undos = nil
+	u.savepoints = nil
+}
+
+func (u *liveUndo) revert(to int) {
+	for i := len(u.undos) - 1; i >= to; i-- {
+		u.undos[i]()
+	}
+	u.undos = u.undos[:to]
+}
+
+func (u *liveUndo) find(name string) int {
+	for n := len(u.savepoints) - 1; n >= 0; n-- {
+		if u.savepoints[n].name == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// liveResponse is the response a live result is captured with.
+func liveResponse(res *store.LiveResult) store.InteractionResponse {
+	return store.InteractionResponse{
+		Rows:         res.Rows,
+		AffectedRows: res.AffectedRows,
+		LastInsertID: res.LastInsertID,
+		Error:        res.Error,
+	}
+}
+
+// answerMySQLLive sends the result of a statement run on live tables.
+func answerMySQLLive(mc *mysqlConn, sql, key string, req store.InteractionRequest, res *store.LiveResult, binaryRows bool) mysqlOutcome {
+	i := store.CaptureLive(store.ProtoMySQL, key, req, liveResponse(res))
+	if res.Error != nil {
+		log.Printf("MYSQL LIVE ERROR %d: %s", res.Error.Code, sql)
+		sendErrReply(mc, res.Error)
+		return mysqlOutcome{interactionID: i.ID, err: res.Error}
+	}
+	log.Printf("MYSQL LIVE: %s", sql)
+	mc.live.add(mc.tx != "", res.Undo)
+	cols := mysqlColumnsNamed(sql, res.Columns, res.Rows)
+	if len(cols) == 0 {
+		if res.LastInsertID != 0 {
+			mc.lastInsertID = res.LastInsertID
+		}
+		sendOKResult(mc, res.AffectedRows, res.LastInsertID)
+		return mysqlOutcome{interactionID: i.ID}
+	}
+	sendResultSet(mc, cols, res.Rows, binaryRows)
+	return mysqlOutcome{interactionID: i.ID}
+}
+
+// answerPostgresLive turns the result of a statement run on live tables
+// into a pgResult.
+func answerPostgresLive(pc *pgConn, sql, key string, req store.InteractionRequest, res *store.LiveResult) *pgResult {
+	i := store.CaptureLive(store.ProtoPostgres, key, req, liveResponse(res))
+	if res.Error != nil {
+		log.Printf("POSTGRES LIVE ERROR %s: %s", res.Error.SQLState, sql)
+		return &pgResult{out: pc.conn, err: res.Error, interactionID: i.ID}
+	}
+	log.Printf("POSTGRES LIVE: %s", sql)
+	pc.live.add(pc.tx != "", res.Undo)
+	return &pgResult{
+		out:           pc.conn,
+		cols:          pgColumnsNamed(sql, res.Columns, res.Rows),
+		rows:          res.Rows,
+		tag:           pgCommandTag(sql, len(res.Rows), res.AffectedRows),
+		interactionID: i.ID,
+	}
+}
@@ -3,24 +3,51 @@ package dbs
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strings"
 
 	"veritaserum/src/store"
 )
 
 type mysqlConn struct {
 	conn   net.Conn
-	stmts  map[uint32]string
+	stmts  map[uint32]*mysqlStmt
 	nextID uint32
 	seq    byte
+
+	// From the HandshakeResponse, recorded on every captured request
+	user     string
+	database string
+	attrs    map[string]string
+
+	connID uint32
+	// lastInsertID is the last non-zero id reported by a write, for
+	// SELECT LAST_INSERT_ID().
+	lastInsertID int64
+	// vars holds the session values of system variables changed with SET.
+	vars map[string]interface{}
+	// housekeeping answers driver housekeeping statements from the built-in
+	// catalog instead of registering them as pending.
+	housekeeping bool
+
+	// tx is the journal entry of the open transaction; txImplicit is set
+	// when autocommit=0 opened it. txCmd is the transaction control
+	// statement being answered, for the status flags.
+	tx         string
+	txImplicit bool
+	txCmd      *txCommand
+	// live reverts the open transaction's writes to live tables.
+	live liveUndo
 }
 
-func StartMySQLMock(port string) {
+func StartMySQLMock(port string, opts MySQLOptions) {
+	switch opts.authPlugin() {
+	case authCachingSHA2, authNative:
+	default:
+		log.Fatalf("mysql: unknown auth plugin %q", opts.AuthPlugin)
+	}
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Fatalf("mysql: listen error: %v", err)
@@ -32,27 +59,30 @@ func StartMySQLMock(port string) {
 			log.Printf("mysql: accept error: %v", err)
 			continue
 		}
-		go handleMySQLConn(conn)
+		go handleMySQLConn(conn, opts)
 	}
 }
 
-func handleMySQLConn(conn net.Conn) {
+func handleMySQLConn(conn net.Conn, opts MySQLOptions) {
 	defer conn.Close()
 
 	mc := &mysqlConn{
 		conn:   conn,
-		stmts:  make(map[uint32]string),
+		stmts:  make(map[uint32]*mysqlStmt),
 		nextID: 1,
 		seq:    0,
+
+		vars:         map[string]interface{}{},
+		housekeeping: !opts.CaptureHousekeeping,
 	}
 
-	sendHandshake(mc)
+	defer func() { mc.endTx(store.TxAborted) }()
 
-	// Read client HandshakeResponse — ignore content, just send OK
-	if _, err := readPacket(mc); err != nil {
+	scramble := newScramble()
+	sendHandshake(mc, scramble)
+	if !authenticate(mc, opts, scramble) {
 		return
 	}
-	sendOK(mc)
 
 	// Reset sequence for command phase
 	mc.seq = 0
@@ -73,145 +103,135 @@ func handleMySQLConn(conn net.Conn) {
 		case 0x03: // COM_QUERY
 			sql := string(data)
 			log.Printf("MYSQL QUERY: %s", sql)
-			handleMySQLQuery(mc, sql)
+			handleMySQLQuery(mc, sql, nil, false)
 		case 0x16: // COM_STMT_PREPARE
 			sql := string(data)
 			log.Printf("MYSQL STMT_PREPARE: %s", sql)
 			handleStmtPrepare(mc, sql)
 		case 0x17: // COM_STMT_EXECUTE
 			handleStmtExecute(mc, data)
+		case 0x18: // COM_STMT_SEND_LONG_DATA
+			handleStmtSendLongData(mc, data)
 		case 0x19: // COM_STMT_CLOSE
 			handleStmtClose(mc, data)
+		case 0x0e: // COM_PING
+			sendOK(mc)
+		case 0x02: // COM_INIT_DB
+			mc.database = string(data)
+			log.Printf("MYSQL INIT_DB: %s", mc.database)
+			sendOK(mc)
+		case 0x1f: // COM_RESET_CONNECTION
+			mc.stmts = make(map[uint32]*mysqlStmt)
+			mc.vars = map[string]interface{}{}
+			mc.endTx(store.TxRolledBack)
+			sendOK(mc)
 		case 0x01: // COM_QUIT
 			return
 		}
 	}
 }
 
-func sendHandshake(mc *mysqlConn) {
-	var p bytes.Buffer
-
-	// Protocol version
-	p.WriteByte(0x0a)
-	// Server version
-	p.WriteString("8.0.0-veritaserum\x00")
-	// Connection ID
-	binary.Write(&p, binary.LittleEndian, uint32(1))
-	// Auth data part 1 (8 bytes) + filler
-	p.Write(make([]byte, 8))
-	p.WriteByte(0x00)
-	// Capability flags lower 2 bytes: CLIENT_LONG_PASSWORD(1) | CLIENT_PROTOCOL_41(0x200) | CLIENT_SECURE_CONNECTION(0x8000)
-	binary.Write(&p, binary.LittleEndian, uint16(0x8201))
-	// Charset: utf8
-	p.WriteByte(0x21)
-	// Status flags
-	binary.Write(&p, binary.LittleEndian, uint16(0x0002))
-	// Capability flags upper 2 bytes
-	binary.Write(&p, binary.LittleEndian, uint16(0x0000))
-	// Auth plugin data length
-	p.WriteByte(21)
-	// Reserved 10 bytes
-	p.Write(make([]byte, 10))
-	// Auth data part 2 (13 bytes)
-	p.Write(make([]byte, 13))
-	// Auth plugin name
-	p.WriteString("mysql_native_password\x00")
-
-	writePacket(mc, p.Bytes())
+// handleMySQLQuery answers a statement from COM_QUERY (text protocol rows)
+// or COM_STMT_EXECUTE (binary protocol rows, with bound params), tracking
+// transaction control whichever way it was answered.
+func handleMySQLQuery(mc *mysqlConn, sql string, params []*string, binaryRows bool) {
+	cmd := parseTxCommand(sql)
+	if cmd == nil && mc.tx == "" && !mc.autocommit() && startsImplicitTx(sql) {
+		mc.beginTx(true)
+	}
+	mc.txCmd = cmd
+	out := answerMySQLQuery(mc, sql, params, binaryRows, cmd)
+	mc.trackTx(sql, cmd, out)
 }
 
-func handleMySQLQuery(mc *mysqlConn, sql string) {
-	key := store.DBKey(store.ProtoMySQL, sql)
+// answerMySQLQuery answers a statement from the store, the built-in catalog,
+// the live tables or as a new pending interaction.
+func answerMySQLQuery(mc *mysqlConn, sql string, params []*string, binaryRows bool, cmd *txCommand) mysqlOutcome {
+	key := store.DBKey(store.ProtoMySQL, sql, params)
+	_, literals := store.NormalizeSQL(store.ProtoMySQL, sql)
+	req := store.InteractionRequest{
+		Query:     sql,
+		Params:    params,
+		Literals:  literals,
+		User:      mc.user,
+		Database:  mc.database,
+		ConnAttrs: mc.attrs,
+	}
 
-	if i := store.LookupConfigured(store.ProtoMySQL, key); i != nil && i.Response != nil {
-		log.Printf("MYSQL PLAYBACK: %s", sql)
-		rowsJSON := "[]"
-		if len(i.Response.Rows) > 0 {
-			if b, err := json.Marshal(i.Response.Rows); err == nil {
-				rowsJSON = string(b)
-			}
+	if i, resp := store.ResolveConfigured(store.ProtoMySQL, key, req); i != nil {
+		if resp == nil {
+			log.Printf("MYSQL EXHAUSTED: %s", sql)
+			e := &store.ErrorReply{Code: 1105, SQLState: "HY000", Message: "veritaserum: response sequence exhausted"}
+			sendErrReply(mc, e)
+			return mysqlOutcome{interactionID: i.ID, err: e}
 		}
-		if err := sendResultSet(mc, rowsJSON); err != nil {
-			log.Printf("mysql: sendResultSet error: %v", err)
+		out, f, action := applyFault(mc.conn, store.ProtoMySQL, resp, nil)
+		switch action {
+		case faultReset:
+			log.Printf("MYSQL FAULT reset: %s", sql)
+			return mysqlOutcome{interactionID: i.ID}
+		case faultError:
+			log.Printf("MYSQL FAULT error: %s", sql)
+			sendErrReply(mc, f.Error)
+			return mysqlOutcome{interactionID: i.ID, err: f.Error}
+		}
+		orig := mc.conn
+		mc.conn = out
+		defer func() { mc.conn = orig }()
+
+		if resp.Error != nil {
+			log.Printf("MYSQL ERROR %d: %s", resp.Error.Code, sql)
+			sendErrReply(mc, resp.Error)
+			return mysqlOutcome{interactionID: i.ID, err: resp.Error}
 		}
-		return
-	}
 
-	if !store.IsPending(store.ProtoMySQL, key) {
-		req := store.InteractionRequest{Query: sql}
-		store.RegisterInteraction(store.ProtoMySQL, key, req)
-		log.Printf("MYSQL INTERCEPT: %s → registered as pending", sql)
+		log.Printf("MYSQL PLAYBACK: %s", sql)
+		cols := mysqlColumns(sql, resp.Rows)
+		if len(cols) == 0 {
+			if resp.LastInsertID != 0 {
+				mc.lastInsertID = resp.LastInsertID
+			}
+			sendOKResult(mc, resp.AffectedRows, resp.LastInsertID)
+			return mysqlOutcome{interactionID: i.ID}
+		}
+		sendResultSet(mc, cols, resp.Rows, binaryRows)
+		return mysqlOutcome{interactionID: i.ID}
 	}
 
-	sendOK(mc)
-}
-
-func handleStmtPrepare(mc *mysqlConn, sql string) {
-	stmtID := mc.nextID
-	mc.stmts[stmtID] = sql
-	mc.nextID++
-
-	numParams := uint16(strings.Count(sql, "?"))
-
-	// COM_STMT_PREPARE_OK
-	var p bytes.Buffer
-	p.WriteByte(0x00)                                          // OK
-	binary.Write(&p, binary.LittleEndian, stmtID)             // stmt_id 4B
-	binary.Write(&p, binary.LittleEndian, uint16(0))          // num_columns
-	binary.Write(&p, binary.LittleEndian, numParams)          // num_params
-	p.WriteByte(0x00)                                          // reserved
-	binary.Write(&p, binary.LittleEndian, uint16(0))          // warning_count
-	writePacket(mc, p.Bytes())
-
-	// Send dummy param definitions + EOF if there are params
-	if numParams > 0 {
-		for i := uint16(0); i < numParams; i++ {
-			writePacket(mc, dummyColumnDef())
+	if mc.housekeeping && len(params) == 0 {
+		if cmd != nil {
+			log.Printf("MYSQL TRANSACTION: %s", sql)
+			sendOK(mc)
+			return mysqlOutcome{}
+		}
+		if hk := mysqlHousekeeping(mc, sql); hk != nil {
+			log.Printf("MYSQL HOUSEKEEPING: %s", sql)
+			sendResultSet(mc, hk.mysqlColumns(), hk.rows, binaryRows)
+			return mysqlOutcome{}
 		}
-		sendEOF(mc)
 	}
-}
 
-func handleStmtExecute(mc *mysqlConn, payload []byte) {
-	if len(payload) < 4 {
-		sendErr(mc, "malformed COM_STMT_EXECUTE")
-		return
+	if res, ok := store.ExecLive(store.ProtoMySQL, sql, params); ok {
+		return answerMySQLLive(mc, sql, key, req, res, binaryRows)
 	}
-	stmtID := binary.LittleEndian.Uint32(payload[0:4])
-	sql, ok := mc.stmts[stmtID]
-	if !ok {
-		sendErr(mc, fmt.Sprintf("unknown stmt_id %d", stmtID))
-		return
-	}
-	log.Printf("MYSQL STMT_EXECUTE stmtID=%d sql=%s", stmtID, sql)
-	handleMySQLQuery(mc, sql)
-}
 
-func handleStmtClose(mc *mysqlConn, payload []byte) {
-	if len(payload) < 4 {
-		return
+	pending := store.IsPending(store.ProtoMySQL, key)
+	i := store.RegisterInteraction(store.ProtoMySQL, key, req)
+	if !pending {
+		log.Printf("MYSQL INTERCEPT: %s → registered as pending", sql)
 	}
-	stmtID := binary.LittleEndian.Uint32(payload[0:4])
-	delete(mc.stmts, stmtID)
-	// No response for COM_STMT_CLOSE
-}
 
-func sendResultSet(mc *mysqlConn, jsonStr string) error {
-	var rows []map[string]interface{}
-	if err := json.Unmarshal([]byte(jsonStr), &rows); err != nil {
-		sendOK(mc)
-		return fmt.Errorf("parse json: %w", err)
-	}
+	sendOK(mc)
+	return mysqlOutcome{interactionID: i.ID}
+}
 
-	if len(rows) == 0 {
+// sendResultSet writes a result set in the text or binary row format, or an
+// OK packet when there are no rows. A value that cannot be encoded as its
+// column type ends the result set with an ERR packet, as the server does.
+func sendResultSet(mc *mysqlConn, cols []mysqlColumn, rows []map[string]interface{}, binaryRows bool) {
+	if len(cols) == 0 {
 		sendOK(mc)
-		return nil
-	}
-
-	// Derive ordered column names from first row
-	cols := make([]string, 0, len(rows[0]))
-	for k := range rows[0] {
-		cols = append(cols, k)
+		return
 	}
 
 	// Column count as length-encoded integer
@@ -228,41 +248,61 @@ func sendResultSet(mc *mysqlConn, jsonStr string) error {
 	// Data rows
 	for _, row := range rows {
 		var rowPkt bytes.Buffer
-		for _, col := range cols {
-			val := row[col]
-			if val == nil {
-				rowPkt.WriteByte(0xfb) // NULL
-			} else {
-				writeLengthEncodedString(&rowPkt, fmt.Sprintf("%v", val))
+		if binaryRows {
+			// Header byte, then a NULL bitmap with an offset of 2 bits
+			rowPkt.WriteByte(0x00)
+			bitmap := make([]byte, (len(cols)+7+2)/8)
+			var values bytes.Buffer
+			for idx, col := range cols {
+				val := row[col.name]
+				if val == nil {
+					bitmap[(idx+2)/8] |= 1 << ((idx + 2) % 8)
+					continue
+				}
+				b, err := mysqlBinaryValue(col, val)
+				if err != nil {
+					sendErrCode(mc, 1366, "HY000", fmt.Sprintf("Incorrect value for column '%s': %v", col.name, err))
+					return
+				}
+				values.Write(b)
+			}
+			rowPkt.Write(bitmap)
+			rowPkt.Write(values.Bytes())
+		} else {
+			for _, col := range cols {
+				val := row[col.name]
+				if val == nil {
+					rowPkt.WriteByte(0xfb) // NULL
+				} else {
+					writeLengthEncodedString(&rowPkt, mysqlTextValue(col, val))
+				}
 			}
 		}
 		writePacket(mc, rowPkt.Bytes())
 	}
 	sendEOF(mc)
-
-	return nil
 }
 
-func columnDef(name string) []byte {
+func columnDef(col mysqlColumn) []byte {
 	var p bytes.Buffer
-	writeLengthEncodedString(&p, "def")    // catalog
-	writeLengthEncodedString(&p, "")       // schema
-	writeLengthEncodedString(&p, "")       // table
-	writeLengthEncodedString(&p, "")       // org_table
-	writeLengthEncodedString(&p, name)     // name
-	writeLengthEncodedString(&p, name)     // org_name
-	p.WriteByte(0x0c)                      // length of fixed fields
-	binary.Write(&p, binary.LittleEndian, uint16(0x21)) // charset utf8
-	binary.Write(&p, binary.LittleEndian, uint32(0))    // column length
-	p.WriteByte(0xfd)                      // type: VAR_STRING
-	binary.Write(&p, binary.LittleEndian, uint16(0))    // flags
-	p.WriteByte(0x00)                      // decimals
-	binary.Write(&p, binary.LittleEndian, uint16(0))    // filler
+	writeLengthEncodedString(&p, "def")                  // catalog
+	writeLengthEncodedString(&p, "")                     // schema
+	writeLengthEncodedString(&p, "")                     // table
+	writeLengthEncodedString(&p, "")                     // org_table
+	writeLengthEncodedString(&p, col.name)               // name
+	writeLengthEncodedString(&p, col.name)               // org_name
+	p.WriteByte(0x0c)                                    // length of fixed fields
+	binary.Write(&p, binary.LittleEndian, col.charset()) // charset
+	binary.Write(&p, binary.LittleEndian, uint32(0))     // column length
+	p.WriteByte(col.typ)                                 // type
+	binary.Write(&p, binary.LittleEndian, col.flags)     // flags
+	p.WriteByte(col.decimals)                            // decimals
+	binary.Write(&p, binary.LittleEndian, uint16(0))     // filler
 	return p.Bytes()
 }
 
 func dummyColumnDef() []byte {
-	return columnDef("?")
+	return columnDef(mysqlColumn{name: "?", typ: mysqlTypeVarString})
 }
 
 // readPacket reads a MySQL packet and advances mc.seq.
@@ -298,21 +338,48 @@ func writePacket(mc *mysqlConn, payload []byte) {
 }
 
 func sendOK(mc *mysqlConn) {
-	// OK packet: 0x00 affected_rows=0 last_insert_id=0 status=0x0002 warnings=0
-	writePacket(mc, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+	sendOKResult(mc, 0, 0)
+}
+
+// sendOKResult sends an OK packet reporting the outcome of a write.
+func sendOKResult(mc *mysqlConn, affectedRows int, lastInsertID int64) {
+	var p bytes.Buffer
+	p.WriteByte(0x00)                                  // OK
+	writeLengthEncodedInt(&p, affectedRows)            // affected_rows
+	writeLengthEncodedInt(&p, int(lastInsertID))       // last_insert_id
+	binary.Write(&p, binary.LittleEndian, mc.status()) // status flags
+	binary.Write(&p, binary.LittleEndian, uint16(0))   // warnings
+	writePacket(mc, p.Bytes())
 }
 
 func sendEOF(mc *mysqlConn) {
-	// EOF packet: 0xfe warnings=0 status=0x0002
-	writePacket(mc, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})
+	// EOF packet: 0xfe, warnings=0, status flags
+	status := mc.status()
+	writePacket(mc, []byte{0xfe, 0x00, 0x00, byte(status), byte(status >> 8)})
 }
 
 func sendErr(mc *mysqlConn, msg string) {
+	sendErrCode(mc, 1105, "HY000", msg)
+}
+
+// sendErrReply sends a configured error, defaulting to ER_UNKNOWN_ERROR/HY000.
+func sendErrReply(mc *mysqlConn, e *store.ErrorReply) {
+	code, state := 1105, "HY000"
+	if e.Code != 0 {
+		code = e.Code
+	}
+	if e.SQLState != "" {
+		state = e.SQLState
+	}
+	sendErrCode(mc, uint16(code), state, e.Message)
+}
+
+func sendErrCode(mc *mysqlConn, code uint16, sqlState, msg string) {
 	var p bytes.Buffer
-	p.WriteByte(0xff)                                        // ERR
-	binary.Write(&p, binary.LittleEndian, uint16(1064))     // error code
-	p.WriteByte('#')                                         // SQL state marker
-	p.WriteString("42000")                                   // SQL state
+	p.WriteByte(0xff)                           // ERR
+	binary.Write(&p, binary.LittleEndian, code) // error code
+	p.WriteByte('#')                            // SQL state marker
+	p.WriteString(sqlState)                     // SQL state
 	p.WriteString(msg)
 	writePacket(mc, p.Bytes())
 }
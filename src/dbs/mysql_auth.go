@@ -0,0 +1,252 @@
+package dbs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// ---- Handshake & authentication ------------------------------------------
+
+const (
+	authCachingSHA2 = "caching_sha2_password"
+	authNative      = "mysql_native_password"
+
+	mysqlServerVersion = "8.0.0-veritaserum"
+)
+
+// MySQLOptions configures the MySQL mock.
+type MySQLOptions struct {
+	// User and Password, when User is set, are the only credentials
+	// accepted; anything else gets ER_ACCESS_DENIED_ERROR. By default every
+	// login succeeds.
+	User     string
+	Password string
+	// AuthPlugin is the plugin the account uses: caching_sha2_password
+	// (default, as in MySQL 8) or mysql_native_password. Clients that open
+	// with the other one are sent an AuthSwitchRequest.
+	AuthPlugin string
+	// CaptureHousekeeping registers driver housekeeping statements (SET
+	// NAMES, SELECT @@version, SHOW VARIABLES …) as pending interactions
+	// instead of answering them from the built-in catalog.
+	CaptureHousekeeping bool
+}
+
+func (o MySQLOptions) authPlugin() string {
+	if o.AuthPlugin == "" {
+		return authCachingSHA2
+	}
+	return o.AuthPlugin
+}
+
+// Capability flags.
+const (
+	clientLongPassword     = 0x00000001
+	clientConnectWithDB    = 0x00000008
+	clientProtocol41       = 0x00000200
+	clientTransactions     = 0x00002000
+	clientSecureConnection = 0x00008000
+	clientPluginAuth       = 0x00080000
+	clientConnectAttrs     = 0x00100000
+	clientPluginAuthLenenc = 0x00200000
+
+	serverCapabilities = clientLongPassword | clientConnectWithDB | clientProtocol41 | clientTransactions |
+		clientSecureConnection | clientPluginAuth | clientConnectAttrs | clientPluginAuthLenenc
+)
+
+var nextConnectionID atomic.Uint32
+
+// newScramble returns a 20-byte nonce. Like the server, it avoids NUL so the
+// second part can be sent NUL-terminated.
+func newScramble() []byte {
+	b := make([]byte, 20)
+	rand.Read(b)
+	for i := range b {
+		b[i] = b[i]&0x7f | 0x01
+	}
+	return b
+}
+
+func sendHandshake(mc *mysqlConn, scramble []byte) {
+	var p bytes.Buffer
+
+	// Protocol version
+	p.WriteByte(0x0a)
+	// Server version
+	p.WriteString(mysqlServerVersion + "\x00")
+	// Connection ID
+	mc.connID = nextConnectionID.Add(1)
+	binary.Write(&p, binary.LittleEndian, mc.connID)
+	// Auth data part 1 (8 bytes) + filler
+	p.Write(scramble[:8])
+	p.WriteByte(0x00)
+	// Capability flags lower 2 bytes
+	binary.Write(&p, binary.LittleEndian, uint16(serverCapabilities&0xffff))
+	// Charset: utf8
+	p.WriteByte(0x21)
+	// Status flags
+	binary.Write(&p, binary.LittleEndian, uint16(0x0002))
+	// Capability flags upper 2 bytes
+	binary.Write(&p, binary.LittleEndian, uint16(serverCapabilities>>16))
+	// Auth plugin data length
+	p.WriteByte(21)
+	// Reserved 10 bytes
+	p.Write(make([]byte, 10))
+	// Auth data part 2 (12 bytes + NUL)
+	p.Write(scramble[8:])
+	p.WriteByte(0x00)
+	// Auth plugin name: the server default, as in MySQL 8
+	p.WriteString(authCachingSHA2 + "\x00")
+
+	writePacket(mc, p.Bytes())
+}
+
+// handshakeResponse is the client's HandshakeResponse41.
+type handshakeResponse struct {
+	capabilities uint32
+	user         string
+	authResponse []byte
+	database     string
+	plugin       string
+	attrs        map[string]string
+}
+
+func parseHandshakeResponse(payload []byte) (*handshakeResponse, error) {
+	r := &mysqlReader{buf: payload}
+	hr := &handshakeResponse{capabilities: r.uint32()}
+	r.take(4 + 1 + 23) // max packet size, charset, filler
+	if hr.capabilities&clientProtocol41 == 0 {
+		return nil, fmt.Errorf("pre-4.1 clients are not supported")
+	}
+	hr.user = r.cstring()
+	switch {
+	case hr.capabilities&clientPluginAuthLenenc != 0:
+		hr.authResponse = r.lenEncBytes()
+	case hr.capabilities&clientSecureConnection != 0:
+		hr.authResponse = r.take(int(r.byte()))
+	default:
+		hr.authResponse = []byte(r.cstring())
+	}
+	if hr.capabilities&clientConnectWithDB != 0 && len(r.buf) > 0 {
+		hr.database = r.cstring()
+	}
+	if hr.capabilities&clientPluginAuth != 0 && len(r.buf) > 0 {
+		hr.plugin = r.cstring()
+	}
+	if hr.capabilities&clientConnectAttrs != 0 && len(r.buf) > 0 {
+		attrs := &mysqlReader{buf: r.lenEncBytes()}
+		hr.attrs = map[string]string{}
+		for len(attrs.buf) > 0 && attrs.err == nil {
+			k := string(attrs.lenEncBytes())
+			hr.attrs[k] = string(attrs.lenEncBytes())
+		}
+	}
+	return hr, r.err
+}
+
+// authenticate runs the connection phase after the initial handshake and
+// records who connected on mc. It reports false when the connection must be
+// closed.
+func authenticate(mc *mysqlConn, opts MySQLOptions, scramble []byte) bool {
+	payload, err := readPacket(mc)
+	if err != nil {
+		return false
+	}
+	hr, err := parseHandshakeResponse(payload)
+	if err != nil {
+		sendErrCode(mc, 1043, "08S01", "Bad handshake")
+		return false
+	}
+	mc.user, mc.database, mc.attrs = hr.user, hr.database, hr.attrs
+
+	plugin := opts.authPlugin()
+	authData := hr.authResponse
+	if hr.capabilities&clientPluginAuth != 0 && hr.plugin != plugin {
+		// AuthSwitchRequest with a fresh nonce
+		scramble = newScramble()
+		var p bytes.Buffer
+		p.WriteByte(0xfe)
+		p.WriteString(plugin + "\x00")
+		p.Write(scramble)
+		p.WriteByte(0x00)
+		writePacket(mc, p.Bytes())
+		if authData, err = readPacket(mc); err != nil {
+			return false
+		}
+	}
+	if len(authData) == 1 && authData[0] == 0 {
+		authData = nil // some clients NUL-terminate an empty password
+	}
+
+	if !checkCredentials(opts, plugin, hr.user, authData, scramble) {
+		log.Printf("MYSQL AUTH denied: user=%s", hr.user)
+		usingPassword := "NO"
+		if len(authData) > 0 {
+			usingPassword = "YES"
+		}
+		host, _, _ := net.SplitHostPort(mc.conn.RemoteAddr().String())
+		sendErrCode(mc, 1045, "28000", fmt.Sprintf("Access denied for user '%s'@'%s' (using password: %s)", hr.user, host, usingPassword))
+		return false
+	}
+	if plugin == authCachingSHA2 && len(authData) > 0 {
+		writePacket(mc, []byte{0x01, 0x03}) // AuthMoreData: fast_auth_success
+	}
+	sendOK(mc)
+	log.Printf("MYSQL CONNECT: user=%s database=%s plugin=%s", hr.user, hr.database, plugin)
+	return true
+}
+
+// checkCredentials verifies the scrambled password the client sent.
+func checkCredentials(opts MySQLOptions, plugin, user string, authData, scramble []byte) bool {
+	if opts.User == "" {
+		return true
+	}
+	if user != opts.User {
+		return false
+	}
+	if opts.Password == "" {
+		return len(authData) == 0
+	}
+	var want []byte
+	if plugin == authNative {
+		want = scrambleNativePassword(scramble, opts.Password)
+	} else {
+		want = scrambleSHA256Password(scramble, opts.Password)
+	}
+	return subtle.ConstantTimeCompare(authData, want) == 1
+}
+
+// scrambleNativePassword: SHA1(password) XOR SHA1(nonce + SHA1(SHA1(password)))
+func scrambleNativePassword(scramble []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= stage1[i]
+	}
+	return out
+}
+
+// scrambleSHA256Password: SHA256(password) XOR SHA256(SHA256(SHA256(password)) + nonce)
+func scrambleSHA256Password(scramble []byte, password string) []byte {
+	m1 := sha256.Sum256([]byte(password))
+	m1Hash := sha256.Sum256(m1[:])
+	h := sha256.New()
+	h.Write(m1Hash[:])
+	h.Write(scramble)
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= m1[i]
+	}
+	return out
+}
@@ -0,0 +1,266 @@
+package dbs
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"veritaserum/src/store"
+)
+
+// ---- Driver housekeeping -------------------------------------------------
+
+// mysqlVariables are the system variables connectors read on connect, with
+// the values of a stock MySQL 8 server. Numbers are float64 like JSON rows.
+var mysqlVariables = map[string]interface{}{
+	"auto_increment_increment": 1.0,
+	"autocommit":               1.0,
+	"character_set_client":     "utf8mb4",
+	"character_set_connection": "utf8mb4",
+	"character_set_database":   "utf8mb4",
+	"character_set_results":    "utf8mb4",
+	"character_set_server":     "utf8mb4",
+	"collation_connection":     "utf8mb4_0900_ai_ci",
+	"collation_database":       "utf8mb4_0900_ai_ci",
+	"collation_server":         "utf8mb4_0900_ai_ci",
+	"default_storage_engine":   "InnoDB",
+	"have_query_cache":         "NO",
+	"init_connect":             "",
+	"interactive_timeout":      28800.0,
+	"license":                  "GPL",
+	"lower_case_table_names":   0.0,
+	"max_allowed_packet":       67108864.0,
+	"net_buffer_length":        16384.0,
+	"net_write_timeout":        60.0,
+	"performance_schema":       0.0,
+	"query_cache_size":         0.0,
+	"query_cache_type":         "OFF",
+	"sql_mode":                 "ONLY_FULL_GROUP_BY,STRICT_TRANS_TABLES,NO_ZERO_IN_DATE,NO_ZERO_DATE,ERROR_FOR_DIVISION_BY_ZERO,NO_ENGINE_SUBSTITUTION",
+	"system_time_zone":         "UTC",
+	"time_zone":                "SYSTEM",
+	"transaction_isolation":    "REPEATABLE-READ",
+	"transaction_read_only":    0.0,
+	"version":                  mysqlServerVersion,
+	"version_comment":          "Veritaserum MySQL mock",
+	"wait_timeout":             28800.0,
+}
+
+// Names removed in MySQL 8 that older connectors still ask for.
+var mysqlVariableAliases = map[string]string{
+	"tx_isolation": "transaction_isolation",
+	"tx_read_only": "transaction_read_only",
+}
+
+// variable returns a system variable: the session value set on this
+// connection, else the server default. global skips the session value.
+func (mc *mysqlConn) variable(name string, global bool) (interface{}, bool) {
+	name = strings.ToLower(name)
+	if alias, ok := mysqlVariableAliases[name]; ok {
+		name = alias
+	}
+	if v, ok := mc.vars[name]; ok && !global {
+		return v, true
+	}
+	v, ok := mysqlVariables[name]
+	return v, ok
+}
+
+// setVariable changes a session variable. DEFAULT restores the server value;
+// ON/OFF and TRUE/FALSE become 1/0 for numeric variables.
+func (mc *mysqlConn) setVariable(name, value string) {
+	name = strings.ToLower(name)
+	if alias, ok := mysqlVariableAliases[name]; ok {
+		name = alias
+	}
+	if strings.EqualFold(value, "default") {
+		delete(mc.vars, name)
+		return
+	}
+	if _, numeric := mysqlVariables[name].(float64); numeric {
+		switch strings.ToLower(value) {
+		case "on", "true":
+			value = "1"
+		case "off", "false":
+			value = "0"
+		}
+	}
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		mc.vars[name] = n
+		return
+	}
+	mc.vars[name] = sqlUnquote(value)
+}
+
+// mysqlHousekeeping answers statements connectors and pools send on their
+// own, or returns nil when sql is not one of them.
+func mysqlHousekeeping(mc *mysqlConn, sql string) *housekeepingResult {
+	if mysqlHousekeepingSet(mc, sql) {
+		return &housekeepingResult{}
+	}
+	return mysqlHousekeepingQuery(mc, sql)
+}
+
+var (
+	setNamesRe     = regexp.MustCompile(`(?is)^set\s+names\s+(\S+)(?:\s+collate\s+(\S+))?$`)
+	setCharsetRe   = regexp.MustCompile(`(?is)^set\s+(?:character\s+set|charset)\s+(\S+)$`)
+	setIsolationRe = regexp.MustCompile(`(?is)^set\s+(?:(session|global)\s+)?transaction\s+.*?isolation\s+level\s+(read\s+uncommitted|read\s+committed|repeatable\s+read|serializable)`)
+	setScopeRe     = regexp.MustCompile(`(?i)^(?:(global|session|local|persist|persist_only)\s+|@@(global|session|local|persist|persist_only)\.|@@)`)
+)
+
+// mysqlHousekeepingSet applies a SET statement to the session and reports
+// whether sql was one.
+func mysqlHousekeepingSet(mc *mysqlConn, sql string) bool {
+	stmt := housekeepingStatement(sql)
+	if firstWord(stmt) != "set" {
+		return false
+	}
+	if m := setNamesRe.FindStringSubmatch(stmt); m != nil {
+		cs := sqlUnquote(m[1])
+		for _, v := range []string{"character_set_client", "character_set_connection", "character_set_results"} {
+			mc.setVariable(v, cs)
+		}
+		if m[2] != "" {
+			mc.setVariable("collation_connection", sqlUnquote(m[2]))
+		}
+		return true
+	}
+	if m := setCharsetRe.FindStringSubmatch(stmt); m != nil {
+		mc.setVariable("character_set_client", sqlUnquote(m[1]))
+		mc.setVariable("character_set_results", sqlUnquote(m[1]))
+		return true
+	}
+	if m := setIsolationRe.FindStringSubmatch(stmt); m != nil {
+		// Without SESSION or GLOBAL it only applies to the next transaction.
+		if strings.EqualFold(m[1], "session") {
+			level := strings.ToUpper(strings.Join(strings.Fields(m[2]), "-"))
+			mc.setVariable("transaction_isolation", level)
+		}
+		return true
+	}
+	for _, assign := range store.SplitTopLevel(strings.TrimSpace(stmt[len("set"):])) {
+		eq := strings.Index(assign, "=")
+		if eq == -1 {
+			continue
+		}
+		name := strings.TrimSpace(strings.TrimSuffix(assign[:eq], ":"))
+		value := strings.TrimSpace(assign[eq+1:])
+		scope := ""
+		if m := setScopeRe.FindStringSubmatch(name); m != nil {
+			scope = strings.ToLower(m[1] + m[2])
+			name = name[len(m[0]):]
+		} else if strings.HasPrefix(name, "@") {
+			continue // user variable
+		}
+		if scope == "" || scope == "session" || scope == "local" {
+			mc.setVariable(sqlUnquote(name), value)
+		}
+	}
+	return true
+}
+
+var showVariablesRe = regexp.MustCompile(`(?is)^show\s+(?:(global|session|local)\s+)?variables(?:\s+like\s+(\S+))?$`)
+
+// mysqlHousekeepingQuery answers SELECTs of system variables and server
+// functions, SHOW VARIABLES and SHOW WARNINGS. It never changes the session,
+// so COM_STMT_PREPARE can use it to describe columns.
+func mysqlHousekeepingQuery(mc *mysqlConn, sql string) *housekeepingResult {
+	stmt := housekeepingStatement(sql)
+	switch firstWord(stmt) {
+	case "select":
+		if !selectsNoTable(stmt) {
+			return nil
+		}
+		items := store.SelectItems(stmt)
+		if len(items) == 0 {
+			return nil
+		}
+		names := make([]string, len(items))
+		values := make([]interface{}, len(items))
+		for i, it := range items {
+			v, ok := mc.evalHousekeeping(it.Expr)
+			if !ok {
+				return nil
+			}
+			names[i], values[i] = it.Expr, v
+			if it.Alias != "" {
+				names[i] = it.Alias
+			}
+		}
+		return singleRow(names, values)
+
+	case "show":
+		lower := strings.ToLower(strings.Join(strings.Fields(stmt), " "))
+		if lower == "show warnings" || lower == "show errors" {
+			return &housekeepingResult{cols: []string{"Level", "Code", "Message"}}
+		}
+		m := showVariablesRe.FindStringSubmatch(stmt)
+		if m == nil {
+			return nil
+		}
+		global := strings.EqualFold(m[1], "global")
+		pattern := sqlUnquote(m[2])
+		names := make([]string, 0, len(mysqlVariables))
+		for name := range mysqlVariables {
+			if pattern == "" || sqlLike(pattern, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		res := &housekeepingResult{cols: []string{"Variable_name", "Value"}}
+		for _, name := range names {
+			v, _ := mc.variable(name, global)
+			res.rows = append(res.rows, map[string]interface{}{"Variable_name": name, "Value": mysqlTextValue(mysqlColumn{}, v)})
+		}
+		return res
+	}
+	return nil
+}
+
+var mysqlVariableRe = regexp.MustCompile(`(?i)^@@(?:(global|session|local)\.)?(\w+)$`)
+
+// evalHousekeeping evaluates one SELECT list expression: a system variable,
+// a server function or a literal.
+func (mc *mysqlConn) evalHousekeeping(expr string) (interface{}, bool) {
+	if m := mysqlVariableRe.FindStringSubmatch(expr); m != nil {
+		return mc.variable(m[2], strings.EqualFold(m[1], "global"))
+	}
+	if v, ok := literalValue(expr); ok {
+		return v, true
+	}
+	fn := strings.ToLower(strings.ReplaceAll(expr, " ", ""))
+	switch fn {
+	case "version()":
+		return mysqlServerVersion, true
+	case "database()", "schema()":
+		if mc.database == "" {
+			return nil, true
+		}
+		return mc.database, true
+	case "user()", "session_user()", "system_user()", "current_user()", "current_user":
+		host := "localhost"
+		if h, _, err := net.SplitHostPort(mc.conn.RemoteAddr().String()); err == nil {
+			host = h
+		}
+		if fn == "current_user()" || fn == "current_user" {
+			host = "%" // the account, not the client
+		}
+		return mc.user + "@" + host, true
+	case "connection_id()":
+		return float64(mc.connID), true
+	case "last_insert_id()":
+		return float64(mc.lastInsertID), true
+	}
+	return nil, false
+}
+
+// mysqlColumns types the columns of a canned answer from its values.
+func (hk *housekeepingResult) mysqlColumns() []mysqlColumn {
+	cols := make([]mysqlColumn, len(hk.cols))
+	for i, name := range hk.cols {
+		cols[i] = inferMySQLColumn(hk.rows, name)
+		cols[i].name = name
+	}
+	return cols
+}
@@ -0,0 +1,335 @@
+package dbs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+
+	"veritaserum/src/store"
+)
+
+// ---- Prepared statements (COM_STMT_*) ------------------------------------
+
+type mysqlStmt struct {
+	query     string
+	numParams int
+	// paramTypes are the types bound by the last execute that sent them;
+	// later executes may omit them.
+	paramTypes []uint16
+	// longData holds values streamed with COM_STMT_SEND_LONG_DATA, by
+	// parameter index, until the next execute.
+	longData map[int][]byte
+}
+
+func handleStmtPrepare(mc *mysqlConn, sql string) {
+	stmtID := mc.nextID
+	stmt := &mysqlStmt{query: sql, numParams: store.SQLPlaceholders(store.ProtoMySQL, sql)}
+	mc.stmts[stmtID] = stmt
+	mc.nextID++
+
+	cols := describeMySQL(mc, sql)
+
+	// COM_STMT_PREPARE_OK
+	var p bytes.Buffer
+	p.WriteByte(0x00)                                             // OK
+	binary.Write(&p, binary.LittleEndian, stmtID)                 // stmt_id 4B
+	binary.Write(&p, binary.LittleEndian, uint16(len(cols)))      // num_columns
+	binary.Write(&p, binary.LittleEndian, uint16(stmt.numParams)) // num_params
+	p.WriteByte(0x00)                                             // reserved
+	binary.Write(&p, binary.LittleEndian, uint16(0))              // warning_count
+	writePacket(mc, p.Bytes())
+
+	// Param definitions + EOF, then column definitions + EOF
+	if stmt.numParams > 0 {
+		for i := 0; i < stmt.numParams; i++ {
+			writePacket(mc, dummyColumnDef())
+		}
+		sendEOF(mc)
+	}
+	if len(cols) > 0 {
+		for _, col := range cols {
+			writePacket(mc, columnDef(col))
+		}
+		sendEOF(mc)
+	}
+}
+
+// describeMySQL predicts the result columns of a prepared statement from
+// any configured interaction for the same SQL, else from the housekeeping
+// catalog or the live tables.
+func describeMySQL(mc *mysqlConn, query string) []mysqlColumn {
+	i := store.LookupConfiguredQuery(store.ProtoMySQL, query)
+	if i == nil {
+		if mc.housekeeping && store.SQLPlaceholders(store.ProtoMySQL, query) == 0 {
+			if hk := mysqlHousekeepingQuery(mc, query); hk != nil {
+				return hk.mysqlColumns()
+			}
+		}
+		if names, ok := store.DescribeLive(store.ProtoMySQL, query); ok {
+			return mysqlColumnsNamed(query, names, nil)
+		}
+		return nil
+	}
+	resp := store.PeekResponse(i)
+	if resp == nil {
+		return nil
+	}
+	return mysqlColumns(query, resp.Rows)
+}
+
+func handleStmtExecute(mc *mysqlConn, payload []byte) {
+	r := &mysqlReader{buf: payload}
+	stmtID := r.uint32()
+	r.take(1)  // flags (cursor type): cursors are not supported
+	r.uint32() // iteration count, always 1
+	if r.err != nil {
+		sendErr(mc, "malformed COM_STMT_EXECUTE")
+		return
+	}
+	stmt, ok := mc.stmts[stmtID]
+	if !ok {
+		sendErr(mc, fmt.Sprintf("unknown stmt_id %d", stmtID))
+		return
+	}
+	params, err := readStmtParams(stmt, r)
+	if err != nil {
+		sendErr(mc, fmt.Sprintf("malformed COM_STMT_EXECUTE: %v", err))
+		return
+	}
+	log.Printf("MYSQL STMT_EXECUTE stmtID=%d sql=%s %v", stmtID, stmt.query, store.SQLValues(params))
+	handleMySQLQuery(mc, stmt.query, params, true)
+}
+
+// readStmtParams decodes the NULL bitmap, parameter types and values of a
+// COM_STMT_EXECUTE, rendering each value as text (nil for NULL).
+func readStmtParams(stmt *mysqlStmt, r *mysqlReader) ([]*string, error) {
+	defer func() { stmt.longData = nil }()
+	n := stmt.numParams
+	if n == 0 {
+		return nil, nil
+	}
+	nullBitmap := r.take((n + 7) / 8)
+	if r.byte() == 1 { // new_params_bound_flag
+		stmt.paramTypes = make([]uint16, n)
+		for i := range stmt.paramTypes {
+			stmt.paramTypes[i] = r.uint16()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(stmt.paramTypes) != n {
+		return nil, errors.New("parameter types were never bound")
+	}
+	params := make([]*string, n)
+	for i := range params {
+		var v string
+		switch {
+		case nullBitmap[i/8]&(1<<(i%8)) != 0, byte(stmt.paramTypes[i]) == mysqlTypeNull:
+			continue
+		case stmt.longData[i] != nil:
+			v = string(stmt.longData[i])
+		default:
+			v = readBinaryParam(r, stmt.paramTypes[i])
+		}
+		params[i] = &v
+	}
+	return params, r.err
+}
+
+// readBinaryParam decodes one binary protocol value other than NULL. The
+// high bit of the type marks unsigned integers.
+func readBinaryParam(r *mysqlReader, typ uint16) string {
+	unsigned := typ&0x8000 != 0
+	switch byte(typ) {
+	case mysqlTypeTiny:
+		v := r.byte()
+		if unsigned {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+		return strconv.FormatInt(int64(int8(v)), 10)
+	case mysqlTypeShort, mysqlTypeYear:
+		v := r.uint16()
+		if unsigned {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+		return strconv.FormatInt(int64(int16(v)), 10)
+	case mysqlTypeLong, mysqlTypeInt24:
+		v := r.uint32()
+		if unsigned {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+		return strconv.FormatInt(int64(int32(v)), 10)
+	case mysqlTypeLongLong:
+		v := r.uint64()
+		if unsigned {
+			return strconv.FormatUint(v, 10)
+		}
+		return strconv.FormatInt(int64(v), 10)
+	case mysqlTypeFloat:
+		return strconv.FormatFloat(float64(math.Float32frombits(r.uint32())), 'g', -1, 32)
+	case mysqlTypeDouble:
+		return strconv.FormatFloat(math.Float64frombits(r.uint64()), 'g', -1, 64)
+	case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp:
+		return readBinaryDateTime(r)
+	case mysqlTypeTime:
+		return readBinaryTime(r)
+	}
+	return string(r.lenEncBytes())
+}
+
+// readBinaryDateTime renders a 0/4/7/11-byte DATE / DATETIME value as
+// "YYYY-MM-DD[ HH:MM:SS[.ffffff]]".
+func readBinaryDateTime(r *mysqlReader) string {
+	b := r.take(int(r.byte()))
+	if len(b) < 4 {
+		return "0000-00-00"
+	}
+	s := fmt.Sprintf("%04d-%02d-%02d", binary.LittleEndian.Uint16(b), b[2], b[3])
+	if len(b) >= 7 {
+		s += fmt.Sprintf(" %02d:%02d:%02d", b[4], b[5], b[6])
+	}
+	if len(b) >= 11 {
+		s += fmt.Sprintf(".%06d", binary.LittleEndian.Uint32(b[7:]))
+	}
+	return s
+}
+
+// readBinaryTime renders a 0/8/12-byte TIME value as "[-]HHH:MM:SS[.ffffff]".
+func readBinaryTime(r *mysqlReader) string {
+	b := r.take(int(r.byte()))
+	if len(b) < 8 {
+		return "00:00:00"
+	}
+	sign := ""
+	if b[0] == 1 {
+		sign = "-"
+	}
+	hours := binary.LittleEndian.Uint32(b[1:])*24 + uint32(b[5])
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, b[6], b[7])
+	if len(b) >= 12 {
+		s += fmt.Sprintf(".%06d", binary.LittleEndian.Uint32(b[8:]))
+	}
+	return s
+}
+
+// handleStmtSendLongData buffers a chunk of a parameter value. The command
+// has no response.
+func handleStmtSendLongData(mc *mysqlConn, payload []byte) {
+	r := &mysqlReader{buf: payload}
+	stmtID := r.uint32()
+	param := int(r.uint16())
+	if r.err != nil {
+		return
+	}
+	stmt, ok := mc.stmts[stmtID]
+	if !ok || param >= stmt.numParams {
+		return
+	}
+	if stmt.longData == nil {
+		stmt.longData = map[int][]byte{}
+	}
+	stmt.longData[param] = append(stmt.longData[param], r.buf...)
+}
+
+func handleStmtClose(mc *mysqlConn, payload []byte) {
+	if len(payload) < 4 {
+		return
+	}
+	stmtID := binary.LittleEndian.Uint32(payload[0:4])
+	delete(mc.stmts, stmtID)
+	// No response for COM_STMT_CLOSE
+}
+
+// ---- Payload reader ------------------------------------------------------
+
+var errShortPacket = errors.New("packet too short")
+
+// mysqlReader decodes little-endian command payloads; the first short read
+// sets err and every later read returns zero values.
+type mysqlReader struct {
+	buf []byte
+	err error
+}
+
+func (r *mysqlReader) take(n int) []byte {
+	if r.err != nil || n < 0 || len(r.buf) < n {
+		r.err = errShortPacket
+		return nil
+	}
+	out := r.buf[:n]
+	r.buf = r.buf[n:]
+	return out
+}
+
+func (r *mysqlReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *mysqlReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *mysqlReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *mysqlReader) uint64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *mysqlReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	idx := bytes.IndexByte(r.buf, 0)
+	if idx == -1 {
+		r.err = errShortPacket
+		return ""
+	}
+	s := string(r.buf[:idx])
+	r.buf = r.buf[idx+1:]
+	return s
+}
+
+// lenEncInt reads a length-encoded integer.
+func (r *mysqlReader) lenEncInt() uint64 {
+	switch b := r.byte(); b {
+	case 0xfc:
+		return uint64(r.uint16())
+	case 0xfd:
+		if v := r.take(3); v != nil {
+			return uint64(v[0]) | uint64(v[1])<<8 | uint64(v[2])<<16
+		}
+		return 0
+	case 0xfe:
+		return r.uint64()
+	default:
+		return uint64(b)
+	}
+}
+
+func (r *mysqlReader) lenEncBytes() []byte {
+	n := r.lenEncInt()
+	if n > uint64(len(r.buf)) {
+		r.err = errShortPacket
+		return nil
+	}
+	return r.take(int(n))
+}
@@ -0,0 +1,143 @@
+package dbs
+
+import (
+	"log"
+
+	"veritaserum/src/store"
+)
+
+// ---- Transactions --------------------------------------------------------
+
+// Server status flags sent in OK and EOF packets.
+const (
+	mysqlStatusInTrans    = 0x0001
+	mysqlStatusAutocommit = 0x0002
+)
+
+// mysqlErrDeadlock rolls back the whole transaction, not just the statement.
+const mysqlErrDeadlock = 1213
+
+// mysqlOutcome is how a statement was answered, for the transaction journal.
+type mysqlOutcome struct {
+	interactionID string
+	err           *store.ErrorReply
+}
+
+// status returns the server status flags for the statement being answered.
+func (mc *mysqlConn) status() uint16 {
+	var s uint16
+	if mc.autocommit() {
+		s |= mysqlStatusAutocommit
+	}
+	if mc.inTx() {
+		s |= mysqlStatusInTrans
+	}
+	return s
+}
+
+func (mc *mysqlConn) autocommit() bool {
+	v, _ := mc.variable("autocommit", false)
+	n, ok := v.(float64)
+	return !ok || n != 0
+}
+
+// inTx reports whether a transaction is open once the statement being
+// answered (mc.txCmd when it is transaction control) completes.
+func (mc *mysqlConn) inTx() bool {
+	switch {
+	case mc.txCmd != nil && mc.txCmd.kind == txBegin:
+		return true
+	case mc.txCmd.endsTx():
+		return mc.txCmd.chain
+	case mc.txImplicit && mc.autocommit():
+		return false // SET autocommit=1 commits
+	}
+	return mc.tx != ""
+}
+
+// startsImplicitTx reports whether sql opens a transaction when autocommit
+// is off: anything that may touch a table, not SET, SHOW or a SELECT of
+// variables and functions.
+func startsImplicitTx(sql string) bool {
+	stmt := housekeepingStatement(sql)
+	switch firstWord(stmt) {
+	case "set", "show", "":
+		return false
+	}
+	return !selectsNoTable(stmt)
+}
+
+// trackTx moves the connection's transaction state along and journals
+// statements run inside a transaction. A deadlock rolls the transaction
+// back; a failing COMMIT ends it rolled back.
+func (mc *mysqlConn) trackTx(sql string, cmd *txCommand, out mysqlOutcome) {
+	mc.txCmd = nil
+	failed := out.err != nil
+	if cmd == nil || failed && cmd.kind != txCommit {
+		if mc.tx == "" {
+			return
+		}
+		store.RecordTxStatement(mc.tx, sql, out.interactionID, failed)
+		switch {
+		case failed && out.err.Code == mysqlErrDeadlock:
+			mc.endTx(store.TxRolledBack)
+		case mc.txImplicit && mc.autocommit():
+			mc.endTx(store.TxCommitted)
+		}
+		return
+	}
+	switch cmd.kind {
+	case txBegin:
+		// BEGIN inside a transaction commits it first.
+		mc.endTx(store.TxCommitted)
+		mc.beginTx(false)
+	case txCommit, txRollback:
+		status := store.TxCommitted
+		if cmd.kind == txRollback || failed {
+			status = store.TxRolledBack
+		}
+		mc.endTx(status)
+		if cmd.chain {
+			mc.beginTx(false)
+		}
+	case txSavepoint, txRelease, txRollbackTo:
+		if mc.tx == "" {
+			return
+		}
+		// The SAVEPOINT statement comes before the savepoint; ROLLBACK TO
+		// after the statements it undoes.
+		switch cmd.kind {
+		case txSavepoint:
+			store.RecordTxStatement(mc.tx, sql, out.interactionID, false)
+			store.Savepoint(mc.tx, cmd.savepoint)
+			mc.live.savepoint(cmd.savepoint)
+		case txRelease:
+			store.ReleaseSavepoint(mc.tx, cmd.savepoint)
+			mc.live.release(cmd.savepoint)
+			store.RecordTxStatement(mc.tx, sql, out.interactionID, false)
+		case txRollbackTo:
+			store.RollbackToSavepoint(mc.tx, cmd.savepoint)
+			mc.live.rollbackTo(cmd.savepoint)
+			store.RecordTxStatement(mc.tx, sql, out.interactionID, false)
+		}
+	}
+}
+
+// beginTx opens a transaction; implicit ones were started by a statement
+// with autocommit off.
+func (mc *mysqlConn) beginTx(implicit bool) {
+	mc.tx = store.BeginTransaction(store.ProtoMySQL, int64(mc.connID))
+	mc.txImplicit = implicit
+}
+
+// endTx closes the open transaction, if any, with status; live-table writes
+// are reverted unless it committed.
+func (mc *mysqlConn) endTx(status string) {
+	mc.live.end(status == store.TxCommitted)
+	if mc.tx != "" {
+		store.EndTransaction(mc.tx, status)
+		log.Printf("MYSQL TRANSACTION %s", status)
+	}
+	mc.tx = ""
+	mc.txImplicit = false
+}
@@ -0,0 +1,367 @@
+package dbs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"veritaserum/src/store"
+)
+
+// ---- Typed result columns ------------------------------------------------
+
+// Column types (enum_field_types).
+const (
+	mysqlTypeTiny       = 0x01
+	mysqlTypeShort      = 0x02
+	mysqlTypeLong       = 0x03
+	mysqlTypeFloat      = 0x04
+	mysqlTypeDouble     = 0x05
+	mysqlTypeNull       = 0x06
+	mysqlTypeTimestamp  = 0x07
+	mysqlTypeLongLong   = 0x08
+	mysqlTypeInt24      = 0x09
+	mysqlTypeDate       = 0x0a
+	mysqlTypeTime       = 0x0b
+	mysqlTypeDateTime   = 0x0c
+	mysqlTypeYear       = 0x0d
+	mysqlTypeJSON       = 0xf5
+	mysqlTypeNewDecimal = 0xf6
+	mysqlTypeBlob       = 0xfc
+	mysqlTypeVarString  = 0xfd
+	mysqlTypeString     = 0xfe
+)
+
+// Column definition flags and character sets.
+const (
+	mysqlFlagUnsigned = 0x0020
+	mysqlFlagBinary   = 0x0080
+
+	mysqlCharsetUTF8   = 0x21
+	mysqlCharsetBinary = 0x3f
+
+	mysqlNotFixedDec = 0x1f // decimals of FLOAT / DOUBLE without a scale
+)
+
+// mysqlColumn is a result column as advertised in its column definition.
+type mysqlColumn struct {
+	name     string
+	typ      byte
+	flags    uint16
+	decimals byte
+}
+
+// mysqlColumns types the columns of a mocked result: from the CREATE TABLE of
+// any schema the query mentions, else from the JSON values in the rows.
+func mysqlColumns(query string, rows []map[string]interface{}) []mysqlColumn {
+	return mysqlColumnsNamed(query, rowColumns(rows), rows)
+}
+
+// mysqlColumnsNamed types the given columns, as mysqlColumns does; live
+// results name their columns even when they have no rows.
+func mysqlColumnsNamed(query string, names []string, rows []map[string]interface{}) []mysqlColumn {
+	if len(names) == 0 {
+		return nil
+	}
+	schemaCols := store.SchemaColumns(store.ProtoMySQL, query)
+	types := make(map[string]string, len(schemaCols))
+	order := make([]string, 0, len(schemaCols))
+	for _, c := range schemaCols {
+		types[c.Name] = c.Type
+		order = append(order, c.Name)
+	}
+	names = orderColumns(names, store.SelectList(query), order)
+
+	cols := make([]mysqlColumn, len(names))
+	for i, name := range names {
+		if t, ok := types[name]; ok {
+			cols[i] = mysqlColumnType(t)
+		} else {
+			cols[i] = inferMySQLColumn(rows, name)
+		}
+		cols[i].name = name
+	}
+	return cols
+}
+
+var decimalScaleRe = regexp.MustCompile(`\(\s*\d+\s*,\s*(\d+)\s*\)`)
+
+// mysqlColumnType maps a SQL type name to a column type; anything unknown is
+// sent as VAR_STRING.
+func mysqlColumnType(sqlType string) mysqlColumn {
+	t := strings.ToLower(sqlType)
+	var c mysqlColumn
+	if strings.Contains(t, "unsigned") {
+		c.flags |= mysqlFlagUnsigned
+	}
+	base := strings.TrimSpace(typeModifierRe.ReplaceAllString(t, ""))
+	if i := strings.IndexByte(base, ' '); i != -1 {
+		base = base[:i]
+	}
+	switch base {
+	case "tinyint", "bool", "boolean":
+		c.typ = mysqlTypeTiny
+	case "smallint":
+		c.typ = mysqlTypeShort
+	case "mediumint":
+		c.typ = mysqlTypeInt24
+	case "int", "integer":
+		c.typ = mysqlTypeLong
+	case "bigint", "serial":
+		c.typ = mysqlTypeLongLong
+	case "float":
+		c.typ, c.decimals = mysqlTypeFloat, mysqlNotFixedDec
+	case "double", "real":
+		c.typ, c.decimals = mysqlTypeDouble, mysqlNotFixedDec
+	case "decimal", "numeric", "dec", "fixed":
+		c.typ = mysqlTypeNewDecimal
+		if m := decimalScaleRe.FindStringSubmatch(t); m != nil {
+			scale, _ := strconv.Atoi(m[1])
+			c.decimals = byte(scale)
+		}
+	case "date":
+		c.typ = mysqlTypeDate
+	case "datetime":
+		c.typ = mysqlTypeDateTime
+	case "timestamp":
+		c.typ = mysqlTypeTimestamp
+	case "time":
+		c.typ = mysqlTypeTime
+	case "year":
+		c.typ = mysqlTypeYear
+	case "json":
+		c.typ = mysqlTypeJSON
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		c.typ, c.flags = mysqlTypeBlob, c.flags|mysqlFlagBinary
+	case "char":
+		c.typ = mysqlTypeString
+	default:
+		c.typ = mysqlTypeVarString
+	}
+	return c
+}
+
+// inferMySQLColumn types a column without a schema from all of its
+// non-null values: whole numbers widen to DOUBLE when any value is
+// fractional, and a column mixing other kinds falls back to VAR_STRING.
+func inferMySQLColumn(rows []map[string]interface{}, col string) mysqlColumn {
+	var typ byte
+	seen := false
+	for _, row := range rows {
+		var next byte
+		switch v := row[col].(type) {
+		case nil:
+			continue
+		case bool:
+			next = mysqlTypeTiny
+		case int64:
+			next = mysqlTypeLongLong
+		case json.Number:
+			next = mysqlTypeDouble
+			if _, err := v.Int64(); err == nil {
+				next = mysqlTypeLongLong
+			}
+		case float64:
+			next = mysqlTypeDouble
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				next = mysqlTypeLongLong
+			}
+		case map[string]interface{}, []interface{}:
+			next = mysqlTypeJSON
+		default:
+			next = mysqlTypeVarString
+		}
+		switch {
+		case !seen || typ == next:
+			typ, seen = next, true
+		case typ == mysqlTypeLongLong && next == mysqlTypeDouble, typ == mysqlTypeDouble && next == mysqlTypeLongLong:
+			typ = mysqlTypeDouble
+		default:
+			return mysqlColumn{typ: mysqlTypeVarString}
+		}
+	}
+	switch {
+	case !seen:
+		return mysqlColumn{typ: mysqlTypeVarString}
+	case typ == mysqlTypeDouble:
+		return mysqlColumn{typ: mysqlTypeDouble, decimals: mysqlNotFixedDec}
+	}
+	return mysqlColumn{typ: typ}
+}
+
+func (c mysqlColumn) charset() uint16 {
+	switch c.typ {
+	case mysqlTypeVarString, mysqlTypeString, mysqlTypeJSON:
+		return mysqlCharsetUTF8
+	}
+	return mysqlCharsetBinary
+}
+
+// ---- Value encoding ------------------------------------------------------
+
+// mysqlTextValue renders v as the text protocol sends it.
+func mysqlTextValue(c mysqlColumn, v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		switch c.typ {
+		case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp:
+			if t, err := parseSQLTime(v); err == nil {
+				return formatMySQLTime(c.typ, t)
+			}
+		}
+		return v
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func formatMySQLTime(typ byte, t time.Time) string {
+	if typ == mysqlTypeDate {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02 15:04:05.999999")
+}
+
+// mysqlBinaryValue encodes v as a binary protocol row value.
+func mysqlBinaryValue(c mysqlColumn, v interface{}) ([]byte, error) {
+	s := mysqlTextValue(c, v)
+	var buf bytes.Buffer
+	switch c.typ {
+	case mysqlTypeTiny, mysqlTypeShort, mysqlTypeYear, mysqlTypeLong, mysqlTypeInt24, mysqlTypeLongLong:
+		size := mysqlIntSize(c.typ)
+		var n uint64
+		if c.flags&mysqlFlagUnsigned != 0 {
+			u, err := strconv.ParseUint(s, 10, size*8)
+			if err != nil {
+				return nil, err
+			}
+			n = u
+		} else {
+			i, err := strconv.ParseInt(s, 10, size*8)
+			if err != nil {
+				return nil, err
+			}
+			n = uint64(i)
+		}
+		out := make([]byte, 8)
+		binary.LittleEndian.PutUint64(out, n)
+		return out[:size], nil
+	case mysqlTypeFloat:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.LittleEndian, float32(f))
+	case mysqlTypeDouble:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.LittleEndian, f)
+	case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp:
+		t, err := parseSQLTime(s)
+		if err != nil {
+			return nil, err
+		}
+		writeBinaryDateTime(&buf, c.typ, t)
+	case mysqlTypeTime:
+		if err := writeBinaryTime(&buf, s); err != nil {
+			return nil, err
+		}
+	default:
+		writeLengthEncodedString(&buf, s)
+	}
+	return buf.Bytes(), nil
+}
+
+// mysqlIntSize is the width of an integer type in the binary protocol.
+func mysqlIntSize(typ byte) int {
+	switch typ {
+	case mysqlTypeTiny:
+		return 1
+	case mysqlTypeShort, mysqlTypeYear:
+		return 2
+	case mysqlTypeLong, mysqlTypeInt24:
+		return 4
+	}
+	return 8
+}
+
+// writeBinaryDateTime writes the shortest of the 0/4/7/11-byte forms that
+// holds t.
+func writeBinaryDateTime(buf *bytes.Buffer, typ byte, t time.Time) {
+	micro := t.Nanosecond() / 1000
+	n := byte(11)
+	switch {
+	case typ == mysqlTypeDate || t.Hour()+t.Minute()+t.Second()+micro == 0:
+		n = 4
+	case micro == 0:
+		n = 7
+	}
+	buf.WriteByte(n)
+	binary.Write(buf, binary.LittleEndian, uint16(t.Year()))
+	buf.WriteByte(byte(t.Month()))
+	buf.WriteByte(byte(t.Day()))
+	if n >= 7 {
+		buf.WriteByte(byte(t.Hour()))
+		buf.WriteByte(byte(t.Minute()))
+		buf.WriteByte(byte(t.Second()))
+	}
+	if n == 11 {
+		binary.Write(buf, binary.LittleEndian, uint32(micro))
+	}
+}
+
+var mysqlTimeRe = regexp.MustCompile(`^(-?)(\d+):(\d{2}):(\d{2})(?:\.(\d{1,6}))?$`)
+
+// writeBinaryTime encodes a TIME value given as "[-]HHH:MM:SS[.ffffff]".
+func writeBinaryTime(buf *bytes.Buffer, s string) error {
+	m := mysqlTimeRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return fmt.Errorf("invalid time %q", s)
+	}
+	hours, _ := strconv.Atoi(m[2])
+	minutes, _ := strconv.Atoi(m[3])
+	seconds, _ := strconv.Atoi(m[4])
+	micro := 0
+	if m[5] != "" {
+		micro, _ = strconv.Atoi(m[5] + strings.Repeat("0", 6-len(m[5])))
+	}
+	if hours+minutes+seconds+micro == 0 {
+		buf.WriteByte(0)
+		return nil
+	}
+	n := byte(8)
+	if micro != 0 {
+		n = 12
+	}
+	buf.WriteByte(n)
+	if m[1] == "-" {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(hours/24))
+	buf.WriteByte(byte(hours % 24))
+	buf.WriteByte(byte(minutes))
+	buf.WriteByte(byte(seconds))
+	if n == 12 {
+		binary.Write(buf, binary.LittleEndian, uint32(micro))
+	}
+	return nil
+}
@@ -3,16 +3,29 @@ package dbs
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
 
 	"veritaserum/src/store"
 )
 
-func StartPostgresMock(port string) {
+// PostgresOptions configures the Postgres mock.
+type PostgresOptions struct {
+	// TLS answers SSLRequest with 'S' and upgrades the connection using a
+	// certificate signed by the Veritaserum CA. Without it clients are told
+	// to carry on in plaintext.
+	TLS bool
+	// CaptureHousekeeping registers driver housekeeping statements (SET,
+	// SHOW, SELECT version() …) as pending interactions instead of
+	// answering them from the built-in catalog.
+	CaptureHousekeeping bool
+}
+
+func StartPostgresMock(port string, opts PostgresOptions) {
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Fatalf("postgres: listen error: %v", err)
@@ -24,31 +37,77 @@ func StartPostgresMock(port string) {
 			log.Printf("postgres: accept error: %v", err)
 			continue
 		}
-		go handlePostgresConn(conn)
+		go handlePostgresConn(conn, opts)
 	}
 }
 
-func handlePostgresConn(conn net.Conn) {
-	defer conn.Close()
+// pgConn is the per-connection state of the Postgres mock.
+type pgConn struct {
+	conn    net.Conn
+	stmts   map[string]*pgStatement
+	portals map[string]*pgPortal
+	// failed is set after an error in the extended protocol; the backend
+	// discards messages until the next Sync.
+	failed bool
+
+	// pid and secret identify the backend in CancelRequest messages.
+	pid, secret int32
+	cancelMu    sync.Mutex
+	running     chan struct{} // closed by a CancelRequest; nil when idle
+
+	// From the StartupMessage
+	user, database string
+	// settings are the current run-time parameters by lower-cased name;
+	// defaults are their values at session start, for RESET.
+	settings, defaults map[string]string
+	// housekeeping answers driver housekeeping statements from the built-in
+	// catalog instead of registering them as pending.
+	housekeeping bool
+
+	// txStatus is reported in ReadyForQuery; tx is the journal entry of the
+	// open transaction.
+	txStatus byte
+	tx       string
+	// live reverts the open transaction's writes to live tables.
+	live liveUndo
+}
+
+func handlePostgresConn(raw net.Conn, opts PostgresOptions) {
+	defer raw.Close()
 
-	// --- Startup message ---
-	// First 4 bytes = total length (big-endian int32)
-	var msgLen int32
-	if err := binary.Read(conn, binary.BigEndian, &msgLen); err != nil {
+	// --- Startup message (after any SSLRequest / GSSENCRequest) ---
+	conn, params, ok := readStartup(raw, opts)
+	if !ok {
 		return
 	}
-	// Read remaining bytes of startup message (msgLen - 4 already consumed)
-	remaining := make([]byte, msgLen-4)
-	if _, err := io.ReadFull(conn, remaining); err != nil {
-		return
+	// Any credentials are accepted
+	pc := &pgConn{
+		conn:         conn,
+		stmts:        make(map[string]*pgStatement),
+		portals:      make(map[string]*pgPortal),
+		housekeeping: !opts.CaptureHousekeeping,
+		txStatus:     pgTxIdle,
 	}
-	// We don't need to parse params — just accept all connections
+	pc.startSession(params)
+	registerBackend(pc)
+	defer unregisterBackend(pc)
+	defer pc.endTx(store.TxAborted)
+	log.Printf("POSTGRES CONNECT: user=%s database=%s application=%s", pc.user, pc.database, pc.settings["application_name"])
 
 	// --- AuthenticationOk ---
 	conn.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 0})
 
+	// --- ParameterStatus ---
+	pc.sendParameterStatuses()
+
+	// --- BackendKeyData ---
+	var key bytes.Buffer
+	binary.Write(&key, binary.BigEndian, pc.pid)
+	binary.Write(&key, binary.BigEndian, pc.secret)
+	writeMessage(conn, 'K', key.Bytes())
+
 	// --- ReadyForQuery ---
-	conn.Write([]byte{'Z', 0, 0, 0, 5, 'I'})
+	sendReadyForQuery(conn, pc.txStatus)
 
 	// --- Query loop ---
 	for {
@@ -75,7 +134,19 @@ func handlePostgresConn(conn net.Conn) {
 			// Body is null-terminated SQL string
 			sql := string(bytes.TrimRight(body, "\x00"))
 			log.Printf("POSTGRES QUERY: %s", sql)
-			handlePostgresQuery(conn, sql)
+			handlePostgresQuery(pc, sql)
+
+		case 'P', 'B', 'D', 'E', 'C': // Extended query protocol
+			if pc.failed {
+				continue
+			}
+			handleExtendedMessage(pc, msgType[0], body)
+
+		case 'H': // Flush — every message is already written immediately
+
+		case 'S': // Sync
+			pc.failed = false
+			sendReadyForQuery(conn, pc.txStatus)
 
 		case 'X': // Terminate
 			return
@@ -83,85 +154,201 @@ func handlePostgresConn(conn net.Conn) {
 	}
 }
 
-func handlePostgresQuery(conn net.Conn, sql string) {
-	key := store.DBKey(store.ProtoPostgres, sql)
+// pgResult is what a statement resolved to against the store.
+type pgResult struct {
+	out   net.Conn // where to write the answer (may be fault-wrapped)
+	cols  []pgColumn
+	rows  []map[string]interface{}
+	tag   string
+	err   *store.ErrorReply
+	reset bool // the connection was aborted by a fault
 
-	if i := store.LookupConfigured(store.ProtoPostgres, key); i != nil && i.Response != nil {
+	interactionID string // the configured or pending interaction, if any
+}
+
+// resolvePostgres looks a statement up, registering it as pending when it
+// is unknown, and returns what to answer with. Transaction control is
+// tracked on the connection whichever way the statement was answered.
+func resolvePostgres(pc *pgConn, sql string, params []*string) *pgResult {
+	cmd := parseTxCommand(sql)
+	if pc.txStatus == pgTxFailed && !cmd.endsTx() && (cmd == nil || cmd.kind != txRollbackTo) {
+		log.Printf("POSTGRES IN FAILED TRANSACTION: %s", sql)
+		return &pgResult{out: pc.conn, err: pgInFailedTx}
+	}
+	res := resolvePostgresStatement(pc, sql, params, cmd)
+	if !res.reset {
+		pc.trackTx(sql, cmd, res)
+	}
+	return res
+}
+
+// resolvePostgresStatement answers a statement from the store, the built-in
+// catalog, the live tables or as a new pending interaction.
+func resolvePostgresStatement(pc *pgConn, sql string, params []*string, cmd *txCommand) *pgResult {
+	conn := pc.conn
+	key := store.DBKey(store.ProtoPostgres, sql, params)
+	_, literals := store.NormalizeSQL(store.ProtoPostgres, sql)
+	req := store.InteractionRequest{Query: sql, Params: params, Literals: literals}
+
+	if i, resp := store.ResolveConfigured(store.ProtoPostgres, key, req); i != nil {
+		if resp == nil {
+			log.Printf("POSTGRES EXHAUSTED: %s", sql)
+			return &pgResult{out: conn, err: &store.ErrorReply{Message: "veritaserum: response sequence exhausted"}, interactionID: i.ID}
+		}
+		cancel := pc.startQuery()
+		out, f, action := applyFault(conn, store.ProtoPostgres, resp, cancel)
+		pc.endQuery()
+		switch action {
+		case faultCanceled:
+			log.Printf("POSTGRES CANCELED: %s", sql)
+			return &pgResult{out: conn, err: &store.ErrorReply{SQLState: "57014", Message: "canceling statement due to user request"}, interactionID: i.ID}
+		case faultReset:
+			log.Printf("POSTGRES FAULT reset: %s", sql)
+			return &pgResult{reset: true}
+		case faultError:
+			log.Printf("POSTGRES FAULT error: %s", sql)
+			return &pgResult{out: conn, err: f.Error, interactionID: i.ID}
+		}
+		if resp.Error != nil {
+			log.Printf("POSTGRES ERROR %s: %s", resp.Error.SQLState, sql)
+			return &pgResult{out: out, err: resp.Error, interactionID: i.ID}
+		}
 		log.Printf("POSTGRES PLAYBACK: %s", sql)
-		rowsJSON := "[]"
-		if len(i.Response.Rows) > 0 {
-			if b, err := json.Marshal(i.Response.Rows); err == nil {
-				rowsJSON = string(b)
-			}
+		tag := resp.CommandTag
+		switch {
+		case tag != "":
+		case cmd != nil:
+			tag = pc.txTag(cmd)
+		default:
+			tag = pgCommandTag(sql, len(resp.Rows), resp.AffectedRows)
 		}
-		if err := sendMockedRows(conn, rowsJSON); err != nil {
-			log.Printf("postgres: sendMockedRows error: %v", err)
+		return &pgResult{out: out, cols: pgColumns(sql, resp.Rows), rows: resp.Rows, tag: tag, interactionID: i.ID}
+	}
+
+	if pc.housekeeping && len(params) == 0 {
+		if cmd != nil {
+			log.Printf("POSTGRES TRANSACTION: %s", sql)
+			return &pgResult{out: conn, tag: pc.txTag(cmd)}
+		}
+		if hk := pgHousekeeping(pc, sql); hk != nil {
+			log.Printf("POSTGRES HOUSEKEEPING: %s", sql)
+			return &pgResult{out: conn, cols: hk.pgColumns(), rows: hk.rows, tag: hk.tag}
 		}
-		return
 	}
 
-	if !store.IsPending(store.ProtoPostgres, key) {
-		req := store.InteractionRequest{Query: sql}
-		store.RegisterInteraction(store.ProtoPostgres, key, req)
-		log.Printf("POSTGRES INTERCEPT: %s → registered as pending", sql)
+	if res, ok := store.ExecLive(store.ProtoPostgres, sql, params); ok {
+		return answerPostgresLive(pc, sql, key, req, res)
 	}
 
-	sendCommandComplete(conn, "SELECT 0")
-	sendReadyForQuery(conn)
+	pending := store.IsPending(store.ProtoPostgres, key)
+	i := store.RegisterInteraction(store.ProtoPostgres, key, req)
+	if !pending {
+		log.Printf("POSTGRES INTERCEPT: %s → registered as pending", sql)
+	}
+	tag := pgCommandTag(sql, 0, 0)
+	if cmd != nil {
+		tag = pc.txTag(cmd)
+	}
+	return &pgResult{out: conn, tag: tag, interactionID: i.ID}
 }
 
-// sendMockedRows parses a JSON array and writes RowDescription + DataRow(s) + CommandComplete.
-// Example jsonStr: [{"id":1,"name":"Alice"},{"id":2,"name":"Bob"}]
-func sendMockedRows(conn net.Conn, jsonStr string) error {
-	var rows []map[string]interface{}
-	if err := json.Unmarshal([]byte(jsonStr), &rows); err != nil {
-		// Fallback: empty result
-		sendCommandComplete(conn, "SELECT 0")
-		sendReadyForQuery(conn)
-		return fmt.Errorf("parse json: %w", err)
+// pgCommandTag builds the CommandComplete tag for a statement. Writes report
+// the affected rows, or the rows their RETURNING clause produced when none
+// were configured.
+func pgCommandTag(sql string, rows, affected int) string {
+	n := affected
+	if n == 0 {
+		n = rows
 	}
+	switch verb := strings.ToUpper(firstWord(housekeepingStatement(sql))); verb {
+	case "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", n)
+	case "UPDATE", "DELETE", "MERGE":
+		return fmt.Sprintf("%s %d", verb, n)
+	}
+	return fmt.Sprintf("SELECT %d", rows)
+}
 
-	if len(rows) == 0 {
-		sendCommandComplete(conn, "SELECT 0")
-		sendReadyForQuery(conn)
-		return nil
+func handlePostgresQuery(pc *pgConn, sql string) {
+	if housekeepingStatement(sql) == "" {
+		writeMessage(pc.conn, 'I', nil) // EmptyQueryResponse
+		sendReadyForQuery(pc.conn, pc.txStatus)
+		return
 	}
+	res := resolvePostgres(pc, sql, nil)
+	if res.reset {
+		return
+	}
+	if res.err != nil {
+		sendErrorReply(res.out, res.err)
+	} else {
+		if len(res.cols) > 0 {
+			sendRowDescription(res.out, res.cols, nil)
+		}
+		sendDataRows(res.out, res.cols, res.rows, nil)
+		sendCommandComplete(res.out, res.tag)
+	}
+	sendReadyForQuery(res.out, pc.txStatus)
+}
 
-	// Derive ordered column names from the first row
-	cols := make([]string, 0)
-	for k := range rows[0] {
-		cols = append(cols, k)
+// formatFor returns the format code for column idx given the result format
+// codes from Bind: none means text, one applies to all columns.
+func formatFor(formats []int16, idx int) int16 {
+	switch len(formats) {
+	case 0:
+		return 0
+	case 1:
+		return formats[0]
+	}
+	if idx < len(formats) {
+		return formats[idx]
 	}
+	return 0
+}
 
-	// RowDescription ('T')
+// sendRowDescription writes a RowDescription ('T').
+func sendRowDescription(conn net.Conn, cols []pgColumn, formats []int16) {
 	var rowDesc bytes.Buffer
 	binary.Write(&rowDesc, binary.BigEndian, int16(len(cols)))
-	for _, col := range cols {
-		rowDesc.WriteString(col)
-		rowDesc.WriteByte(0) // null terminator
+	for idx, col := range cols {
+		rowDesc.WriteString(col.name)
+		rowDesc.WriteByte(0)                                // null terminator
 		binary.Write(&rowDesc, binary.BigEndian, int32(0))  // table OID
 		binary.Write(&rowDesc, binary.BigEndian, int16(0))  // column attr
-		binary.Write(&rowDesc, binary.BigEndian, int32(25)) // type OID = text
-		binary.Write(&rowDesc, binary.BigEndian, int16(-1)) // type size = variable
+		binary.Write(&rowDesc, binary.BigEndian, col.oid)   // type OID
+		binary.Write(&rowDesc, binary.BigEndian, col.size)  // type size
 		binary.Write(&rowDesc, binary.BigEndian, int32(-1)) // type modifier
-		binary.Write(&rowDesc, binary.BigEndian, int16(0))  // format = text
+		binary.Write(&rowDesc, binary.BigEndian, formatFor(formats, idx))
 	}
 	writeMessage(conn, 'T', rowDesc.Bytes())
+}
 
-	// DataRow ('D') for each row
+// sendDataRows writes one DataRow ('D') per row, each value in the format
+// Bind asked for. It stops at the first value that cannot be encoded in
+// binary and reports it the way Postgres reports invalid input.
+func sendDataRows(conn net.Conn, cols []pgColumn, rows []map[string]interface{}, formats []int16) *store.ErrorReply {
 	for _, row := range rows {
 		var dataRow bytes.Buffer
 		binary.Write(&dataRow, binary.BigEndian, int16(len(cols)))
-		for _, col := range cols {
-			val := fmt.Sprintf("%v", row[col])
+		for idx, col := range cols {
+			v := row[col.name]
+			if v == nil {
+				binary.Write(&dataRow, binary.BigEndian, int32(-1)) // NULL
+				continue
+			}
+			val := []byte(pgTextValue(col.oid, v))
+			if formatFor(formats, idx) == 1 {
+				b, err := pgBinaryValue(col.oid, v)
+				if err != nil {
+					return &store.ErrorReply{SQLState: "22P02", Message: fmt.Sprintf("column %s: %v", col.name, err)}
+				}
+				val = b
+			}
 			binary.Write(&dataRow, binary.BigEndian, int32(len(val)))
-			dataRow.WriteString(val)
+			dataRow.Write(val)
 		}
 		writeMessage(conn, 'D', dataRow.Bytes())
 	}
-
-	sendCommandComplete(conn, fmt.Sprintf("SELECT %d", len(rows)))
-	sendReadyForQuery(conn)
 	return nil
 }
 
@@ -182,6 +369,39 @@ func sendCommandComplete(conn net.Conn, tag string) {
 	writeMessage(conn, 'C', body.Bytes())
 }
 
-func sendReadyForQuery(conn net.Conn) {
-	conn.Write([]byte{'Z', 0, 0, 0, 5, 'I'})
+// sendErrorResponse writes an ErrorResponse ('E') with severity, SQLSTATE and message.
+func sendErrorResponse(conn net.Conn, sqlState, msg string) {
+	sendErrorReply(conn, &store.ErrorReply{SQLState: sqlState, Message: msg})
+}
+
+// sendErrorReply sends a configured error, defaulting to internal_error
+// (XX000). Optional fields are only sent when set.
+func sendErrorReply(conn net.Conn, e *store.ErrorReply) {
+	state := "XX000"
+	if e.SQLState != "" {
+		state = e.SQLState
+	}
+	var body bytes.Buffer
+	for _, f := range []struct {
+		code  byte
+		value string
+	}{
+		{'S', "ERROR"}, {'V', "ERROR"}, {'C', state}, {'M', e.Message},
+		{'D', e.Detail}, {'H', e.Hint}, {'t', e.Table}, {'n', e.Constraint},
+	} {
+		if f.value == "" && f.code != 'M' {
+			continue
+		}
+		body.WriteByte(f.code)
+		body.WriteString(f.value)
+		body.WriteByte(0)
+	}
+	body.WriteByte(0)
+	writeMessage(conn, 'E', body.Bytes())
+}
+
+// sendReadyForQuery writes ReadyForQuery ('Z') with the transaction status:
+// pgTxIdle, pgTxActive or pgTxFailed.
+func sendReadyForQuery(conn net.Conn, status byte) {
+	conn.Write([]byte{'Z', 0, 0, 0, 5, status})
 }
@@ -0,0 +1,351 @@
+package dbs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+
+	"veritaserum/src/store"
+)
+
+// ---- Extended query protocol (Parse/Bind/Describe/Execute/Close) ---------
+
+type pgStatement struct {
+	query     string
+	paramOIDs []uint32
+}
+
+type pgPortal struct {
+	stmt    *pgStatement
+	params  []*string
+	formats []int16 // result column format codes from Bind
+	// result is resolved by Describe(portal) so that the RowDescription it
+	// sends matches what Execute then streams.
+	result *pgResult
+}
+
+// oidUnspecified leaves a parameter's type to the client, which then sends
+// it in text format.
+const oidUnspecified = 0
+
+var errShortMessage = errors.New("message too short")
+
+func handleExtendedMessage(pc *pgConn, msgType byte, body []byte) {
+	r := &pgReader{buf: body}
+	var err error
+	switch msgType {
+	case 'P':
+		err = handleParse(pc, r)
+	case 'B':
+		err = handleBind(pc, r)
+	case 'D':
+		err = handleDescribe(pc, r)
+	case 'E':
+		err = handleExecute(pc, r)
+	case 'C':
+		err = handleClose(pc, r)
+	}
+	if errors.Is(err, errShortMessage) {
+		pc.fail("08P01", fmt.Sprintf("invalid message format (%c)", msgType))
+	} else if err != nil {
+		pc.fail("26000", err.Error())
+	}
+}
+
+// fail sends an ErrorResponse and discards messages until the next Sync.
+func (pc *pgConn) fail(sqlState, msg string) {
+	sendErrorResponse(pc.conn, sqlState, msg)
+	pc.failed = true
+	pc.failTx()
+}
+
+func handleParse(pc *pgConn, r *pgReader) error {
+	name := r.cstring()
+	query := r.cstring()
+	n := r.count()
+	oids := make([]uint32, 0, n)
+	for i := 0; i < n; i++ {
+		oids = append(oids, uint32(r.int32()))
+	}
+	if r.err != nil {
+		return r.err
+	}
+	pc.stmts[name] = &pgStatement{query: query, paramOIDs: oids}
+	log.Printf("POSTGRES PARSE: %s", query)
+	writeMessage(pc.conn, '1', nil) // ParseComplete
+	return nil
+}
+
+func handleBind(pc *pgConn, r *pgReader) error {
+	portal := r.cstring()
+	stmtName := r.cstring()
+	paramFormats := make([]int16, r.count())
+	for i := range paramFormats {
+		paramFormats[i] = r.int16()
+	}
+	params := make([]*string, r.count())
+	for i := range params {
+		size := r.int32()
+		if size < 0 {
+			continue // SQL NULL
+		}
+		raw := r.bytes(int(size))
+		v := string(raw)
+		if formatFor(paramFormats, i) == 1 {
+			v = decodeBinaryParam(paramOID(pc.stmts[stmtName], i), raw)
+		}
+		params[i] = &v
+	}
+	resultFormats := make([]int16, r.count())
+	for i := range resultFormats {
+		resultFormats[i] = r.int16()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	stmt, ok := pc.stmts[stmtName]
+	if !ok {
+		return fmt.Errorf("prepared statement %q does not exist", stmtName)
+	}
+	pc.portals[portal] = &pgPortal{stmt: stmt, params: params, formats: resultFormats}
+	writeMessage(pc.conn, '2', nil) // BindComplete
+	return nil
+}
+
+func handleDescribe(pc *pgConn, r *pgReader) error {
+	kind := r.byte()
+	name := r.cstring()
+	if r.err != nil {
+		return r.err
+	}
+	switch kind {
+	case 'S':
+		stmt, ok := pc.stmts[name]
+		if !ok {
+			return fmt.Errorf("prepared statement %q does not exist", name)
+		}
+		sendParameterDescription(pc, stmt)
+		if cols := describeColumns(pc, stmt.query); len(cols) > 0 {
+			sendRowDescription(pc.conn, cols, nil)
+		} else {
+			writeMessage(pc.conn, 'n', nil) // NoData
+		}
+	case 'P':
+		portal, ok := pc.portals[name]
+		if !ok {
+			return fmt.Errorf("portal %q does not exist", name)
+		}
+		if portal.result == nil {
+			portal.result = resolvePostgres(pc, portal.stmt.query, portal.params)
+		}
+		if cols := portal.result.cols; len(cols) > 0 && portal.result.err == nil {
+			sendRowDescription(pc.conn, cols, portal.formats)
+		} else {
+			writeMessage(pc.conn, 'n', nil) // NoData
+		}
+	}
+	return nil
+}
+
+func handleExecute(pc *pgConn, r *pgReader) error {
+	name := r.cstring()
+	r.int32() // max rows: results are always sent in full
+	if r.err != nil {
+		return r.err
+	}
+	portal, ok := pc.portals[name]
+	if !ok {
+		return fmt.Errorf("portal %q does not exist", name)
+	}
+	query := portal.stmt.query
+	log.Printf("POSTGRES EXECUTE: %s %v", query, store.SQLValues(portal.params))
+
+	if housekeepingStatement(query) == "" {
+		writeMessage(pc.conn, 'I', nil) // EmptyQueryResponse
+		return nil
+	}
+	res := portal.result
+	if res == nil {
+		res = resolvePostgres(pc, query, portal.params)
+	}
+	portal.result = nil
+	switch {
+	case res.reset:
+	case res.err != nil:
+		sendErrorReply(res.out, res.err)
+		pc.failed = true
+	default:
+		if err := sendDataRows(res.out, res.cols, res.rows, portal.formats); err != nil {
+			sendErrorReply(res.out, err)
+			pc.failed = true
+			pc.failTx()
+			break
+		}
+		sendCommandComplete(res.out, res.tag)
+	}
+	return nil
+}
+
+func handleClose(pc *pgConn, r *pgReader) error {
+	kind := r.byte()
+	name := r.cstring()
+	if r.err != nil {
+		return r.err
+	}
+	if kind == 'S' {
+		delete(pc.stmts, name)
+	} else {
+		delete(pc.portals, name)
+	}
+	writeMessage(pc.conn, '3', nil) // CloseComplete
+	return nil
+}
+
+var placeholderRe = regexp.MustCompile(`\$(\d+)`)
+
+// sendParameterDescription advertises one type per placeholder. Types the
+// client left unspecified stay unspecified, so drivers send values as text
+// that we can capture verbatim.
+func sendParameterDescription(pc *pgConn, stmt *pgStatement) {
+	n := len(stmt.paramOIDs)
+	for _, m := range placeholderRe.FindAllStringSubmatch(stmt.query, -1) {
+		if idx, _ := strconv.Atoi(m[1]); idx > n {
+			n = idx
+		}
+	}
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, int16(n))
+	for i := 0; i < n; i++ {
+		binary.Write(&body, binary.BigEndian, paramOID(stmt, i))
+	}
+	writeMessage(pc.conn, 't', body.Bytes())
+}
+
+func paramOID(stmt *pgStatement, idx int) uint32 {
+	if stmt == nil || idx >= len(stmt.paramOIDs) || stmt.paramOIDs[idx] == 0 {
+		return oidUnspecified
+	}
+	return stmt.paramOIDs[idx]
+}
+
+// describeColumns predicts the result columns of a prepared statement before
+// its parameters are bound, from any configured interaction for the same SQL,
+// else from the housekeeping catalog or the live tables.
+func describeColumns(pc *pgConn, query string) []pgColumn {
+	i := store.LookupConfiguredQuery(store.ProtoPostgres, query)
+	if i == nil {
+		if pc.housekeeping && !placeholderRe.MatchString(query) {
+			if hk := pgHousekeepingQuery(pc, query); hk != nil {
+				return hk.pgColumns()
+			}
+		}
+		if names, ok := store.DescribeLive(store.ProtoPostgres, query); ok {
+			return pgColumnsNamed(query, names, nil)
+		}
+		return nil
+	}
+	resp := store.PeekResponse(i)
+	if resp == nil {
+		return nil
+	}
+	return pgColumns(query, resp.Rows)
+}
+
+// decodeBinaryParam renders a binary-format parameter as text.
+func decodeBinaryParam(oid uint32, b []byte) string {
+	switch {
+	case oid == oidBool && len(b) == 1: // bool
+		return strconv.FormatBool(b[0] != 0)
+	case oid == oidInt2 && len(b) == 2: // int2
+		return strconv.Itoa(int(int16(binary.BigEndian.Uint16(b))))
+	case oid == oidInt4 && len(b) == 4: // int4
+		return strconv.Itoa(int(int32(binary.BigEndian.Uint32(b))))
+	case oid == oidInt8 && len(b) == 8: // int8
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(b)), 10)
+	case oid == oidFloat4 && len(b) == 4: // float4
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(b))), 'g', -1, 32)
+	case oid == oidFloat8 && len(b) == 8: // float8
+		return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(b)), 'g', -1, 64)
+	case oid == oidUUID && len(b) == 16: // uuid
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	case oid == oidText || oid == oidVarchar || oid == oidBpchar || oid == 19 || oid == oidJSON: // text, varchar, bpchar, name, json
+		return string(b)
+	case oid == oidJSONB && len(b) > 0: // jsonb: version byte + text
+		return string(b[1:])
+	}
+	return `\x` + hex.EncodeToString(b)
+}
+
+// ---- Message reader ------------------------------------------------------
+
+// pgReader decodes frontend message bodies; the first short read sets err
+// and every later read returns zero values.
+type pgReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pgReader) take(n int) []byte {
+	if r.err != nil || n < 0 || len(r.buf) < n {
+		r.err = errShortMessage
+		return nil
+	}
+	out := r.buf[:n]
+	r.buf = r.buf[n:]
+	return out
+}
+
+func (r *pgReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *pgReader) int16() int16 {
+	if b := r.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *pgReader) int32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+// count reads an int16 element count, rejecting negative values.
+func (r *pgReader) count() int {
+	n := int(r.int16())
+	if n < 0 {
+		r.err = errShortMessage
+		return 0
+	}
+	return n
+}
+
+func (r *pgReader) bytes(n int) []byte {
+	return r.take(n)
+}
+
+func (r *pgReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	idx := bytes.IndexByte(r.buf, 0)
+	if idx == -1 {
+		r.err = errShortMessage
+		return ""
+	}
+	s := string(r.buf[:idx])
+	r.buf = r.buf[idx+1:]
+	return s
+}
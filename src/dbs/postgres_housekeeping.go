@@ -0,0 +1,388 @@
+package dbs
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"veritaserum/src/store"
+)
+
+// ---- Session settings & driver housekeeping ------------------------------
+
+const (
+	pgServerVersion = "16.0"
+	pgVersionString = "PostgreSQL 16.0 (Veritaserum mock) on x86_64-pc-linux-gnu, compiled by Go, 64-bit"
+)
+
+// pgSetting is a run-time parameter with its server default.
+type pgSetting struct {
+	name   string // as SHOW and ParameterStatus spell it
+	value  string
+	report bool // sent in ParameterStatus at startup and whenever it changes
+}
+
+var pgSettings = []pgSetting{
+	{"application_name", "", true},
+	{"client_encoding", "UTF8", true},
+	{"DateStyle", "ISO, MDY", true},
+	{"default_transaction_isolation", "read committed", false},
+	{"default_transaction_read_only", "off", true},
+	{"extra_float_digits", "1", false},
+	{"idle_in_transaction_session_timeout", "0", false},
+	{"in_hot_standby", "off", true},
+	{"integer_datetimes", "on", true},
+	{"IntervalStyle", "postgres", true},
+	{"is_superuser", "on", true},
+	{"lock_timeout", "0", false},
+	{"max_identifier_length", "63", false},
+	{"search_path", `"$user", public`, false},
+	{"server_encoding", "UTF8", true},
+	{"server_version", pgServerVersion, true},
+	{"server_version_num", "160000", false},
+	{"session_authorization", "", true},
+	{"standard_conforming_strings", "on", true},
+	{"statement_timeout", "0", false},
+	{"TimeZone", "UTC", true},
+	{"transaction_isolation", "read committed", false},
+	{"transaction_read_only", "off", false},
+}
+
+// pgSettingByName indexes pgSettings by lower-cased name.
+var pgSettingByName = func() map[string]pgSetting {
+	m := make(map[string]pgSetting, len(pgSettings))
+	for _, s := range pgSettings {
+		m[strings.ToLower(s.name)] = s
+	}
+	return m
+}()
+
+// startSession takes the user, database and run-time parameters from the
+// StartupMessage. Parameters set there are also what RESET goes back to.
+func (pc *pgConn) startSession(params map[string]string) {
+	pc.user = params["user"]
+	pc.database = params["database"]
+	if pc.database == "" {
+		pc.database = pc.user
+	}
+	pc.defaults = make(map[string]string, len(pgSettings)+len(params))
+	for _, s := range pgSettings {
+		pc.defaults[strings.ToLower(s.name)] = s.value
+	}
+	pc.defaults["session_authorization"] = pc.user
+	for name, value := range params {
+		switch name {
+		case "user", "database", "replication":
+		case "options":
+			for n, v := range parseStartupOptions(value) {
+				pc.defaults[n] = v
+			}
+		default:
+			pc.defaults[strings.ToLower(name)] = value
+		}
+	}
+	pc.settings = make(map[string]string, len(pc.defaults))
+	for name, value := range pc.defaults {
+		pc.settings[name] = value
+	}
+}
+
+// parseStartupOptions reads "-c name=value" and "--name=value" switches
+// from the options startup parameter.
+func parseStartupOptions(options string) map[string]string {
+	out := map[string]string{}
+	fields := strings.Fields(options)
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		switch {
+		case f == "-c" && i+1 < len(fields):
+			i++
+			f = fields[i]
+		case strings.HasPrefix(f, "--"):
+			f = f[2:]
+		case strings.HasPrefix(f, "-c"):
+			f = f[2:]
+		default:
+			continue
+		}
+		if name, value, ok := strings.Cut(f, "="); ok {
+			out[strings.ToLower(strings.ReplaceAll(name, "-", "_"))] = value
+		}
+	}
+	return out
+}
+
+// sendParameterStatuses reports every GUC_REPORT setting, as the server does
+// between AuthenticationOk and BackendKeyData.
+func (pc *pgConn) sendParameterStatuses() {
+	for _, s := range pgSettings {
+		if s.report {
+			sendParameterStatus(pc.conn, s.name, pc.settings[strings.ToLower(s.name)])
+		}
+	}
+}
+
+// sendParameterStatus writes a ParameterStatus ('S').
+func sendParameterStatus(conn net.Conn, name, value string) {
+	writeMessage(conn, 'S', []byte(name+"\x00"+value+"\x00"))
+}
+
+// setSetting changes a run-time parameter, reporting it to the client when
+// it is one drivers track.
+func (pc *pgConn) setSetting(name, value string) {
+	name = strings.ToLower(name)
+	if old, ok := pc.settings[name]; ok && old == value {
+		return
+	}
+	pc.settings[name] = value
+	if s, ok := pgSettingByName[name]; ok && s.report {
+		sendParameterStatus(pc.conn, s.name, value)
+	}
+}
+
+// resetSetting puts a parameter back to its value at session start.
+func (pc *pgConn) resetSetting(name string) {
+	name = strings.ToLower(name)
+	if v, ok := pc.defaults[name]; ok {
+		pc.setSetting(name, v)
+		return
+	}
+	delete(pc.settings, name)
+}
+
+func (pc *pgConn) resetAllSettings() {
+	for name := range pc.settings {
+		pc.resetSetting(name)
+	}
+}
+
+// settingDisplayName is how SHOW titles its column.
+func settingDisplayName(name string) string {
+	if s, ok := pgSettingByName[name]; ok {
+		return s.name
+	}
+	return name
+}
+
+// pgSettingAliases maps the multi-word forms SET and SHOW accept.
+var pgSettingAliases = map[string]string{
+	"time zone":                   "timezone",
+	"names":                       "client_encoding",
+	"schema":                      "search_path",
+	"session authorization":       "session_authorization",
+	"transaction isolation level": "transaction_isolation",
+}
+
+// pgHousekeeping answers statements drivers and pools send on their own, or
+// returns nil when sql is not one of them.
+func pgHousekeeping(pc *pgConn, sql string) *housekeepingResult {
+	if tag, ok := pgHousekeepingCommand(pc, sql); ok {
+		return &housekeepingResult{tag: tag}
+	}
+	return pgHousekeepingQuery(pc, sql)
+}
+
+var (
+	pgSetRe          = regexp.MustCompile(`(?is)^set\s+(?:(session|local)\s+)?(.*)$`)
+	pgSetAliasRe     = regexp.MustCompile(`(?is)^(time\s+zone|names|schema)\s+(.*)$`)
+	pgSetValueRe     = regexp.MustCompile(`(?is)^([\w.]+)\s*(?:=|\s+to\s+)\s*(.*)$`)
+	pgSetIsolationRe = regexp.MustCompile(`(?is)^characteristics\s+as\s+transaction\s+.*?isolation\s+level\s+(read\s+uncommitted|read\s+committed|repeatable\s+read|serializable)`)
+	pgResetRe        = regexp.MustCompile(`(?is)^reset\s+(.+)$`)
+	pgDiscardRe      = regexp.MustCompile(`(?is)^discard\s+(all|plans|sequences|temp|temporary)$`)
+)
+
+// pgHousekeepingCommand applies SET, RESET and DISCARD to the session and
+// returns the command tag, or false when sql is none of them.
+func pgHousekeepingCommand(pc *pgConn, sql string) (string, bool) {
+	stmt := housekeepingStatement(sql)
+	switch firstWord(stmt) {
+	case "set":
+		m := pgSetRe.FindStringSubmatch(stmt)
+		if m == nil {
+			return "", false
+		}
+		if strings.EqualFold(m[1], "local") {
+			return "SET", true // lasts until the end of the transaction
+		}
+		rest := m[2]
+		if im := pgSetIsolationRe.FindStringSubmatch(rest); im != nil {
+			pc.setSetting("default_transaction_isolation", strings.ToLower(strings.Join(strings.Fields(im[1]), " ")))
+			return "SET", true
+		}
+		var name, value string
+		if am := pgSetAliasRe.FindStringSubmatch(rest); am != nil {
+			name, value = pgSettingAliases[strings.ToLower(strings.Join(strings.Fields(am[1]), " "))], am[2]
+		} else if vm := pgSetValueRe.FindStringSubmatch(rest); vm != nil {
+			name, value = strings.ToLower(vm[1]), vm[2]
+		} else {
+			return "SET", true // SET ROLE, SET TRANSACTION …
+		}
+		if strings.EqualFold(value, "default") || strings.EqualFold(value, "local") && name == "timezone" {
+			pc.resetSetting(name)
+			return "SET", true
+		}
+		parts := store.SplitTopLevel(value)
+		for i, p := range parts {
+			parts[i] = sqlUnquote(p)
+		}
+		pc.setSetting(name, strings.Join(parts, ", "))
+		return "SET", true
+
+	case "reset":
+		m := pgResetRe.FindStringSubmatch(stmt)
+		if m == nil {
+			return "", false
+		}
+		name := strings.ToLower(strings.Join(strings.Fields(m[1]), " "))
+		if alias, ok := pgSettingAliases[name]; ok {
+			name = alias
+		}
+		if name == "all" {
+			pc.resetAllSettings()
+		} else {
+			pc.resetSetting(name)
+		}
+		return "RESET", true
+
+	case "discard":
+		m := pgDiscardRe.FindStringSubmatch(stmt)
+		if m == nil {
+			return "", false
+		}
+		what := strings.ToUpper(m[1])
+		if what == "TEMPORARY" {
+			what = "TEMP"
+		}
+		if what == "ALL" {
+			pc.resetAllSettings()
+		}
+		return "DISCARD " + what, true
+	}
+	return "", false
+}
+
+var (
+	pgShowRe           = regexp.MustCompile(`(?is)^show\s+(.+)$`)
+	pgCurrentSettingRe = regexp.MustCompile(`(?is)^(?:pg_catalog\.)?current_setting\s*\(\s*'([^']*)'\s*(?:,\s*(true|false)\s*)?\)$`)
+	pgFuncNameRe       = regexp.MustCompile(`^(?:\w+\.)?(\w+)\s*\(`)
+	pgIdentRe          = regexp.MustCompile(`^\w+$`)
+)
+
+// pgHousekeepingQuery answers SHOW and SELECTs of server functions and
+// session information. It never changes the session, so Describe can use it
+// ahead of execution.
+func pgHousekeepingQuery(pc *pgConn, sql string) *housekeepingResult {
+	stmt := housekeepingStatement(sql)
+	switch firstWord(stmt) {
+	case "show":
+		m := pgShowRe.FindStringSubmatch(stmt)
+		if m == nil {
+			return nil
+		}
+		name := strings.ToLower(strings.Join(strings.Fields(m[1]), " "))
+		if alias, ok := pgSettingAliases[name]; ok {
+			name = alias
+		}
+		value, ok := pc.settings[name]
+		if !ok {
+			return nil
+		}
+		col := settingDisplayName(name)
+		return &housekeepingResult{cols: []string{col}, rows: []map[string]interface{}{{col: value}}, tag: "SHOW"}
+
+	case "select":
+		if !selectsNoTable(stmt) {
+			return nil
+		}
+		items := store.SelectItems(stmt)
+		if len(items) == 0 {
+			return nil
+		}
+		names := make([]string, len(items))
+		values := make([]interface{}, len(items))
+		for i, it := range items {
+			v, ok := pc.evalHousekeeping(it.Expr)
+			if !ok {
+				return nil
+			}
+			names[i], values[i] = it.Alias, v
+			if names[i] == "" {
+				names[i] = pgColumnName(it.Expr)
+			}
+		}
+		return singleRow(names, values)
+	}
+	return nil
+}
+
+// pgColumnName is the name Postgres gives an unaliased expression: the
+// function or keyword, else "?column?".
+func pgColumnName(expr string) string {
+	if m := pgFuncNameRe.FindStringSubmatch(expr); m != nil {
+		return strings.ToLower(m[1])
+	}
+	if pgIdentRe.MatchString(expr) && !intLiteralRe.MatchString(expr) {
+		return strings.ToLower(expr)
+	}
+	return "?column?"
+}
+
+// evalHousekeeping evaluates one SELECT list expression: a session
+// information function, current_setting() or a literal.
+func (pc *pgConn) evalHousekeeping(expr string) (interface{}, bool) {
+	if v, ok := literalValue(expr); ok {
+		return v, true
+	}
+	if m := pgCurrentSettingRe.FindStringSubmatch(expr); m != nil {
+		if v, ok := pc.settings[strings.ToLower(m[1])]; ok {
+			return v, true
+		}
+		if strings.EqualFold(m[2], "true") {
+			return nil, true // missing_ok
+		}
+		return nil, false
+	}
+	switch strings.TrimPrefix(strings.ToLower(strings.ReplaceAll(expr, " ", "")), "pg_catalog.") {
+	case "version()":
+		return pgVersionString, true
+	case "current_schema", "current_schema()":
+		if schemas := pc.searchPath(); len(schemas) > 0 {
+			return schemas[0], true
+		}
+		return nil, true
+	case "current_schemas(false)":
+		return "{" + strings.Join(pc.searchPath(), ",") + "}", true
+	case "current_schemas(true)":
+		return "{" + strings.Join(append([]string{"pg_catalog"}, pc.searchPath()...), ",") + "}", true
+	case "current_database()", "current_catalog":
+		return pc.database, true
+	case "current_user", "current_role", "session_user", "user":
+		return pc.settings["session_authorization"], true
+	case "pg_backend_pid()":
+		return float64(pc.pid), true
+	case "pg_is_in_recovery()":
+		return false, true
+	}
+	return nil, false
+}
+
+// searchPath returns the schemas in search_path, without "$user".
+func (pc *pgConn) searchPath() []string {
+	var out []string
+	for _, s := range store.SplitTopLevel(pc.settings["search_path"]) {
+		if s = sqlUnquote(s); s != "" && s != "$user" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// pgColumns types the columns of a canned answer from its values.
+func (hk *housekeepingResult) pgColumns() []pgColumn {
+	cols := make([]pgColumn, len(hk.cols))
+	for i, name := range hk.cols {
+		oid := inferOID(hk.rows, name)
+		cols[i] = pgColumn{name: name, oid: oid, size: pgTypeSize(oid)}
+	}
+	return cols
+}
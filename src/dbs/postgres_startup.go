@@ -0,0 +1,146 @@
+package dbs
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"veritaserum/src/certs"
+)
+
+// ---- Startup negotiation & query cancellation ----------------------------
+
+// Request codes sent in place of a protocol version in the first message.
+const (
+	pgCancelRequest = 80877102
+	pgSSLRequest    = 80877103
+	pgGSSENCRequest = 80877104
+
+	maxStartupLen = 10000 // same limit as the real server
+)
+
+// readStartup answers encryption requests until the client sends its
+// StartupMessage, and returns the connection the session continues on
+// (TLS-wrapped when upgraded) and the startup parameters. It reports false
+// when the client hung up or the connection only carried a CancelRequest.
+func readStartup(conn net.Conn, opts PostgresOptions) (net.Conn, map[string]string, bool) {
+	for {
+		var msgLen int32
+		if err := binary.Read(conn, binary.BigEndian, &msgLen); err != nil {
+			return nil, nil, false
+		}
+		if msgLen < 8 || msgLen > maxStartupLen {
+			log.Printf("postgres: invalid startup packet length %d", msgLen)
+			return nil, nil, false
+		}
+		body := make([]byte, msgLen-4)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return nil, nil, false
+		}
+
+		switch binary.BigEndian.Uint32(body) {
+		case pgSSLRequest:
+			if !opts.TLS {
+				conn.Write([]byte{'N'})
+				continue
+			}
+			conn.Write([]byte{'S'})
+			tc := tls.Server(conn, certs.ServerTLSConfig("localhost"))
+			if err := tc.Handshake(); err != nil {
+				log.Printf("postgres: TLS handshake: %v", err)
+				return nil, nil, false
+			}
+			conn = tc
+
+		case pgGSSENCRequest:
+			conn.Write([]byte{'N'})
+
+		case pgCancelRequest:
+			if len(body) >= 12 {
+				cancelBackend(int32(binary.BigEndian.Uint32(body[4:])), int32(binary.BigEndian.Uint32(body[8:])))
+			}
+			return nil, nil, false
+
+		default:
+			return conn, parseStartupParams(body[4:]), true
+		}
+	}
+}
+
+// parseStartupParams reads the NUL-terminated name/value pairs that follow
+// the protocol version in a StartupMessage.
+func parseStartupParams(b []byte) map[string]string {
+	r := &pgReader{buf: b}
+	params := map[string]string{}
+	for len(r.buf) > 1 {
+		name := r.cstring()
+		value := r.cstring()
+		if r.err != nil {
+			break
+		}
+		params[name] = value
+	}
+	return params
+}
+
+var (
+	backendsMu sync.Mutex
+	backends         = map[int32]*pgConn{}
+	nextPID    int32 = 1000
+)
+
+// registerBackend gives pc a process ID and secret key to report in
+// BackendKeyData, so a CancelRequest on another connection can find it.
+func registerBackend(pc *pgConn) {
+	var secret [4]byte
+	rand.Read(secret[:])
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	nextPID++
+	pc.pid = nextPID
+	pc.secret = int32(binary.BigEndian.Uint32(secret[:]))
+	backends[pc.pid] = pc
+}
+
+func unregisterBackend(pc *pgConn) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	delete(backends, pc.pid)
+}
+
+// cancelBackend aborts the query the backend is waiting on, if any. Like the
+// real server it never tells the requester whether anything was canceled.
+func cancelBackend(pid, secret int32) {
+	backendsMu.Lock()
+	pc := backends[pid]
+	backendsMu.Unlock()
+	if pc == nil || pc.secret != secret {
+		log.Printf("POSTGRES CANCEL ignored: unknown backend %d", pid)
+		return
+	}
+	pc.cancelMu.Lock()
+	defer pc.cancelMu.Unlock()
+	if pc.running != nil {
+		close(pc.running)
+		pc.running = nil
+		log.Printf("POSTGRES CANCEL: backend %d", pid)
+	}
+}
+
+// startQuery marks pc as busy and returns the channel a CancelRequest closes.
+func (pc *pgConn) startQuery() <-chan struct{} {
+	pc.cancelMu.Lock()
+	defer pc.cancelMu.Unlock()
+	pc.running = make(chan struct{})
+	return pc.running
+}
+
+func (pc *pgConn) endQuery() {
+	pc.cancelMu.Lock()
+	defer pc.cancelMu.Unlock()
+	pc.running = nil
+}
@@ -0,0 +1,120 @@
+package dbs
+
+import (
+	"log"
+
+	"veritaserum/src/store"
+)
+
+// ---- Transactions --------------------------------------------------------
+
+// Transaction status reported in ReadyForQuery.
+const (
+	pgTxIdle   = 'I'
+	pgTxActive = 'T'
+	pgTxFailed = 'E' // an error occurred; only COMMIT or ROLLBACK get through
+)
+
+// pgInFailedTx is the error for statements sent after a failure inside a
+// transaction block.
+var pgInFailedTx = &store.ErrorReply{
+	SQLState: "25P02",
+	Message:  "current transaction is aborted, commands ignored until end of transaction block",
+}
+
+// txTag is the CommandComplete tag for a transaction control statement;
+// COMMIT of a failed transaction reports the rollback it turns into.
+func (pc *pgConn) txTag(cmd *txCommand) string {
+	switch cmd.kind {
+	case txBegin:
+		if cmd.verb == "START" {
+			return "START TRANSACTION"
+		}
+		return "BEGIN"
+	case txCommit:
+		if pc.txStatus == pgTxFailed {
+			return "ROLLBACK"
+		}
+		return "COMMIT"
+	case txSavepoint:
+		return "SAVEPOINT"
+	case txRelease:
+		return "RELEASE"
+	}
+	return "ROLLBACK"
+}
+
+// trackTx moves the connection's transaction status along and journals
+// statements run inside a transaction. A failing statement fails the
+// transaction; a failing COMMIT ends it rolled back.
+func (pc *pgConn) trackTx(sql string, cmd *txCommand, res *pgResult) {
+	failed := res.err != nil
+	if cmd == nil || failed && cmd.kind != txCommit {
+		if pc.tx != "" {
+			store.RecordTxStatement(pc.tx, sql, res.interactionID, failed)
+			if failed {
+				pc.txStatus = pgTxFailed
+			}
+		}
+		return
+	}
+	switch cmd.kind {
+	case txBegin:
+		if pc.tx == "" {
+			pc.tx = store.BeginTransaction(store.ProtoPostgres, int64(pc.pid))
+			pc.txStatus = pgTxActive
+		}
+	case txCommit, txRollback:
+		status := store.TxRolledBack
+		if cmd.kind == txCommit && pc.txStatus == pgTxActive && !failed {
+			status = store.TxCommitted
+		}
+		pc.endTx(status)
+		if cmd.chain {
+			pc.tx = store.BeginTransaction(store.ProtoPostgres, int64(pc.pid))
+			pc.txStatus = pgTxActive
+		}
+	case txSavepoint, txRelease, txRollbackTo:
+		if pc.tx == "" {
+			return
+		}
+		// The SAVEPOINT statement comes before the savepoint; ROLLBACK TO
+		// after the statements it undoes.
+		switch cmd.kind {
+		case txSavepoint:
+			store.RecordTxStatement(pc.tx, sql, res.interactionID, false)
+			store.Savepoint(pc.tx, cmd.savepoint)
+			pc.live.savepoint(cmd.savepoint)
+		case txRelease:
+			store.ReleaseSavepoint(pc.tx, cmd.savepoint)
+			pc.live.release(cmd.savepoint)
+			store.RecordTxStatement(pc.tx, sql, res.interactionID, false)
+		case txRollbackTo:
+			if store.RollbackToSavepoint(pc.tx, cmd.savepoint) {
+				pc.txStatus = pgTxActive
+			}
+			pc.live.rollbackTo(cmd.savepoint)
+			store.RecordTxStatement(pc.tx, sql, res.interactionID, false)
+		}
+	}
+}
+
+// failTx fails the open transaction after an error raised outside
+// resolvePostgres (a bad Bind, a value that cannot be encoded …).
+func (pc *pgConn) failTx() {
+	if pc.txStatus == pgTxActive {
+		pc.txStatus = pgTxFailed
+	}
+}
+
+// endTx closes the open transaction, if any, with status; live-table writes
+// are reverted unless it committed.
+func (pc *pgConn) endTx(status string) {
+	pc.live.end(status == store.TxCommitted)
+	if pc.tx != "" {
+		store.EndTransaction(pc.tx, status)
+		log.Printf("POSTGRES TRANSACTION %s", status)
+	}
+	pc.tx = ""
+	pc.txStatus = pgTxIdle
+}
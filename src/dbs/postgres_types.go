@@ -0,0 +1,368 @@
+package dbs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"veritaserum/src/store"
+)
+
+// ---- Typed result columns ------------------------------------------------
+
+// Type OIDs from pg_type.
+const (
+	oidBool        = 16
+	oidBytea       = 17
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidText        = 25
+	oidJSON        = 114
+	oidFloat4      = 700
+	oidFloat8      = 701
+	oidBpchar      = 1042
+	oidVarchar     = 1043
+	oidDate        = 1082
+	oidTimestamp   = 1114
+	oidTimestamptz = 1184
+	oidNumeric     = 1700
+	oidUUID        = 2950
+	oidJSONB       = 3802
+)
+
+// pgColumn is a result column as advertised in RowDescription.
+type pgColumn struct {
+	name string
+	oid  uint32
+	size int16 // typlen: -1 for variable-length types
+}
+
+// pgColumns types the columns of a mocked result: from the CREATE TABLE of
+// any schema the query mentions, else from the JSON values in the rows.
+func pgColumns(query string, rows []map[string]interface{}) []pgColumn {
+	return pgColumnsNamed(query, rowColumns(rows), rows)
+}
+
+// pgColumnsNamed types the given columns, as pgColumns does; live results
+// name their columns even when they have no rows.
+func pgColumnsNamed(query string, names []string, rows []map[string]interface{}) []pgColumn {
+	if len(names) == 0 {
+		return nil
+	}
+	schemaCols := store.SchemaColumns(store.ProtoPostgres, query)
+	types := make(map[string]string, len(schemaCols))
+	order := make([]string, 0, len(schemaCols))
+	for _, c := range schemaCols {
+		types[c.Name] = c.Type
+		order = append(order, c.Name)
+	}
+	names = orderColumns(names, store.SelectList(query), order)
+
+	cols := make([]pgColumn, len(names))
+	for i, name := range names {
+		var oid uint32
+		if t, ok := types[name]; ok {
+			oid = pgTypeOID(t)
+		} else {
+			oid = inferOID(rows, name)
+		}
+		cols[i] = pgColumn{name: name, oid: oid, size: pgTypeSize(oid)}
+	}
+	return cols
+}
+
+var typeModifierRe = regexp.MustCompile(`\s*\([^)]*\)`)
+
+// pgTypeOID maps a SQL type name to its OID; anything unknown (including
+// arrays) is sent as text.
+func pgTypeOID(sqlType string) uint32 {
+	t := strings.TrimSpace(typeModifierRe.ReplaceAllString(strings.ToLower(sqlType), ""))
+	if strings.HasSuffix(t, "[]") {
+		return oidText
+	}
+	switch t {
+	case "bool", "boolean":
+		return oidBool
+	case "smallint", "int2", "smallserial", "serial2":
+		return oidInt2
+	case "int", "integer", "int4", "serial", "serial4":
+		return oidInt4
+	case "bigint", "int8", "bigserial", "serial8":
+		return oidInt8
+	case "real", "float4":
+		return oidFloat4
+	case "double precision", "float8", "float":
+		return oidFloat8
+	case "numeric", "decimal":
+		return oidNumeric
+	case "varchar", "character varying":
+		return oidVarchar
+	case "char", "character", "bpchar":
+		return oidBpchar
+	case "bytea":
+		return oidBytea
+	case "uuid":
+		return oidUUID
+	case "date":
+		return oidDate
+	case "timestamp", "timestamp without time zone":
+		return oidTimestamp
+	case "timestamptz", "timestamp with time zone":
+		return oidTimestamptz
+	case "json":
+		return oidJSON
+	case "jsonb":
+		return oidJSONB
+	}
+	return oidText
+}
+
+func pgTypeSize(oid uint32) int16 {
+	switch oid {
+	case oidBool:
+		return 1
+	case oidInt2:
+		return 2
+	case oidInt4, oidFloat4, oidDate:
+		return 4
+	case oidInt8, oidFloat8, oidTimestamp, oidTimestamptz:
+		return 8
+	case oidUUID:
+		return 16
+	}
+	return -1
+}
+
+// inferOID types a column without a schema from all of its non-null
+// values: whole numbers widen to float8 when any value is fractional, and a
+// column mixing other kinds falls back to text.
+func inferOID(rows []map[string]interface{}, col string) uint32 {
+	oid := uint32(0)
+	for _, row := range rows {
+		var next uint32
+		switch v := row[col].(type) {
+		case nil:
+			continue
+		case bool:
+			next = oidBool
+		case int64:
+			next = oidInt8
+		case json.Number:
+			next = oidFloat8
+			if _, err := v.Int64(); err == nil {
+				next = oidInt8
+			}
+		case float64:
+			next = oidFloat8
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				next = oidInt8
+			}
+		case map[string]interface{}, []interface{}:
+			next = oidJSONB
+		default:
+			next = oidText
+		}
+		switch {
+		case oid == 0 || oid == next:
+			oid = next
+		case oid == oidInt8 && next == oidFloat8, oid == oidFloat8 && next == oidInt8:
+			oid = oidFloat8
+		default:
+			return oidText
+		}
+	}
+	if oid == 0 {
+		return oidText
+	}
+	return oid
+}
+
+// ---- Value encoding ------------------------------------------------------
+
+// pgTextValue renders v in the text format of the column type.
+func pgTextValue(oid uint32, v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		switch oid {
+		case oidBool:
+			if b, err := parsePgBool(v); err == nil {
+				return pgBoolText(b)
+			}
+		case oidDate, oidTimestamp, oidTimestamptz:
+			if t, err := parseSQLTime(v); err == nil {
+				return formatPgTime(oid, t)
+			}
+		}
+		return v
+	case bool:
+		if oid == oidBool {
+			return pgBoolText(v)
+		}
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// pgBinaryValue encodes v in the binary format of the column type.
+func pgBinaryValue(oid uint32, v interface{}) ([]byte, error) {
+	s := pgTextValue(oid, v)
+	var buf bytes.Buffer
+	switch oid {
+	case oidBool:
+		b, err := parsePgBool(s)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case oidInt2, oidInt4, oidInt8:
+		size := int(pgTypeSize(oid))
+		n, err := strconv.ParseInt(s, 10, size*8)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, 8)
+		binary.BigEndian.PutUint64(out, uint64(n))
+		return out[8-size:], nil
+	case oidFloat4:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.BigEndian, float32(f))
+	case oidFloat8:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.BigEndian, f)
+	case oidNumeric:
+		return encodeNumeric(s)
+	case oidUUID:
+		b, err := hex.DecodeString(strings.ReplaceAll(strings.Trim(s, "{}"), "-", ""))
+		if err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("invalid uuid %q", s)
+		}
+		return b, nil
+	case oidBytea:
+		if strings.HasPrefix(s, `\x`) {
+			return hex.DecodeString(s[2:])
+		}
+		return []byte(s), nil
+	case oidDate:
+		t, err := parseSQLTime(s)
+		if err != nil {
+			return nil, err
+		}
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		binary.Write(&buf, binary.BigEndian, int32((day.Unix()-pgEpoch.Unix())/86400))
+	case oidTimestamp, oidTimestamptz:
+		t, err := parseSQLTime(s)
+		if err != nil {
+			return nil, err
+		}
+		// Not t.Sub: a time.Duration saturates at ±292 years, short of
+		// sentinels like 0001-01-01 and 9999-12-31.
+		binary.Write(&buf, binary.BigEndian, (t.Unix()-pgEpoch.Unix())*1000000+int64(t.Nanosecond()/1000))
+	case oidJSONB:
+		buf.WriteByte(1) // jsonb format version
+		buf.WriteString(s)
+	default:
+		buf.WriteString(s)
+	}
+	return buf.Bytes(), nil
+}
+
+func parsePgBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "t", "true", "y", "yes", "on", "1":
+		return true, nil
+	case "f", "false", "n", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
+
+func pgBoolText(b bool) string {
+	if b {
+		return "t"
+	}
+	return "f"
+}
+
+// pgEpoch is the zero point of binary dates and timestamps.
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func formatPgTime(oid uint32, t time.Time) string {
+	switch oid {
+	case oidDate:
+		return t.Format("2006-01-02")
+	case oidTimestamptz:
+		return t.Format("2006-01-02 15:04:05.999999-07:00")
+	}
+	return t.Format("2006-01-02 15:04:05.999999")
+}
+
+var numericRe = regexp.MustCompile(`^([+-]?)(\d*)(?:\.(\d*))?$`)
+
+// encodeNumeric writes a decimal string in numeric's binary form: base-10000
+// digit groups with a weight (position of the first group relative to the
+// decimal point), a sign and the display scale.
+func encodeNumeric(s string) ([]byte, error) {
+	var buf bytes.Buffer
+	if strings.EqualFold(s, "NaN") {
+		binary.Write(&buf, binary.BigEndian, []int16{0, 0, -0x4000, 0}) // sign 0xC000
+		return buf.Bytes(), nil
+	}
+	m := numericRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || m[2]+m[3] == "" {
+		return nil, fmt.Errorf("invalid numeric %q", s)
+	}
+	intPart, fracPart := m[2], m[3]
+	if pad := len(intPart) % 4; pad != 0 {
+		intPart = strings.Repeat("0", 4-pad) + intPart
+	}
+	frac := fracPart
+	if pad := len(frac) % 4; pad != 0 {
+		frac += strings.Repeat("0", 4-pad)
+	}
+	all := intPart + frac
+	digits := make([]int16, 0, len(all)/4)
+	for i := 0; i < len(all); i += 4 {
+		d, _ := strconv.Atoi(all[i : i+4])
+		digits = append(digits, int16(d))
+	}
+	weight := len(intPart)/4 - 1
+	for len(digits) > 0 && digits[0] == 0 {
+		digits = digits[1:]
+		weight--
+	}
+	for len(digits) > 0 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+	if len(digits) == 0 {
+		weight = 0
+	}
+	var sign int16
+	if m[1] == "-" && len(digits) > 0 {
+		sign = 0x4000
+	}
+	binary.Write(&buf, binary.BigEndian, []int16{int16(len(digits)), int16(weight), sign, int16(len(fracPart))})
+	binary.Write(&buf, binary.BigEndian, digits)
+	return buf.Bytes(), nil
+}
@@ -2,69 +2,308 @@ package dbs
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"veritaserum/src/store"
 )
 
-func StartRedisMock(port string) {
+// RedisOptions configures the Redis mock.
+type RedisOptions struct {
+	// Stateful runs commands without a configured stub on an in-memory
+	// keyspace (strings, hashes, lists, sets, sorted sets, TTLs) instead of
+	// leaving them pending. Each command is still captured as a live
+	// interaction.
+	Stateful bool
+
+	// ClusterNodes presents the mock as a Redis Cluster of that many nodes
+	// on consecutive ports from its own, with the hash slots split evenly;
+	// 1 is a single-node cluster, 0 standalone mode.
+	ClusterNodes int
+	// SentinelPort, when set, serves a Sentinel endpoint reporting the mock
+	// as master.
+	SentinelPort string
+	// AnnounceHost is the host advertised in CLUSTER replies, redirects and
+	// Sentinel replies; by default the address the client connected to.
+	AnnounceHost string
+}
+
+// redisPort is the mock's own port, which Sentinel reports as the master.
+var redisPort string
+
+func StartRedisMock(port string, opts RedisOptions) {
+	redisPort = port
+	if opts.ClusterNodes > 0 {
+		base, err := strconv.Atoi(port)
+		if err != nil {
+			log.Fatalf("redis: cluster mode needs a numeric port: %v", err)
+		}
+		cluster = newRedisCluster(base, opts.ClusterNodes)
+		for n := 1; n < opts.ClusterNodes; n++ {
+			go listenRedis(strconv.Itoa(base+n), fmt.Sprintf("Redis node %d", n), opts, n)
+		}
+	}
+	if opts.SentinelPort != "" {
+		go listenRedis(opts.SentinelPort, "Redis sentinel", opts, sentinelNode)
+	}
+	listenRedis(port, "Redis mock", opts, 0)
+}
+
+// listenRedis accepts connections for a cluster node, or for the Sentinel
+// endpoint when node is sentinelNode.
+func listenRedis(port, what string, opts RedisOptions, node int) {
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Fatalf("redis: listen error: %v", err)
 	}
-	log.Printf("Redis mock listening on :%s", port)
+	log.Printf("%s listening on :%s", what, port)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Printf("redis: accept error: %v", err)
 			continue
 		}
-		go handleRedisConn(conn)
+		go handleRedisConn(conn, opts, node)
 	}
 }
 
-func handleRedisConn(conn net.Conn) {
+// redisMu serializes commands across connections, as the single Redis
+// thread does, so that EXEC runs its queue without others interleaving.
+var redisMu sync.Mutex
+
+var redisConnIDs atomic.Int64
+
+// redisConn is a client connection and its session state.
+type redisConn struct {
+	conn  net.Conn
+	mu    sync.Mutex // guards w and resp3: pub/sub messages come from other goroutines
+	w     *bufio.Writer
+	opts  RedisOptions
+	id    int64
+	resp3 bool   // HELLO 3 switched the connection to RESP3
+	db    int    // SELECTed database, recorded on every interaction
+	name  string // CLIENT SETNAME
+	tx    redisTx
+
+	node   int  // cluster node the connection is on, or sentinelNode
+	asking bool // ASKING was sent: the next command may use a migrating slot
+
+	// Subscriptions, guarded by broker.mu
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+func handleRedisConn(conn net.Conn, opts RedisOptions, node int) {
 	defer conn.Close()
 	r := bufio.NewReader(conn)
+	rc := &redisConn{conn: conn, w: bufio.NewWriter(conn), opts: opts, id: redisConnIDs.Add(1), node: node}
+	defer broker.unsubscribeAll(rc)
 
 	for {
 		args, err := readRESP(r)
 		if err != nil || len(args) == 0 {
 			return
 		}
+		if !rc.handle(args) {
+			rc.flush()
+			return
+		}
+		// Replies to pipelined commands go out together once the whole
+		// batch has been read
+		if r.Buffered() == 0 {
+			if err := rc.flush(); err != nil {
+				return
+			}
+		}
+	}
+}
 
-		cmd := strings.ToUpper(args[0])
+// handle answers one command. It returns false when the connection must be
+// closed.
+func (rc *redisConn) handle(args []string) bool {
+	cmd := strings.ToUpper(args[0])
 
-		if cmd == "PING" {
-			conn.Write([]byte("+PONG\r\n"))
-			continue
+	switch cmd {
+	case "QUIT":
+		rc.write(redisOK)
+		return false
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		rc.subscribe(cmd, args[1:])
+		return true
+	}
+	if !rc.resp3 && rc.subscribed() {
+		rc.write(rc.subscribedReply(cmd, args[1:]))
+		return true
+	}
+
+	if reply, redirected := rc.redirect(cmd, args[1:]); redirected {
+		if rc.tx.open {
+			rc.tx.dirty = true
 		}
+		rc.write(reply)
+		return true
+	}
 
-		key := store.RedisKey(cmd, args[1:])
+	switch cmd {
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+		rc.transaction(cmd, args[1:])
+		return true
+	}
+	if rc.tx.open {
+		rc.write(rc.queue(cmd, args[1:]))
+		return true
+	}
 
-		if i := store.LookupConfigured(store.ProtoRedis, key); i != nil && i.Response != nil {
-			log.Printf("REDIS PLAYBACK: %s", key)
-			writeBulkString(conn, i.Response.Value)
-			continue
+	reply, resp := rc.run(cmd, args[1:])
+	if resp == nil {
+		rc.write(reply)
+		return true
+	}
+
+	// A configured response: earlier replies go out before its fault applies
+	key := store.RedisKey(cmd, args[1:])
+	rc.flush()
+	out, f, action := applyFault(rc.conn, store.ProtoRedis, resp, nil)
+	switch action {
+	case faultReset:
+		log.Printf("REDIS FAULT reset: %s", key)
+		return false
+	case faultError:
+		log.Printf("REDIS FAULT error: %s", key)
+		rc.write(redisError(f.Error.Message))
+		return true
+	}
+	log.Printf("REDIS PLAYBACK: %s", key)
+	if out != rc.conn {
+		var b bytes.Buffer
+		encodeRESP(&b, reply, rc.resp3)
+		out.Write(b.Bytes())
+		return true
+	}
+	rc.write(reply)
+	return true
+}
+
+// run executes a command outside a transaction. A blocking stream read
+// that finds nothing waits for the next XADD and retries, until its
+// timeout.
+func (rc *redisConn) run(cmd string, args []string) (store.RESPValue, *store.InteractionResponse) {
+	timeout, retry, blocking := store.RedisBlocking(rc.db, cmd, args)
+	var deadline <-chan time.Time
+	if blocking && timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for {
+		redisMu.Lock()
+		added := store.RedisStreamAdded()
+		reply, resp := rc.exec(cmd, args)
+		redisMu.Unlock()
+		if !blocking || resp != nil || reply.Type != store.RESPNull {
+			return reply, resp
+		}
+		args = retry
+		select {
+		case <-added:
+		case <-deadline:
+			return reply, nil
+		}
+	}
+}
+
+// exec runs a command and returns its reply; for a configured response the
+// response also comes back, so that the caller can apply its fault. Caller
+// holds redisMu.
+func (rc *redisConn) exec(cmd string, args []string) (store.RESPValue, *store.InteractionResponse) {
+	if reply, ok := rc.session(cmd, args); ok {
+		return reply, nil
+	}
+
+	if rc.node == sentinelNode {
+		return rc.sentinel(cmd, args), nil
+	}
+	if reply, ok := scriptCommand(cmd, args); ok {
+		return reply, nil
+	}
+	script, err := store.ParseRedisScript(cmd, args)
+	if err != nil {
+		return redisError(err.Error()), nil
+	}
+	if script != nil && script.Source != "" {
+		store.LoadRedisScript(script.Source)
+	}
+
+	key := store.RedisKey(cmd, args)
+	req := store.RedisRequest(cmd, args)
+	req.Database = strconv.Itoa(rc.db)
+
+	if i, resp := store.ResolveConfigured(store.ProtoRedis, key, req); i != nil {
+		if resp == nil {
+			log.Printf("REDIS EXHAUSTED: %s", key)
+			return redisError("veritaserum: response sequence exhausted"), nil
+		}
+		return replyOf(resp), resp
+	}
+
+	if script != nil && req.Script == "" {
+		log.Printf("REDIS NOSCRIPT: %s", key)
+		return errNoScript, nil
+	}
+
+	if cmd == "PUBLISH" {
+		if len(args) != 2 {
+			return wrongArgs(cmd), nil
 		}
+		n := PublishRedis(args[0], args[1])
+		reply := redisInt(int64(n))
+		store.CaptureLive(store.ProtoRedis, key, req, store.InteractionResponse{RESP: &reply})
+		log.Printf("REDIS PUBLISH: %s → %d subscribers", args[0], n)
+		return reply, nil
+	}
 
-		if !store.IsPending(store.ProtoRedis, key) {
-			req := store.InteractionRequest{
-				Command: cmd,
-				Args:    args[1:],
+	if rc.opts.Stateful || store.IsRedisStreamCommand(cmd) {
+		if reply, ok := store.ExecRedis(rc.db, cmd, args); ok {
+			store.CaptureLive(store.ProtoRedis, key, req, store.InteractionResponse{RESP: &reply})
+			if reply.Type == store.RESPError {
+				log.Printf("REDIS LIVE ERROR: %s", key)
+			} else {
+				log.Printf("REDIS LIVE: %s", key)
 			}
-			store.RegisterInteraction(store.ProtoRedis, key, req)
-			log.Printf("REDIS INTERCEPT: %s → registered as pending", key)
+			return reply, nil
 		}
+	}
 
-		// Return null bulk string so the client does not crash
-		conn.Write([]byte("$-1\r\n"))
+	if !store.IsPending(store.ProtoRedis, key) {
+		store.RegisterInteraction(store.ProtoRedis, key, req)
+		log.Printf("REDIS INTERCEPT: %s → registered as pending", key)
 	}
+
+	// Return null so the client does not crash
+	return store.RESPValue{Type: store.RESPNull}, nil
+}
+
+// write queues a reply, encoded for the connection's protocol version.
+func (rc *redisConn) write(v store.RESPValue) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var b bytes.Buffer
+	encodeRESP(&b, v, rc.resp3)
+	rc.w.Write(b.Bytes())
+}
+
+func (rc *redisConn) flush() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.w.Flush()
 }
 
 // readRESP reads one RESP array command from the reader.
@@ -113,10 +352,113 @@ func readRESP(r *bufio.Reader) ([]string, error) {
 	}
 }
 
-func writeBulkString(conn net.Conn, s string) {
-	if s == "" {
-		conn.Write([]byte("$-1\r\n"))
-		return
+// errorLine is the text of an error reply. Messages that already start with
+// an error prefix (WRONGTYPE, NOSCRIPT, …) are sent as-is, anything else
+// gets "ERR".
+func errorLine(msg string) string {
+	prefix := msg
+	if i := strings.IndexByte(msg, ' '); i != -1 {
+		prefix = msg[:i]
+	}
+	if prefix == "" || strings.ToUpper(prefix) != prefix {
+		msg = "ERR " + msg
+	}
+	return oneLine(msg)
+}
+
+func oneLine(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+var redisOK = store.RESPValue{Type: store.RESPSimple, Value: "OK"}
+
+func redisError(msg string) store.RESPValue {
+	return store.RESPValue{Type: store.RESPError, Value: msg}
+}
+
+func redisInt(n int64) store.RESPValue {
+	return store.RESPValue{Type: store.RESPInteger, Value: strconv.FormatInt(n, 10)}
+}
+
+// replyOf is the reply for a configured response: its typed RESP value,
+// else its Error as an error reply, else Value as a bulk string (null when
+// empty).
+func replyOf(resp *store.InteractionResponse) store.RESPValue {
+	switch {
+	case resp.RESP != nil:
+		return *resp.RESP
+	case resp.Error != nil:
+		return redisError(resp.Error.Message)
+	case resp.Value == "":
+		return store.RESPValue{Type: store.RESPNull}
+	}
+	return store.RESPValue{Type: store.RESPBulk, Value: resp.Value}
+}
+
+// encodeRESP writes a typed reply. For RESP2 clients maps become flat
+// arrays of keys and values, sets and pushes arrays, doubles bulk strings
+// and booleans the integers 1 and 0.
+func encodeRESP(b *bytes.Buffer, v store.RESPValue, resp3 bool) {
+	switch v.Type {
+	case store.RESPSimple:
+		b.WriteString("+" + oneLine(v.Text()) + "\r\n")
+	case store.RESPError:
+		b.WriteString("-" + errorLine(v.Text()) + "\r\n")
+	case store.RESPInteger:
+		n, _ := v.Int()
+		fmt.Fprintf(b, ":%d\r\n", n)
+	case store.RESPBulk:
+		s := v.Text()
+		fmt.Fprintf(b, "$%d\r\n%s\r\n", len(s), s)
+	case store.RESPDouble:
+		f, _ := v.Float()
+		s := store.FormatRedisFloat(f)
+		if resp3 {
+			b.WriteString("," + s + "\r\n")
+		} else {
+			fmt.Fprintf(b, "$%d\r\n%s\r\n", len(s), s)
+		}
+	case store.RESPBoolean:
+		t, _ := v.Value.(bool)
+		switch {
+		case resp3 && t:
+			b.WriteString("#t\r\n")
+		case resp3:
+			b.WriteString("#f\r\n")
+		case t:
+			b.WriteString(":1\r\n")
+		default:
+			b.WriteString(":0\r\n")
+		}
+	case store.RESPArray, store.RESPSet, store.RESPPush:
+		elems, _ := v.Elements()
+		prefix := "*"
+		switch {
+		case resp3 && v.Type == store.RESPSet:
+			prefix = "~"
+		case resp3 && v.Type == store.RESPPush:
+			prefix = ">"
+		}
+		fmt.Fprintf(b, "%s%d\r\n", prefix, len(elems))
+		for _, e := range elems {
+			encodeRESP(b, e, resp3)
+		}
+	case store.RESPMap:
+		pairs, _ := v.Pairs()
+		if resp3 {
+			fmt.Fprintf(b, "%%%d\r\n", len(pairs))
+		} else {
+			fmt.Fprintf(b, "*%d\r\n", 2*len(pairs))
+		}
+		for _, p := range pairs {
+			encodeRESP(b, p[0], resp3)
+			encodeRESP(b, p[1], resp3)
+		}
+	default: // null
+		if resp3 {
+			b.WriteString("_\r\n")
+		} else {
+			b.WriteString("$-1\r\n")
+		}
 	}
-	conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)))
 }
@@ -0,0 +1,398 @@
+package dbs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"veritaserum/src/store"
+)
+
+// ---- Cluster -------------------------------------------------------------
+
+// In cluster mode the mock presents itself as a Redis Cluster of one or
+// more nodes on consecutive ports. Every node serves the same interactions
+// and keyspace; nodes only differ in the hash slots they own, so that
+// cluster clients see the topology and redirects they get in production.
+
+const redisSlots = 16384
+
+// redisCluster is the slot map shared by all nodes.
+type redisCluster struct {
+	mu        sync.Mutex
+	ports     []int
+	ids       []string
+	owner     [redisSlots]int
+	migrating map[int]int // slot → node it is moving to; the owner answers ASK
+}
+
+// cluster is nil outside cluster mode.
+var cluster *redisCluster
+
+func newRedisCluster(base, nodes int) *redisCluster {
+	c := &redisCluster{migrating: map[int]int{}}
+	for n := 0; n < nodes; n++ {
+		c.ports = append(c.ports, base+n)
+		sum := sha1.Sum([]byte(fmt.Sprintf("veritaserum-node-%d", base+n)))
+		c.ids = append(c.ids, hex.EncodeToString(sum[:]))
+	}
+	// Split like redis-cli --cluster create: 0-5460, 5461-10922, …
+	for n := 0; n < nodes; n++ {
+		first, next := (2*n*redisSlots+nodes)/(2*nodes), (2*(n+1)*redisSlots+nodes)/(2*nodes)
+		for slot := first; slot < next; slot++ {
+			c.owner[slot] = n
+		}
+	}
+	return c
+}
+
+// slotRanges returns the slots a node owns as [first, last] ranges.
+// Caller holds c.mu.
+func (c *redisCluster) slotRanges(node int) [][2]int {
+	var out [][2]int
+	for slot := 0; slot < redisSlots; slot++ {
+		if c.owner[slot] != node {
+			continue
+		}
+		if n := len(out); n > 0 && out[n-1][1] == slot-1 {
+			out[n-1][1] = slot
+		} else {
+			out = append(out, [2]int{slot, slot})
+		}
+	}
+	return out
+}
+
+// RedisClusterNode is a node of the emulated cluster, as the API shows it.
+type RedisClusterNode struct {
+	ID    string   `json:"id"`
+	Port  int      `json:"port"`
+	Slots [][2]int `json:"slots"`
+}
+
+// RedisClusterState describes the emulated cluster: its nodes and the slots
+// being migrated, by the node they move to. ok is false outside cluster
+// mode.
+func RedisClusterState() (nodes []RedisClusterNode, migrating map[int]int, ok bool) {
+	if cluster == nil {
+		return nil, nil, false
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	for n := range cluster.ports {
+		nodes = append(nodes, RedisClusterNode{ID: cluster.ids[n], Port: cluster.ports[n], Slots: cluster.slotRanges(n)})
+	}
+	migrating = map[int]int{}
+	for slot, to := range cluster.migrating {
+		migrating[slot] = to
+	}
+	return nodes, migrating, true
+}
+
+// MigrateRedisSlot starts moving a slot to another node: until it is
+// assigned, its owner answers ASK and the target serves clients that send
+// ASKING first.
+func MigrateRedisSlot(slot, node int) error {
+	if err := checkSlotNode(slot, node); err != nil {
+		return err
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if cluster.owner[slot] == node {
+		return fmt.Errorf("slot %d is already on node %d", slot, node)
+	}
+	cluster.migrating[slot] = node
+	return nil
+}
+
+// AssignRedisSlot gives a slot to a node, ending any migration; its
+// previous owner answers MOVED from then on.
+func AssignRedisSlot(slot, node int) error {
+	if err := checkSlotNode(slot, node); err != nil {
+		return err
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.owner[slot] = node
+	delete(cluster.migrating, slot)
+	return nil
+}
+
+func checkSlotNode(slot, node int) error {
+	if cluster == nil {
+		return fmt.Errorf("the Redis mock is not in cluster mode")
+	}
+	if slot < 0 || slot >= redisSlots {
+		return fmt.Errorf("slot must be between 0 and %d", redisSlots-1)
+	}
+	if node < 0 || node >= len(cluster.ports) {
+		return fmt.Errorf("node must be between 0 and %d", len(cluster.ports)-1)
+	}
+	return nil
+}
+
+// redirect checks that the command's keys belong to this node. It returns
+// the CROSSSLOT, MOVED or ASK error to send instead of running it.
+func (rc *redisConn) redirect(cmd string, args []string) (store.RESPValue, bool) {
+	if cluster == nil || rc.node < 0 {
+		return store.RESPValue{}, false
+	}
+	asking := rc.asking
+	if cmd != "ASKING" {
+		rc.asking = false
+	}
+	keys := commandKeys(cmd, args)
+	if len(keys) == 0 {
+		return store.RESPValue{}, false
+	}
+	slot := keySlot(keys[0])
+	for _, k := range keys[1:] {
+		if keySlot(k) != slot {
+			return redisError("CROSSSLOT Keys in request don't hash to the same slot"), true
+		}
+	}
+
+	cluster.mu.Lock()
+	owner := cluster.owner[slot]
+	target, migrating := cluster.migrating[slot]
+	cluster.mu.Unlock()
+	switch {
+	case owner == rc.node && migrating:
+		return redisError(fmt.Sprintf("ASK %d %s", slot, rc.nodeAddr(target))), true
+	case owner == rc.node, migrating && target == rc.node && asking:
+		return store.RESPValue{}, false
+	}
+	return redisError(fmt.Sprintf("MOVED %d %s", slot, rc.nodeAddr(owner))), true
+}
+
+// announceHost is the address other nodes are advertised on: the one the
+// client reached this node at, unless set explicitly.
+func (rc *redisConn) announceHost() string {
+	if rc.opts.AnnounceHost != "" {
+		return rc.opts.AnnounceHost
+	}
+	host, _, err := net.SplitHostPort(rc.conn.LocalAddr().String())
+	if err != nil {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+func (rc *redisConn) nodeAddr(node int) string {
+	return net.JoinHostPort(rc.announceHost(), strconv.Itoa(cluster.ports[node]))
+}
+
+// clusterCommand answers CLUSTER SLOTS, SHARDS, NODES, INFO, MYID and
+// KEYSLOT in cluster mode. ok is false outside it and for other
+// subcommands, which are then treated as stubs.
+func (rc *redisConn) clusterCommand(args []string) (store.RESPValue, bool) {
+	if cluster == nil || rc.node < 0 {
+		return store.RESPValue{}, false
+	}
+	if len(args) == 0 {
+		return wrongArgs("CLUSTER"), true
+	}
+	host := rc.announceHost()
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "SLOTS":
+		type shard struct{ node, first, last int }
+		var shards []shard
+		for n := range cluster.ports {
+			for _, r := range cluster.slotRanges(n) {
+				shards = append(shards, shard{n, r[0], r[1]})
+			}
+		}
+		sort.Slice(shards, func(a, b int) bool { return shards[a].first < shards[b].first })
+		out := make([]interface{}, len(shards))
+		for i, sh := range shards {
+			out[i] = []interface{}{
+				redisInt(int64(sh.first)), redisInt(int64(sh.last)),
+				[]interface{}{host, redisInt(int64(cluster.ports[sh.node])), cluster.ids[sh.node], store.RESPValue{Type: store.RESPMap}},
+			}
+		}
+		return store.RESPValue{Type: store.RESPArray, Value: out}, true
+
+	case "SHARDS":
+		var out []interface{}
+		for n := range cluster.ports {
+			var slots []interface{}
+			for _, r := range cluster.slotRanges(n) {
+				slots = append(slots, redisInt(int64(r[0])), redisInt(int64(r[1])))
+			}
+			node := store.RESPValue{Type: store.RESPMap, Value: []interface{}{
+				[]interface{}{"id", cluster.ids[n]},
+				[]interface{}{"port", redisInt(int64(cluster.ports[n]))},
+				[]interface{}{"ip", host},
+				[]interface{}{"endpoint", host},
+				[]interface{}{"role", "master"},
+				[]interface{}{"replication-offset", redisInt(0)},
+				[]interface{}{"health", "online"},
+			}}
+			out = append(out, store.RESPValue{Type: store.RESPMap, Value: []interface{}{
+				[]interface{}{"slots", slots},
+				[]interface{}{"nodes", []interface{}{node}},
+			}})
+		}
+		return store.RESPValue{Type: store.RESPArray, Value: out}, true
+
+	case "NODES":
+		var b strings.Builder
+		for n := range cluster.ports {
+			flags := "master"
+			if n == rc.node {
+				flags = "myself,master"
+			}
+			fmt.Fprintf(&b, "%s %s:%d@%d %s - 0 0 %d connected", cluster.ids[n], host, cluster.ports[n], cluster.ports[n]+10000, flags, n+1)
+			for _, r := range cluster.slotRanges(n) {
+				if r[0] == r[1] {
+					fmt.Fprintf(&b, " %d", r[0])
+				} else {
+					fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+				}
+			}
+			for slot, to := range cluster.migrating {
+				switch n {
+				case cluster.owner[slot]:
+					fmt.Fprintf(&b, " [%d->-%s]", slot, cluster.ids[to])
+				case to:
+					fmt.Fprintf(&b, " [%d-<-%s]", slot, cluster.ids[cluster.owner[slot]])
+				}
+			}
+			b.WriteString("\n")
+		}
+		return store.RESPValue{Type: store.RESPBulk, Value: b.String()}, true
+
+	case "INFO":
+		n := len(cluster.ports)
+		info := fmt.Sprintf("cluster_enabled:1\r\ncluster_state:ok\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\n"+
+			"cluster_slots_pfail:0\r\ncluster_slots_fail:0\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\n"+
+			"cluster_current_epoch:%d\r\ncluster_my_epoch:%d\r\n", redisSlots, redisSlots, n, n, n, rc.node+1)
+		return store.RESPValue{Type: store.RESPBulk, Value: info}, true
+
+	case "MYID":
+		return store.RESPValue{Type: store.RESPBulk, Value: cluster.ids[rc.node]}, true
+
+	case "KEYSLOT":
+		if len(args) != 2 {
+			return wrongArgs("cluster|keyslot"), true
+		}
+		return redisInt(int64(keySlot(args[1]))), true
+	}
+	return store.RESPValue{}, false
+}
+
+// commandKeys returns the keys a command addresses, the way cluster clients
+// route it: the first argument, unless the command's key specs place its
+// keys elsewhere or it takes none.
+func commandKeys(cmd string, args []string) []string {
+	switch cmd {
+	case "PING", "ECHO", "HELLO", "AUTH", "SELECT", "CLIENT", "CLUSTER", "ASKING", "READONLY", "READWRITE",
+		"ROLE", "INFO", "TIME", "COMMAND", "CONFIG", "SCRIPT", "FUNCTION", "SENTINEL", "PUBLISH",
+		"KEYS", "SCAN", "DBSIZE", "FLUSHDB", "FLUSHALL", "RANDOMKEY", "SWAPDB", "WAIT", "LASTSAVE",
+		"SLOWLOG", "LATENCY", "MULTI", "EXEC", "DISCARD", "UNWATCH":
+		return nil
+	case "DEL", "UNLINK", "EXISTS", "TOUCH", "MGET", "WATCH", "SINTER", "SUNION", "SDIFF",
+		"SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE", "PFCOUNT", "PFMERGE":
+		return args
+	case "MSET", "MSETNX":
+		var keys []string
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "RENAME", "RENAMENX", "SMOVE", "RPOPLPUSH", "LMOVE", "BRPOPLPUSH", "BLMOVE", "COPY", "LCS",
+		"ZRANGESTORE", "GEOSEARCHSTORE":
+		return args[:min(len(args), 2)]
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX":
+		return args[:max(len(args)-1, 0)]
+	case "XREAD", "XREADGROUP":
+		for i, a := range args {
+			if strings.EqualFold(a, "STREAMS") {
+				rest := args[i+1:]
+				return rest[:len(rest)/2]
+			}
+		}
+		return nil
+
+	// Subcommand first, then the key
+	case "XGROUP", "XINFO", "OBJECT":
+		if len(args) < 2 || strings.EqualFold(args[0], "HELP") {
+			return nil
+		}
+		return args[1:2]
+	case "MEMORY":
+		if len(args) < 2 || !strings.EqualFold(args[0], "USAGE") {
+			return nil
+		}
+		return args[1:2]
+
+	// A count of keys, then the keys
+	case "ZUNIONSTORE", "ZINTERSTORE", "ZDIFFSTORE":
+		if len(args) == 0 {
+			return nil
+		}
+		return append([]string{args[0]}, numKeys(args, 1)...)
+	case "ZUNION", "ZINTER", "ZDIFF", "ZINTERCARD", "SINTERCARD", "LMPOP", "ZMPOP":
+		return numKeys(args, 0)
+	case "BLMPOP", "BZMPOP", "FCALL", "FCALL_RO":
+		return numKeys(args, 1)
+	}
+	if call, err := store.ParseRedisScript(cmd, args); call != nil {
+		if err != nil {
+			return nil
+		}
+		return call.Keys
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args[:1]
+}
+
+// numKeys returns the keys that follow the count at args[at], or none when
+// the count is not a number or exceeds the arguments.
+func numKeys(args []string, at int) []string {
+	if at >= len(args) {
+		return nil
+	}
+	n, err := strconv.Atoi(args[at])
+	if err != nil || n < 0 || n > len(args)-at-1 {
+		return nil
+	}
+	return args[at+1 : at+1+n]
+}
+
+// keySlot is the hash slot of a key: CRC16 of the key, or of its {hash
+// tag} when it has a non-empty one, modulo 16384.
+func keySlot(key string) int {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			key = key[open+1 : open+1+end]
+		}
+	}
+	return int(crc16(key)) % redisSlots
+}
+
+// crc16 is CRC-16/XMODEM, the checksum Redis Cluster hashes keys with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,160 @@
+package dbs
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"veritaserum/src/store"
+)
+
+// ---- Pub/sub -------------------------------------------------------------
+
+// redisBroker tracks which connections subscribed to which channels and
+// patterns. Messages come from PUBLISH on any connection and from the API.
+type redisBroker struct {
+	mu       sync.Mutex
+	channels map[string]map[*redisConn]bool
+	patterns map[string]map[*redisConn]bool
+}
+
+var broker = &redisBroker{
+	channels: map[string]map[*redisConn]bool{},
+	patterns: map[string]map[*redisConn]bool{},
+}
+
+// PublishRedis sends a message to the subscribers of channel, including
+// pattern subscribers, and returns how many received it.
+func PublishRedis(channel, message string) int {
+	type delivery struct {
+		rc  *redisConn
+		msg store.RESPValue
+	}
+	var out []delivery
+	broker.mu.Lock()
+	for rc := range broker.channels[channel] {
+		out = append(out, delivery{rc, pushReply("message", channel, message)})
+	}
+	for pattern, conns := range broker.patterns {
+		if !store.RedisGlob(pattern, channel) {
+			continue
+		}
+		for rc := range conns {
+			out = append(out, delivery{rc, pushReply("pmessage", pattern, channel, message)})
+		}
+	}
+	broker.mu.Unlock()
+
+	for _, d := range out {
+		d.rc.push(d.msg)
+	}
+	return len(out)
+}
+
+func pushReply(elems ...interface{}) store.RESPValue {
+	return store.RESPValue{Type: store.RESPPush, Value: elems}
+}
+
+// push writes a message to a subscribed connection, from the publisher's
+// goroutine.
+func (rc *redisConn) push(v store.RESPValue) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var b bytes.Buffer
+	encodeRESP(&b, v, rc.resp3)
+	rc.w.Write(b.Bytes())
+	rc.w.Flush()
+}
+
+// subscribe answers SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE and PUNSUBSCRIBE
+// with one confirmation per channel or pattern, carrying the number of
+// subscriptions left on the connection.
+func (rc *redisConn) subscribe(cmd string, names []string) {
+	pattern := cmd == "PSUBSCRIBE" || cmd == "PUNSUBSCRIBE"
+	kind := strings.ToLower(cmd)
+	adding := cmd == "SUBSCRIBE" || cmd == "PSUBSCRIBE"
+	if adding && len(names) == 0 {
+		rc.write(wrongArgs(cmd))
+		return
+	}
+
+	broker.mu.Lock()
+	mine, all := &rc.channels, broker.channels
+	if pattern {
+		mine, all = &rc.patterns, broker.patterns
+	}
+	if *mine == nil {
+		*mine = map[string]bool{}
+	}
+	if !adding && len(names) == 0 {
+		for name := range *mine {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var replies []store.RESPValue
+	for _, name := range names {
+		if adding {
+			(*mine)[name] = true
+			if all[name] == nil {
+				all[name] = map[*redisConn]bool{}
+			}
+			all[name][rc] = true
+		} else {
+			delete(*mine, name)
+			delete(all[name], rc)
+			if len(all[name]) == 0 {
+				delete(all, name)
+			}
+		}
+		replies = append(replies, pushReply(kind, name, redisInt(int64(len(rc.channels)+len(rc.patterns)))))
+	}
+	if len(replies) == 0 {
+		replies = append(replies, pushReply(kind, nil, redisInt(int64(len(rc.channels)+len(rc.patterns)))))
+	}
+	broker.mu.Unlock()
+
+	for _, r := range replies {
+		rc.write(r)
+	}
+	log.Printf("REDIS %s: %s", cmd, strings.Join(names, " "))
+}
+
+func (rc *redisConn) subscribed() bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return len(rc.channels)+len(rc.patterns) > 0
+}
+
+// subscribedReply answers a command sent by a RESP2 connection with
+// subscriptions, which may only manage them, PING or QUIT.
+func (rc *redisConn) subscribedReply(cmd string, args []string) store.RESPValue {
+	if cmd == "PING" {
+		msg := ""
+		if len(args) > 0 {
+			msg = args[0]
+		}
+		return store.RESPValue{Type: store.RESPArray, Value: []interface{}{"pong", msg}}
+	}
+	return redisError("ERR Can't execute '" + strings.ToLower(cmd) + "': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")
+}
+
+// unsubscribeAll drops a closed connection's subscriptions.
+func (b *redisBroker) unsubscribeAll(rc *redisConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name := range rc.channels {
+		delete(b.channels[name], rc)
+		if len(b.channels[name]) == 0 {
+			delete(b.channels, name)
+		}
+	}
+	for name := range rc.patterns {
+		delete(b.patterns[name], rc)
+		if len(b.patterns[name]) == 0 {
+			delete(b.patterns, name)
+		}
+	}
+}
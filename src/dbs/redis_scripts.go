@@ -0,0 +1,54 @@
+package dbs
+
+import (
+	"log"
+	"strings"
+
+	"veritaserum/src/store"
+)
+
+// ---- Scripts -------------------------------------------------------------
+
+// The mock cannot run Lua, so EVAL and EVALSHA are answered from configured
+// interactions like any other command. It does keep the script cache that
+// clients rely on: go-redis and Lettuce send EVALSHA first and fall back
+// to EVAL on NOSCRIPT.
+
+var errNoScript = redisError("NOSCRIPT No matching script. Please use EVAL.")
+
+// scriptCommand answers SCRIPT LOAD, EXISTS and FLUSH, which are never
+// captured. ok is false for any other command.
+func scriptCommand(cmd string, args []string) (reply store.RESPValue, ok bool) {
+	if cmd != "SCRIPT" {
+		return store.RESPValue{}, false
+	}
+	if len(args) == 0 {
+		return wrongArgs(cmd), true
+	}
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) != 2 {
+			return wrongArgs("script|load"), true
+		}
+		sha := store.LoadRedisScript(args[1])
+		log.Printf("REDIS SCRIPT LOAD: %s", sha)
+		return store.RESPValue{Type: store.RESPBulk, Value: sha}, true
+	case "EXISTS":
+		if len(args) < 2 {
+			return wrongArgs("script|exists"), true
+		}
+		out := make([]interface{}, len(args)-1)
+		for n, sha := range args[1:] {
+			out[n] = redisInt(0)
+			if _, known := store.RedisScriptSource(sha); known {
+				out[n] = redisInt(1)
+			}
+		}
+		return store.RESPValue{Type: store.RESPArray, Value: out}, true
+	case "FLUSH":
+		store.FlushRedisScripts()
+		return redisOK, true
+	default:
+		return redisError("ERR unknown subcommand '" + args[0] + "'. Try SCRIPT HELP."), true
+	}
+}
@@ -0,0 +1,76 @@
+package dbs
+
+import (
+	"log"
+	"strings"
+
+	"veritaserum/src/store"
+)
+
+// ---- Sentinel ------------------------------------------------------------
+
+// The Sentinel endpoint reports the mock as the master of whatever name the
+// client asks for, with no replicas and no other sentinels, so clients
+// configured for Sentinel discover the mock and connect to it.
+
+// sentinelNode marks a connection to the Sentinel port.
+const sentinelNode = -1
+
+// sentinel answers SENTINEL subcommands. Data commands are rejected, as a
+// real sentinel does.
+func (rc *redisConn) sentinel(cmd string, args []string) store.RESPValue {
+	if cmd != "SENTINEL" {
+		quoted := make([]string, len(args))
+		for n, a := range args {
+			quoted[n] = "'" + a + "'"
+		}
+		return redisError("ERR unknown command '" + strings.ToLower(cmd) + "', with args beginning with: " + strings.Join(quoted, " "))
+	}
+	if len(args) == 0 {
+		return wrongArgs(cmd)
+	}
+	sub := strings.ToUpper(args[0])
+	name := "mymaster"
+	if len(args) > 1 {
+		name = args[1]
+	}
+	switch sub {
+	case "GET-MASTER-ADDR-BY-NAME":
+		if len(args) != 2 {
+			return wrongArgs("sentinel|get-master-addr-by-name")
+		}
+		log.Printf("REDIS SENTINEL: master %s → %s:%s", name, rc.announceHost(), redisPort)
+		return store.RESPValue{Type: store.RESPArray, Value: []interface{}{rc.announceHost(), redisPort}}
+	case "MASTERS":
+		return store.RESPValue{Type: store.RESPArray, Value: []interface{}{rc.masterInfo(name)}}
+	case "MASTER":
+		if len(args) != 2 {
+			return wrongArgs("sentinel|master")
+		}
+		return rc.masterInfo(name)
+	case "REPLICAS", "SLAVES", "SENTINELS":
+		if len(args) != 2 {
+			return wrongArgs("sentinel|" + strings.ToLower(sub))
+		}
+		return store.RESPValue{Type: store.RESPArray, Value: []interface{}{}}
+	case "MYID":
+		return store.RESPValue{Type: store.RESPBulk, Value: strings.Repeat("0", 40)}
+	case "CKQUORUM":
+		return store.RESPValue{Type: store.RESPSimple, Value: "OK 1 usable Sentinels. Quorum and failover authorization can be reached"}
+	}
+	return redisError("ERR unknown subcommand '" + args[0] + "'. Try SENTINEL HELP.")
+}
+
+// masterInfo is the SENTINEL MASTER reply for the mock.
+func (rc *redisConn) masterInfo(name string) store.RESPValue {
+	return store.RESPValue{Type: store.RESPMap, Value: []interface{}{
+		[]interface{}{"name", name},
+		[]interface{}{"ip", rc.announceHost()},
+		[]interface{}{"port", redisPort},
+		[]interface{}{"runid", strings.Repeat("0", 40)},
+		[]interface{}{"flags", "master"},
+		[]interface{}{"num-slaves", "0"},
+		[]interface{}{"num-other-sentinels", "0"},
+		[]interface{}{"quorum", "1"},
+	}}
+}
@@ -0,0 +1,296 @@
+package dbs
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"veritaserum/src/store"
+)
+
+// ---- Connection commands -------------------------------------------------
+
+// Clients send these on connect (go-redis v9, Lettuce); they are answered
+// from the connection's state and never captured.
+
+const redisDatabases = 16
+
+// session answers PING, HELLO, AUTH, SELECT, CLIENT, ROLE and the cluster
+// commands. ok is false for any other command, including CLIENT and
+// CLUSTER subcommands it does not know.
+func (rc *redisConn) session(cmd string, args []string) (reply store.RESPValue, ok bool) {
+	switch cmd {
+	case "PING":
+		switch len(args) {
+		case 0:
+			return store.RESPValue{Type: store.RESPSimple, Value: "PONG"}, true
+		case 1:
+			return store.RESPValue{Type: store.RESPBulk, Value: args[0]}, true
+		}
+		return wrongArgs(cmd), true
+
+	case "HELLO":
+		return rc.hello(args), true
+
+	case "AUTH":
+		// Any credentials are accepted
+		if len(args) < 1 || len(args) > 2 {
+			return wrongArgs(cmd), true
+		}
+		return redisOK, true
+
+	case "SELECT":
+		if len(args) != 1 {
+			return wrongArgs(cmd), true
+		}
+		db, err := strconv.Atoi(args[0])
+		if err != nil {
+			return redisError("ERR value is not an integer or out of range"), true
+		}
+		if db < 0 || db >= redisDatabases {
+			return redisError("ERR DB index is out of range"), true
+		}
+		if cluster != nil && db != 0 {
+			return redisError("ERR SELECT is not allowed in cluster mode"), true
+		}
+		rc.db = db
+		return redisOK, true
+
+	case "CLIENT":
+		if len(args) == 0 {
+			return wrongArgs(cmd), true
+		}
+		return rc.client(strings.ToUpper(args[0]), args[1:])
+
+	case "ROLE":
+		if rc.node == sentinelNode {
+			return store.RESPValue{Type: store.RESPArray, Value: []interface{}{"sentinel", []interface{}{"mymaster"}}}, true
+		}
+		return store.RESPValue{Type: store.RESPArray, Value: []interface{}{"master", redisInt(0), []interface{}{}}}, true
+
+	case "CLUSTER":
+		return rc.clusterCommand(args)
+
+	case "READONLY", "READWRITE", "ASKING":
+		if cluster == nil || rc.node == sentinelNode {
+			break
+		}
+		rc.asking = cmd == "ASKING"
+		return redisOK, true
+	}
+	return store.RESPValue{}, false
+}
+
+// hello negotiates the protocol version: HELLO [2|3] [AUTH user pass]
+// [SETNAME name]. The reply is already encoded with the new version.
+func (rc *redisConn) hello(args []string) store.RESPValue {
+	resp3 := rc.resp3
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return redisError("ERR Protocol version is not an integer or out of range")
+		}
+		if v != 2 && v != 3 {
+			return redisError("NOPROTO unsupported protocol version")
+		}
+		resp3 = v == 3
+		args = args[1:]
+	}
+	name := rc.name
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return redisError("ERR Syntax error in HELLO option 'auth'")
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return redisError("ERR Syntax error in HELLO option 'setname'")
+			}
+			i++
+			name = args[i]
+		default:
+			return redisError("ERR Syntax error in HELLO option '" + args[i] + "'")
+		}
+	}
+	rc.mu.Lock()
+	rc.resp3, rc.name = resp3, name
+	rc.mu.Unlock()
+	log.Printf("REDIS HELLO: RESP%d", rc.proto())
+
+	return store.RESPValue{Type: store.RESPMap, Value: []interface{}{
+		[]interface{}{"server", "redis"},
+		[]interface{}{"version", "7.2.0"},
+		[]interface{}{"proto", redisInt(int64(rc.proto()))},
+		[]interface{}{"id", redisInt(rc.id)},
+		[]interface{}{"mode", rc.mode()},
+		[]interface{}{"role", "master"},
+		[]interface{}{"modules", []interface{}{}},
+	}}
+}
+
+func (rc *redisConn) mode() string {
+	switch {
+	case rc.node == sentinelNode:
+		return "sentinel"
+	case cluster != nil:
+		return "cluster"
+	}
+	return "standalone"
+}
+
+func (rc *redisConn) proto() int {
+	if rc.resp3 {
+		return 3
+	}
+	return 2
+}
+
+func (rc *redisConn) client(sub string, args []string) (store.RESPValue, bool) {
+	switch sub {
+	case "SETNAME":
+		if len(args) != 1 {
+			return wrongArgs("client|setname"), true
+		}
+		if strings.ContainsAny(args[0], " \r\n") {
+			return redisError("ERR Client names cannot contain spaces, newlines or special characters."), true
+		}
+		rc.name = args[0]
+		return redisOK, true
+	case "GETNAME":
+		if rc.name == "" {
+			return store.RESPValue{Type: store.RESPNull}, true
+		}
+		return store.RESPValue{Type: store.RESPBulk, Value: rc.name}, true
+	case "ID":
+		return redisInt(rc.id), true
+	case "SETINFO":
+		return redisOK, true
+	case "INFO":
+		info := fmt.Sprintf("id=%d addr=%s name=%s db=%d resp=%d\n", rc.id, rc.conn.RemoteAddr(), rc.name, rc.db, rc.proto())
+		return store.RESPValue{Type: store.RESPBulk, Value: info}, true
+	}
+	return store.RESPValue{}, false
+}
+
+func wrongArgs(cmd string) store.RESPValue {
+	return redisError("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
+
+// ---- Transactions --------------------------------------------------------
+
+// redisTx is the MULTI state of a connection: the queued commands and the
+// versions of the WATCHed keys.
+type redisTx struct {
+	open    bool
+	dirty   bool // a command was rejected while queued; EXEC aborts
+	queued  [][]string
+	watched map[redisWatch]uint64
+}
+
+// redisWatch is a WATCHed key in the database selected at the time.
+type redisWatch struct {
+	db  int
+	key string
+}
+
+// transaction answers MULTI, EXEC, DISCARD, WATCH and UNWATCH.
+func (rc *redisConn) transaction(cmd string, args []string) {
+	switch cmd {
+	case "MULTI":
+		if rc.tx.open {
+			rc.write(redisError("ERR MULTI calls can not be nested"))
+			return
+		}
+		rc.tx.open = true
+		rc.write(redisOK)
+
+	case "DISCARD":
+		if !rc.tx.open {
+			rc.write(redisError("ERR DISCARD without MULTI"))
+			return
+		}
+		rc.tx = redisTx{}
+		rc.write(redisOK)
+
+	case "WATCH":
+		if rc.tx.open {
+			rc.write(redisError("ERR WATCH inside MULTI is not allowed"))
+			return
+		}
+		if len(args) == 0 {
+			rc.write(wrongArgs(cmd))
+			return
+		}
+		if rc.tx.watched == nil {
+			rc.tx.watched = map[redisWatch]uint64{}
+		}
+		for _, k := range args {
+			w := redisWatch{rc.db, k}
+			if _, ok := rc.tx.watched[w]; !ok {
+				rc.tx.watched[w] = store.RedisKeyVersion(rc.db, k)
+			}
+		}
+		rc.write(redisOK)
+
+	case "UNWATCH":
+		rc.tx.watched = nil
+		rc.write(redisOK)
+
+	case "EXEC":
+		if !rc.tx.open {
+			rc.write(redisError("ERR EXEC without MULTI"))
+			return
+		}
+		tx := rc.tx
+		rc.tx = redisTx{}
+		if tx.dirty {
+			rc.write(redisError("EXECABORT Transaction discarded because of previous errors."))
+			return
+		}
+		redisMu.Lock()
+		defer redisMu.Unlock()
+		for w, v := range tx.watched {
+			if store.RedisKeyVersion(w.db, w.key) != v {
+				log.Printf("REDIS EXEC aborted: %s was modified", w.key)
+				rc.writeNullArray()
+				return
+			}
+		}
+		replies := make([]interface{}, len(tx.queued))
+		for n, q := range tx.queued {
+			reply, resp := rc.exec(q[0], q[1:])
+			if resp != nil {
+				log.Printf("REDIS PLAYBACK: %s", store.RedisKey(q[0], q[1:]))
+			}
+			replies[n] = reply
+		}
+		rc.write(store.RESPValue{Type: store.RESPArray, Value: replies})
+	}
+}
+
+// queue adds a command to the open transaction. In stateful mode commands
+// with the wrong number of arguments are rejected, which aborts the EXEC.
+func (rc *redisConn) queue(cmd string, args []string) store.RESPValue {
+	if rc.opts.Stateful {
+		if reply, bad := store.CheckRedisArity(cmd, args); bad {
+			rc.tx.dirty = true
+			return reply
+		}
+	}
+	rc.tx.queued = append(rc.tx.queued, append([]string{cmd}, args...))
+	return store.RESPValue{Type: store.RESPSimple, Value: "QUEUED"}
+}
+
+// writeNullArray is the reply of an EXEC aborted by WATCH.
+func (rc *redisConn) writeNullArray() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.resp3 {
+		rc.w.WriteString("_\r\n")
+	} else {
+		rc.w.WriteString("*-1\r\n")
+	}
+}
@@ -0,0 +1,66 @@
+package dbs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---- Mocked result rows (shared by the SQL mocks) ------------------------
+
+// rowColumns returns the column names of a mocked result, sorted so that a
+// statement described ahead of execution gets the same order.
+func rowColumns(rows []map[string]interface{}) []string {
+	if len(rows) == 0 {
+		return nil
+	}
+	cols := make([]string, 0, len(rows[0]))
+	for k := range rows[0] {
+		cols = append(cols, k)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// orderColumns puts result columns in the order the SELECT lists them, then
+// in table order, and any others by name.
+func orderColumns(names, selected, tableOrder []string) []string {
+	rank := make(map[string]int, len(selected)+len(tableOrder))
+	for i, name := range tableOrder {
+		rank[name] = len(selected) + i
+	}
+	for i, name := range selected {
+		rank[name] = i
+	}
+	out := append([]string(nil), names...)
+	sort.SliceStable(out, func(a, b int) bool {
+		ra, oka := rank[out[a]]
+		rb, okb := rank[out[b]]
+		if oka && okb {
+			return ra < rb
+		}
+		return oka && !okb
+	})
+	return out
+}
+
+var sqlTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// parseSQLTime accepts ISO 8601 / RFC 3339 and the MySQL / Postgres output
+// formats. Values without a zone are taken as UTC.
+func parseSQLTime(s string) (time.Time, error) {
+	for _, layout := range sqlTimeLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
@@ -0,0 +1,90 @@
+package dbs
+
+import (
+	"strings"
+)
+
+// ---- Transaction control (shared by the SQL mocks) -----------------------
+
+type txKind int
+
+const (
+	txBegin txKind = iota + 1
+	txCommit
+	txRollback
+	txSavepoint
+	txRelease
+	txRollbackTo
+)
+
+// txCommand is a parsed transaction control statement.
+type txCommand struct {
+	kind      txKind
+	verb      string // leading keyword, upper-cased: BEGIN, START, END, ABORT …
+	savepoint string
+	chain     bool // COMMIT AND CHAIN: a new transaction starts straight away
+}
+
+// parseTxCommand recognizes BEGIN / START TRANSACTION, COMMIT / END,
+// ROLLBACK / ABORT, SAVEPOINT, RELEASE [SAVEPOINT] and ROLLBACK TO
+// [SAVEPOINT], or returns nil.
+func parseTxCommand(sql string) *txCommand {
+	fields := strings.Fields(housekeepingStatement(sql))
+	if len(fields) == 0 {
+		return nil
+	}
+	words := strings.Fields(strings.ToLower(strings.Join(fields, " ")))
+	name := sqlUnquote(fields[len(fields)-1]) // savepoint names keep their case
+	cmd := &txCommand{verb: strings.ToUpper(words[0])}
+	rest := words[1:]
+	// WORK and TRANSACTION are noise words after every verb but START.
+	if len(rest) > 0 && (rest[0] == "work" || rest[0] == "transaction") && words[0] != "start" {
+		rest = rest[1:]
+	}
+	switch words[0] {
+	case "begin":
+		cmd.kind = txBegin
+	case "start":
+		if len(rest) == 0 || rest[0] != "transaction" {
+			return nil
+		}
+		cmd.kind = txBegin
+	case "commit", "end":
+		cmd.kind = txCommit
+		cmd.chain = len(rest) >= 2 && rest[0] == "and" && rest[1] == "chain"
+	case "rollback", "abort":
+		cmd.kind = txRollback
+		cmd.chain = len(rest) >= 2 && rest[0] == "and" && rest[1] == "chain"
+		if len(rest) > 0 && rest[0] == "to" {
+			rest = rest[1:]
+			if len(rest) > 0 && rest[0] == "savepoint" {
+				rest = rest[1:]
+			}
+			if len(rest) != 1 {
+				return nil
+			}
+			cmd.kind, cmd.savepoint = txRollbackTo, name
+		}
+	case "savepoint":
+		if len(rest) != 1 {
+			return nil
+		}
+		cmd.kind, cmd.savepoint = txSavepoint, name
+	case "release":
+		if len(rest) > 0 && rest[0] == "savepoint" {
+			rest = rest[1:]
+		}
+		if len(rest) != 1 {
+			return nil
+		}
+		cmd.kind, cmd.savepoint = txRelease, name
+	default:
+		return nil
+	}
+	return cmd
+}
+
+// endsTx reports whether the command closes the transaction.
+func (c *txCommand) endsTx() bool {
+	return c != nil && (c.kind == txCommit || c.kind == txRollback)
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"veritaserum/src/certs"
+)
+
+// handleConnect terminates a CONNECT tunnel with a leaf certificate minted
+// for the target host, then serves the decrypted requests with serve().
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+	if target == "" {
+		target = r.RequestURI
+	}
+	hostOnly := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		hostOnly = h
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "veritaserum: CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("CONNECT   %s hijack error: %v", target, err)
+		return
+	}
+	if rw.Reader.Buffered() > 0 {
+		// The client sent its ClientHello without waiting for the 200
+		clientConn = &bufferedConn{Conn: clientConn, r: rw.Reader}
+	}
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		clientConn.Close()
+		return
+	}
+
+	cfg := certs.ServerTLSConfig(hostOnly)
+	cfg.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Server(clientConn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("CONNECT   %s TLS handshake failed: %v (is the Veritaserum CA trusted?)", target, err)
+		tlsConn.Close()
+		return
+	}
+	log.Printf("CONNECT   %s → TLS intercepted", target)
+
+	ln := newSingleConnListener(tlsConn)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			host := req.Host
+			if host == "" {
+				host = target
+			}
+			serve(w, req, &url.URL{
+				Scheme:   "https",
+				Host:     host,
+				Path:     req.URL.Path,
+				RawQuery: req.URL.RawQuery,
+			})
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
+	}
+	srv.Serve(ln)
+}
+
+// bufferedConn reads what the server already buffered before the conn
+// itself.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// NetConn returns the wrapped connection, like tls.Conn does.
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// singleConnListener hands out exactly one connection, then blocks until it
+// is closed so http.Server can drive a single tunnelled connection.
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+	mu   sync.Mutex
+	used bool
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.used {
+		l.used = true
+		l.mu.Unlock()
+		return l.conn, nil
+	}
+	l.mu.Unlock()
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
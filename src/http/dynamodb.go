@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"veritaserum/src/store"
+)
+
+// writeDynamoDB answers a DynamoDB call with a configured response, in the
+// wire shape of its operation (see store.DynamoDBReply). It returns the
+// status sent.
+func writeDynamoDB(w http.ResponseWriter, req store.InteractionRequest, resp *store.InteractionResponse) int {
+	status, body, err := store.DynamoDBReply(req, resp)
+	if err != nil {
+		status, body, _ = store.DynamoDBReply(req, &store.InteractionResponse{
+			Error: &store.ErrorReply{Type: "InternalServerError", Message: "veritaserum: " + err.Error()},
+		})
+	}
+	setHeaders(w.Header(), resp)
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	}
+	// The AWS SDKs verify the body against this checksum
+	w.Header().Set("X-Amz-Crc32", strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(body))), 10))
+	if w.Header().Get("X-Amzn-Requestid") == "" {
+		w.Header().Set("X-Amzn-Requestid", strconv.FormatInt(time.Now().UnixNano(), 36))
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+	return status
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"veritaserum/src/store"
+)
+
+// writeFault answers with the failure mode of f instead of a normal
+// playback. It reports false when f has nothing to inject beyond latency.
+func writeFault(w http.ResponseWriter, resp *store.InteractionResponse, f *store.Fault) bool {
+	switch {
+	case f.Reset:
+		conn, ok := hijack(w)
+		if !ok {
+			return false
+		}
+		resetConn(conn)
+		return true
+
+	case f.Error != nil:
+		status := f.Error.StatusCode
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		msg := f.Error.Message
+		if msg == "" {
+			msg = http.StatusText(status)
+		}
+		http.Error(w, msg, status)
+		return true
+
+	case f.DropAfterBytes > 0 || f.TrickleBytes > 0:
+		conn, ok := hijack(w)
+		if !ok {
+			return false
+		}
+		defer conn.Close()
+		raw := rawResponse(resp)
+		if f.DropAfterBytes > 0 && len(raw) > f.DropAfterBytes {
+			raw = raw[:f.DropAfterBytes]
+		}
+		chunk := len(raw)
+		if f.TrickleBytes > 0 {
+			chunk = f.TrickleBytes
+		}
+		for off := 0; off < len(raw); off += chunk {
+			if off > 0 {
+				time.Sleep(time.Duration(f.TrickleDelayMs) * time.Millisecond)
+			}
+			end := min(off+chunk, len(raw))
+			if _, err := conn.Write(raw[off:end]); err != nil {
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// resetConn closes conn with SO_LINGER 0 so the client sees a RST rather
+// than an orderly FIN. Intercepted HTTPS connections are unwrapped down to
+// the TCP connection first.
+func resetConn(conn net.Conn) {
+	for {
+		inner, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = inner.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func hijack(w http.ResponseWriter) (net.Conn, bool) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, false
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return nil, false
+	}
+	return conn, true
+}
+
+// rawResponse serialises resp as it would appear on the wire.
+func rawResponse(resp *store.InteractionResponse) []byte {
+	header := http.Header{}
+	setHeaders(header, resp)
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+	header.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	r := &http.Response{
+		StatusCode:    resp.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(resp.Body))),
+		ContentLength: int64(len(resp.Body)),
+	}
+	var buf bytes.Buffer
+	r.Write(&buf)
+	return buf.Bytes()
+}
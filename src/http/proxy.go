@@ -11,33 +11,32 @@ import (
 	"veritaserum/src/store"
 )
 
-// isDynamoDB returns true when the host looks like an AWS DynamoDB endpoint.
+// isDynamoDB returns true when the host looks like an AWS DynamoDB endpoint,
+// e.g. dynamodb.us-east-1.amazonaws.com or a VPC endpoint
+// (vpce-….dynamodb.us-east-1.vpce.amazonaws.com).
 func isDynamoDB(host string) bool {
-	return strings.Contains(host, ".dynamodb.")
+	return strings.HasPrefix(host, "dynamodb.") || strings.Contains(host, ".dynamodb.")
 }
 
-// parseDynamoDB extracts the DynamoDB operation and table name from the request.
-// Operation comes from the X-Amz-Target header (e.g. "DynamoDB_20120810.GetItem").
-// Table comes from the JSON body field "TableName".
-func parseDynamoDB(r *http.Request, body []byte) (operation, table string) {
-	target := r.Header.Get("X-Amz-Target")
-	if idx := strings.Index(target, "."); idx != -1 {
-		operation = target[idx+1:]
+// requestHeaders flattens the request headers, skipping the ones that only
+// describe the hop between the client and the proxy.
+func requestHeaders(r *http.Request) map[string]string {
+	headers := make(map[string]string, len(r.Header))
+	for k, v := range r.Header {
+		headers[k] = strings.Join(v, ", ")
 	}
-	bodyStr := string(body)
-	if i := strings.Index(bodyStr, `"TableName"`); i != -1 {
-		rest := strings.TrimSpace(bodyStr[i+10:])
-		rest = strings.TrimPrefix(rest, ":")
-		rest = strings.TrimSpace(rest)
-		rest = strings.TrimPrefix(rest, `"`)
-		if end := strings.IndexByte(rest, '"'); end != -1 {
-			table = rest[:end]
-		}
+	for _, h := range hopHeaders {
+		delete(headers, h)
 	}
-	return
+	return headers
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		handleConnect(w, r)
+		return
+	}
+
 	targetURL := r.RequestURI
 	if targetURL == "" || targetURL == "/" {
 		http.Error(w, "bad request: missing absolute URI", http.StatusBadRequest)
@@ -50,6 +49,13 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	serve(w, r, parsed)
+}
+
+// serve runs a request through lookup → playback / register. It is shared by
+// plain absolute-URI requests and requests decrypted from a CONNECT tunnel.
+func serve(w http.ResponseWriter, r *http.Request, parsed *url.URL) {
+	targetURL := parsed.String()
 	host := parsed.Host
 	path := parsed.Path
 	if path == "" {
@@ -58,47 +64,92 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
 	rawBody, _ := io.ReadAll(r.Body)
 	bodyHash := store.BodyHash(rawBody)
+	query := store.CanonicalQuery(parsed.RawQuery)
+	headers := requestHeaders(r)
 
 	protocol := store.ProtoHTTP
 	var req store.InteractionRequest
 
 	if isDynamoDB(host) {
 		protocol = store.ProtoDynamoDB
-		op, table := parseDynamoDB(r, rawBody)
 		req = store.InteractionRequest{
-			Method:    r.Method,
-			Host:      host,
-			Path:      path,
-			BodyHash:  bodyHash,
-			Body:      string(rawBody),
-			Operation: op,
-			Table:     table,
+			Method:      r.Method,
+			Host:        host,
+			Path:        path,
+			QueryString: query,
+			Headers:     headers,
+			BodyHash:    bodyHash,
+			Body:        string(rawBody),
 		}
+		store.ParseDynamoDB(&req, r.Header.Get("X-Amz-Target"))
 	} else {
 		req = store.InteractionRequest{
-			Method:   r.Method,
-			Host:     host,
-			Path:     path,
-			BodyHash: bodyHash,
-			Body:     string(rawBody),
+			Method:      r.Method,
+			Host:        host,
+			Path:        path,
+			QueryString: query,
+			Headers:     headers,
+			BodyHash:    bodyHash,
+			Body:        string(rawBody),
 		}
 	}
 
-	key := store.HTTPKey(r.Method, host, path, bodyHash)
+	key := store.HTTPKey(r.Method, host, path, query, headers, bodyHash)
+	if protocol == store.ProtoDynamoDB && req.Operation != "" {
+		key = store.DynamoDBKey(req)
+	}
 
-	if i := store.LookupConfigured(protocol, key); i != nil && i.Response != nil {
-		if i.Response.LatencyMs > 0 {
-			time.Sleep(time.Duration(i.Response.LatencyMs) * time.Millisecond)
+	if i, resp := store.ResolveConfigured(protocol, key, req); i != nil {
+		if resp == nil {
+			http.Error(w, "veritaserum: response sequence exhausted", http.StatusServiceUnavailable)
+			log.Printf("EXHAUSTED %s %s", r.Method, targetURL)
+			return
+		}
+		f := store.FaultFor(protocol, resp)
+		delay := f.Delay()
+		if resp.LatencyMs > 0 {
+			delay += time.Duration(resp.LatencyMs) * time.Millisecond
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		fires := f.Fires()
+		if fires && protocol == store.ProtoDynamoDB && f.Error != nil {
+			writeDynamoDB(w, req, &store.InteractionResponse{Error: f.Error})
+			log.Printf("FAULT     %s %s", req.Operation, key)
+			return
 		}
-		for k, v := range i.Response.Headers {
-			w.Header().Set(k, v)
+		if fires && writeFault(w, resp, f) {
+			log.Printf("FAULT     %s %s", r.Method, targetURL)
+			return
 		}
+		if protocol == store.ProtoDynamoDB {
+			status := writeDynamoDB(w, req, resp)
+			log.Printf("PLAYBACK  %s  →  %d", key, status)
+			return
+		}
+		setHeaders(w.Header(), resp)
 		if w.Header().Get("Content-Type") == "" {
 			w.Header().Set("Content-Type", "application/json")
 		}
-		w.WriteHeader(i.Response.StatusCode)
-		io.WriteString(w, i.Response.Body)
-		log.Printf("PLAYBACK  %s %s  →  %d", r.Method, targetURL, i.Response.StatusCode)
+		w.WriteHeader(resp.StatusCode)
+		io.WriteString(w, resp.Body)
+		log.Printf("PLAYBACK  %s %s  →  %d", r.Method, targetURL, resp.StatusCode)
+		return
+	}
+
+	if store.IsRecording(protocol) {
+		resp, err := forwardUpstream(r, parsed, rawBody)
+		if err != nil {
+			http.Error(w, "veritaserum: upstream error: "+err.Error(), http.StatusBadGateway)
+			log.Printf("RECORD    %s %s  →  upstream error: %v", r.Method, targetURL, err)
+			return
+		}
+		store.RecordInteraction(protocol, key, r.Method+" "+path, req, *resp)
+		setHeaders(w.Header(), resp)
+		w.WriteHeader(resp.StatusCode)
+		io.WriteString(w, resp.Body)
+		log.Printf("RECORD    %s %s  →  %d (%dms)", r.Method, targetURL, resp.StatusCode, resp.LatencyMs)
 		return
 	}
 
@@ -112,3 +163,17 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "veritaserum: intercepted, configure mock in UI", http.StatusServiceUnavailable)
 	log.Printf("INTERCEPT %s %s → registered as pending", r.Method, targetURL)
 }
+
+// setHeaders copies the headers of a stored response into h, sending each
+// of HeaderValues as its own line.
+func setHeaders(h http.Header, resp *store.InteractionResponse) {
+	for k, v := range resp.Headers {
+		h.Set(k, v)
+	}
+	for k, vs := range resp.HeaderValues {
+		h.Del(k)
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+}
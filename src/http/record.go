@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"veritaserum/src/store"
+)
+
+// upstream talks to the real hosts in record mode. It deliberately ignores
+// HTTP_PROXY so a service pointed at Veritaserum cannot make us loop.
+var upstream = &http.Transport{
+	Proxy:                 nil,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// hopHeaders are connection-scoped and must not be forwarded or recorded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardUpstream sends the request to the real host and returns the answer
+// as an InteractionResponse, with LatencyMs set to the measured round trip.
+func forwardUpstream(r *http.Request, target *url.URL, body []byte) (*store.InteractionResponse, error) {
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	out.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	// Let the transport negotiate compression so the recorded body is plain.
+	out.Header.Del("Accept-Encoding")
+
+	start := time.Now()
+	resp, err := upstream.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	latency := time.Since(start)
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	resp.Header.Del("Content-Length")
+	// Repeated headers such as Set-Cookie are kept value by value; joining
+	// them with commas would change their meaning.
+	headers := map[string]string{}
+	var values map[string][]string
+	for k, v := range resp.Header {
+		if len(v) == 1 {
+			headers[k] = v[0]
+			continue
+		}
+		if values == nil {
+			values = map[string][]string{}
+		}
+		values[k] = v
+	}
+
+	return &store.InteractionResponse{
+		StatusCode:   resp.StatusCode,
+		Headers:      headers,
+		HeaderValues: values,
+		Body:         string(respBody),
+		LatencyMs:    int(latency.Milliseconds()),
+	}, nil
+}
@@ -2,13 +2,18 @@ package messaging
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"io/fs"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"veritaserum/src/certs"
+	"veritaserum/src/dbs"
 	"veritaserum/src/store"
 )
 
@@ -55,17 +60,148 @@ func StartAPIServer(port string, staticFiles fs.FS) {
 	r.POST("/api/interactions/:id/configure", func(c *gin.Context) {
 		id := c.Param("id")
 		var req struct {
-			Name     string                   `json:"name"`
-			Response store.InteractionResponse `json:"response"`
+			Name           string                       `json:"name"`
+			Response       store.InteractionResponse    `json:"response"`
+			Matcher        *store.Matcher               `json:"matcher"`
+			Responses      []*store.InteractionResponse `json:"responses"`
+			SequencePolicy string                       `json:"sequencePolicy"`
+			Scenario       string                       `json:"scenario"`
+			RequiredState  string                       `json:"requiredState"`
+			NewState       string                       `json:"newState"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		// Everything is checked before the interaction changes
+		if err := validateConfig(&req.Response, req.Matcher, req.Responses, req.SequencePolicy); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		if err := store.ConfigureInteraction(id, req.Name, req.Response); err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
+		if req.Matcher != nil {
+			store.SetMatcher(id, req.Matcher)
+		}
+		store.ConfigureSequence(id, req.Responses, req.SequencePolicy)
+		store.ConfigureScenario(id, req.Scenario, req.RequiredState, req.NewState)
+		c.Status(http.StatusNoContent)
+	})
+
+	r.PUT("/api/interactions/:id/matcher", func(c *gin.Context) {
+		var m *store.Matcher
+		if err := c.ShouldBindJSON(&m); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := store.SetMatcher(c.Param("id"), m); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// ---- Scenarios -----------------------------------------------------------
+
+	r.GET("/api/scenarios", func(c *gin.Context) {
+		c.JSON(http.StatusOK, store.GetScenarios())
+	})
+
+	r.PUT("/api/scenarios/:name", func(c *gin.Context) {
+		var req struct {
+			State string `json:"state"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.State == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state is required"})
+			return
+		}
+		store.SetScenarioState(c.Param("name"), req.State)
+		c.Status(http.StatusNoContent)
+	})
+
+	r.POST("/api/scenarios/reset", func(c *gin.Context) {
+		store.ResetScenarios()
+		log.Printf("SCENARIOS reset")
+		c.Status(http.StatusNoContent)
+	})
+
+	// ---- Transactions --------------------------------------------------------
+
+	// ?protocol=POSTGRES limits to one mock; ?testCase=<id> to transactions
+	// in which one of the test case's interactions ran.
+	r.GET("/api/transactions", func(c *gin.Context) {
+		var ids []string
+		if id := c.Query("testCase"); id != "" {
+			tc, ok := store.GetTestCase(id)
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "test case not found"})
+				return
+			}
+			ids = append([]string{}, tc.InteractionIDs...)
+		}
+		c.JSON(http.StatusOK, store.GetTransactions(strings.ToUpper(c.Query("protocol")), ids))
+	})
+
+	r.DELETE("/api/transactions", func(c *gin.Context) {
+		store.ClearTransactions()
+		c.Status(http.StatusNoContent)
+	})
+
+	// ---- Faults --------------------------------------------------------------
+
+	r.GET("/api/faults", func(c *gin.Context) {
+		c.JSON(http.StatusOK, store.GetProtocolFaults())
+	})
+
+	r.PUT("/api/faults/:protocol", func(c *gin.Context) {
+		var f *store.Fault
+		if err := c.ShouldBindJSON(&f); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := store.SetProtocolFault(strings.ToUpper(c.Param("protocol")), f); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// ---- Record mode ---------------------------------------------------------
+
+	r.GET("/api/record", func(c *gin.Context) {
+		c.JSON(http.StatusOK, store.GetRecording())
+	})
+
+	r.PUT("/api/record/:protocol", func(c *gin.Context) {
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := store.SetRecording(strings.ToUpper(c.Param("protocol")), req.Enabled); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// ---- Settings ------------------------------------------------------------
+
+	r.GET("/api/settings/match-headers", func(c *gin.Context) {
+		c.JSON(http.StatusOK, store.GetMatchHeaders())
+	})
+
+	r.PUT("/api/settings/match-headers", func(c *gin.Context) {
+		var names []string
+		if err := c.ShouldBindJSON(&names); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		store.SetMatchHeaders(names)
 		c.Status(http.StatusNoContent)
 	})
 
@@ -136,10 +272,45 @@ func StartAPIServer(port string, staticFiles fs.FS) {
 			"testCase":     tc.Name,
 			"interactions": kept,
 		}
+		if len(tc.RedisKeyspace) > 0 {
+			payload["redisKeyspace"] = tc.RedisKeyspace
+		}
 		c.Header("Content-Disposition", "attachment; filename=\""+tc.Name+".json\"")
 		c.JSON(http.StatusOK, payload)
 	})
 
+	// Snapshot the Redis keyspace into the test case, so that replaying it
+	// starts from the same cache state.
+	r.POST("/api/testcases/:id/redis-snapshot", func(c *gin.Context) {
+		if err := store.SetTestCaseRedisKeyspace(c.Param("id"), store.RedisSnapshot()); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	r.DELETE("/api/testcases/:id/redis-snapshot", func(c *gin.Context) {
+		if err := store.SetTestCaseRedisKeyspace(c.Param("id"), nil); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Load a test case's snapshot into the keyspace.
+	r.POST("/api/testcases/:id/redis-restore", func(c *gin.Context) {
+		tc, ok := store.GetTestCase(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		if err := store.RestoreRedis(tc.RedisKeyspace); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
 	// ---- Import --------------------------------------------------------------
 
 	r.POST("/api/import", func(c *gin.Context) {
@@ -149,14 +320,25 @@ func StartAPIServer(port string, staticFiles fs.FS) {
 			return
 		}
 		var suite struct {
-			TestCase     string               `json:"testCase"`
-			Interactions []*store.Interaction `json:"interactions"`
+			TestCase      string                      `json:"testCase"`
+			Interactions  []*store.Interaction        `json:"interactions"`
+			RedisKeyspace map[string]store.RedisEntry `json:"redisKeyspace"`
 		}
 		if err := json.Unmarshal(body, &suite); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		for _, i := range suite.Interactions {
+			if i.State != store.StateConfigured {
+				continue
+			}
+			if err := validateConfig(i.Response, i.Matcher, i.Responses, i.SequencePolicy); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "interaction " + i.Key + ": " + err.Error()})
+				return
+			}
+		}
 		tc := store.CreateTestCase(suite.TestCase, "imported")
+		store.SetTestCaseRedisKeyspace(tc.ID, suite.RedisKeyspace)
 		ids := make([]string, 0)
 		for _, i := range suite.Interactions {
 			if i.State == store.StateConfigured {
@@ -164,6 +346,11 @@ func StartAPIServer(port string, staticFiles fs.FS) {
 				if i.Response != nil {
 					store.ConfigureInteraction(existing.ID, i.Name, *i.Response)
 				}
+				if i.Matcher != nil {
+					store.SetMatcher(existing.ID, i.Matcher)
+				}
+				store.ConfigureSequence(existing.ID, i.Responses, i.SequencePolicy)
+				store.ConfigureScenario(existing.ID, i.Scenario, i.RequiredState, i.NewState)
 				ids = append(ids, existing.ID)
 			}
 		}
@@ -182,12 +369,155 @@ func StartAPIServer(port string, staticFiles fs.FS) {
 			Protocol        string `json:"protocol"`
 			TableName       string `json:"tableName"`
 			CreateStatement string `json:"createStatement"`
+			// Optional; left unchanged when omitted.
+			Live     *bool      `json:"live"`
+			Fixtures store.Rows `json:"fixtures"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil || req.TableName == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "protocol and tableName are required"})
 			return
 		}
 		store.UpsertSchema(req.Protocol, req.TableName, req.CreateStatement)
+		if req.Live != nil || req.Fixtures != nil {
+			s, _ := store.GetSchema(req.Protocol, req.TableName)
+			live, fixtures := s.Live, s.Fixtures
+			if req.Live != nil {
+				live = *req.Live
+			}
+			if req.Fixtures != nil {
+				fixtures = req.Fixtures
+			}
+			if err := store.SetSchemaLive(req.Protocol, req.TableName, live, fixtures); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// ---- Redis keyspace ------------------------------------------------------
+
+	r.GET("/api/redis/keyspace", func(c *gin.Context) {
+		c.JSON(http.StatusOK, store.RedisSnapshot())
+	})
+
+	r.PUT("/api/redis/keyspace", func(c *gin.Context) {
+		var snapshot map[string]store.RedisEntry
+		if err := c.ShouldBindJSON(&snapshot); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := store.RestoreRedis(snapshot); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	r.DELETE("/api/redis/keyspace", func(c *gin.Context) {
+		store.FlushRedis()
+		c.Status(http.StatusNoContent)
+	})
+
+	// Publish to the Redis mock's subscribers.
+	r.POST("/api/redis/publish", func(c *gin.Context) {
+		var req struct {
+			Channel string `json:"channel"`
+			Message string `json:"message"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Channel == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "channel is required"})
+			return
+		}
+		n := dbs.PublishRedis(req.Channel, req.Message)
+		log.Printf("REDIS PUBLISH (api): %s → %d subscribers", req.Channel, n)
+		c.JSON(http.StatusOK, gin.H{"receivers": n})
+	})
+
+	// Append an entry to a stream, waking blocked readers. Fields are added
+	// in key order.
+	r.POST("/api/redis/streams/:key", func(c *gin.Context) {
+		var req struct {
+			ID     string            `json:"id"`
+			Fields map[string]string `json:"fields"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || len(req.Fields) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "fields are required"})
+			return
+		}
+		names := make([]string, 0, len(req.Fields))
+		for f := range req.Fields {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		fields := make([]string, 0, 2*len(names))
+		for _, f := range names {
+			fields = append(fields, f, req.Fields[f])
+		}
+		id, err := store.AddRedisStreamEntry(c.Param("key"), req.ID, fields)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"id": id})
+	})
+
+	// Cluster topology, with --redis-cluster. Moving a slot makes its owner
+	// answer ASK while migrating and MOVED once assigned elsewhere.
+	r.GET("/api/redis/cluster", func(c *gin.Context) {
+		nodes, migrating, ok := dbs.RedisClusterState()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "the Redis mock is not in cluster mode"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"nodes": nodes, "migrating": migrating})
+	})
+
+	r.POST("/api/redis/cluster/slots/:slot/:action", func(c *gin.Context) {
+		slot, err := strconv.Atoi(c.Param("slot"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "slot must be a number"})
+			return
+		}
+		var req struct {
+			Node *int `json:"node"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Node == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "node is required"})
+			return
+		}
+		switch c.Param("action") {
+		case "migrate":
+			err = dbs.MigrateRedisSlot(slot, *req.Node)
+		case "assign":
+			err = dbs.AssignRedisSlot(slot, *req.Node)
+		default:
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown action " + c.Param("action")})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("REDIS CLUSTER: slot %d %s → node %d", slot, c.Param("action"), *req.Node)
+		c.Status(http.StatusNoContent)
+	})
+
+	// ---- Live tables ---------------------------------------------------------
+
+	r.GET("/api/live/:protocol/:table", func(c *gin.Context) {
+		rows, ok := store.LiveRows(strings.ToUpper(c.Param("protocol")), c.Param("table"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no live table with that name"})
+			return
+		}
+		c.JSON(http.StatusOK, rows)
+	})
+
+	// Discards every write; tables are seeded from their fixtures again.
+	r.POST("/api/live/reset", func(c *gin.Context) {
+		store.ResetLiveTables()
+		log.Printf("LIVE tables reset")
 		c.Status(http.StatusNoContent)
 	})
 
@@ -202,6 +532,18 @@ func StartAPIServer(port string, staticFiles fs.FS) {
 		c.Status(http.StatusNoContent)
 	})
 
+	// ---- CA certificate ------------------------------------------------------
+
+	r.GET("/api/ca.pem", func(c *gin.Context) {
+		pem := certs.CACertPEM()
+		if len(pem) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "CA not initialised"})
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=\""+certs.CACertFileName+"\"")
+		c.Data(http.StatusOK, "application/x-pem-file", pem)
+	})
+
 	// ---- Health --------------------------------------------------------------
 
 	r.GET("/healthz", func(c *gin.Context) {
@@ -213,3 +555,35 @@ func StartAPIServer(port string, staticFiles fs.FS) {
 		log.Fatalf("api: %v", err)
 	}
 }
+
+// validateConfig checks what configuring an interaction would store: its
+// matcher, sequence policy and every response with its fault.
+func validateConfig(resp *store.InteractionResponse, matcher *store.Matcher, responses []*store.InteractionResponse, policy string) error {
+	if matcher != nil {
+		if err := matcher.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := store.ValidateSequencePolicy(policy); err != nil {
+		return err
+	}
+	for _, r := range append([]*store.InteractionResponse{resp}, responses...) {
+		if r == nil {
+			continue
+		}
+		if r.Fault != nil {
+			if err := r.Fault.Validate(); err != nil {
+				return err
+			}
+		}
+		if r.RESP != nil {
+			if err := r.RESP.Validate(); err != nil {
+				return err
+			}
+		}
+		if r.ItemJSON != "" && !r.Template && !json.Valid([]byte(r.ItemJSON)) {
+			return errors.New("itemJSON is not valid JSON")
+		}
+	}
+	return nil
+}
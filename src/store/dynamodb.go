@@ -0,0 +1,442 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ---- DynamoDB ------------------------------------------------------------
+
+// DynamoDB calls reach the HTTP proxy as JSON 1.0 requests: the operation in
+// the X-Amz-Target header, its input as the body. Attribute values are
+// typed ({"S": "123"}); requests are keyed and responses configured with
+// plain JSON ({"orderId": "123"}) instead.
+
+// dynamoErrorPrefix qualifies error types in the __type field.
+const dynamoErrorPrefix = "com.amazonaws.dynamodb.v20120810#"
+
+// dynamoInput is the part of an operation's input that routing reads.
+type dynamoInput struct {
+	TableName                 string
+	IndexName                 string
+	Key                       map[string]interface{}
+	Item                      map[string]interface{}
+	KeyConditionExpression    string
+	FilterExpression          string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues map[string]interface{}
+	Limit                     int
+	ExclusiveStartKey         map[string]interface{}
+	ReturnValues              string
+}
+
+// ParseDynamoDB fills the DynamoDB fields of req from the X-Amz-Target
+// header (e.g. "DynamoDB_20120810.GetItem") and the JSON body in req.Body.
+func ParseDynamoDB(req *InteractionRequest, target string) {
+	if idx := strings.Index(target, "."); idx != -1 {
+		req.Operation = target[idx+1:]
+	}
+	parseDynamoBody(req)
+}
+
+// parseDynamoBody fills the fields read from the body. A body that is not
+// JSON leaves them empty.
+func parseDynamoBody(req *InteractionRequest) {
+	var in dynamoInput
+	dec := json.NewDecoder(strings.NewReader(req.Body))
+	dec.UseNumber()
+	if err := dec.Decode(&in); err != nil {
+		return
+	}
+	req.Table = in.TableName
+	req.IndexName = in.IndexName
+	req.Limit = in.Limit
+	req.ReturnValues = in.ReturnValues
+	req.KeyJSON = plainJSON(in.Key)
+	if req.KeyJSON == "" && req.Operation == "PutItem" {
+		req.KeyJSON = plainJSON(in.Item)
+	}
+	req.StartKeyJSON = plainJSON(in.ExclusiveStartKey)
+	req.ValuesJSON = plainJSON(in.ExpressionAttributeValues)
+	expr := in.KeyConditionExpression
+	if expr == "" {
+		expr = in.FilterExpression
+	}
+	req.KeyCondition = substituteExpression(expr, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+}
+
+// DynamoDBKey builds the routing key of a DynamoDB request:
+//
+//	GetItem orders {"orderId":"123"}
+//	Query orders index=byCustomer customerId = "c1" AND createdAt > 100 limit=10
+//
+// The detail is the Key (the Item for PutItem), the substituted key
+// condition or filter for Query and Scan, and the body hash for any other
+// operation.
+func DynamoDBKey(req InteractionRequest) string {
+	parts := []string{req.Operation}
+	if req.Table != "" {
+		parts = append(parts, req.Table)
+	}
+	if req.IndexName != "" {
+		parts = append(parts, "index="+req.IndexName)
+	}
+	switch {
+	case req.KeyJSON != "":
+		parts = append(parts, req.KeyJSON)
+	case req.KeyCondition != "":
+		parts = append(parts, req.KeyCondition)
+	case req.Operation != "Query" && req.Operation != "Scan":
+		parts = append(parts, req.BodyHash)
+	}
+	if req.Limit > 0 {
+		parts = append(parts, "limit="+strconv.Itoa(req.Limit))
+	}
+	if req.StartKeyJSON != "" {
+		parts = append(parts, "from="+req.StartKeyJSON)
+	}
+	return strings.Join(parts, " ")
+}
+
+// substituteExpression replaces #name and :value placeholders with the
+// attribute names and plain JSON values they stand for, and collapses
+// whitespace.
+func substituteExpression(expr string, names map[string]string, values map[string]interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		if c != '#' && c != ':' {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(expr) && (expr[j] == '_' || expr[j] >= '0' && expr[j] <= '9' || expr[j] >= 'a' && expr[j] <= 'z' || expr[j] >= 'A' && expr[j] <= 'Z') {
+			j++
+		}
+		token := expr[i:j]
+		switch {
+		case c == '#' && names[token] != "":
+			b.WriteString(names[token])
+		case c == ':' && values[token] != nil:
+			b.WriteString(marshalDynamo(FromAttributeValue(values[token])))
+		default:
+			b.WriteString(token)
+		}
+		i = j
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// plainJSON converts a map of attribute values to plain JSON; "" for none.
+func plainJSON(attrs map[string]interface{}) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	return marshalDynamo(FromAttributeValue(map[string]interface{}{"M": attrs}))
+}
+
+// ---- Attribute values ----------------------------------------------------
+
+// FromAttributeValue converts a typed attribute value ({"S": "x"},
+// {"N": "1"}, {"M": {…}}, …) to plain JSON. Numbers become json.Number so
+// that they keep their digits.
+func FromAttributeValue(av interface{}) interface{} {
+	m, ok := av.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return av
+	}
+	for typ, v := range m {
+		switch typ {
+		case "S", "B":
+			return v
+		case "N":
+			if s, ok := v.(string); ok {
+				return json.Number(s)
+			}
+			return v
+		case "BOOL":
+			return v
+		case "NULL":
+			return nil
+		case "SS", "BS":
+			return v
+		case "NS":
+			list, _ := v.([]interface{})
+			out := make([]interface{}, len(list))
+			for i, x := range list {
+				if s, ok := x.(string); ok {
+					out[i] = json.Number(s)
+				} else {
+					out[i] = x
+				}
+			}
+			return out
+		case "L":
+			list, _ := v.([]interface{})
+			out := make([]interface{}, len(list))
+			for i, x := range list {
+				out[i] = FromAttributeValue(x)
+			}
+			return out
+		case "M":
+			attrs, _ := v.(map[string]interface{})
+			out := make(map[string]interface{}, len(attrs))
+			for k, x := range attrs {
+				out[k] = FromAttributeValue(x)
+			}
+			return out
+		}
+	}
+	return av
+}
+
+// ToAttributeValue converts plain JSON to a typed attribute value. A value
+// that already is one, like {"S": "x"}, is kept as it is, so recorded
+// DynamoDB JSON can be used as well.
+func ToAttributeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return map[string]interface{}{"NULL": true}
+	case string:
+		return map[string]interface{}{"S": x}
+	case json.Number:
+		return map[string]interface{}{"N": x.String()}
+	case float64:
+		return map[string]interface{}{"N": strconv.FormatFloat(x, 'f', -1, 64)}
+	case bool:
+		return map[string]interface{}{"BOOL": x}
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = ToAttributeValue(e)
+		}
+		return map[string]interface{}{"L": out}
+	case map[string]interface{}:
+		if isAttributeValue(x) {
+			return x
+		}
+		return map[string]interface{}{"M": toAttributeMap(x)}
+	}
+	return map[string]interface{}{"S": fmt.Sprint(v)}
+}
+
+// toAttributeMap converts a plain JSON object to an item: attribute name →
+// typed value.
+func toAttributeMap(obj map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(obj))
+	for k, e := range obj {
+		out[k] = ToAttributeValue(e)
+	}
+	return out
+}
+
+// isAttributeValue reports whether m is already a typed attribute value.
+func isAttributeValue(m map[string]interface{}) bool {
+	if len(m) != 1 {
+		return false
+	}
+	for typ, v := range m {
+		switch typ {
+		case "S", "N", "B":
+			_, ok := v.(string)
+			return ok
+		case "BOOL", "NULL":
+			_, ok := v.(bool)
+			return ok
+		case "SS", "NS", "BS", "L":
+			_, ok := v.([]interface{})
+			return ok
+		case "M":
+			_, ok := v.(map[string]interface{})
+			return ok
+		}
+	}
+	return false
+}
+
+// ---- Responses -----------------------------------------------------------
+
+// DynamoDBReply builds the HTTP answer for a configured DynamoDB response.
+// A configured Body is sent as it is. Otherwise Error becomes a DynamoDB
+// error, and ItemJSON the output of the operation:
+//
+//	GetItem                        {"Item": …}
+//	Query, Scan                    {"Items": […], "Count": n, "ScannedCount": n, "LastEvaluatedKey": …}
+//	PutItem, UpdateItem, DeleteItem {"Attributes": …} when ReturnValues asks for them
+//	BatchGetItem                   {"Responses": {table: […]}, "UnprocessedKeys": {}}
+//	TransactGetItems               {"Responses": [{"Item": …}, …]}
+//
+// ItemJSON is plain JSON; a Query or Scan takes an array of items or
+// {"Items": […], "LastEvaluatedKey": {…}}.
+func DynamoDBReply(req InteractionRequest, resp *InteractionResponse) (status int, body string, err error) {
+	if resp.Error != nil {
+		return dynamoError(resp)
+	}
+	status = resp.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if resp.Body != "" {
+		return status, resp.Body, nil
+	}
+
+	var item interface{}
+	if strings.TrimSpace(resp.ItemJSON) != "" {
+		dec := json.NewDecoder(strings.NewReader(resp.ItemJSON))
+		dec.UseNumber()
+		if err := dec.Decode(&item); err != nil {
+			return 0, "", fmt.Errorf("itemJSON: %w", err)
+		}
+	}
+
+	out := map[string]interface{}{}
+	switch req.Operation {
+	case "GetItem":
+		if obj, ok := item.(map[string]interface{}); ok {
+			out["Item"] = toAttributeMap(obj)
+		}
+
+	case "Query", "Scan":
+		items, last := queryItems(item)
+		if req.Limit > 0 && len(items) > req.Limit {
+			items = items[:req.Limit]
+			if last == nil {
+				last = lastEvaluatedKey(req, items[len(items)-1])
+			}
+		}
+		list := make([]interface{}, len(items))
+		for i, it := range items {
+			list[i] = toAttributeMap(it)
+		}
+		out["Items"] = list
+		out["Count"] = len(items)
+		out["ScannedCount"] = len(items)
+		if last != nil {
+			out["LastEvaluatedKey"] = toAttributeMap(last)
+		}
+
+	case "PutItem", "UpdateItem", "DeleteItem":
+		if obj, ok := item.(map[string]interface{}); ok && req.ReturnValues != "" && req.ReturnValues != "NONE" {
+			out["Attributes"] = toAttributeMap(obj)
+		}
+
+	case "BatchGetItem":
+		responses := map[string]interface{}{}
+		if tables, ok := item.(map[string]interface{}); ok {
+			for table, v := range tables {
+				items, _ := queryItems(v)
+				list := make([]interface{}, len(items))
+				for i, it := range items {
+					list[i] = toAttributeMap(it)
+				}
+				responses[table] = list
+			}
+		}
+		out["Responses"] = responses
+		out["UnprocessedKeys"] = map[string]interface{}{}
+
+	case "BatchWriteItem":
+		out["UnprocessedItems"] = map[string]interface{}{}
+
+	case "TransactGetItems":
+		items, _ := queryItems(item)
+		list := make([]interface{}, len(items))
+		for i, it := range items {
+			list[i] = map[string]interface{}{"Item": toAttributeMap(it)}
+		}
+		out["Responses"] = list
+
+	default:
+		// Other operations answer with ItemJSON as their output
+		if item != nil {
+			return status, resp.ItemJSON, nil
+		}
+	}
+	return status, marshalDynamo(out), nil
+}
+
+// queryItems reads the items of a Query or Scan answer: an array, a single
+// object, or {"Items": […], "LastEvaluatedKey": {…}}.
+func queryItems(v interface{}) (items []map[string]interface{}, last map[string]interface{}) {
+	switch x := v.(type) {
+	case []interface{}:
+		for _, e := range x {
+			if obj, ok := e.(map[string]interface{}); ok {
+				items = append(items, obj)
+			}
+		}
+	case map[string]interface{}:
+		if list, ok := x["Items"].([]interface{}); ok {
+			items, _ = queryItems(list)
+			last, _ = x["LastEvaluatedKey"].(map[string]interface{})
+			return items, last
+		}
+		items = append(items, x)
+	}
+	return items, nil
+}
+
+// lastEvaluatedKey picks the attributes of the last returned item that the
+// key condition names, or the whole item without one.
+func lastEvaluatedKey(req InteractionRequest, item map[string]interface{}) map[string]interface{} {
+	named := map[string]bool{}
+	for _, w := range strings.FieldsFunc(req.KeyCondition, func(r rune) bool {
+		return r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		named[w] = true
+	}
+	key := map[string]interface{}{}
+	for name, v := range item {
+		if named[name] {
+			key[name] = v
+		}
+	}
+	if len(key) == 0 {
+		return item
+	}
+	return key
+}
+
+// dynamoError answers with a DynamoDB error: {"__type": "…#Type",
+// "message": …}, HTTP 400 unless set otherwise (500 for
+// InternalServerError). A ConditionalCheckFailedException carries the
+// ItemJSON as the existing Item.
+func dynamoError(resp *InteractionResponse) (int, string, error) {
+	e := resp.Error
+	typ := e.Type
+	if typ == "" {
+		typ = "ValidationException"
+	}
+	status := e.StatusCode
+	if status == 0 {
+		status = http.StatusBadRequest
+		if typ == "InternalServerError" {
+			status = http.StatusInternalServerError
+		}
+	}
+	out := map[string]interface{}{"__type": dynamoErrorPrefix + typ, "message": e.Message}
+	if typ == "ConditionalCheckFailedException" && strings.TrimSpace(resp.ItemJSON) != "" {
+		dec := json.NewDecoder(strings.NewReader(resp.ItemJSON))
+		dec.UseNumber()
+		var item map[string]interface{}
+		if err := dec.Decode(&item); err != nil {
+			return 0, "", fmt.Errorf("itemJSON: %w", err)
+		}
+		out["Item"] = toAttributeMap(item)
+	}
+	return status, marshalDynamo(out), nil
+}
+
+func marshalDynamo(v interface{}) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ---- Fault injection -----------------------------------------------------
+
+// Fault describes how a mock should misbehave when answering. Latency is
+// always applied; the failure modes below it only fire with probability
+// Rate (always when Rate is 0).
+type Fault struct {
+	Rate    float64  `json:"rate,omitempty"`
+	Latency *Latency `json:"latency,omitempty"`
+
+	Reset          bool        `json:"reset,omitempty"`          // abort the connection (TCP RST)
+	DropAfterBytes int         `json:"dropAfterBytes,omitempty"` // send this many bytes, then close
+	TrickleBytes   int         `json:"trickleBytes,omitempty"`   // send the response in chunks of this size…
+	TrickleDelayMs int         `json:"trickleDelayMs,omitempty"` // …pausing this long between chunks
+	Error          *ErrorReply `json:"error,omitempty"`          // answer with a protocol error instead
+}
+
+const (
+	LatencyFixed   = "fixed"
+	LatencyUniform = "uniform"
+	LatencyNormal  = "normal"
+)
+
+// Latency is a delay distribution: fixed (Ms), uniform (MinMs..MaxMs) or
+// normal (MeanMs ± StdDevMs, never negative).
+type Latency struct {
+	Distribution string `json:"distribution,omitempty"`
+	Ms           int    `json:"ms,omitempty"`
+	MinMs        int    `json:"minMs,omitempty"`
+	MaxMs        int    `json:"maxMs,omitempty"`
+	MeanMs       int    `json:"meanMs,omitempty"`
+	StdDevMs     int    `json:"stdDevMs,omitempty"`
+}
+
+// ErrorReply is a protocol-level error: an HTTP status, a MySQL ERR packet,
+// a Postgres ErrorResponse, a Redis error reply or a DynamoDB error,
+// depending on where it is sent. Fields that do not apply to a protocol are
+// ignored.
+type ErrorReply struct {
+	StatusCode int    `json:"statusCode,omitempty"` // HTTP / DynamoDB
+	Code       int    `json:"code,omitempty"`       // MySQL error number
+	SQLState   string `json:"sqlState,omitempty"`   // MySQL / Postgres
+	Message    string `json:"message,omitempty"`
+
+	// DynamoDB error type, e.g. "ConditionalCheckFailedException"
+	Type string `json:"type,omitempty"`
+
+	// Postgres only
+	Detail     string `json:"detail,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+	Table      string `json:"table,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+}
+
+func (f *Fault) Validate() error {
+	if f.Rate < 0 || f.Rate > 1 {
+		return fmt.Errorf("fault rate must be between 0 and 1")
+	}
+	if f.Latency != nil {
+		switch f.Latency.Distribution {
+		case "", LatencyFixed, LatencyUniform, LatencyNormal:
+		default:
+			return fmt.Errorf("unknown latency distribution %q", f.Latency.Distribution)
+		}
+	}
+	return nil
+}
+
+// Delay samples the latency distribution.
+func (f *Fault) Delay() time.Duration {
+	if f == nil || f.Latency == nil {
+		return 0
+	}
+	l := f.Latency
+	var ms float64
+	switch l.Distribution {
+	case LatencyUniform:
+		ms = float64(l.MinMs)
+		if l.MaxMs > l.MinMs {
+			ms += rand.Float64() * float64(l.MaxMs-l.MinMs)
+		}
+	case LatencyNormal:
+		ms = float64(l.MeanMs) + rand.NormFloat64()*float64(l.StdDevMs)
+	default:
+		ms = float64(l.Ms)
+	}
+	if ms < 0 {
+		ms = 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// Fires rolls the dice for the failure modes.
+func (f *Fault) Fires() bool {
+	if f == nil {
+		return false
+	}
+	return f.Rate == 0 || rand.Float64() < f.Rate
+}
+
+// ---- Per-protocol faults -------------------------------------------------
+
+var protocolFaults = map[string]*Fault{}
+
+// SetProtocolFault applies f to every mocked answer on a protocol's listener
+// unless the response carries its own fault. nil clears it.
+func SetProtocolFault(protocol string, f *Fault) error {
+	switch protocol {
+	case ProtoHTTP, ProtoMySQL, ProtoPostgres, ProtoRedis, ProtoDynamoDB:
+	default:
+		return fmt.Errorf("unknown protocol %s", protocol)
+	}
+	if f != nil {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if f == nil {
+		delete(protocolFaults, protocol)
+	} else {
+		protocolFaults[protocol] = f
+	}
+	return nil
+}
+
+func GetProtocolFaults() map[string]*Fault {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make(map[string]*Fault, len(protocolFaults))
+	for k, v := range protocolFaults {
+		out[k] = v
+	}
+	return out
+}
+
+// FaultFor returns the fault that applies to a response: its own, or the
+// protocol-wide one.
+func FaultFor(protocol string, resp *InteractionResponse) *Fault {
+	if resp != nil && resp.Fault != nil {
+		return resp.Fault
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	return protocolFaults[protocol]
+}
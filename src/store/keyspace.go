@@ -0,0 +1,357 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---- Redis keyspace ------------------------------------------------------
+
+// In stateful mode the Redis mock keeps a real keyspace: commands without a
+// configured stub read and write it instead of being left pending. Each
+// SELECTed database has a keyspace of its own.
+
+// Redis value types, as reported by TYPE.
+const (
+	RedisString = "string"
+	RedisHash   = "hash"
+	RedisList   = "list"
+	RedisSet    = "set"
+	RedisZSet   = "zset"
+)
+
+// RedisEntry is a key's value in a keyspace snapshot. Only the fields for
+// Type are set; a stream's Groups maps each consumer group to the last ID
+// it delivered. TTLMs is the time left to live, 0 for keys without one.
+type RedisEntry struct {
+	Type   string             `json:"type"`
+	String string             `json:"string,omitempty"`
+	Hash   map[string]string  `json:"hash,omitempty"`
+	List   []string           `json:"list,omitempty"`
+	Set    []string           `json:"set,omitempty"`
+	ZSet   map[string]float64 `json:"zset,omitempty"`
+	Stream []RedisStreamEntry `json:"stream,omitempty"`
+	Groups map[string]string  `json:"groups,omitempty"`
+	TTLMs  int64              `json:"ttlMs,omitempty"`
+}
+
+type redisValue struct {
+	typ     string
+	str     string
+	hash    map[string]string
+	list    []string
+	set     map[string]bool
+	zset    map[string]float64
+	stream  *redisStream
+	expires time.Time // zero: no TTL
+}
+
+// redisKeyRef names a key in one database.
+type redisKeyRef struct {
+	db  int
+	key string
+}
+
+var (
+	// Runtime state, never persisted; test cases keep snapshots of
+	// database 0. keyspace is the database of the running command, chosen
+	// with useDB.
+	keyspaceMu sync.Mutex
+	databases  = map[int]map[string]*redisValue{0: {}}
+	currentDB  int
+	keyspace   = databases[0]
+
+	// Modification counters for WATCH: each write takes the next version,
+	// and flushing a database changes every key in it at once.
+	version      uint64
+	touched      = map[redisKeyRef]uint64{}
+	flushedAt    = map[int]uint64{}
+	flushedAllAt uint64
+)
+
+// useDB makes db the database commands run on. Caller holds keyspaceMu.
+func useDB(db int) {
+	if databases[db] == nil {
+		databases[db] = map[string]*redisValue{}
+	}
+	currentDB, keyspace = db, databases[db]
+}
+
+// touch records that key was modified. Caller holds keyspaceMu.
+func touch(key string) {
+	version++
+	touched[redisKeyRef{currentDB, key}] = version
+}
+
+// flushDB empties the current database (FLUSHDB). Caller holds keyspaceMu.
+func flushDB() {
+	keyspace = map[string]*redisValue{}
+	databases[currentDB] = keyspace
+	version++
+	for ref := range touched {
+		if ref.db == currentDB {
+			delete(touched, ref)
+		}
+	}
+	flushedAt[currentDB] = version
+}
+
+// flushAll empties every database (FLUSHALL). Caller holds keyspaceMu.
+func flushAll() {
+	databases = map[int]map[string]*redisValue{}
+	version++
+	touched = map[redisKeyRef]uint64{}
+	flushedAt = map[int]uint64{}
+	flushedAllAt = version
+	useDB(currentDB)
+}
+
+// RedisKeyVersion returns a counter that changes whenever key is modified
+// in database db; EXEC compares it with the one seen at WATCH.
+func RedisKeyVersion(db int, key string) uint64 {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	return max(touched[redisKeyRef{db, key}], flushedAt[db], flushedAllAt)
+}
+
+// lookupKey returns a key's value, dropping it when it has expired. Caller
+// holds keyspaceMu.
+func lookupKey(key string) *redisValue {
+	v, ok := keyspace[key]
+	if !ok {
+		return nil
+	}
+	if !v.expires.IsZero() && !time.Now().Before(v.expires) {
+		delete(keyspace, key)
+		return nil
+	}
+	return v
+}
+
+// liveKeys returns the names of the keys that have not expired, sorted.
+// Caller holds keyspaceMu.
+func liveKeys() []string {
+	keys := make([]string, 0, len(keyspace))
+	for k := range keyspace {
+		if lookupKey(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RedisSnapshot returns a copy of database 0.
+func RedisSnapshot() map[string]RedisEntry {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	useDB(0)
+	out := make(map[string]RedisEntry, len(keyspace))
+	for _, k := range liveKeys() {
+		v := keyspace[k]
+		e := RedisEntry{Type: v.typ}
+		switch v.typ {
+		case RedisString:
+			e.String = v.str
+		case RedisHash:
+			e.Hash = make(map[string]string, len(v.hash))
+			for f, x := range v.hash {
+				e.Hash[f] = x
+			}
+		case RedisList:
+			e.List = append([]string{}, v.list...)
+		case RedisSet:
+			e.Set = setMembers(v.set)
+		case RedisZSet:
+			e.ZSet = make(map[string]float64, len(v.zset))
+			for m, s := range v.zset {
+				e.ZSet[m] = s
+			}
+		case RedisStream:
+			for _, x := range v.stream.entries {
+				e.Stream = append(e.Stream, RedisStreamEntry{ID: x.id.String(), Fields: append([]string{}, x.fields...)})
+			}
+			if len(v.stream.groups) > 0 {
+				e.Groups = map[string]string{}
+				for name, g := range v.stream.groups {
+					e.Groups[name] = g.lastDelivered.String()
+				}
+			}
+		}
+		if !v.expires.IsZero() {
+			e.TTLMs = max(time.Until(v.expires).Milliseconds(), 1)
+		}
+		out[k] = e
+	}
+	return out
+}
+
+// RestoreRedis replaces database 0 with a snapshot and empties the others.
+func RestoreRedis(snapshot map[string]RedisEntry) error {
+	ks := make(map[string]*redisValue, len(snapshot))
+	now := time.Now()
+	for k, e := range snapshot {
+		v := &redisValue{typ: e.Type}
+		switch e.Type {
+		case RedisString:
+			v.str = e.String
+		case RedisHash:
+			v.hash = map[string]string{}
+			for f, x := range e.Hash {
+				v.hash[f] = x
+			}
+		case RedisList:
+			v.list = append([]string{}, e.List...)
+		case RedisSet:
+			v.set = map[string]bool{}
+			for _, m := range e.Set {
+				v.set[m] = true
+			}
+		case RedisZSet:
+			v.zset = map[string]float64{}
+			for m, s := range e.ZSet {
+				v.zset[m] = s
+			}
+		case RedisStream:
+			v.stream = &redisStream{groups: map[string]*streamGroup{}}
+			for _, x := range e.Stream {
+				id, ok := parseStreamID(x.ID, 0)
+				if !ok || !v.stream.lastID.less(id) || len(x.Fields)%2 != 0 {
+					return fmt.Errorf("key %q: invalid stream entry %q", k, x.ID)
+				}
+				v.stream.entries = append(v.stream.entries, streamEntry{id: id, fields: append([]string{}, x.Fields...)})
+				v.stream.lastID = id
+			}
+			for name, last := range e.Groups {
+				id, ok := parseStreamID(last, 0)
+				if !ok {
+					return fmt.Errorf("key %q: invalid group ID %q", k, last)
+				}
+				v.stream.groups[name] = &streamGroup{lastDelivered: id, consumers: map[string]bool{}, pending: map[streamID]*pendingEntry{}}
+			}
+		default:
+			return fmt.Errorf("key %q: unknown type %q", k, e.Type)
+		}
+		if e.TTLMs > 0 {
+			v.expires = now.Add(time.Duration(e.TTLMs) * time.Millisecond)
+		}
+		ks[k] = v
+	}
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	flushAll()
+	databases[0] = ks
+	useDB(0)
+	return nil
+}
+
+// FlushRedis empties every database.
+func FlushRedis() {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	flushAll()
+}
+
+func setMembers(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for m := range set {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// FormatRedisFloat formats a float the way Redis replies with one: integral
+// values without a fraction, inf, -inf and nan spelled out.
+func FormatRedisFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	case f == math.Trunc(f) && math.Abs(f) < 1e17:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// RedisGlob matches a key or channel against a KEYS, SCAN or PSUBSCRIBE
+// pattern: * ? [abc] [^a-z] and \ escapes.
+func RedisGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if RedisGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			end := 1
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(pattern) || len(s) == 0 {
+				return false
+			}
+			class := pattern[1:end]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			match := false
+			for i := 0; i < len(class); i++ {
+				c := class[i]
+				if c == '\\' && i+1 < len(class) {
+					i++
+					c = class[i]
+				}
+				if i+2 < len(class) && class[i+1] == '-' {
+					if s[0] >= c && s[0] <= class[i+2] {
+						match = true
+					}
+					i += 2
+				} else if s[0] == c {
+					match = true
+				}
+			}
+			if match == negate {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[end+1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,1605 @@
+package store
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisCommand is a command run on the keyspace. arity counts the command
+// name like Redis does: n means exactly n arguments, -n at least n. writes
+// names the keys the command modifies, for WATCH.
+type redisCommand struct {
+	arity  int
+	run    func(args []string) RESPValue
+	writes keyRange
+}
+
+// keyRange picks keys out of the arguments like Redis' key specs: from
+// first to last (negative counts from the end) every step arguments.
+type keyRange struct {
+	first, last, step int
+}
+
+var (
+	readOnly = keyRange{}
+	firstKey = keyRange{1, 1, 1}
+	twoKeys  = keyRange{1, 2, 1}
+	allKeys  = keyRange{1, -1, 1}
+	keyPairs = keyRange{1, -1, 2}
+)
+
+func (r keyRange) keys(args []string) []string {
+	if r.step == 0 {
+		return nil
+	}
+	last := r.last
+	if last < 0 {
+		last += len(args)
+	}
+	var out []string
+	for i := r.first; i <= last && i < len(args); i += r.step {
+		out = append(out, args[i])
+	}
+	return out
+}
+
+var redisCommands map[string]redisCommand
+
+func init() {
+	redisCommands = map[string]redisCommand{
+		// keys
+		"DEL":       {-2, cmdDel, allKeys},
+		"UNLINK":    {-2, cmdDel, allKeys},
+		"EXISTS":    {-2, cmdExists, readOnly},
+		"TYPE":      {2, cmdType, readOnly},
+		"EXPIRE":    {-3, cmdExpire(time.Second, false), firstKey},
+		"PEXPIRE":   {-3, cmdExpire(time.Millisecond, false), firstKey},
+		"EXPIREAT":  {-3, cmdExpire(time.Second, true), firstKey},
+		"PEXPIREAT": {-3, cmdExpire(time.Millisecond, true), firstKey},
+		"TTL":       {2, cmdTTL(time.Second), readOnly},
+		"PTTL":      {2, cmdTTL(time.Millisecond), readOnly},
+		"PERSIST":   {2, cmdPersist, firstKey},
+		"KEYS":      {2, cmdKeys, readOnly},
+		"SCAN":      {-2, cmdScan, readOnly},
+		"RENAME":    {3, cmdRename(false), twoKeys},
+		"RENAMENX":  {3, cmdRename(true), twoKeys},
+		"DBSIZE":    {1, cmdDBSize, readOnly},
+		"FLUSHDB":   {-1, cmdFlushDB, readOnly},
+		"FLUSHALL":  {-1, cmdFlushAll, readOnly},
+
+		// strings
+		"GET":         {2, cmdGet, readOnly},
+		"SET":         {-3, cmdSet, firstKey},
+		"SETNX":       {3, cmdSetNX, firstKey},
+		"SETEX":       {4, cmdSetEx(time.Second), firstKey},
+		"PSETEX":      {4, cmdSetEx(time.Millisecond), firstKey},
+		"GETSET":      {3, cmdGetSet, firstKey},
+		"GETDEL":      {2, cmdGetDel, firstKey},
+		"MGET":        {-2, cmdMGet, readOnly},
+		"MSET":        {-3, cmdMSet(false), keyPairs},
+		"MSETNX":      {-3, cmdMSet(true), keyPairs},
+		"INCR":        {2, func(a []string) RESPValue { return incrBy(a[1], 1) }, firstKey},
+		"DECR":        {2, func(a []string) RESPValue { return incrBy(a[1], -1) }, firstKey},
+		"INCRBY":      {3, cmdIncrBy(1), firstKey},
+		"DECRBY":      {3, cmdIncrBy(-1), firstKey},
+		"INCRBYFLOAT": {3, cmdIncrByFloat, firstKey},
+		"APPEND":      {3, cmdAppend, firstKey},
+		"STRLEN":      {2, cmdStrlen, readOnly},
+
+		// hashes
+		"HGET":         {3, cmdHGet, readOnly},
+		"HSET":         {-4, cmdHSet, firstKey},
+		"HMSET":        {-4, cmdHSet, firstKey},
+		"HSETNX":       {4, cmdHSetNX, firstKey},
+		"HGETALL":      {2, cmdHGetAll, readOnly},
+		"HMGET":        {-3, cmdHMGet, readOnly},
+		"HDEL":         {-3, cmdHDel, firstKey},
+		"HEXISTS":      {3, cmdHExists, readOnly},
+		"HLEN":         {2, cmdHLen, readOnly},
+		"HKEYS":        {2, cmdHKeys(true), readOnly},
+		"HVALS":        {2, cmdHKeys(false), readOnly},
+		"HINCRBY":      {4, cmdHIncrBy, firstKey},
+		"HINCRBYFLOAT": {4, cmdHIncrByFloat, firstKey},
+
+		// lists
+		"LPUSH":  {-3, cmdPush(true), firstKey},
+		"RPUSH":  {-3, cmdPush(false), firstKey},
+		"LPOP":   {-2, cmdPop(true), firstKey},
+		"RPOP":   {-2, cmdPop(false), firstKey},
+		"LLEN":   {2, cmdLLen, readOnly},
+		"LRANGE": {4, cmdLRange, readOnly},
+		"LINDEX": {3, cmdLIndex, readOnly},
+		"LSET":   {4, cmdLSet, firstKey},
+		"LREM":   {4, cmdLRem, firstKey},
+		"LTRIM":  {4, cmdLTrim, firstKey},
+
+		// sets
+		"SADD":      {-3, cmdSAdd, firstKey},
+		"SREM":      {-3, cmdSRem, firstKey},
+		"SMEMBERS":  {2, cmdSMembers, readOnly},
+		"SISMEMBER": {3, cmdSIsMember, readOnly},
+		"SCARD":     {2, cmdSCard, readOnly},
+		"SINTER":    {-2, cmdSCombine("inter"), readOnly},
+		"SUNION":    {-2, cmdSCombine("union"), readOnly},
+		"SDIFF":     {-2, cmdSCombine("diff"), readOnly},
+
+		// sorted sets
+		"ZADD":             {-4, cmdZAdd, firstKey},
+		"ZINCRBY":          {4, cmdZIncrBy, firstKey},
+		"ZREM":             {-3, cmdZRem, firstKey},
+		"ZSCORE":           {3, cmdZScore, readOnly},
+		"ZCARD":            {2, cmdZCard, readOnly},
+		"ZCOUNT":           {4, cmdZCount, readOnly},
+		"ZRANK":            {3, cmdZRank(false), readOnly},
+		"ZREVRANK":         {3, cmdZRank(true), readOnly},
+		"ZRANGE":           {-4, cmdZRange(""), readOnly},
+		"ZREVRANGE":        {-4, cmdZRange("REV"), readOnly},
+		"ZRANGEBYSCORE":    {-4, cmdZRange("BYSCORE"), readOnly},
+		"ZREVRANGEBYSCORE": {-4, cmdZRange("BYSCORE REV"), readOnly},
+		"ZREMRANGEBYRANK":  {4, cmdZRemRangeByRank, firstKey},
+		"ZREMRANGEBYSCORE": {4, cmdZRemRangeByScore, firstKey},
+
+		// streams
+		"XADD":       {-5, cmdXAdd, firstKey},
+		"XLEN":       {2, cmdXLen, readOnly},
+		"XRANGE":     {-4, cmdXRange(false), readOnly},
+		"XREVRANGE":  {-4, cmdXRange(true), readOnly},
+		"XDEL":       {-3, cmdXDel, firstKey},
+		"XTRIM":      {-4, cmdXTrim, firstKey},
+		"XREAD":      {-4, cmdXRead, readOnly},
+		"XREADGROUP": {-7, cmdXReadGroup, readOnly},
+		"XACK":       {-4, cmdXAck, firstKey},
+		"XGROUP":     {-2, cmdXGroup, keyRange{2, 2, 1}},
+		"XPENDING":   {-3, cmdXPending, readOnly},
+	}
+}
+
+// ExecRedis runs a command on the keyspace. ok is false for commands the
+// keyspace does not implement, which the mock then treats as stubs.
+func ExecRedis(db int, command string, args []string) (reply RESPValue, ok bool) {
+	c, ok := redisCommands[strings.ToUpper(command)]
+	if !ok {
+		return RESPValue{}, false
+	}
+	if reply, bad := CheckRedisArity(command, args); bad {
+		return reply, true
+	}
+	argv := append([]string{command}, args...)
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	useDB(db)
+	reply = c.run(argv)
+	if reply.Type != RESPError {
+		for _, k := range c.writes.keys(argv) {
+			touch(k)
+		}
+	}
+	return reply, true
+}
+
+// CheckRedisArity returns the error reply for a keyspace command sent with
+// the wrong number of arguments, so that MULTI can reject it when queued.
+func CheckRedisArity(command string, args []string) (RESPValue, bool) {
+	c, ok := redisCommands[strings.ToUpper(command)]
+	n := len(args) + 1
+	if !ok || (c.arity > 0 && n == c.arity) || (c.arity < 0 && n >= -c.arity) {
+		return RESPValue{}, false
+	}
+	return errWrongArgs(command), true
+}
+
+// ---- Replies -------------------------------------------------------------
+
+var (
+	replyOK       = RESPValue{Type: RESPSimple, Value: "OK"}
+	replyNull     = RESPValue{Type: RESPNull}
+	errWrongType  = redisError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInteger = redisError("ERR value is not an integer or out of range")
+	errNotFloat   = redisError("ERR value is not a valid float")
+	errSyntax     = redisError("ERR syntax error")
+)
+
+func redisError(msg string) RESPValue {
+	return RESPValue{Type: RESPError, Value: msg}
+}
+
+func errWrongArgs(command string) RESPValue {
+	return redisError("ERR wrong number of arguments for '" + strings.ToLower(command) + "' command")
+}
+
+// Integers are kept as strings so that replies beyond 2^53 stay exact.
+func replyInt(n int64) RESPValue {
+	return RESPValue{Type: RESPInteger, Value: strconv.FormatInt(n, 10)}
+}
+
+func replyBulk(s string) RESPValue {
+	return RESPValue{Type: RESPBulk, Value: s}
+}
+
+func replyBool(b bool) RESPValue {
+	if b {
+		return replyInt(1)
+	}
+	return replyInt(0)
+}
+
+func replyStrings(list []string) RESPValue {
+	out := make([]interface{}, len(list))
+	for i, s := range list {
+		out[i] = s
+	}
+	return RESPValue{Type: RESPArray, Value: out}
+}
+
+// ---- Access --------------------------------------------------------------
+
+// get returns a key's value, or errWrongType when it holds another type.
+func get(key, typ string) (*redisValue, *RESPValue) {
+	v := lookupKey(key)
+	if v != nil && v.typ != typ {
+		return nil, &errWrongType
+	}
+	return v, nil
+}
+
+// getOrCreate returns a key's value, creating an empty one of typ.
+func getOrCreate(key, typ string) (*redisValue, *RESPValue) {
+	v, errReply := get(key, typ)
+	if errReply != nil || v != nil {
+		return v, errReply
+	}
+	v = &redisValue{typ: typ}
+	switch typ {
+	case RedisHash:
+		v.hash = map[string]string{}
+	case RedisSet:
+		v.set = map[string]bool{}
+	case RedisZSet:
+		v.zset = map[string]float64{}
+	}
+	keyspace[key] = v
+	return v, nil
+}
+
+// dropIfEmpty deletes a key whose hash, list, set or sorted set became
+// empty. Strings and streams stay.
+func dropIfEmpty(key string, v *redisValue) {
+	if len(v.hash)+len(v.list)+len(v.set)+len(v.zset) == 0 && v.typ != RedisString && v.typ != RedisStream {
+		delete(keyspace, key)
+	}
+}
+
+func parseInt(s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+func parseFloat(s string) (float64, bool) {
+	switch strings.ToLower(s) {
+	case "inf", "+inf":
+		return math.Inf(1), true
+	case "-inf":
+		return math.Inf(-1), true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil && !math.IsNaN(f)
+}
+
+// ---- Keys ----------------------------------------------------------------
+
+func cmdDel(a []string) RESPValue {
+	n := 0
+	for _, k := range a[1:] {
+		if lookupKey(k) != nil {
+			delete(keyspace, k)
+			n++
+		}
+	}
+	return replyInt(int64(n))
+}
+
+func cmdExists(a []string) RESPValue {
+	n := 0
+	for _, k := range a[1:] {
+		if lookupKey(k) != nil {
+			n++
+		}
+	}
+	return replyInt(int64(n))
+}
+
+func cmdType(a []string) RESPValue {
+	if v := lookupKey(a[1]); v != nil {
+		return RESPValue{Type: RESPSimple, Value: v.typ}
+	}
+	return RESPValue{Type: RESPSimple, Value: "none"}
+}
+
+// cmdExpire implements EXPIRE and its variants, with the NX, XX, GT and LT
+// conditions. A time in the past deletes the key.
+func cmdExpire(unit time.Duration, at bool) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		n, ok := parseInt(a[2])
+		if !ok {
+			return errNotInteger
+		}
+		v := lookupKey(a[1])
+		if v == nil {
+			return replyInt(0)
+		}
+		when := time.Now().Add(time.Duration(n) * unit)
+		if at {
+			when = time.Unix(0, 0).Add(time.Duration(n) * unit)
+		}
+		for _, opt := range a[3:] {
+			var skip bool
+			switch strings.ToUpper(opt) {
+			case "NX":
+				skip = !v.expires.IsZero()
+			case "XX":
+				skip = v.expires.IsZero()
+			case "GT":
+				skip = v.expires.IsZero() || !when.After(v.expires)
+			case "LT":
+				skip = !v.expires.IsZero() && !when.Before(v.expires)
+			default:
+				return redisError("ERR Unsupported option " + opt)
+			}
+			if skip {
+				return replyInt(0)
+			}
+		}
+		if !when.After(time.Now()) {
+			delete(keyspace, a[1])
+			return replyInt(1)
+		}
+		v.expires = when
+		return replyInt(1)
+	}
+}
+
+func cmdTTL(unit time.Duration) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		v := lookupKey(a[1])
+		switch {
+		case v == nil:
+			return replyInt(-2)
+		case v.expires.IsZero():
+			return replyInt(-1)
+		}
+		left := time.Until(v.expires)
+		// Round up, as Redis does, so a live key never reports 0 seconds
+		return replyInt(int64((left + unit - 1) / unit))
+	}
+}
+
+func cmdPersist(a []string) RESPValue {
+	v := lookupKey(a[1])
+	if v == nil || v.expires.IsZero() {
+		return replyInt(0)
+	}
+	v.expires = time.Time{}
+	return replyInt(1)
+}
+
+func cmdKeys(a []string) RESPValue {
+	var out []string
+	for _, k := range liveKeys() {
+		if RedisGlob(a[1], k) {
+			out = append(out, k)
+		}
+	}
+	return replyStrings(out)
+}
+
+// cmdScan walks the keys in sorted order; the cursor is the position of the
+// next key, and 0 once every key was returned.
+func cmdScan(a []string) RESPValue {
+	cursor, ok := parseInt(a[1])
+	if !ok || cursor < 0 {
+		return redisError("ERR invalid cursor")
+	}
+	pattern, typ, count := "*", "", int64(10)
+	for i := 2; i < len(a); i += 2 {
+		if i+1 >= len(a) {
+			return errSyntax
+		}
+		switch strings.ToUpper(a[i]) {
+		case "MATCH":
+			pattern = a[i+1]
+		case "COUNT":
+			if count, ok = parseInt(a[i+1]); !ok {
+				return errNotInteger
+			}
+			if count < 1 {
+				return errSyntax
+			}
+		case "TYPE":
+			typ = strings.ToLower(a[i+1])
+		default:
+			return errSyntax
+		}
+	}
+	keys := liveKeys()
+	var out []string
+	next := cursor
+	for ; next < int64(len(keys)) && next < cursor+count; next++ {
+		k := keys[next]
+		if RedisGlob(pattern, k) && (typ == "" || keyspace[k].typ == typ) {
+			out = append(out, k)
+		}
+	}
+	if next >= int64(len(keys)) {
+		next = 0
+	}
+	return RESPValue{Type: RESPArray, Value: []interface{}{
+		strconv.FormatInt(next, 10),
+		replyStrings(out),
+	}}
+}
+
+func cmdRename(nx bool) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		v := lookupKey(a[1])
+		if v == nil {
+			return redisError("ERR no such key")
+		}
+		if nx {
+			if lookupKey(a[2]) != nil {
+				return replyInt(0)
+			}
+		}
+		delete(keyspace, a[1])
+		keyspace[a[2]] = v
+		if nx {
+			return replyInt(1)
+		}
+		return replyOK
+	}
+}
+
+func cmdDBSize(a []string) RESPValue {
+	return replyInt(int64(len(liveKeys())))
+}
+
+func cmdFlushDB(a []string) RESPValue {
+	flushDB()
+	return replyOK
+}
+
+func cmdFlushAll(a []string) RESPValue {
+	flushAll()
+	return replyOK
+}
+
+// ---- Strings -------------------------------------------------------------
+
+func cmdGet(a []string) RESPValue {
+	v, errReply := get(a[1], RedisString)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyNull
+	}
+	return replyBulk(v.str)
+}
+
+// setString stores a string, keeping the key's TTL only when keepTTL.
+func setString(key, s string, expires time.Time, keepTTL bool) {
+	if old := lookupKey(key); old != nil && keepTTL {
+		expires = old.expires
+	}
+	keyspace[key] = &redisValue{typ: RedisString, str: s, expires: expires}
+}
+
+// cmdSet implements SET with NX, XX, GET, KEEPTTL and the EX, PX, EXAT and
+// PXAT expiries.
+func cmdSet(a []string) RESPValue {
+	var nx, xx, getOld, keepTTL, hasExpiry bool
+	var expires time.Time
+	for i := 3; i < len(a); i++ {
+		opt := strings.ToUpper(a[i])
+		switch opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			getOld = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpiry || i+1 >= len(a) {
+				return errSyntax
+			}
+			i++
+			n, ok := parseInt(a[i])
+			if !ok {
+				return errNotInteger
+			}
+			if n <= 0 {
+				return redisError("ERR invalid expire time in 'set' command")
+			}
+			hasExpiry = true
+			switch opt {
+			case "EX":
+				expires = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				expires = time.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EXAT":
+				expires = time.Unix(n, 0)
+			case "PXAT":
+				expires = time.UnixMilli(n)
+			}
+		default:
+			return errSyntax
+		}
+	}
+	if (nx && xx) || (keepTTL && hasExpiry) {
+		return errSyntax
+	}
+	old, errReply := get(a[1], RedisString)
+	if getOld && errReply != nil {
+		return *errReply
+	}
+	reply := replyOK
+	if getOld {
+		reply = replyNull
+		if old != nil {
+			reply = replyBulk(old.str)
+		}
+	}
+	exists := lookupKey(a[1]) != nil
+	if (nx && exists) || (xx && !exists) {
+		if getOld {
+			return reply
+		}
+		return replyNull
+	}
+	setString(a[1], a[2], expires, keepTTL)
+	return reply
+}
+
+func cmdSetNX(a []string) RESPValue {
+	if lookupKey(a[1]) != nil {
+		return replyInt(0)
+	}
+	setString(a[1], a[2], time.Time{}, false)
+	return replyInt(1)
+}
+
+func cmdSetEx(unit time.Duration) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		n, ok := parseInt(a[2])
+		if !ok {
+			return errNotInteger
+		}
+		if n <= 0 {
+			return redisError("ERR invalid expire time in '" + strings.ToLower(a[0]) + "' command")
+		}
+		setString(a[1], a[3], time.Now().Add(time.Duration(n)*unit), false)
+		return replyOK
+	}
+}
+
+func cmdGetSet(a []string) RESPValue {
+	reply := cmdGet(a)
+	if reply.Type == RESPError {
+		return reply
+	}
+	setString(a[1], a[2], time.Time{}, false)
+	return reply
+}
+
+func cmdGetDel(a []string) RESPValue {
+	reply := cmdGet(a)
+	if reply.Type == RESPBulk {
+		delete(keyspace, a[1])
+	}
+	return reply
+}
+
+func cmdMGet(a []string) RESPValue {
+	out := make([]interface{}, len(a)-1)
+	for i, k := range a[1:] {
+		if v := lookupKey(k); v != nil && v.typ == RedisString {
+			out[i] = v.str
+		}
+	}
+	return RESPValue{Type: RESPArray, Value: out}
+}
+
+func cmdMSet(nx bool) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		if len(a)%2 == 0 {
+			return errWrongArgs(a[0])
+		}
+		if nx {
+			for i := 1; i < len(a); i += 2 {
+				if lookupKey(a[i]) != nil {
+					return replyInt(0)
+				}
+			}
+		}
+		for i := 1; i < len(a); i += 2 {
+			setString(a[i], a[i+1], time.Time{}, false)
+		}
+		if nx {
+			return replyInt(1)
+		}
+		return replyOK
+	}
+}
+
+// incrBy adds to the integer stored at key, keeping its TTL.
+func incrBy(key string, by int64) RESPValue {
+	v, errReply := get(key, RedisString)
+	if errReply != nil {
+		return *errReply
+	}
+	var n int64
+	if v != nil {
+		var ok bool
+		if n, ok = parseInt(v.str); !ok {
+			return errNotInteger
+		}
+	}
+	if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+		return redisError("ERR increment or decrement would overflow")
+	}
+	n += by
+	setString(key, strconv.FormatInt(n, 10), time.Time{}, true)
+	return replyInt(n)
+}
+
+func cmdIncrBy(sign int64) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		by, ok := parseInt(a[2])
+		if !ok {
+			return errNotInteger
+		}
+		if sign < 0 && by == math.MinInt64 {
+			// Negating it would overflow
+			return redisError("ERR decrement would overflow")
+		}
+		return incrBy(a[1], sign*by)
+	}
+}
+
+func cmdIncrByFloat(a []string) RESPValue {
+	by, ok := parseFloat(a[2])
+	if !ok {
+		return errNotFloat
+	}
+	v, errReply := get(a[1], RedisString)
+	if errReply != nil {
+		return *errReply
+	}
+	var f float64
+	if v != nil {
+		if f, ok = parseFloat(v.str); !ok {
+			return errNotFloat
+		}
+	}
+	f += by
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return redisError("ERR increment would produce NaN or Infinity")
+	}
+	s := FormatRedisFloat(f)
+	setString(a[1], s, time.Time{}, true)
+	return replyBulk(s)
+}
+
+func cmdAppend(a []string) RESPValue {
+	v, errReply := get(a[1], RedisString)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		setString(a[1], a[2], time.Time{}, false)
+		return replyInt(int64(len(a[2])))
+	}
+	v.str += a[2]
+	return replyInt(int64(len(v.str)))
+}
+
+func cmdStrlen(a []string) RESPValue {
+	v, errReply := get(a[1], RedisString)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	return replyInt(int64(len(v.str)))
+}
+
+// ---- Hashes --------------------------------------------------------------
+
+func cmdHGet(a []string) RESPValue {
+	v, errReply := get(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyNull
+	}
+	if x, ok := v.hash[a[2]]; ok {
+		return replyBulk(x)
+	}
+	return replyNull
+}
+
+// cmdHSet implements HSET, which replies with the number of new fields, and
+// HMSET, which replies OK.
+func cmdHSet(a []string) RESPValue {
+	if len(a)%2 != 0 {
+		return errWrongArgs(a[0])
+	}
+	v, errReply := getOrCreate(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	added := 0
+	for i := 2; i < len(a); i += 2 {
+		if _, ok := v.hash[a[i]]; !ok {
+			added++
+		}
+		v.hash[a[i]] = a[i+1]
+	}
+	if strings.EqualFold(a[0], "HMSET") {
+		return replyOK
+	}
+	return replyInt(int64(added))
+}
+
+func cmdHSetNX(a []string) RESPValue {
+	v, errReply := getOrCreate(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	if _, ok := v.hash[a[2]]; ok {
+		return replyInt(0)
+	}
+	v.hash[a[2]] = a[3]
+	return replyInt(1)
+}
+
+// cmdHGetAll replies with a map, sent to RESP2 clients as a flat array of
+// fields and values.
+func cmdHGetAll(a []string) RESPValue {
+	v, errReply := get(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	pairs := []interface{}{}
+	if v != nil {
+		for _, f := range sortedKeys(v.hash) {
+			pairs = append(pairs, []interface{}{f, v.hash[f]})
+		}
+	}
+	return RESPValue{Type: RESPMap, Value: pairs}
+}
+
+func cmdHMGet(a []string) RESPValue {
+	v, errReply := get(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	out := make([]interface{}, len(a)-2)
+	for i, f := range a[2:] {
+		if x, ok := v.hashField(f); ok {
+			out[i] = x
+		}
+	}
+	return RESPValue{Type: RESPArray, Value: out}
+}
+
+func (v *redisValue) hashField(f string) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	x, ok := v.hash[f]
+	return x, ok
+}
+
+func cmdHDel(a []string) RESPValue {
+	v, errReply := get(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	n := 0
+	for _, f := range a[2:] {
+		if _, ok := v.hash[f]; ok {
+			delete(v.hash, f)
+			n++
+		}
+	}
+	dropIfEmpty(a[1], v)
+	return replyInt(int64(n))
+}
+
+func cmdHExists(a []string) RESPValue {
+	v, errReply := get(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	_, ok := v.hashField(a[2])
+	return replyBool(ok)
+}
+
+func cmdHLen(a []string) RESPValue {
+	v, errReply := get(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	return replyInt(int64(len(v.hash)))
+}
+
+func cmdHKeys(keys bool) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		v, errReply := get(a[1], RedisHash)
+		if errReply != nil {
+			return *errReply
+		}
+		var out []string
+		if v != nil {
+			for _, f := range sortedKeys(v.hash) {
+				if keys {
+					out = append(out, f)
+				} else {
+					out = append(out, v.hash[f])
+				}
+			}
+		}
+		return replyStrings(out)
+	}
+}
+
+func cmdHIncrBy(a []string) RESPValue {
+	by, ok := parseInt(a[3])
+	if !ok {
+		return errNotInteger
+	}
+	v, errReply := getOrCreate(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	var n int64
+	if x, exists := v.hash[a[2]]; exists {
+		if n, ok = parseInt(x); !ok {
+			dropIfEmpty(a[1], v)
+			return redisError("ERR hash value is not an integer")
+		}
+	}
+	if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+		dropIfEmpty(a[1], v)
+		return redisError("ERR increment or decrement would overflow")
+	}
+	n += by
+	v.hash[a[2]] = strconv.FormatInt(n, 10)
+	return replyInt(n)
+}
+
+func cmdHIncrByFloat(a []string) RESPValue {
+	by, ok := parseFloat(a[3])
+	if !ok {
+		return errNotFloat
+	}
+	v, errReply := getOrCreate(a[1], RedisHash)
+	if errReply != nil {
+		return *errReply
+	}
+	var f float64
+	if x, exists := v.hash[a[2]]; exists {
+		if f, ok = parseFloat(x); !ok {
+			return redisError("ERR hash value is not a float")
+		}
+	}
+	f += by
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		dropIfEmpty(a[1], v)
+		return redisError("ERR increment would produce NaN or Infinity")
+	}
+	s := FormatRedisFloat(f)
+	v.hash[a[2]] = s
+	return replyBulk(s)
+}
+
+func sortedKeys(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ---- Lists ---------------------------------------------------------------
+
+func cmdPush(left bool) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		v, errReply := getOrCreate(a[1], RedisList)
+		if errReply != nil {
+			return *errReply
+		}
+		for _, x := range a[2:] {
+			if left {
+				v.list = append([]string{x}, v.list...)
+			} else {
+				v.list = append(v.list, x)
+			}
+		}
+		return replyInt(int64(len(v.list)))
+	}
+}
+
+// cmdPop implements LPOP and RPOP: one element, or with a count an array of
+// up to count elements.
+func cmdPop(left bool) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		if len(a) > 3 {
+			return errWrongArgs(a[0])
+		}
+		count := int64(1)
+		if len(a) == 3 {
+			var ok bool
+			if count, ok = parseInt(a[2]); !ok || count < 0 {
+				return redisError("ERR value is out of range, must be positive")
+			}
+		}
+		v, errReply := get(a[1], RedisList)
+		if errReply != nil {
+			return *errReply
+		}
+		if v == nil {
+			return replyNull
+		}
+		n := int(min(count, int64(len(v.list))))
+		var popped []string
+		if left {
+			popped = append(popped, v.list[:n]...)
+			v.list = v.list[n:]
+		} else {
+			for i := 0; i < n; i++ {
+				popped = append(popped, v.list[len(v.list)-1-i])
+			}
+			v.list = v.list[:len(v.list)-n]
+		}
+		dropIfEmpty(a[1], v)
+		if len(a) == 3 {
+			return replyStrings(popped)
+		}
+		return replyBulk(popped[0])
+	}
+}
+
+func cmdLLen(a []string) RESPValue {
+	v, errReply := get(a[1], RedisList)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	return replyInt(int64(len(v.list)))
+}
+
+// listRange resolves Redis start and stop indexes, which may be negative,
+// into a slice range of a list of n elements.
+func listRange(start, stop int64, n int) (int, int) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	start = max(start, 0)
+	stop = min(stop, int64(n)-1)
+	if start > stop {
+		return 0, 0
+	}
+	return int(start), int(stop) + 1
+}
+
+func cmdLRange(a []string) RESPValue {
+	start, ok1 := parseInt(a[2])
+	stop, ok2 := parseInt(a[3])
+	if !ok1 || !ok2 {
+		return errNotInteger
+	}
+	v, errReply := get(a[1], RedisList)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyStrings(nil)
+	}
+	from, to := listRange(start, stop, len(v.list))
+	return replyStrings(v.list[from:to])
+}
+
+func listIndex(v *redisValue, s string) (int, bool) {
+	i, _ := parseInt(s)
+	if i < 0 {
+		i += int64(len(v.list))
+	}
+	return int(i), i >= 0 && i < int64(len(v.list))
+}
+
+func cmdLIndex(a []string) RESPValue {
+	if _, ok := parseInt(a[2]); !ok {
+		return errNotInteger
+	}
+	v, errReply := get(a[1], RedisList)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyNull
+	}
+	if i, ok := listIndex(v, a[2]); ok {
+		return replyBulk(v.list[i])
+	}
+	return replyNull
+}
+
+func cmdLSet(a []string) RESPValue {
+	if _, ok := parseInt(a[2]); !ok {
+		return errNotInteger
+	}
+	v, errReply := get(a[1], RedisList)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return redisError("ERR no such key")
+	}
+	i, ok := listIndex(v, a[2])
+	if !ok {
+		return redisError("ERR index out of range")
+	}
+	v.list[i] = a[3]
+	return replyOK
+}
+
+// cmdLRem removes count occurrences of an element: from the head when count
+// is positive, from the tail when negative, all of them when 0.
+func cmdLRem(a []string) RESPValue {
+	count, ok := parseInt(a[2])
+	if !ok {
+		return errNotInteger
+	}
+	v, errReply := get(a[1], RedisList)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	removed := int64(0)
+	keep := make([]string, len(v.list))
+	copy(keep, v.list)
+	drop := make([]bool, len(v.list))
+	for n := 0; n < len(v.list) && (limit == 0 || removed < limit); n++ {
+		i := n
+		if count < 0 {
+			i = len(v.list) - 1 - n
+		}
+		if v.list[i] == a[3] {
+			drop[i] = true
+			removed++
+		}
+	}
+	v.list = v.list[:0]
+	for i, x := range keep {
+		if !drop[i] {
+			v.list = append(v.list, x)
+		}
+	}
+	dropIfEmpty(a[1], v)
+	return replyInt(removed)
+}
+
+func cmdLTrim(a []string) RESPValue {
+	start, ok1 := parseInt(a[2])
+	stop, ok2 := parseInt(a[3])
+	if !ok1 || !ok2 {
+		return errNotInteger
+	}
+	v, errReply := get(a[1], RedisList)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyOK
+	}
+	from, to := listRange(start, stop, len(v.list))
+	v.list = append([]string{}, v.list[from:to]...)
+	dropIfEmpty(a[1], v)
+	return replyOK
+}
+
+// ---- Sets ----------------------------------------------------------------
+
+func cmdSAdd(a []string) RESPValue {
+	v, errReply := getOrCreate(a[1], RedisSet)
+	if errReply != nil {
+		return *errReply
+	}
+	n := 0
+	for _, m := range a[2:] {
+		if !v.set[m] {
+			v.set[m] = true
+			n++
+		}
+	}
+	return replyInt(int64(n))
+}
+
+func cmdSRem(a []string) RESPValue {
+	v, errReply := get(a[1], RedisSet)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	n := 0
+	for _, m := range a[2:] {
+		if v.set[m] {
+			delete(v.set, m)
+			n++
+		}
+	}
+	dropIfEmpty(a[1], v)
+	return replyInt(int64(n))
+}
+
+func replySet(set map[string]bool) RESPValue {
+	reply := replyStrings(setMembers(set))
+	reply.Type = RESPSet
+	return reply
+}
+
+func cmdSMembers(a []string) RESPValue {
+	v, errReply := get(a[1], RedisSet)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replySet(nil)
+	}
+	return replySet(v.set)
+}
+
+func cmdSIsMember(a []string) RESPValue {
+	v, errReply := get(a[1], RedisSet)
+	if errReply != nil {
+		return *errReply
+	}
+	return replyBool(v != nil && v.set[a[2]])
+}
+
+func cmdSCard(a []string) RESPValue {
+	v, errReply := get(a[1], RedisSet)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	return replyInt(int64(len(v.set)))
+}
+
+func cmdSCombine(op string) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		var out map[string]bool
+		for n, k := range a[1:] {
+			v, errReply := get(k, RedisSet)
+			if errReply != nil {
+				return *errReply
+			}
+			var members map[string]bool
+			if v != nil {
+				members = v.set
+			}
+			if n == 0 {
+				out = map[string]bool{}
+				for m := range members {
+					out[m] = true
+				}
+				continue
+			}
+			for m := range out {
+				if (op == "inter" && !members[m]) || (op == "diff" && members[m]) {
+					delete(out, m)
+				}
+			}
+			if op == "union" {
+				for m := range members {
+					out[m] = true
+				}
+			}
+		}
+		return replySet(out)
+	}
+}
+
+// ---- Sorted sets ---------------------------------------------------------
+
+type zmember struct {
+	member string
+	score  float64
+}
+
+// sortedZSet returns the members by score, then member.
+func sortedZSet(v *redisValue) []zmember {
+	if v == nil {
+		return nil
+	}
+	out := make([]zmember, 0, len(v.zset))
+	for m, s := range v.zset {
+		out = append(out, zmember{m, s})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].score != out[j].score {
+			return out[i].score < out[j].score
+		}
+		return out[i].member < out[j].member
+	})
+	return out
+}
+
+// replyScore is a double, kept as a string so that inf survives JSON.
+func replyScore(f float64) RESPValue {
+	return RESPValue{Type: RESPDouble, Value: FormatRedisFloat(f)}
+}
+
+// cmdZAdd implements ZADD with the NX, XX, GT, LT, CH and INCR options.
+func cmdZAdd(a []string) RESPValue {
+	var nx, xx, gt, lt, ch, incr bool
+	i := 2
+options:
+	for ; i < len(a); i++ {
+		switch strings.ToUpper(a[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := a[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errSyntax
+	}
+	if nx && xx {
+		return redisError("ERR XX and NX options at the same time are not compatible")
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return redisError("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) != 2 {
+		return redisError("ERR INCR option supports a single increment-element pair")
+	}
+	scores := make([]float64, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		s, ok := parseFloat(pairs[j])
+		if !ok {
+			return errNotFloat
+		}
+		scores = append(scores, s)
+	}
+	v, errReply := getOrCreate(a[1], RedisZSet)
+	if errReply != nil {
+		return *errReply
+	}
+	added, changed := 0, 0
+	for j, s := range scores {
+		m := pairs[2*j+1]
+		old, exists := v.zset[m]
+		if incr && exists {
+			s += old
+		}
+		if (nx && exists) || (xx && !exists) || (exists && ((gt && s <= old) || (lt && s >= old))) {
+			if incr {
+				dropIfEmpty(a[1], v)
+				return replyNull
+			}
+			continue
+		}
+		if !exists {
+			added++
+		} else if s != old {
+			changed++
+		}
+		v.zset[m] = s
+		if incr {
+			return replyScore(s)
+		}
+	}
+	dropIfEmpty(a[1], v)
+	if ch {
+		return replyInt(int64(added + changed))
+	}
+	return replyInt(int64(added))
+}
+
+func cmdZIncrBy(a []string) RESPValue {
+	by, ok := parseFloat(a[2])
+	if !ok {
+		return errNotFloat
+	}
+	v, errReply := getOrCreate(a[1], RedisZSet)
+	if errReply != nil {
+		return *errReply
+	}
+	v.zset[a[3]] += by
+	return replyScore(v.zset[a[3]])
+}
+
+func cmdZRem(a []string) RESPValue {
+	v, errReply := get(a[1], RedisZSet)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	n := 0
+	for _, m := range a[2:] {
+		if _, ok := v.zset[m]; ok {
+			delete(v.zset, m)
+			n++
+		}
+	}
+	dropIfEmpty(a[1], v)
+	return replyInt(int64(n))
+}
+
+func cmdZScore(a []string) RESPValue {
+	v, errReply := get(a[1], RedisZSet)
+	if errReply != nil {
+		return *errReply
+	}
+	if v != nil {
+		if s, ok := v.zset[a[2]]; ok {
+			return replyScore(s)
+		}
+	}
+	return replyNull
+}
+
+func cmdZCard(a []string) RESPValue {
+	v, errReply := get(a[1], RedisZSet)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	return replyInt(int64(len(v.zset)))
+}
+
+// scoreBound is a ZRANGEBYSCORE bound: a score, -inf, +inf, or a score
+// prefixed with ( to exclude it.
+type scoreBound struct {
+	score     float64
+	exclusive bool
+}
+
+func parseScoreBound(s string) (scoreBound, bool) {
+	b := scoreBound{}
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+	f, ok := parseFloat(s)
+	b.score = f
+	return b, ok
+}
+
+func (b scoreBound) below(f float64) bool { // b <= f
+	return b.score < f || (b.score == f && !b.exclusive)
+}
+
+func (b scoreBound) above(f float64) bool { // f <= b
+	return f < b.score || (f == b.score && !b.exclusive)
+}
+
+func cmdZCount(a []string) RESPValue {
+	lo, ok1 := parseScoreBound(a[2])
+	hi, ok2 := parseScoreBound(a[3])
+	if !ok1 || !ok2 {
+		return redisError("ERR min or max is not a float")
+	}
+	v, errReply := get(a[1], RedisZSet)
+	if errReply != nil {
+		return *errReply
+	}
+	n := 0
+	for _, z := range sortedZSet(v) {
+		if lo.below(z.score) && hi.above(z.score) {
+			n++
+		}
+	}
+	return replyInt(int64(n))
+}
+
+func cmdZRank(rev bool) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		v, errReply := get(a[1], RedisZSet)
+		if errReply != nil {
+			return *errReply
+		}
+		members := sortedZSet(v)
+		for i, z := range members {
+			if z.member == a[2] {
+				if rev {
+					i = len(members) - 1 - i
+				}
+				return replyInt(int64(i))
+			}
+		}
+		return replyNull
+	}
+}
+
+// cmdZRange implements ZRANGE with BYSCORE, REV, LIMIT and WITHSCORES, and
+// the older ZREVRANGE, ZRANGEBYSCORE and ZREVRANGEBYSCORE, which imply some
+// of them. Scores come as a flat array after each member.
+func cmdZRange(implied string) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		byScore := strings.Contains(implied, "BYSCORE")
+		rev := strings.Contains(implied, "REV")
+		withScores := false
+		offset, count := int64(0), int64(-1)
+		limited := false
+		for i := 4; i < len(a); i++ {
+			switch strings.ToUpper(a[i]) {
+			case "BYSCORE":
+				byScore = true
+			case "REV":
+				rev = true
+			case "WITHSCORES":
+				withScores = true
+			case "LIMIT":
+				if i+2 >= len(a) {
+					return errSyntax
+				}
+				var ok1, ok2 bool
+				offset, ok1 = parseInt(a[i+1])
+				count, ok2 = parseInt(a[i+2])
+				if !ok1 || !ok2 {
+					return errNotInteger
+				}
+				limited = true
+				i += 2
+			default:
+				return errSyntax
+			}
+		}
+		if limited && !byScore {
+			return redisError("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+		}
+		v, errReply := get(a[1], RedisZSet)
+		if errReply != nil {
+			return *errReply
+		}
+		members := sortedZSet(v)
+		if rev {
+			for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+				members[i], members[j] = members[j], members[i]
+			}
+		}
+		var picked []zmember
+		if byScore {
+			lo, ok1 := parseScoreBound(a[2])
+			hi, ok2 := parseScoreBound(a[3])
+			if !ok1 || !ok2 {
+				return redisError("ERR min or max is not a float")
+			}
+			if rev {
+				lo, hi = hi, lo
+			}
+			for _, z := range members {
+				if lo.below(z.score) && hi.above(z.score) {
+					picked = append(picked, z)
+				}
+			}
+			if offset < 0 || offset >= int64(len(picked)) {
+				picked = nil
+			} else {
+				picked = picked[offset:]
+				if count >= 0 && count < int64(len(picked)) {
+					picked = picked[:count]
+				}
+			}
+		} else {
+			start, ok1 := parseInt(a[2])
+			stop, ok2 := parseInt(a[3])
+			if !ok1 || !ok2 {
+				return errNotInteger
+			}
+			from, to := listRange(start, stop, len(members))
+			picked = members[from:to]
+		}
+		out := []interface{}{}
+		for _, z := range picked {
+			out = append(out, z.member)
+			if withScores {
+				out = append(out, FormatRedisFloat(z.score))
+			}
+		}
+		return RESPValue{Type: RESPArray, Value: out}
+	}
+}
+
+func cmdZRemRangeByRank(a []string) RESPValue {
+	start, ok1 := parseInt(a[2])
+	stop, ok2 := parseInt(a[3])
+	if !ok1 || !ok2 {
+		return errNotInteger
+	}
+	v, errReply := get(a[1], RedisZSet)
+	if errReply != nil {
+		return *errReply
+	}
+	members := sortedZSet(v)
+	from, to := listRange(start, stop, len(members))
+	for _, z := range members[from:to] {
+		delete(v.zset, z.member)
+	}
+	if v != nil {
+		dropIfEmpty(a[1], v)
+	}
+	return replyInt(int64(to - from))
+}
+
+func cmdZRemRangeByScore(a []string) RESPValue {
+	lo, ok1 := parseScoreBound(a[2])
+	hi, ok2 := parseScoreBound(a[3])
+	if !ok1 || !ok2 {
+		return redisError("ERR min or max is not a float")
+	}
+	v, errReply := get(a[1], RedisZSet)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	n := 0
+	for m, s := range v.zset {
+		if lo.below(s) && hi.above(s) {
+			delete(v.zset, m)
+			n++
+		}
+	}
+	dropIfEmpty(a[1], v)
+	return replyInt(int64(n))
+}
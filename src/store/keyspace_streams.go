@@ -0,0 +1,830 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Streams ---------------------------------------------------------------
+
+// Stream commands are always run on the keyspace, stateful mode or not, so
+// that a test can script a sequence of events for a consumer to read.
+
+const RedisStream = "stream"
+
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+// parseStreamID reads "ms-seq" or "ms"; a missing seq is missingSeq.
+func parseStreamID(s string, missingSeq uint64) (streamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, true
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	return streamID{ms, seq}, err == nil
+}
+
+// parseRangeID reads an XRANGE bound: - and + for the ends, ( to exclude.
+func parseRangeID(s string, start bool) (id streamID, ok bool) {
+	switch s {
+	case "-":
+		return streamID{}, true
+	case "+":
+		return streamID{math.MaxUint64, math.MaxUint64}, true
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	missing := uint64(0)
+	if !start {
+		missing = math.MaxUint64
+	}
+	if id, ok = parseStreamID(s, missing); !ok || !exclusive {
+		return id, ok
+	}
+	if start {
+		return id.next()
+	}
+	return id.prev()
+}
+
+func (id streamID) next() (streamID, bool) {
+	if id.seq == math.MaxUint64 {
+		return streamID{id.ms + 1, 0}, id.ms != math.MaxUint64
+	}
+	return streamID{id.ms, id.seq + 1}, true
+}
+
+func (id streamID) prev() (streamID, bool) {
+	if id.seq == 0 {
+		return streamID{id.ms - 1, math.MaxUint64}, id.ms != 0
+	}
+	return streamID{id.ms, id.seq - 1}, true
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string // field, value, field, value, …
+}
+
+type redisStream struct {
+	entries []streamEntry
+	lastID  streamID
+	groups  map[string]*streamGroup
+}
+
+type streamGroup struct {
+	lastDelivered streamID
+	consumers     map[string]bool
+	pending       map[streamID]*pendingEntry
+}
+
+type pendingEntry struct {
+	consumer    string
+	deliveries  int64
+	deliveredAt time.Time
+}
+
+// RedisStreamEntry is a stream entry in a keyspace snapshot. Fields lists
+// field names and values in turn, keeping their order.
+type RedisStreamEntry struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+var streamAdded = make(chan struct{})
+
+// RedisStreamAdded returns a channel closed at the next XADD, for blocking
+// reads to wait on.
+func RedisStreamAdded() <-chan struct{} {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	return streamAdded
+}
+
+// signalStreamAdded wakes blocked readers. Caller holds keyspaceMu.
+func signalStreamAdded() {
+	close(streamAdded)
+	streamAdded = make(chan struct{})
+}
+
+// IsRedisStreamCommand tells the commands run on the keyspace in every mode.
+func IsRedisStreamCommand(command string) bool {
+	switch strings.ToUpper(command) {
+	case "XADD", "XLEN", "XRANGE", "XREVRANGE", "XDEL", "XTRIM", "XREAD", "XREADGROUP", "XACK", "XGROUP", "XPENDING":
+		return true
+	}
+	return false
+}
+
+// RedisBlocking tells whether XREAD or XREADGROUP was sent with BLOCK, and
+// for how long it may wait (0: forever). args comes back with $ resolved to
+// the stream's current last ID, so that retries only see entries added
+// after the command was sent.
+func RedisBlocking(db int, command string, args []string) (timeout time.Duration, retry []string, ok bool) {
+	cmd := strings.ToUpper(command)
+	if cmd != "XREAD" && cmd != "XREADGROUP" {
+		return 0, nil, false
+	}
+	streams := -1
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return 0, nil, false
+			}
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ms < 0 {
+				return 0, nil, false
+			}
+			timeout, ok = time.Duration(ms)*time.Millisecond, true
+			i++
+		case "STREAMS":
+			streams = i + 1
+			i = len(args)
+		case "GROUP":
+			i += 2
+		case "COUNT":
+			i++
+		}
+	}
+	if !ok || streams == -1 || (len(args)-streams)%2 != 0 {
+		return 0, nil, false
+	}
+	retry = append([]string{}, args...)
+	n := (len(args) - streams) / 2
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	useDB(db)
+	for i := 0; i < n; i++ {
+		if retry[streams+n+i] != "$" {
+			continue
+		}
+		last := streamID{}
+		if v := lookupKey(retry[streams+i]); v != nil && v.typ == RedisStream {
+			last = v.stream.lastID
+		}
+		retry[streams+n+i] = last.String()
+	}
+	return timeout, retry, true
+}
+
+// AddRedisStreamEntry appends an entry to a stream in database 0, creating
+// it, and returns its ID. An empty or "*" id is generated.
+func AddRedisStreamEntry(key, id string, fields []string) (string, error) {
+	if id == "" {
+		id = "*"
+	}
+	args := append([]string{"XADD", key, id}, fields...)
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	useDB(0)
+	reply := cmdXAdd(args)
+	if reply.Type == RESPError {
+		return "", fmt.Errorf("%s", reply.Text())
+	}
+	touch(key)
+	return reply.Text(), nil
+}
+
+func streamOf(key string, create bool) (*redisValue, *RESPValue) {
+	v, errReply := get(key, RedisStream)
+	if errReply != nil || v != nil || !create {
+		return v, errReply
+	}
+	v = &redisValue{typ: RedisStream, stream: &redisStream{groups: map[string]*streamGroup{}}}
+	keyspace[key] = v
+	return v, nil
+}
+
+func replyEntry(e streamEntry) interface{} {
+	fields := make([]interface{}, len(e.fields))
+	for i, f := range e.fields {
+		fields[i] = f
+	}
+	return []interface{}{e.id.String(), fields}
+}
+
+func replyEntries(entries []streamEntry) RESPValue {
+	out := make([]interface{}, len(entries))
+	for i, e := range entries {
+		out[i] = replyEntry(e)
+	}
+	return RESPValue{Type: RESPArray, Value: out}
+}
+
+// cmdXAdd implements XADD key [NOMKSTREAM] [MAXLEN [=|~] n] *|id field
+// value ….
+func cmdXAdd(a []string) RESPValue {
+	i := 2
+	noMk, maxLen := false, int64(-1)
+	for ; i < len(a); i++ {
+		switch strings.ToUpper(a[i]) {
+		case "NOMKSTREAM":
+			noMk = true
+			continue
+		case "MAXLEN":
+			if i+1 < len(a) && (a[i+1] == "=" || a[i+1] == "~") {
+				i++
+			}
+			if i+1 >= len(a) {
+				return errSyntax
+			}
+			i++
+			n, ok := parseInt(a[i])
+			if !ok || n < 0 {
+				return errNotInteger
+			}
+			maxLen = n
+			continue
+		}
+		break
+	}
+	if i >= len(a) {
+		return errWrongArgs(a[0])
+	}
+	idArg, fields := a[i], a[i+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return errWrongArgs(a[0])
+	}
+	v, errReply := streamOf(a[1], false)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil && noMk {
+		return replyNull
+	}
+	last := streamID{}
+	if v != nil {
+		last = v.stream.lastID
+	}
+	var id streamID
+	switch {
+	case idArg == "*":
+		ms := uint64(time.Now().UnixMilli())
+		id = streamID{ms, 0}
+		if ms <= last.ms {
+			id = streamID{last.ms, last.seq + 1}
+		}
+	case strings.HasSuffix(idArg, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(idArg, "-*"), 10, 64)
+		if err != nil {
+			return redisError("ERR Invalid stream ID specified as stream command argument")
+		}
+		id = streamID{ms, 0}
+		if ms == last.ms && last != (streamID{}) {
+			id.seq = last.seq + 1
+		}
+	default:
+		var ok bool
+		if id, ok = parseStreamID(idArg, 0); !ok {
+			return redisError("ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+	if id == (streamID{}) {
+		return redisError("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	if !last.less(id) {
+		return redisError("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	v, _ = streamOf(a[1], true)
+	s := v.stream
+	s.entries = append(s.entries, streamEntry{id: id, fields: append([]string{}, fields...)})
+	s.lastID = id
+	if maxLen >= 0 && int64(len(s.entries)) > maxLen {
+		s.entries = s.entries[int64(len(s.entries))-maxLen:]
+	}
+	signalStreamAdded()
+	return replyBulk(id.String())
+}
+
+func cmdXLen(a []string) RESPValue {
+	v, errReply := streamOf(a[1], false)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	return replyInt(int64(len(v.stream.entries)))
+}
+
+// cmdXRange implements XRANGE key start end [COUNT n], and XREVRANGE with
+// end and start swapped.
+func cmdXRange(rev bool) func([]string) RESPValue {
+	return func(a []string) RESPValue {
+		startArg, endArg := a[2], a[3]
+		if rev {
+			startArg, endArg = endArg, startArg
+		}
+		start, ok1 := parseRangeID(startArg, true)
+		end, ok2 := parseRangeID(endArg, false)
+		if !ok1 || !ok2 {
+			return redisError("ERR Invalid stream ID specified as stream command argument")
+		}
+		count := int64(-1)
+		if len(a) > 4 {
+			if len(a) != 6 || !strings.EqualFold(a[4], "COUNT") {
+				return errSyntax
+			}
+			var ok bool
+			if count, ok = parseInt(a[5]); !ok {
+				return errNotInteger
+			}
+		}
+		v, errReply := streamOf(a[1], false)
+		if errReply != nil {
+			return *errReply
+		}
+		var out []streamEntry
+		if v != nil {
+			for _, e := range v.stream.entries {
+				if !e.id.less(start) && !end.less(e.id) {
+					out = append(out, e)
+				}
+			}
+		}
+		if rev {
+			for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+				out[i], out[j] = out[j], out[i]
+			}
+		}
+		if count >= 0 && count < int64(len(out)) {
+			out = out[:count]
+		}
+		return replyEntries(out)
+	}
+}
+
+func cmdXDel(a []string) RESPValue {
+	v, errReply := streamOf(a[1], false)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	drop := map[streamID]bool{}
+	for _, s := range a[2:] {
+		id, ok := parseStreamID(s, 0)
+		if !ok {
+			return redisError("ERR Invalid stream ID specified as stream command argument")
+		}
+		drop[id] = true
+	}
+	kept := v.stream.entries[:0]
+	n := 0
+	for _, e := range v.stream.entries {
+		if drop[e.id] {
+			n++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	v.stream.entries = kept
+	return replyInt(int64(n))
+}
+
+// cmdXTrim implements XTRIM key MAXLEN|MINID [=|~] threshold.
+func cmdXTrim(a []string) RESPValue {
+	strategy := strings.ToUpper(a[2])
+	i := 3
+	if i < len(a) && (a[i] == "=" || a[i] == "~") {
+		i++
+	}
+	if i != len(a)-1 || (strategy != "MAXLEN" && strategy != "MINID") {
+		return errSyntax
+	}
+	v, errReply := streamOf(a[1], false)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil {
+		return replyInt(0)
+	}
+	s := v.stream
+	before := len(s.entries)
+	if strategy == "MAXLEN" {
+		n, ok := parseInt(a[i])
+		if !ok || n < 0 {
+			return errNotInteger
+		}
+		if int64(len(s.entries)) > n {
+			s.entries = s.entries[int64(len(s.entries))-n:]
+		}
+	} else {
+		minID, ok := parseStreamID(a[i], 0)
+		if !ok {
+			return redisError("ERR Invalid stream ID specified as stream command argument")
+		}
+		for len(s.entries) > 0 && s.entries[0].id.less(minID) {
+			s.entries = s.entries[1:]
+		}
+	}
+	return replyInt(int64(before - len(s.entries)))
+}
+
+// streamsArgs splits the keys and IDs after STREAMS.
+func streamsArgs(args []string) (keys, ids []string, errReply *RESPValue) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		e := redisError("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+		return nil, nil, &e
+	}
+	n := len(args) / 2
+	return args[:n], args[n:], nil
+}
+
+// cmdXRead implements XREAD [COUNT n] [BLOCK ms] STREAMS key … id ….
+// Blocking is left to the caller, which retries until entries arrive.
+func cmdXRead(a []string) RESPValue {
+	count := int64(-1)
+	i := 1
+	for ; i < len(a); i++ {
+		switch strings.ToUpper(a[i]) {
+		case "COUNT":
+			if i+1 >= len(a) {
+				return errSyntax
+			}
+			i++
+			var ok bool
+			if count, ok = parseInt(a[i]); !ok {
+				return errNotInteger
+			}
+			continue
+		case "BLOCK":
+			i++
+			continue
+		case "STREAMS":
+		default:
+			return errSyntax
+		}
+		break
+	}
+	if i >= len(a) {
+		return errSyntax
+	}
+	keys, ids, errReply := streamsArgs(a[i+1:])
+	if errReply != nil {
+		return *errReply
+	}
+	var out []interface{}
+	for n, key := range keys {
+		v, errReply := streamOf(key, false)
+		if errReply != nil {
+			return *errReply
+		}
+		var after streamID
+		if ids[n] == "$" {
+			if v == nil {
+				continue
+			}
+			after = v.stream.lastID
+		} else {
+			var ok bool
+			if after, ok = parseStreamID(ids[n], 0); !ok {
+				return redisError("ERR Invalid stream ID specified as stream command argument")
+			}
+		}
+		if v == nil {
+			continue
+		}
+		var entries []streamEntry
+		for _, e := range v.stream.entries {
+			if after.less(e.id) && (count < 0 || int64(len(entries)) < count) {
+				entries = append(entries, e)
+			}
+		}
+		if len(entries) > 0 {
+			out = append(out, []interface{}{key, replyEntries(entries)})
+		}
+	}
+	if len(out) == 0 {
+		return replyNull
+	}
+	return RESPValue{Type: RESPArray, Value: out}
+}
+
+// cmdXReadGroup implements XREADGROUP GROUP group consumer [COUNT n]
+// [BLOCK ms] [NOACK] STREAMS key … id …. With > it delivers new entries
+// and adds them to the consumer's pending list; with an ID it returns the
+// consumer's pending entries after it.
+func cmdXReadGroup(a []string) RESPValue {
+	if !strings.EqualFold(a[1], "GROUP") {
+		return errSyntax
+	}
+	group, consumer := a[2], a[3]
+	count, noAck := int64(-1), false
+	i := 4
+	for ; i < len(a); i++ {
+		switch strings.ToUpper(a[i]) {
+		case "COUNT":
+			if i+1 >= len(a) {
+				return errSyntax
+			}
+			i++
+			var ok bool
+			if count, ok = parseInt(a[i]); !ok {
+				return errNotInteger
+			}
+			continue
+		case "BLOCK":
+			i++
+			continue
+		case "NOACK":
+			noAck = true
+			continue
+		case "STREAMS":
+		default:
+			return errSyntax
+		}
+		break
+	}
+	if i >= len(a) {
+		return errSyntax
+	}
+	keys, ids, errReply := streamsArgs(a[i+1:])
+	if errReply != nil {
+		return *errReply
+	}
+	var out []interface{}
+	newOnly := true
+	for n, key := range keys {
+		v, errReply := streamOf(key, false)
+		if errReply != nil {
+			return *errReply
+		}
+		var g *streamGroup
+		if v != nil {
+			g = v.stream.groups[group]
+		}
+		if g == nil {
+			return redisError("NOGROUP No such key '" + key + "' or consumer group '" + group + "' in XREADGROUP with GROUP option")
+		}
+		g.consumers[consumer] = true
+		now := time.Now()
+		var replied []interface{}
+		if ids[n] == ">" {
+			for _, e := range v.stream.entries {
+				if count >= 0 && int64(len(replied)) >= count {
+					break
+				}
+				if !g.lastDelivered.less(e.id) {
+					continue
+				}
+				g.lastDelivered = e.id
+				if !noAck {
+					g.pending[e.id] = &pendingEntry{consumer: consumer, deliveries: 1, deliveredAt: now}
+				}
+				replied = append(replied, replyEntry(e))
+			}
+			if len(replied) == 0 {
+				continue
+			}
+		} else {
+			newOnly = false
+			after, ok := parseStreamID(ids[n], 0)
+			if !ok {
+				return redisError("ERR Invalid stream ID specified as stream command argument")
+			}
+			for _, id := range g.pendingIDs(consumer) {
+				if count >= 0 && int64(len(replied)) >= count {
+					break
+				}
+				if !after.less(id) {
+					continue
+				}
+				p := g.pending[id]
+				p.deliveries++
+				p.deliveredAt = now
+				if e, ok := v.stream.find(id); ok {
+					replied = append(replied, replyEntry(e))
+				} else {
+					replied = append(replied, []interface{}{id.String(), nil})
+				}
+			}
+		}
+		out = append(out, []interface{}{key, RESPValue{Type: RESPArray, Value: replied}})
+	}
+	if len(out) == 0 && newOnly {
+		return replyNull
+	}
+	return RESPValue{Type: RESPArray, Value: out}
+}
+
+func (s *redisStream) find(id streamID) (streamEntry, bool) {
+	n := sort.Search(len(s.entries), func(i int) bool { return !s.entries[i].id.less(id) })
+	if n < len(s.entries) && s.entries[n].id == id {
+		return s.entries[n], true
+	}
+	return streamEntry{}, false
+}
+
+// pendingIDs returns the pending entries of a consumer, or of every consumer
+// when consumer is empty, in ID order.
+func (g *streamGroup) pendingIDs(consumer string) []streamID {
+	var ids []streamID
+	for id, p := range g.pending {
+		if consumer == "" || p.consumer == consumer {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	return ids
+}
+
+func cmdXAck(a []string) RESPValue {
+	v, errReply := streamOf(a[1], false)
+	if errReply != nil {
+		return *errReply
+	}
+	if v == nil || v.stream.groups[a[2]] == nil {
+		return replyInt(0)
+	}
+	g := v.stream.groups[a[2]]
+	n := 0
+	for _, s := range a[3:] {
+		id, ok := parseStreamID(s, 0)
+		if !ok {
+			return redisError("ERR Invalid stream ID specified as stream command argument")
+		}
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			n++
+		}
+	}
+	return replyInt(int64(n))
+}
+
+// cmdXGroup implements XGROUP CREATE, SETID, DESTROY, CREATECONSUMER and
+// DELCONSUMER.
+func cmdXGroup(a []string) RESPValue {
+	sub := strings.ToUpper(a[1])
+	if len(a) < 4 {
+		return errWrongArgs("xgroup|" + strings.ToLower(sub))
+	}
+	key, group := a[2], a[3]
+	v, errReply := streamOf(key, false)
+	if errReply != nil {
+		return *errReply
+	}
+	if sub == "CREATE" && v == nil && len(a) > 5 && strings.EqualFold(a[5], "MKSTREAM") {
+		v, _ = streamOf(key, true)
+	}
+	if v == nil {
+		return redisError("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	s := v.stream
+	g := s.groups[group]
+	groupID := func(arg string) (streamID, *RESPValue) {
+		if arg == "$" {
+			return s.lastID, nil
+		}
+		id, ok := parseStreamID(arg, 0)
+		if !ok {
+			e := redisError("ERR Invalid stream ID specified as stream command argument")
+			return id, &e
+		}
+		return id, nil
+	}
+	noGroup := redisError("NOGROUP No such consumer group '" + group + "' for key name '" + key + "'")
+	switch sub {
+	case "CREATE":
+		if len(a) < 5 {
+			return errWrongArgs("xgroup|create")
+		}
+		if g != nil {
+			return redisError("BUSYGROUP Consumer Group name already exists")
+		}
+		id, errReply := groupID(a[4])
+		if errReply != nil {
+			return *errReply
+		}
+		s.groups[group] = &streamGroup{lastDelivered: id, consumers: map[string]bool{}, pending: map[streamID]*pendingEntry{}}
+		return replyOK
+	case "SETID":
+		if len(a) < 5 {
+			return errWrongArgs("xgroup|setid")
+		}
+		if g == nil {
+			return noGroup
+		}
+		id, errReply := groupID(a[4])
+		if errReply != nil {
+			return *errReply
+		}
+		g.lastDelivered = id
+		return replyOK
+	case "DESTROY":
+		if g == nil {
+			return replyInt(0)
+		}
+		delete(s.groups, group)
+		return replyInt(1)
+	case "CREATECONSUMER", "DELCONSUMER":
+		if len(a) != 5 {
+			return errWrongArgs("xgroup|" + strings.ToLower(sub))
+		}
+		if g == nil {
+			return noGroup
+		}
+		consumer := a[4]
+		if sub == "CREATECONSUMER" {
+			if g.consumers[consumer] {
+				return replyInt(0)
+			}
+			g.consumers[consumer] = true
+			return replyInt(1)
+		}
+		ids := g.pendingIDs(consumer)
+		for _, id := range ids {
+			delete(g.pending, id)
+		}
+		delete(g.consumers, consumer)
+		return replyInt(int64(len(ids)))
+	}
+	return redisError("ERR unknown subcommand '" + a[1] + "'")
+}
+
+// cmdXPending implements XPENDING key group, a summary, and XPENDING key
+// group start end count [consumer], the entries.
+func cmdXPending(a []string) RESPValue {
+	v, errReply := streamOf(a[1], false)
+	if errReply != nil {
+		return *errReply
+	}
+	var g *streamGroup
+	if v != nil {
+		g = v.stream.groups[a[2]]
+	}
+	if g == nil {
+		return redisError("NOGROUP No such key '" + a[1] + "' or consumer group '" + a[2] + "'")
+	}
+	if len(a) == 3 {
+		ids := g.pendingIDs("")
+		if len(ids) == 0 {
+			return RESPValue{Type: RESPArray, Value: []interface{}{replyInt(0), nil, nil, nil}}
+		}
+		perConsumer := map[string]int64{}
+		for _, id := range ids {
+			perConsumer[g.pending[id].consumer]++
+		}
+		names := make([]string, 0, len(perConsumer))
+		for c := range perConsumer {
+			names = append(names, c)
+		}
+		sort.Strings(names)
+		consumers := make([]interface{}, len(names))
+		for i, c := range names {
+			consumers[i] = []interface{}{c, strconv.FormatInt(perConsumer[c], 10)}
+		}
+		return RESPValue{Type: RESPArray, Value: []interface{}{
+			replyInt(int64(len(ids))), ids[0].String(), ids[len(ids)-1].String(), consumers,
+		}}
+	}
+	if len(a) < 6 || len(a) > 7 {
+		return errSyntax
+	}
+	start, ok1 := parseRangeID(a[3], true)
+	end, ok2 := parseRangeID(a[4], false)
+	count, ok3 := parseInt(a[5])
+	if !ok1 || !ok2 || !ok3 {
+		return errSyntax
+	}
+	consumer := ""
+	if len(a) == 7 {
+		consumer = a[6]
+	}
+	out := []interface{}{}
+	now := time.Now()
+	for _, id := range g.pendingIDs(consumer) {
+		if int64(len(out)) >= count {
+			break
+		}
+		if id.less(start) || end.less(id) {
+			continue
+		}
+		p := g.pending[id]
+		out = append(out, []interface{}{
+			id.String(), p.consumer,
+			replyInt(now.Sub(p.deliveredAt).Milliseconds()), replyInt(p.deliveries),
+		})
+	}
+	return RESPValue{Type: RESPArray, Value: out}
+}
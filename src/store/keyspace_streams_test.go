@@ -0,0 +1,116 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedisStreams(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []redisStep
+	}{
+		{"XADD and XRANGE", []redisStep{
+			{"XADD s 1-1 f a", "1-1"},
+			{"XADD s 1-1 f b", "ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+			{"XADD s 2 f b", "2-0"},
+			{"XLEN s", "2"},
+			{"XRANGE s - +", "[[1-1 [f a]] [2-0 [f b]]]"},
+			{"XRANGE s (1-1 +", "[[2-0 [f b]]]"},
+			{"XREVRANGE s + - COUNT 1", "[[2-0 [f b]]]"},
+		}},
+		{"XREAD after an ID", []redisStep{
+			{"XADD s 1-1 f a", "1-1"},
+			{"XADD s 1-2 f b", "1-2"},
+			{"XREAD STREAMS s 1-1", "[[s [[1-2 [f b]]]]]"},
+			{"XREAD STREAMS s 1-2", "(nil)"},
+		}},
+		{"XREADGROUP delivers new entries once", []redisStep{
+			{"XADD s 1-1 f a", "1-1"},
+			{"XADD s 1-2 f b", "1-2"},
+			{"XGROUP CREATE s g 0", "OK"},
+			{"XREADGROUP GROUP g alice COUNT 1 STREAMS s >", "[[s [[1-1 [f a]]]]]"},
+			{"XREADGROUP GROUP g bob STREAMS s >", "[[s [[1-2 [f b]]]]]"},
+			{"XREADGROUP GROUP g alice STREAMS s >", "(nil)"},
+		}},
+		{"pending lists per consumer", []redisStep{
+			{"XADD s 1-1 f a", "1-1"},
+			{"XADD s 1-2 f b", "1-2"},
+			{"XADD s 1-3 f c", "1-3"},
+			{"XGROUP CREATE s g 0", "OK"},
+			{"XREADGROUP GROUP g alice COUNT 2 STREAMS s >", "[[s [[1-1 [f a]] [1-2 [f b]]]]]"},
+			{"XREADGROUP GROUP g bob STREAMS s >", "[[s [[1-3 [f c]]]]]"},
+			{"XPENDING s g", "[3 1-1 1-3 [[alice 2] [bob 1]]]"},
+			{"XREADGROUP GROUP g alice STREAMS s 0", "[[s [[1-1 [f a]] [1-2 [f b]]]]]"},
+			{"XREADGROUP GROUP g alice STREAMS s 1-1", "[[s [[1-2 [f b]]]]]"},
+			{"XACK s g 1-1 1-3 9-9", "2"},
+			{"XPENDING s g", "[1 1-2 1-2 [[alice 1]]]"},
+			{"XREADGROUP GROUP g bob STREAMS s 0", "[[s []]]"},
+		}},
+		{"deleted entries stay pending", []redisStep{
+			{"XADD s 1-1 f a", "1-1"},
+			{"XGROUP CREATE s g 0", "OK"},
+			{"XREADGROUP GROUP g alice STREAMS s >", "[[s [[1-1 [f a]]]]]"},
+			{"XDEL s 1-1", "1"},
+			{"XREADGROUP GROUP g alice STREAMS s 0", "[[s [[1-1 (nil)]]]]"},
+		}},
+		{"NOACK skips the pending list", []redisStep{
+			{"XADD s 1-1 f a", "1-1"},
+			{"XGROUP CREATE s g 0", "OK"},
+			{"XREADGROUP GROUP g alice NOACK STREAMS s >", "[[s [[1-1 [f a]]]]]"},
+			{"XPENDING s g", "[0 (nil) (nil) (nil)]"},
+		}},
+		{"DELCONSUMER drops its pending entries", []redisStep{
+			{"XADD s 1-1 f a", "1-1"},
+			{"XGROUP CREATE s g 0", "OK"},
+			{"XREADGROUP GROUP g alice STREAMS s >", "[[s [[1-1 [f a]]]]]"},
+			{"XGROUP DELCONSUMER s g alice", "1"},
+			{"XPENDING s g", "[0 (nil) (nil) (nil)]"},
+		}},
+		{"groups", []redisStep{
+			{"XGROUP CREATE s g $", "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."},
+			{"XGROUP CREATE s g $ MKSTREAM", "OK"},
+			{"XGROUP CREATE s g $", "BUSYGROUP Consumer Group name already exists"},
+			{"XREADGROUP GROUP nope alice STREAMS s >", "NOGROUP No such key 's' or consumer group 'nope' in XREADGROUP with GROUP option"},
+			{"XADD s 5-0 f a", "5-0"},
+			{"XREADGROUP GROUP g alice STREAMS s >", "[[s [[5-0 [f a]]]]]"},
+			{"XGROUP SETID s g 0", "OK"},
+			{"XREADGROUP GROUP g bob STREAMS s >", "[[s [[5-0 [f a]]]]]"},
+			{"XGROUP DESTROY s g", "1"},
+			{"XGROUP DESTROY s g", "0"},
+		}},
+		{"wrong type", []redisStep{
+			{"SET s v", "OK"},
+			{"XADD s * f a", "WRONGTYPE Operation against a key holding the wrong kind of value"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { runRedisSteps(t, tt.steps) })
+	}
+}
+
+func TestRedisXPendingEntries(t *testing.T) {
+	runRedisSteps(t, []redisStep{
+		{"XADD s 1-1 f a", "1-1"},
+		{"XADD s 1-2 f b", "1-2"},
+		{"XGROUP CREATE s g 0", "OK"},
+		{"XREADGROUP GROUP g alice STREAMS s >", "[[s [[1-1 [f a]] [1-2 [f b]]]]]"},
+		{"XREADGROUP GROUP g alice STREAMS s 0", "[[s [[1-1 [f a]] [1-2 [f b]]]]]"},
+	})
+	reply, _ := ExecRedis(0, "XPENDING", strings.Fields("s g - + 10 alice"))
+	entries, _ := reply.Value.([]interface{})
+	if len(entries) != 2 {
+		t.Fatalf("XPENDING = %s, want 2 entries", redisText(reply))
+	}
+	for i, want := range []string{"1-1", "1-2"} {
+		e := entries[i].([]interface{})
+		// ID, consumer, idle time, deliveries; the idle time varies
+		if e[0] != want || e[1] != "alice" || redisText(RESPElement(e[3])) != "2" {
+			t.Errorf("entry %d = %v, want %s delivered twice to alice", i, e, want)
+		}
+	}
+	reply, _ = ExecRedis(0, "XPENDING", strings.Fields("s g (1-1 + 10"))
+	if got := len(reply.Value.([]interface{})); got != 1 {
+		t.Errorf("XPENDING after 1-1 = %d entries, want 1", got)
+	}
+}
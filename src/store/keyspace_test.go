@@ -0,0 +1,273 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// redisStep is a command, split on spaces, and its reply as rendered by
+// redisText.
+type redisStep struct {
+	cmd  string
+	want string
+}
+
+// redisText renders a reply compactly: errors and values as their text,
+// null as (nil) and arrays in brackets.
+func redisText(v RESPValue) string {
+	switch v.Type {
+	case RESPNull:
+		return "(nil)"
+	case RESPArray, RESPSet, RESPMap:
+		list, _ := v.Value.([]interface{})
+		parts := make([]string, len(list))
+		for i, x := range list {
+			parts[i] = redisText(RESPElement(x))
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return v.Text()
+}
+
+// runRedisSteps runs steps on a flushed keyspace, in database 0 unless a
+// step starts with "@n ".
+func runRedisSteps(t *testing.T, steps []redisStep) {
+	t.Helper()
+	FlushRedis()
+	t.Cleanup(FlushRedis)
+	for _, s := range steps {
+		db, cmd := 0, s.cmd
+		if strings.HasPrefix(cmd, "@") {
+			db = int(cmd[1] - '0')
+			cmd = cmd[3:]
+		}
+		args := strings.Fields(cmd)
+		reply, ok := ExecRedis(db, args[0], args[1:])
+		if !ok {
+			t.Fatalf("%s: not a keyspace command", s.cmd)
+		}
+		if got := redisText(reply); got != s.want {
+			t.Fatalf("%s = %q, want %q", s.cmd, got, s.want)
+		}
+	}
+}
+
+func TestRedisSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []redisStep
+	}{
+		{"plain", []redisStep{
+			{"SET k v", "OK"},
+			{"GET k", "v"},
+		}},
+		{"NX on a missing key", []redisStep{
+			{"SET k v NX", "OK"},
+			{"SET k w NX", "(nil)"},
+			{"GET k", "v"},
+		}},
+		{"XX on a missing key", []redisStep{
+			{"SET k v XX", "(nil)"},
+			{"EXISTS k", "0"},
+			{"SET k v", "OK"},
+			{"SET k w XX", "OK"},
+			{"GET k", "w"},
+		}},
+		{"GET returns the old value", []redisStep{
+			{"SET k v GET", "(nil)"},
+			{"SET k w GET", "v"},
+			{"SET k x NX GET", "w"},
+			{"GET k", "w"},
+		}},
+		{"GET on the wrong type", []redisStep{
+			{"LPUSH k a", "1"},
+			{"SET k v GET", "WRONGTYPE Operation against a key holding the wrong kind of value"},
+			{"SET k v", "OK"},
+		}},
+		{"EX sets a TTL, a plain SET clears it", []redisStep{
+			{"SET k v EX 100", "OK"},
+			{"TTL k", "100"},
+			{"SET k w", "OK"},
+			{"TTL k", "-1"},
+		}},
+		{"KEEPTTL", []redisStep{
+			{"SET k v PX 100000", "OK"},
+			{"SET k w KEEPTTL", "OK"},
+			{"TTL k", "100"},
+		}},
+		{"conflicting options", []redisStep{
+			{"SET k v NX XX", "ERR syntax error"},
+			{"SET k v EX 10 PX 10", "ERR syntax error"},
+			{"SET k v EX 10 KEEPTTL", "ERR syntax error"},
+			{"SET k v EX", "ERR syntax error"},
+			{"SET k v BOGUS", "ERR syntax error"},
+		}},
+		{"bad expiries", []redisStep{
+			{"SET k v EX 0", "ERR invalid expire time in 'set' command"},
+			{"SET k v PX -5", "ERR invalid expire time in 'set' command"},
+			{"SET k v EX ten", "ERR value is not an integer or out of range"},
+			{"EXISTS k", "0"},
+		}},
+		{"EXAT in the past", []redisStep{
+			{"SET k v EXAT 1", "OK"},
+			{"EXISTS k", "0"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { runRedisSteps(t, tt.steps) })
+	}
+}
+
+func TestRedisIncr(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []redisStep
+	}{
+		{"missing key starts at 0", []redisStep{
+			{"INCR n", "1"},
+			{"INCRBY n 10", "11"},
+			{"DECR n", "10"},
+			{"DECRBY n 20", "-10"},
+		}},
+		{"overflow", []redisStep{
+			{"SET n 9223372036854775806", "OK"},
+			{"INCR n", "9223372036854775807"},
+			{"INCR n", "ERR increment or decrement would overflow"},
+			{"GET n", "9223372036854775807"},
+		}},
+		{"underflow", []redisStep{
+			{"SET n -9223372036854775807", "OK"},
+			{"DECR n", "-9223372036854775808"},
+			{"DECR n", "ERR increment or decrement would overflow"},
+			{"DECRBY m -9223372036854775808", "ERR decrement would overflow"},
+		}},
+		{"not an integer", []redisStep{
+			{"SET n 1.5", "OK"},
+			{"INCR n", "ERR value is not an integer or out of range"},
+			{"SET n 99999999999999999999", "OK"},
+			{"INCR n", "ERR value is not an integer or out of range"},
+			{"INCRBY n x", "ERR value is not an integer or out of range"},
+		}},
+		{"keeps the TTL", []redisStep{
+			{"SET n 1 EX 100", "OK"},
+			{"INCR n", "2"},
+			{"TTL n", "100"},
+		}},
+		{"float", []redisStep{
+			{"INCRBYFLOAT f 1.5", "1.5"},
+			{"INCRBYFLOAT f 2", "3.5"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { runRedisSteps(t, tt.steps) })
+	}
+}
+
+func TestRedisScan(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []redisStep
+	}{
+		{"cursor walks every key", []redisStep{
+			{"MSET a 1 b 2 c 3 d 4 e 5", "OK"},
+			{"SCAN 0 COUNT 2", "[2 [a b]]"},
+			{"SCAN 2 COUNT 2", "[4 [c d]]"},
+			{"SCAN 4 COUNT 2", "[0 [e]]"},
+		}},
+		{"MATCH filters within each batch", []redisStep{
+			{"MSET user:1 a order:1 b user:2 c", "OK"},
+			{"SCAN 0 MATCH user:* COUNT 2", "[2 [user:1]]"},
+			{"SCAN 2 MATCH user:* COUNT 2", "[0 [user:2]]"},
+		}},
+		{"TYPE", []redisStep{
+			{"SET s v", "OK"},
+			{"LPUSH l a", "1"},
+			{"SCAN 0 TYPE list", "[0 [l]]"},
+		}},
+		{"bad arguments", []redisStep{
+			{"SCAN -1", "ERR invalid cursor"},
+			{"SCAN x", "ERR invalid cursor"},
+			{"SCAN 0 COUNT 0", "ERR syntax error"},
+			{"SCAN 0 MATCH", "ERR syntax error"},
+		}},
+		{"cursor past the end", []redisStep{
+			{"SET a 1", "OK"},
+			{"SCAN 10", "[0 []]"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { runRedisSteps(t, tt.steps) })
+	}
+}
+
+func TestRedisExpiry(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []redisStep
+	}{
+		{"TTL of missing and persistent keys", []redisStep{
+			{"TTL k", "-2"},
+			{"SET k v", "OK"},
+			{"TTL k", "-1"},
+			{"PTTL k", "-1"},
+		}},
+		{"EXPIRE conditions", []redisStep{
+			{"SET k v", "OK"},
+			{"EXPIRE k 100 XX", "0"},
+			{"EXPIRE k 100 NX", "1"},
+			{"EXPIRE k 200 NX", "0"},
+			{"EXPIRE k 50 GT", "0"},
+			{"EXPIRE k 200 GT", "1"},
+			{"EXPIRE k 300 LT", "0"},
+			{"TTL k", "200"},
+			{"PERSIST k", "1"},
+			{"TTL k", "-1"},
+		}},
+		{"expiry in the past deletes", []redisStep{
+			{"SET k v", "OK"},
+			{"PEXPIREAT k 1", "1"},
+			{"EXISTS k", "0"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { runRedisSteps(t, tt.steps) })
+	}
+
+	t.Run("expired keys vanish", func(t *testing.T) {
+		runRedisSteps(t, []redisStep{
+			{"SET gone v PX 100000", "OK"},
+			{"SET kept v", "OK"},
+		})
+		keyspaceMu.Lock()
+		keyspace["gone"].expires = time.Now().Add(-time.Millisecond)
+		keyspaceMu.Unlock()
+		for _, s := range []redisStep{
+			{"GET gone", "(nil)"},
+			{"TTL gone", "-2"},
+			{"KEYS *", "[kept]"},
+			{"DBSIZE", "1"},
+		} {
+			args := strings.Fields(s.cmd)
+			if reply, _ := ExecRedis(0, args[0], args[1:]); redisText(reply) != s.want {
+				t.Errorf("%s = %q, want %q", s.cmd, redisText(reply), s.want)
+			}
+		}
+	})
+}
+
+func TestRedisDatabases(t *testing.T) {
+	runRedisSteps(t, []redisStep{
+		{"SET k zero", "OK"},
+		{"@1 SET k one", "OK"},
+		{"GET k", "zero"},
+		{"@1 GET k", "one"},
+		{"@1 FLUSHDB", "OK"},
+		{"@1 DBSIZE", "0"},
+		{"DBSIZE", "1"},
+		{"@1 SET k one", "OK"},
+		{"@2 FLUSHALL", "OK"},
+		{"DBSIZE", "0"},
+		{"@1 DBSIZE", "0"},
+	})
+}
@@ -0,0 +1,605 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- Live tables ---------------------------------------------------------
+
+// A schema in live mode backs its table with rows held in memory: the SQL
+// mocks run INSERT, UPDATE, DELETE and single-table SELECT statements on it
+// instead of waiting for a configured response.
+
+// LiveResult is the outcome of a statement run against live tables.
+type LiveResult struct {
+	Columns      []string // result columns in order; empty for writes without RETURNING
+	Rows         []map[string]interface{}
+	AffectedRows int
+	LastInsertID int64
+	Error        *ErrorReply
+	// Undo reverts the statement's writes, for ROLLBACK; nil for reads.
+	Undo func()
+}
+
+type liveColumn struct {
+	name    string
+	typ     string // lower-cased SQL type, as in SchemaColumn
+	notNull bool
+	autoInc bool
+	def     string // DEFAULT expression as written; "" when none
+}
+
+// liveRow is a row of a live table. Rows are pointers so that undoing a
+// write finds them again after other connections changed the table.
+type liveRow struct {
+	vals map[string]interface{}
+}
+
+type liveKey struct {
+	name string   // constraint name, for error messages
+	cols []string // primary key or unique columns
+}
+
+type liveTable struct {
+	protocol string
+	name     string
+	cols     []liveColumn
+	keys     []liveKey // primary key first, then unique constraints
+	rows     []*liveRow
+	nextID   int64
+}
+
+var (
+	// Runtime state: built from the schema on first use, dropped when the
+	// schema changes or with ResetLiveTables.
+	liveMu     sync.Mutex
+	liveTables = map[string]*liveTable{} // schemaKey → table
+)
+
+// SetSchemaLive switches a schema's table to live mode, or back, and
+// replaces its fixture rows. The table is rebuilt on next use.
+func SetSchemaLive(protocol, tableName string, live bool, fixtures Rows) error {
+	mu.Lock()
+	s, ok := schemas[schemaKey(protocol, tableName)]
+	if ok {
+		s.Live = live
+		s.Fixtures = fixtures
+	}
+	mu.Unlock()
+	if !ok {
+		return fmt.Errorf("schema %s %s not found", protocol, tableName)
+	}
+	dropLiveTable(protocol, tableName)
+	return nil
+}
+
+// ResetLiveTables discards every live table's rows; they are seeded again
+// from the fixtures on next use.
+func ResetLiveTables() {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	liveTables = map[string]*liveTable{}
+}
+
+func dropLiveTable(protocol, tableName string) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	delete(liveTables, schemaKey(protocol, tableName))
+}
+
+// LiveRows returns the current rows of a live table.
+func LiveRows(protocol, tableName string) ([]map[string]interface{}, bool) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	t := lookupLiveTable(protocol, tableName)
+	if t == nil {
+		return nil, false
+	}
+	out := make([]map[string]interface{}, len(t.rows))
+	for i, r := range t.rows {
+		out[i] = copyRow(r.vals)
+	}
+	return out, true
+}
+
+// lookupLiveTable returns the live table called name, building it from its
+// schema when first used, or nil when no live schema has that name. Caller
+// holds liveMu.
+func lookupLiveTable(protocol, name string) *liveTable {
+	mu.RLock()
+	var schema *Schema
+	for _, s := range schemas {
+		if s.Protocol == protocol && s.Live && strings.EqualFold(s.TableName, name) {
+			schema = s
+			break
+		}
+	}
+	mu.RUnlock()
+	if schema == nil {
+		return nil
+	}
+	key := schemaKey(protocol, schema.TableName)
+	if t, ok := liveTables[key]; ok {
+		return t
+	}
+	t := newLiveTable(schema)
+	liveTables[key] = t
+	return t
+}
+
+// newLiveTable builds a table from a schema's CREATE TABLE and seeds it with
+// the fixtures. Fixture rows that violate the schema are skipped.
+func newLiveTable(s *Schema) *liveTable {
+	t := &liveTable{protocol: s.Protocol, name: s.TableName, nextID: 1}
+	stmt := s.CreateStatement
+	open, end := strings.Index(stmt, "("), strings.LastIndex(stmt, ")")
+	if open == -1 || end <= open {
+		return t
+	}
+	var pk []string
+	var unique []liveKey
+	for _, def := range SplitTopLevel(stmt[open+1 : end]) {
+		sc, constraints, ok := parseColumnDef(def)
+		if !ok {
+			lower := strings.ToLower(def)
+			cols := constraintColumns(def)
+			switch {
+			case strings.Contains(lower, "primary key"):
+				pk = cols
+			case strings.Contains(lower, "unique") && len(cols) > 0:
+				unique = append(unique, liveKey{name: constraintName(def), cols: cols})
+			}
+			continue
+		}
+		c := liveColumn{name: sc.Name, typ: sc.Type}
+		rest := strings.ToLower(strings.Join(constraints, " "))
+		c.notNull = strings.Contains(rest, "not null") || strings.Contains(rest, "primary key")
+		c.autoInc = strings.Contains(c.typ, "serial") || strings.Contains(rest, "auto_increment") ||
+			strings.Contains(rest, "identity") || strings.Contains(rest, "nextval(")
+		for i, w := range constraints {
+			if strings.EqualFold(w, "default") && i+1 < len(constraints) && !c.autoInc {
+				c.def = constraints[i+1]
+			}
+		}
+		if strings.Contains(rest, "primary key") {
+			pk = []string{c.name}
+		} else if strings.Contains(rest, "unique") {
+			unique = append(unique, liveKey{cols: []string{c.name}})
+		}
+		t.cols = append(t.cols, c)
+	}
+	if pk != nil {
+		name := t.name + "_pkey"
+		if t.protocol == ProtoMySQL {
+			name = "PRIMARY"
+		}
+		t.keys = append(t.keys, liveKey{name: name, cols: pk})
+	}
+	for _, key := range unique {
+		// Unnamed keys are named as each server would name them.
+		switch {
+		case key.name != "":
+		case t.protocol == ProtoMySQL:
+			key.name = key.cols[0]
+		default:
+			key.name = t.name + "_" + strings.Join(key.cols, "_") + "_key"
+		}
+		t.keys = append(t.keys, key)
+	}
+	for _, fixture := range s.Fixtures {
+		vals := map[string]interface{}{}
+		for k, v := range fixture {
+			vals[k] = v
+		}
+		if row, err := t.newRow(vals); err == nil && t.conflict(row, nil) == nil {
+			t.rows = append(t.rows, &liveRow{vals: row})
+		}
+	}
+	return t
+}
+
+// constraintColumns returns the column list in the parentheses of a table
+// constraint, e.g. "PRIMARY KEY (a, b)".
+func constraintColumns(def string) []string {
+	open, end := strings.Index(def, "("), strings.Index(def, ")")
+	if open == -1 || end <= open {
+		return nil
+	}
+	var cols []string
+	for _, c := range strings.Split(def[open+1:end], ",") {
+		cols = append(cols, strings.Trim(strings.TrimSpace(c), "\"`[]"))
+	}
+	return cols
+}
+
+// constraintName returns the name given to a table constraint, as in
+// "CONSTRAINT uq_email UNIQUE (email)" or MySQL's "UNIQUE KEY uq_email
+// (email)", or "".
+func constraintName(def string) string {
+	if i := strings.Index(def, "("); i != -1 {
+		def = def[:i]
+	}
+	fields := strings.Fields(def)
+	for i, f := range fields {
+		lower := strings.ToLower(f)
+		if i+1 < len(fields) && (lower == "constraint" || i > 0 && (lower == "key" || lower == "index")) {
+			return strings.Trim(fields[i+1], "\"`[]")
+		}
+	}
+	return ""
+}
+
+// column finds a column case-insensitively.
+func (t *liveTable) column(name string) *liveColumn {
+	for i := range t.cols {
+		if strings.EqualFold(t.cols[i].name, name) {
+			return &t.cols[i]
+		}
+	}
+	return nil
+}
+
+func (t *liveTable) columnNames() []string {
+	names := make([]string, len(t.cols))
+	for i, c := range t.cols {
+		names[i] = c.name
+	}
+	return names
+}
+
+// newRow completes a row for insertion: values are converted to their
+// column types, missing columns get their default or the next id, and
+// NOT NULL is enforced.
+func (t *liveTable) newRow(vals map[string]interface{}) (map[string]interface{}, *ErrorReply) {
+	row := make(map[string]interface{}, len(t.cols))
+	for k, v := range vals {
+		c := t.column(k)
+		if c == nil {
+			return nil, t.unknownColumn(k)
+		}
+		cv, err := t.coerce(c, v)
+		if err != nil {
+			return nil, err
+		}
+		row[c.name] = cv
+	}
+	for i := range t.cols {
+		c := &t.cols[i]
+		v, set := row[c.name]
+		switch {
+		case c.autoInc && (!set || v == nil):
+			row[c.name] = t.nextID
+			t.nextID++
+		case c.autoInc:
+			if id, ok := asInt(v); ok && id >= t.nextID {
+				t.nextID = id + 1
+			}
+		case !set && c.def != "":
+			dv, err := t.coerce(c, defaultValue(c.def))
+			if err != nil {
+				return nil, err
+			}
+			row[c.name] = dv
+		case !set:
+			row[c.name] = nil
+		}
+		if c.notNull && row[c.name] == nil {
+			return nil, t.notNull(c.name)
+		}
+	}
+	return row, nil
+}
+
+// defaultValue evaluates a DEFAULT expression: a literal or the current
+// time.
+func defaultValue(def string) interface{} {
+	lower := strings.ToLower(def)
+	switch {
+	case lower == "null":
+		return nil
+	case lower == "true" || lower == "false":
+		return lower == "true"
+	case strings.HasPrefix(lower, "current_timestamp") || strings.HasPrefix(lower, "now(") ||
+		strings.HasPrefix(lower, "localtimestamp"):
+		return time.Now().UTC().Format("2006-01-02 15:04:05")
+	case strings.HasPrefix(lower, "current_date"):
+		return time.Now().UTC().Format("2006-01-02")
+	}
+	if n, err := strconv.ParseInt(def, 10, 64); err == nil {
+		return n
+	}
+	if n, err := strconv.ParseFloat(def, 64); err == nil {
+		return n
+	}
+	// 'text' or 'text'::type
+	if i := strings.Index(def, "::"); i != -1 {
+		def = def[:i]
+	}
+	return strings.Trim(def, "'")
+}
+
+// coerce converts a value to the JSON shape of its column type: int64 for
+// integer types, so that bigint ids keep every digit, float64 for other
+// numeric types, booleans for boolean ones, strings otherwise.
+func (t *liveTable) coerce(c *liveColumn, v interface{}) (interface{}, *ErrorReply) {
+	if v == nil {
+		return nil, nil
+	}
+	switch {
+	case isIntegerType(c.typ):
+		if n, ok := asInt(v); ok {
+			return n, nil
+		}
+		if b, ok := v.(bool); ok {
+			if b {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+		// Fractions are rounded, as both servers do for numbers; Postgres
+		// rejects them in text.
+		f, ok := toNumber(v)
+		if _, text := v.(string); !ok || text && t.protocol != ProtoMySQL || math.Abs(f) >= 1<<63 {
+			return nil, t.invalidValue(c, toString(v))
+		}
+		return int64(math.Round(f)), nil
+	case isNumericType(c.typ):
+		switch x := v.(type) {
+		case bool:
+			if x {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		case string:
+			n, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			if err != nil {
+				return nil, t.invalidValue(c, x)
+			}
+			return n, nil
+		}
+		if n, ok := toNumber(v); ok {
+			return n, nil
+		}
+	case c.typ == "bool" || c.typ == "boolean":
+		switch x := v.(type) {
+		case bool:
+			return x, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(x)) {
+			case "t", "true", "y", "yes", "on", "1":
+				return true, nil
+			case "f", "false", "n", "no", "off", "0":
+				return false, nil
+			}
+			return nil, t.invalidValue(c, x)
+		}
+		if n, ok := toNumber(v); ok {
+			return n != 0, nil
+		}
+	}
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	}
+	return toString(v), nil
+}
+
+// baseType is a column type without its size, e.g. "varchar" for
+// "varchar(255)" or "double" for "double precision".
+func baseType(typ string) string {
+	if i := strings.IndexAny(typ, "( "); i != -1 {
+		return typ[:i]
+	}
+	return typ
+}
+
+func isIntegerType(typ string) bool {
+	switch baseType(typ) {
+	case "int", "integer", "bigint", "smallint", "tinyint", "mediumint", "int2", "int4", "int8",
+		"serial", "bigserial", "smallserial", "serial2", "serial4", "serial8":
+		return true
+	}
+	return false
+}
+
+func isNumericType(typ string) bool {
+	switch baseType(typ) {
+	case "numeric", "decimal", "real", "double", "float", "float4", "float8":
+		return true
+	}
+	return isIntegerType(typ)
+}
+
+// conflict returns the unique constraint row would violate, ignoring self
+// (the row being updated), or nil.
+func (t *liveTable) conflict(row map[string]interface{}, self *liveRow) *liveKey {
+	for k := range t.keys {
+		key := &t.keys[k]
+		for _, r := range t.rows {
+			if r != self && sameKey(key.cols, r.vals, row) {
+				return key
+			}
+		}
+	}
+	return nil
+}
+
+// sameKey reports whether two rows agree on every key column. NULLs never
+// conflict.
+func sameKey(cols []string, a, b map[string]interface{}) bool {
+	for _, c := range cols {
+		if a[c] == nil || b[c] == nil || compareValues(a[c], b[c]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func keyValues(cols []string, row map[string]interface{}) string {
+	vals := make([]string, len(cols))
+	for i, c := range cols {
+		vals[i] = fmt.Sprint(row[c])
+	}
+	return strings.Join(vals, ", ")
+}
+
+func copyRow(row map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		out[k] = v
+	}
+	return out
+}
+
+// indexOf finds a row by identity.
+func (t *liveTable) indexOf(r *liveRow) int {
+	for i, x := range t.rows {
+		if x == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// ---- Errors in each dialect -----------------------------------------------
+
+func (t *liveTable) unknownColumn(name string) *ErrorReply {
+	if t.protocol == ProtoMySQL {
+		return &ErrorReply{Code: 1054, SQLState: "42S22", Message: fmt.Sprintf("Unknown column '%s' in 'field list'", name)}
+	}
+	return &ErrorReply{SQLState: "42703", Message: fmt.Sprintf("column %q of relation %q does not exist", name, t.name)}
+}
+
+// unknownReference is unknownColumn for a column read by an expression.
+func (t *liveTable) unknownReference(name string) *ErrorReply {
+	if t.protocol == ProtoMySQL {
+		return t.unknownColumn(name)
+	}
+	return &ErrorReply{SQLState: "42703", Message: fmt.Sprintf("column %q does not exist", name)}
+}
+
+func (t *liveTable) notNull(col string) *ErrorReply {
+	if t.protocol == ProtoMySQL {
+		return &ErrorReply{Code: 1048, SQLState: "23000", Message: fmt.Sprintf("Column '%s' cannot be null", col)}
+	}
+	return &ErrorReply{
+		SQLState: "23502",
+		Message:  fmt.Sprintf("null value in column %q of relation %q violates not-null constraint", col, t.name),
+		Table:    t.name,
+	}
+}
+
+func (t *liveTable) duplicate(key *liveKey, row map[string]interface{}) *ErrorReply {
+	vals := keyValues(key.cols, row)
+	if t.protocol == ProtoMySQL {
+		return &ErrorReply{Code: 1062, SQLState: "23000", Message: fmt.Sprintf("Duplicate entry '%s' for key '%s.%s'", vals, t.name, key.name)}
+	}
+	return &ErrorReply{
+		SQLState:   "23505",
+		Message:    fmt.Sprintf("duplicate key value violates unique constraint %q", key.name),
+		Detail:     fmt.Sprintf("Key (%s)=(%s) already exists.", strings.Join(key.cols, ", "), vals),
+		Table:      t.name,
+		Constraint: key.name,
+	}
+}
+
+func (t *liveTable) invalidValue(c *liveColumn, v string) *ErrorReply {
+	if t.protocol == ProtoMySQL {
+		return &ErrorReply{Code: 1366, SQLState: "HY000", Message: fmt.Sprintf("Incorrect %s value: '%s' for column '%s'", c.typ, v, c.name)}
+	}
+	return &ErrorReply{SQLState: "22P02", Message: fmt.Sprintf("invalid input syntax for type %s: %q", c.typ, v)}
+}
+
+// ---- Execution -----------------------------------------------------------
+
+// ExecLive runs a statement against the live tables of protocol. ok is
+// false when the statement reads no live table or uses SQL the engine does
+// not support; the mock then handles it like any other statement, and a
+// warning is logged if it names a live table.
+func ExecLive(protocol, query string, params []*string) (res *LiveResult, ok bool) {
+	stmt, err := parseLive(protocol, query, params)
+	if err != nil {
+		warnUnsupported(protocol, query)
+		return nil, false
+	}
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	t := lookupLiveTable(protocol, stmt.table)
+	if t == nil {
+		return nil, false
+	}
+	stmt.scope.table = t
+	res, err = stmt.exec(t)
+	var le *liveError
+	switch {
+	case errors.As(err, &le):
+		return &LiveResult{Error: le.reply}, true
+	case err != nil:
+		warnUnsupported(protocol, query)
+		return nil, false
+	}
+	return res, true
+}
+
+// warnUnsupported logs a statement the live engine cannot run when it names
+// a live table, e.g. a join or subquery, since its answer then comes from
+// the mock rather than the table.
+func warnUnsupported(protocol, query string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, tok := range tokenizeSQL(protocol, query) {
+		if tok.kind != sqlWord {
+			continue
+		}
+		name := strings.Trim(tok.text, "\"`")
+		for _, s := range schemas {
+			if s.Protocol == protocol && s.Live && strings.EqualFold(s.TableName, name) {
+				log.Printf("warn: live table %s: statement not supported by the live engine, answered by the mock: %s", s.TableName, query)
+				return
+			}
+		}
+	}
+}
+
+// DescribeLive returns the result columns a statement on a live table will
+// have, without running it, for drivers that describe prepared statements.
+func DescribeLive(protocol, query string) ([]string, bool) {
+	stmt, err := parseLive(protocol, query, nil)
+	if err != nil {
+		return nil, false
+	}
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	t := lookupLiveTable(protocol, stmt.table)
+	if t == nil {
+		return nil, false
+	}
+	stmt.scope.table = t
+	cols, err := stmt.columns(t)
+	return cols, err == nil
+}
+
+// ---- Captured statements -------------------------------------------------
+
+// CaptureLive records a statement answered from live tables as an
+// interaction in StateLive, keeping the latest response. Live interactions
+// document what ran; they never answer requests themselves.
+func CaptureLive(protocol, key string, req InteractionRequest, resp InteractionResponse) *Interaction {
+	i := RegisterInteraction(protocol, key, req)
+	mu.Lock()
+	defer mu.Unlock()
+	if i.State == StatePending || i.State == StateLive {
+		i.State = StateLive
+		i.Response = &resp
+	}
+	return i
+}
@@ -0,0 +1,1847 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Live SQL: parsing ---------------------------------------------------
+
+// The engine understands one table per statement:
+//
+//	SELECT [DISTINCT] items FROM t [WHERE …] [GROUP BY …] [HAVING …]
+//	       [ORDER BY …] [LIMIT n [OFFSET m]] [FOR UPDATE …]
+//	INSERT [IGNORE] INTO t [(cols)] VALUES (…), … [ON CONFLICT … | ON
+//	       DUPLICATE KEY UPDATE …] [RETURNING …]
+//	UPDATE t SET col = expr, … [WHERE …] [RETURNING …]
+//	DELETE FROM t [WHERE …] [RETURNING …]
+//
+// with comparisons, AND / OR / NOT, IN, BETWEEN, LIKE, IS NULL, arithmetic,
+// COUNT / SUM / MIN / MAX / AVG and a few scalar functions. Anything else
+// is not supported and leaves the statement to the regular mock.
+
+var errLiveUnsupported = errors.New("not supported by the live engine")
+
+// liveError carries an SQL error to send to the client, as opposed to
+// errLiveUnsupported.
+type liveError struct{ reply *ErrorReply }
+
+func (e *liveError) Error() string { return e.reply.Message }
+
+// liveExpr evaluates an expression against a row.
+type liveExpr func(row map[string]interface{}) (interface{}, error)
+
+// liveScope is what column references resolve against at execution time.
+type liveScope struct {
+	table    *liveTable
+	excluded map[string]interface{} // the proposed row of an upsert
+}
+
+type liveItem struct {
+	expr liveExpr
+	star bool
+}
+
+type liveOrder struct {
+	expr liveExpr
+	pos  int // ORDER BY 2: 1-based output column; 0 for expressions
+	desc bool
+}
+
+type liveAgg struct {
+	fn       string
+	arg      liveExpr // nil for COUNT(*)
+	distinct bool
+	result   interface{}
+}
+
+type liveSet struct {
+	col  string
+	expr liveExpr
+}
+
+type liveStmt struct {
+	protocol string
+	query    string
+	kind     string // select, insert, update, delete
+	table    string
+	scope    *liveScope
+
+	items    []liveItem // SELECT list or RETURNING
+	distinct bool
+	where    liveExpr
+	groupBy  []liveExpr
+	having   liveExpr
+	order    []liveOrder
+	limit    liveExpr
+	offset   liveExpr
+	aggs     []*liveAgg
+
+	cols     []string     // INSERT column list
+	values   [][]liveExpr // INSERT rows
+	ignore   bool         // INSERT IGNORE / ON CONFLICT DO NOTHING
+	onUpdate []liveSet    // ON DUPLICATE KEY UPDATE / ON CONFLICT DO UPDATE
+	sets     []liveSet    // UPDATE
+}
+
+type liveParser struct {
+	toks   []sqlToken
+	pos    int
+	params []*string
+	next   int // next ? placeholder
+	stmt   *liveStmt
+	inAgg  bool
+}
+
+// parseLive parses a statement for the live engine. params are the bound
+// values, nil for SQL NULL; the slice is nil when only describing.
+func parseLive(protocol, query string, params []*string) (*liveStmt, error) {
+	stmt := &liveStmt{protocol: protocol, query: query, scope: &liveScope{}}
+	p := &liveParser{toks: tokenizeSQL(protocol, query), params: params, stmt: stmt}
+	var err error
+	switch {
+	case p.acceptWord("select"):
+		err = p.parseSelect()
+	case p.acceptWord("insert"):
+		err = p.parseInsert()
+	case p.acceptWord("update"):
+		err = p.parseUpdate()
+	case p.acceptWord("delete"):
+		err = p.parseDelete()
+	default:
+		return nil, errLiveUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.accept(";")
+	if p.pos != len(p.toks) {
+		return nil, errLiveUnsupported
+	}
+	return stmt, nil
+}
+
+func (p *liveParser) peek() sqlToken {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return sqlToken{kind: sqlPunct} // end of statement
+}
+
+func (p *liveParser) isWord(w string) bool {
+	t := p.peek()
+	return t.kind == sqlWord && strings.EqualFold(t.text, w)
+}
+
+// acceptWord consumes a sequence of keywords, or nothing.
+func (p *liveParser) acceptWord(words ...string) bool {
+	for i, w := range words {
+		if p.pos+i >= len(p.toks) {
+			return false
+		}
+		t := p.toks[p.pos+i]
+		if t.kind != sqlWord || !strings.EqualFold(t.text, w) {
+			return false
+		}
+	}
+	p.pos += len(words)
+	return true
+}
+
+func (p *liveParser) expectWord(words ...string) error {
+	if !p.acceptWord(words...) {
+		return errLiveUnsupported
+	}
+	return nil
+}
+
+func (p *liveParser) accept(text string) bool {
+	if t := p.peek(); t.kind != sqlWord && t.kind != sqlLiteral && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *liveParser) expect(text string) error {
+	if !p.accept(text) {
+		return errLiveUnsupported
+	}
+	return nil
+}
+
+// ident reads an identifier, unquoted, skipping a schema qualifier.
+func (p *liveParser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != sqlWord || liveReserved[strings.ToLower(t.text)] {
+		return "", errLiveUnsupported
+	}
+	p.pos++
+	name := unquoteIdent(t.text)
+	if p.accept(".") {
+		return p.ident()
+	}
+	return name, nil
+}
+
+func unquoteIdent(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '`') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// Words that end an expression or a table reference.
+var liveReserved = map[string]bool{
+	"from": true, "where": true, "group": true, "having": true, "order": true, "limit": true,
+	"offset": true, "for": true, "returning": true, "on": true, "values": true, "set": true,
+	"and": true, "or": true, "not": true, "as": true, "asc": true, "desc": true, "join": true,
+	"inner": true, "left": true, "right": true, "full": true, "cross": true, "union": true,
+	"select": true, "into": true, "is": true, "in": true, "like": true, "ilike": true,
+	"between": true, "using": true, "natural": true, "lock": true, "window": true,
+}
+
+// tableRef reads "name [[AS] alias]"; the alias is accepted but not needed
+// with a single table.
+func (p *liveParser) tableRef() (string, error) {
+	name, err := p.ident()
+	if err != nil {
+		return "", err
+	}
+	p.acceptWord("as")
+	if t := p.peek(); t.kind == sqlWord && !liveReserved[strings.ToLower(t.text)] {
+		p.pos++
+	}
+	return name, nil
+}
+
+func (p *liveParser) parseSelect() error {
+	s := p.stmt
+	s.kind = "select"
+	s.distinct = p.acceptWord("distinct")
+	items, err := p.parseItems()
+	if err != nil {
+		return err
+	}
+	s.items = items
+	if err := p.expectWord("from"); err != nil {
+		return err
+	}
+	if s.table, err = p.tableRef(); err != nil {
+		return err
+	}
+	if p.accept(",") {
+		return errLiveUnsupported // joins
+	}
+	if p.acceptWord("where") {
+		if s.where, err = p.expr(); err != nil {
+			return err
+		}
+	}
+	if p.acceptWord("group", "by") {
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return err
+			}
+			s.groupBy = append(s.groupBy, e)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.acceptWord("having") {
+		if s.having, err = p.expr(); err != nil {
+			return err
+		}
+	}
+	if p.acceptWord("order", "by") {
+		for {
+			var o liveOrder
+			if t := p.peek(); t.kind == sqlLiteral && !t.str {
+				n, err := strconv.Atoi(t.text)
+				if err != nil || n < 1 {
+					return errLiveUnsupported
+				}
+				o.pos = n
+				p.pos++
+			} else if o.expr, err = p.expr(); err != nil {
+				return err
+			}
+			if p.acceptWord("desc") {
+				o.desc = true
+			} else {
+				p.acceptWord("asc")
+			}
+			if p.acceptWord("nulls") && !p.acceptWord("first") && !p.acceptWord("last") {
+				return errLiveUnsupported
+			}
+			s.order = append(s.order, o)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.acceptWord("limit") {
+		first, err := p.primary()
+		if err != nil {
+			return err
+		}
+		s.limit = first
+		if p.accept(",") { // LIMIT offset, count
+			s.offset = first
+			if s.limit, err = p.primary(); err != nil {
+				return err
+			}
+		}
+	}
+	if p.acceptWord("offset") {
+		if s.offset, err = p.primary(); err != nil {
+			return err
+		}
+		p.acceptWord("rows")
+	}
+	// Row locks have nothing to lock here.
+	if p.acceptWord("for") {
+		for p.pos < len(p.toks) && p.peek().text != ";" {
+			p.pos++
+		}
+	}
+	return nil
+}
+
+// parseItems reads a SELECT or RETURNING list. Aliases are read from the
+// statement text by SelectItems, so they are only skipped here.
+func (p *liveParser) parseItems() ([]liveItem, error) {
+	var items []liveItem
+	for {
+		if p.accept("*") {
+			items = append(items, liveItem{star: true})
+		} else {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, liveItem{expr: e})
+			if p.acceptWord("as") {
+				if _, err := p.ident(); err != nil {
+					return nil, err
+				}
+			} else if t := p.peek(); t.kind == sqlWord && !liveReserved[strings.ToLower(t.text)] {
+				p.pos++
+			}
+		}
+		if !p.accept(",") {
+			return items, nil
+		}
+	}
+}
+
+func (p *liveParser) parseInsert() error {
+	s := p.stmt
+	s.kind = "insert"
+	s.ignore = p.acceptWord("ignore")
+	if err := p.expectWord("into"); err != nil {
+		return err
+	}
+	var err error
+	if s.table, err = p.tableRef(); err != nil {
+		return err
+	}
+	if p.accept("(") {
+		for {
+			c, err := p.ident()
+			if err != nil {
+				return err
+			}
+			s.cols = append(s.cols, c)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+	}
+	if !p.acceptWord("values") && !p.acceptWord("value") {
+		return errLiveUnsupported // INSERT … SELECT, DEFAULT VALUES
+	}
+	for {
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		var row []liveExpr
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return err
+			}
+			row = append(row, e)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+		s.values = append(s.values, row)
+		if !p.accept(",") {
+			break
+		}
+	}
+	switch {
+	case p.acceptWord("on", "duplicate", "key", "update"):
+		if s.onUpdate, err = p.parseSets(); err != nil {
+			return err
+		}
+	case p.acceptWord("on", "conflict"):
+		if p.accept("(") {
+			for !p.accept(")") {
+				if p.pos >= len(p.toks) {
+					return errLiveUnsupported
+				}
+				p.pos++
+			}
+		} else if p.acceptWord("on", "constraint") {
+			if _, err := p.ident(); err != nil {
+				return err
+			}
+		}
+		if err := p.expectWord("do"); err != nil {
+			return err
+		}
+		if p.acceptWord("nothing") {
+			s.ignore = true
+		} else {
+			if err := p.expectWord("update", "set"); err != nil {
+				return err
+			}
+			if s.onUpdate, err = p.parseSets(); err != nil {
+				return err
+			}
+			if p.isWord("where") {
+				return errLiveUnsupported
+			}
+		}
+	}
+	return p.parseReturning()
+}
+
+// parseSets reads "col = expr, …".
+func (p *liveParser) parseSets() ([]liveSet, error) {
+	var sets []liveSet
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, liveSet{col: col, expr: e})
+		if !p.accept(",") {
+			return sets, nil
+		}
+	}
+}
+
+func (p *liveParser) parseUpdate() error {
+	s := p.stmt
+	s.kind = "update"
+	var err error
+	if s.table, err = p.tableRef(); err != nil {
+		return err
+	}
+	if err := p.expectWord("set"); err != nil {
+		return err
+	}
+	if s.sets, err = p.parseSets(); err != nil {
+		return err
+	}
+	if p.acceptWord("where") {
+		if s.where, err = p.expr(); err != nil {
+			return err
+		}
+	}
+	return p.parseReturning()
+}
+
+func (p *liveParser) parseDelete() error {
+	s := p.stmt
+	s.kind = "delete"
+	if err := p.expectWord("from"); err != nil {
+		return err
+	}
+	var err error
+	if s.table, err = p.tableRef(); err != nil {
+		return err
+	}
+	if p.acceptWord("where") {
+		if s.where, err = p.expr(); err != nil {
+			return err
+		}
+	}
+	return p.parseReturning()
+}
+
+func (p *liveParser) parseReturning() error {
+	if !p.acceptWord("returning") {
+		return nil
+	}
+	items, err := p.parseItems()
+	p.stmt.items = items
+	return err
+}
+
+// ---- Live SQL: expressions -----------------------------------------------
+
+func (p *liveParser) expr() (liveExpr, error) { return p.or() }
+
+func (p *liveParser) or() (liveExpr, error) {
+	left, err := p.and()
+	for err == nil && p.acceptWord("or") {
+		l := left
+		var r liveExpr
+		if r, err = p.and(); err == nil {
+			left = func(row map[string]interface{}) (interface{}, error) {
+				return logic(row, l, r, true)
+			}
+		}
+	}
+	return left, err
+}
+
+func (p *liveParser) and() (liveExpr, error) {
+	left, err := p.not()
+	for err == nil && p.acceptWord("and") {
+		l := left
+		var r liveExpr
+		if r, err = p.not(); err == nil {
+			left = func(row map[string]interface{}) (interface{}, error) {
+				return logic(row, l, r, false)
+			}
+		}
+	}
+	return left, err
+}
+
+// logic evaluates OR / AND with SQL's three-valued logic.
+func logic(row map[string]interface{}, l, r liveExpr, or bool) (interface{}, error) {
+	a, err := l(row)
+	if err != nil {
+		return nil, err
+	}
+	if a != nil && truthy(a) == or {
+		return or, nil
+	}
+	b, err := r(row)
+	if err != nil {
+		return nil, err
+	}
+	if b != nil && truthy(b) == or {
+		return or, nil
+	}
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	return !or, nil
+}
+
+func (p *liveParser) not() (liveExpr, error) {
+	if p.acceptWord("not") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(row map[string]interface{}) (interface{}, error) {
+			v, err := e(row)
+			if v == nil || err != nil {
+				return nil, err
+			}
+			return !truthy(v), nil
+		}, nil
+	}
+	return p.comparison()
+}
+
+func (p *liveParser) comparison() (liveExpr, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == sqlOther {
+		switch op := t.text; op {
+		case "=", "<>", "!=", "<", "<=", ">", ">=", "<=>":
+			p.pos++
+			right, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			return func(row map[string]interface{}) (interface{}, error) {
+				a, b, err := eval2(row, left, right)
+				if err != nil {
+					return nil, err
+				}
+				if op == "<=>" { // MySQL NULL-safe equality
+					return (a == nil && b == nil) || (a != nil && b != nil && compareValues(a, b) == 0), nil
+				}
+				if a == nil || b == nil {
+					return nil, nil
+				}
+				c := compareValues(a, b)
+				switch op {
+				case "=":
+					return c == 0, nil
+				case "<>", "!=":
+					return c != 0, nil
+				case "<":
+					return c < 0, nil
+				case "<=":
+					return c <= 0, nil
+				case ">":
+					return c > 0, nil
+				}
+				return c >= 0, nil
+			}, nil
+		}
+	}
+	negate := p.acceptWord("not")
+	var e liveExpr
+	switch {
+	case p.acceptWord("is"):
+		if negate {
+			return nil, errLiveUnsupported
+		}
+		isNot := p.acceptWord("not")
+		var want interface{}
+		switch {
+		case p.acceptWord("null"):
+		case p.acceptWord("true"):
+			want = true
+		case p.acceptWord("false"):
+			want = false
+		default:
+			return nil, errLiveUnsupported
+		}
+		return func(row map[string]interface{}) (interface{}, error) {
+			v, err := left(row)
+			if err != nil {
+				return nil, err
+			}
+			match := v == want
+			if want != nil && v != nil {
+				match = truthy(v) == want.(bool)
+			}
+			return match != isNot, nil
+		}, nil
+	case p.acceptWord("in"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var list []liveExpr
+		for {
+			if p.isWord("select") {
+				return nil, errLiveUnsupported
+			}
+			item, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		e = func(row map[string]interface{}) (interface{}, error) {
+			v, err := left(row)
+			if v == nil || err != nil {
+				return nil, err
+			}
+			sawNull := false
+			for _, item := range list {
+				x, err := item(row)
+				if err != nil {
+					return nil, err
+				}
+				if x == nil {
+					sawNull = true
+				} else if compareValues(v, x) == 0 {
+					return true, nil
+				}
+			}
+			if sawNull {
+				return nil, nil
+			}
+			return false, nil
+		}
+	case p.acceptWord("between"):
+		lo, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectWord("and"); err != nil {
+			return nil, err
+		}
+		hi, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		e = func(row map[string]interface{}) (interface{}, error) {
+			v, err := left(row)
+			if err != nil {
+				return nil, err
+			}
+			a, b, err := eval2(row, lo, hi)
+			if v == nil || a == nil || b == nil || err != nil {
+				return nil, err
+			}
+			return compareValues(v, a) >= 0 && compareValues(v, b) <= 0, nil
+		}
+	case p.isWord("like") || p.isWord("ilike"):
+		// MySQL's default collations compare case-insensitively.
+		fold := p.isWord("ilike") || p.stmt.protocol == ProtoMySQL
+		p.pos++
+		pattern, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		e = func(row map[string]interface{}) (interface{}, error) {
+			v, pat, err := eval2(row, left, pattern)
+			if v == nil || pat == nil || err != nil {
+				return nil, err
+			}
+			return likeValue(toString(pat), toString(v), fold), nil
+		}
+	default:
+		if negate {
+			return nil, errLiveUnsupported
+		}
+		return left, nil
+	}
+	if !negate {
+		return e, nil
+	}
+	return func(row map[string]interface{}) (interface{}, error) {
+		v, err := e(row)
+		if v == nil || err != nil {
+			return nil, err
+		}
+		return !v.(bool), nil
+	}, nil
+}
+
+func (p *liveParser) additive() (liveExpr, error) {
+	left, err := p.multiplicative()
+	for err == nil {
+		t := p.peek()
+		if t.kind != sqlOther || (t.text != "+" && t.text != "-" && t.text != "||") {
+			break
+		}
+		p.pos++
+		var right liveExpr
+		if right, err = p.multiplicative(); err == nil {
+			left = arith(p.stmt.protocol, t.text, left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *liveParser) multiplicative() (liveExpr, error) {
+	left, err := p.unary()
+	for err == nil {
+		t := p.peek()
+		if t.kind != sqlOther || (t.text != "*" && t.text != "/" && t.text != "%") {
+			break
+		}
+		p.pos++
+		var right liveExpr
+		if right, err = p.unary(); err == nil {
+			left = arith(p.stmt.protocol, t.text, left, right)
+		}
+	}
+	return left, err
+}
+
+func arith(protocol, op string, left, right liveExpr) liveExpr {
+	return func(row map[string]interface{}) (interface{}, error) {
+		a, b, err := eval2(row, left, right)
+		if a == nil || b == nil || err != nil {
+			return nil, err
+		}
+		if op == "||" {
+			return toString(a) + toString(b), nil
+		}
+		if x, ok := asInt(a); ok {
+			if y, ok := asInt(b); ok {
+				if v, ok := intArith(op, x, y, protocol); ok {
+					return v, nil
+				}
+			}
+		}
+		x, ok1 := toNumber(a)
+		y, ok2 := toNumber(b)
+		if !ok1 || !ok2 {
+			return nil, errLiveUnsupported
+		}
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		}
+		if y == 0 {
+			return nil, nil
+		}
+		if op == "%" {
+			return math.Mod(x, y), nil
+		}
+		return x / y, nil
+	}
+}
+
+func (p *liveParser) unary() (liveExpr, error) {
+	if t := p.peek(); t.kind == sqlOther && (t.text == "-" || t.text == "+") {
+		p.pos++
+		e, err := p.unary()
+		if err != nil || t.text == "+" {
+			return e, err
+		}
+		return arith(p.stmt.protocol, "-", constant(int64(0)), e), nil
+	}
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	// Casts change nothing for JSON-shaped values.
+	for p.accept("::") {
+		if _, err := p.ident(); err != nil {
+			return nil, err
+		}
+		if p.accept("(") {
+			for !p.accept(")") {
+				if p.pos >= len(p.toks) {
+					return nil, errLiveUnsupported
+				}
+				p.pos++
+			}
+		}
+	}
+	return e, nil
+}
+
+func constant(v interface{}) liveExpr {
+	return func(map[string]interface{}) (interface{}, error) { return v, nil }
+}
+
+func (p *liveParser) primary() (liveExpr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == sqlLiteral && t.str:
+		p.pos++
+		return constant(t.text), nil
+	case t.kind == sqlLiteral:
+		p.pos++
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return constant(n), nil
+		}
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, errLiveUnsupported
+		}
+		return constant(n), nil
+	case t.kind == sqlOther && (t.text == "?" || strings.HasPrefix(t.text, "$")):
+		p.pos++
+		idx := p.next
+		if t.text == "?" {
+			p.next++
+		} else {
+			n, err := strconv.Atoi(t.text[1:])
+			if err != nil || n < 1 {
+				return nil, errLiveUnsupported
+			}
+			idx = n - 1
+		}
+		if p.params == nil { // describing
+			return constant(nil), nil
+		}
+		if idx >= len(p.params) {
+			return nil, errLiveUnsupported
+		}
+		if p.params[idx] == nil {
+			return constant(nil), nil
+		}
+		return constant(*p.params[idx]), nil
+	case p.accept("("):
+		if p.isWord("select") {
+			return nil, errLiveUnsupported
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case t.kind != sqlWord:
+		return nil, errLiveUnsupported
+	}
+
+	switch strings.ToLower(t.text) {
+	case "null":
+		p.pos++
+		return constant(nil), nil
+	case "true", "false":
+		p.pos++
+		return constant(strings.EqualFold(t.text, "true")), nil
+	case "current_timestamp", "localtimestamp":
+		p.pos++
+		p.accept("(") // CURRENT_TIMESTAMP(6)
+		for p.peek().kind == sqlLiteral || p.peek().text == ")" {
+			p.pos++
+		}
+		return nowExpr, nil
+	}
+	if p.pos+1 < len(p.toks) && p.toks[p.pos+1].text == "(" {
+		return p.call()
+	}
+	return p.columnRef()
+}
+
+func nowExpr(map[string]interface{}) (interface{}, error) {
+	return time.Now().UTC().Format("2006-01-02 15:04:05"), nil
+}
+
+// columnRef reads col, t.col or excluded.col.
+func (p *liveParser) columnRef() (liveExpr, error) {
+	name, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	qualifier := ""
+	if p.accept(".") {
+		qualifier = name
+		if name, err = p.word(); err != nil {
+			return nil, err
+		}
+	}
+	scope := p.stmt.scope
+	if strings.EqualFold(qualifier, "excluded") {
+		return func(map[string]interface{}) (interface{}, error) {
+			return lookupFold(scope.excluded, name), nil
+		}, nil
+	}
+	return func(row map[string]interface{}) (interface{}, error) {
+		if c := scope.table.column(name); c != nil {
+			return row[c.name], nil
+		}
+		// An output column, for ORDER BY and HAVING on aliases
+		for k, v := range row {
+			if strings.EqualFold(k, name) {
+				return v, nil
+			}
+		}
+		return nil, &liveError{scope.table.unknownReference(name)}
+	}, nil
+}
+
+func (p *liveParser) word() (string, error) {
+	t := p.peek()
+	if t.kind != sqlWord || liveReserved[strings.ToLower(t.text)] {
+		return "", errLiveUnsupported
+	}
+	p.pos++
+	return unquoteIdent(t.text), nil
+}
+
+func lookupFold(row map[string]interface{}, name string) interface{} {
+	for k, v := range row {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// call reads a function call: an aggregate or one of a few scalar functions.
+func (p *liveParser) call() (liveExpr, error) {
+	fn := strings.ToLower(p.peek().text)
+	p.pos += 2 // name and (
+	switch fn {
+	case "count", "sum", "min", "max", "avg":
+		if p.inAgg {
+			return nil, errLiveUnsupported
+		}
+		agg := &liveAgg{fn: fn}
+		agg.distinct = p.acceptWord("distinct")
+		if fn == "count" && p.accept("*") {
+			// COUNT(*)
+		} else {
+			p.inAgg = true
+			arg, err := p.expr()
+			p.inAgg = false
+			if err != nil {
+				return nil, err
+			}
+			agg.arg = arg
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		p.stmt.aggs = append(p.stmt.aggs, agg)
+		return func(map[string]interface{}) (interface{}, error) { return agg.result, nil }, nil
+	case "values": // ON DUPLICATE KEY UPDATE c = VALUES(c)
+		name, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		scope := p.stmt.scope
+		return func(map[string]interface{}) (interface{}, error) {
+			return lookupFold(scope.excluded, name), nil
+		}, p.expect(")")
+	}
+	var args []liveExpr
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+	}
+	return scalarFunc(fn, args)
+}
+
+func scalarFunc(fn string, args []liveExpr) (liveExpr, error) {
+	one := func(f func(interface{}) interface{}) (liveExpr, error) {
+		if len(args) != 1 {
+			return nil, errLiveUnsupported
+		}
+		return func(row map[string]interface{}) (interface{}, error) {
+			v, err := args[0](row)
+			if v == nil || err != nil {
+				return nil, err
+			}
+			return f(v), nil
+		}, nil
+	}
+	switch fn {
+	case "lower", "lcase":
+		return one(func(v interface{}) interface{} { return strings.ToLower(toString(v)) })
+	case "upper", "ucase":
+		return one(func(v interface{}) interface{} { return strings.ToUpper(toString(v)) })
+	case "length", "char_length", "character_length":
+		return one(func(v interface{}) interface{} { return int64(len([]rune(toString(v)))) })
+	case "abs":
+		return one(func(v interface{}) interface{} {
+			if n, ok := asInt(v); ok && n != math.MinInt64 {
+				if n < 0 {
+					return -n
+				}
+				return n
+			}
+			n, _ := toNumber(v)
+			return math.Abs(n)
+		})
+	case "now", "current_timestamp", "localtimestamp", "utc_timestamp":
+		return nowExpr, nil
+	case "coalesce", "ifnull":
+		return func(row map[string]interface{}) (interface{}, error) {
+			for _, a := range args {
+				v, err := a(row)
+				if v != nil || err != nil {
+					return v, err
+				}
+			}
+			return nil, nil
+		}, nil
+	case "concat":
+		return func(row map[string]interface{}) (interface{}, error) {
+			var b strings.Builder
+			for _, a := range args {
+				v, err := a(row)
+				if err != nil {
+					return nil, err
+				}
+				if v != nil {
+					b.WriteString(toString(v))
+				}
+			}
+			return b.String(), nil
+		}, nil
+	}
+	return nil, errLiveUnsupported
+}
+
+// ---- Live SQL: values ----------------------------------------------------
+
+func eval2(row map[string]interface{}, a, b liveExpr) (interface{}, interface{}, error) {
+	x, err := a(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	y, err := b(row)
+	return x, y, err
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case int64:
+		return x != 0
+	case float64:
+		return x != 0
+	case string:
+		n, err := strconv.ParseFloat(x, 64)
+		if err == nil {
+			return n != 0
+		}
+		return x == "t" || strings.EqualFold(x, "true")
+	}
+	return v != nil
+}
+
+// asInt returns v as an exact integer: an int64, or a string or
+// json.Number holding one. Floats never are, so 1.5 + 1 stays fractional.
+func asInt(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return x, true
+	case json.Number:
+		n, err := strconv.ParseInt(x.String(), 10, 64)
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// intArith computes x op y on integers. ok is false when the result does
+// not fit an int64, or is not an integer: division in MySQL, or by zero.
+func intArith(op string, x, y int64, protocol string) (interface{}, bool) {
+	switch op {
+	case "+":
+		if r := x + y; (r > x) == (y > 0) {
+			return r, true
+		}
+	case "-":
+		if r := x - y; (r < x) == (y > 0) {
+			return r, true
+		}
+	case "*":
+		if x == 0 || y == 0 {
+			return int64(0), true
+		}
+		if r := x * y; r/y == x && !(x == -1 && y == math.MinInt64) && !(y == -1 && x == math.MinInt64) {
+			return r, true
+		}
+	case "/", "%":
+		// Postgres divides integers exactly, truncating; MySQL's / is a
+		// decimal division.
+		if y == 0 || y == -1 && x == math.MinInt64 || op == "/" && protocol == ProtoMySQL {
+			return nil, false
+		}
+		if op == "/" {
+			return x / y, true
+		}
+		return x % y, true
+	}
+	return nil, false
+}
+
+// sumInts adds integer values exactly; ok is false when one is not an
+// integer or the sum overflows.
+func sumInts(vals []interface{}) (int64, bool) {
+	var sum int64
+	for _, v := range vals {
+		n, ok := asInt(v)
+		if !ok {
+			return 0, false
+		}
+		r, ok := intArith("+", sum, n, "")
+		if !ok {
+			return 0, false
+		}
+		sum = r.(int64)
+	}
+	return sum, true
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case int64:
+		return float64(x), true
+	case json.Number:
+		n, err := x.Float64()
+		return n, err == nil
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// compareValues orders two non-NULL values: exactly when both are
+// integers, numerically when both read as numbers, else as strings.
+func compareValues(a, b interface{}) int {
+	if x, ok := asInt(a); ok {
+		if y, ok := asInt(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(toString(a), toString(b))
+}
+
+// compareNullable sorts NULLs first, like MySQL and Postgres DESC … NULLS
+// LAST.
+func compareNullable(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return compareValues(a, b)
+}
+
+// likeValue matches s against a LIKE pattern.
+func likeValue(pattern, s string, fold bool) bool {
+	if fold {
+		return sqlLikeMatch(strings.ToLower(pattern), strings.ToLower(s))
+	}
+	return sqlLikeMatch(pattern, s)
+}
+
+// sqlLikeMatch implements % and _ with backslash escapes.
+func sqlLikeMatch(pattern, s string) bool {
+	p, r := []rune(pattern), []rune(s)
+	var match func(i, j int) bool
+	match = func(i, j int) bool {
+		for i < len(p) {
+			switch p[i] {
+			case '%':
+				for k := j; k <= len(r); k++ {
+					if match(i+1, k) {
+						return true
+					}
+				}
+				return false
+			case '_':
+				if j >= len(r) {
+					return false
+				}
+			case '\\':
+				if i+1 < len(p) {
+					i++
+				}
+				fallthrough
+			default:
+				if j >= len(r) || r[j] != p[i] {
+					return false
+				}
+			}
+			i++
+			j++
+		}
+		return j == len(r)
+	}
+	return match(0, 0)
+}
+
+// ---- Live SQL: execution -------------------------------------------------
+
+// liveOutRow is a result row with its ORDER BY values, computed before the
+// next group's aggregates replace the current ones.
+type liveOutRow struct {
+	vals []interface{}
+	keys []interface{}
+}
+
+// liveLog records the writes of a statement so that they can be reverted:
+// at once when the statement fails, or later by ROLLBACK.
+type liveLog []func()
+
+func (l liveLog) undo() {
+	for i := len(l) - 1; i >= 0; i-- {
+		l[i]()
+	}
+}
+
+func (t *liveTable) insert(log *liveLog, vals map[string]interface{}) *liveRow {
+	r := &liveRow{vals: vals}
+	t.rows = append(t.rows, r)
+	*log = append(*log, func() {
+		if i := t.indexOf(r); i != -1 {
+			t.rows = append(t.rows[:i], t.rows[i+1:]...)
+		}
+	})
+	return r
+}
+
+func (t *liveTable) replace(log *liveLog, r *liveRow, vals map[string]interface{}) {
+	old := r.vals
+	r.vals = vals
+	*log = append(*log, func() { r.vals = old })
+}
+
+func (t *liveTable) remove(log *liveLog, r *liveRow) {
+	i := t.indexOf(r)
+	if i == -1 {
+		return
+	}
+	t.rows = append(t.rows[:i], t.rows[i+1:]...)
+	*log = append(*log, func() {
+		if i > len(t.rows) {
+			i = len(t.rows)
+		}
+		t.rows = append(t.rows[:i], append([]*liveRow{r}, t.rows[i:]...)...)
+	})
+}
+
+// exec runs the statement on t. Caller holds liveMu. A failing statement
+// leaves the table as it was.
+func (s *liveStmt) exec(t *liveTable) (*LiveResult, error) {
+	var log liveLog
+	var res *LiveResult
+	var err error
+	switch s.kind {
+	case "select":
+		res, err = s.execSelect(t)
+	case "insert":
+		res, err = s.execInsert(t, &log)
+	case "update":
+		res, err = s.execUpdate(t, &log)
+	default:
+		res, err = s.execDelete(t, &log)
+	}
+	if err != nil {
+		log.undo()
+		return nil, err
+	}
+	if len(log) > 0 {
+		res.Undo = func() {
+			liveMu.Lock()
+			defer liveMu.Unlock()
+			log.undo()
+		}
+	}
+	return res, nil
+}
+
+// columns returns the names of the result columns: the SELECT or RETURNING
+// list, with * expanded to the table's columns.
+func (s *liveStmt) columns(t *liveTable) ([]string, error) {
+	switch {
+	case len(s.items) == 0:
+		return nil, nil
+	case s.items[0].star:
+		if len(s.items) > 1 {
+			return nil, errLiveUnsupported
+		}
+		return t.columnNames(), nil
+	}
+	items := SelectItems(s.query)
+	if len(items) != len(s.items) {
+		return nil, errLiveUnsupported
+	}
+	names := make([]string, len(items))
+	for i, it := range items {
+		names[i] = it.Name()
+	}
+	return names, nil
+}
+
+// project evaluates the SELECT or RETURNING list against row.
+func (s *liveStmt) project(t *liveTable, row map[string]interface{}) ([]interface{}, error) {
+	if len(s.items) == 1 && s.items[0].star {
+		vals := make([]interface{}, len(t.cols))
+		for i, c := range t.cols {
+			vals[i] = row[c.name]
+		}
+		return vals, nil
+	}
+	vals := make([]interface{}, len(s.items))
+	for i, it := range s.items {
+		v, err := it.expr(row)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// matches returns the rows satisfying the WHERE clause.
+func (s *liveStmt) matches(t *liveTable) ([]*liveRow, error) {
+	var out []*liveRow
+	for _, r := range t.rows {
+		if s.where != nil {
+			v, err := s.where(r.vals)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil || !truthy(v) {
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (s *liveStmt) execSelect(t *liveTable) (*LiveResult, error) {
+	names, err := s.columns(t)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.matches(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each group becomes one output row; without GROUP BY or aggregates
+	// every row is its own group.
+	var groups [][]map[string]interface{}
+	switch {
+	case len(s.groupBy) > 0:
+		index := map[string]int{}
+		for _, r := range rows {
+			key := make([]interface{}, len(s.groupBy))
+			for i, g := range s.groupBy {
+				if key[i], err = g(r.vals); err != nil {
+					return nil, err
+				}
+			}
+			k := fmt.Sprint(key...)
+			if _, ok := index[k]; !ok {
+				index[k] = len(groups)
+				groups = append(groups, nil)
+			}
+			groups[index[k]] = append(groups[index[k]], r.vals)
+		}
+	case len(s.aggs) > 0:
+		group := []map[string]interface{}{}
+		for _, r := range rows {
+			group = append(group, r.vals)
+		}
+		groups = [][]map[string]interface{}{group}
+	default:
+		for _, r := range rows {
+			groups = append(groups, []map[string]interface{}{r.vals})
+		}
+	}
+
+	var out []liveOutRow
+	seen := map[string]bool{}
+	for _, group := range groups {
+		if err := s.aggregate(group); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		if len(group) > 0 {
+			row = group[0]
+		}
+		vals, err := s.project(t, row)
+		if err != nil {
+			return nil, err
+		}
+		// HAVING and ORDER BY may name output columns.
+		env := copyRow(row)
+		for i, name := range names {
+			if t.column(name) == nil {
+				env[name] = vals[i]
+			}
+		}
+		if s.having != nil {
+			v, err := s.having(env)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil || !truthy(v) {
+				continue
+			}
+		}
+		if s.distinct {
+			k := fmt.Sprintf("%#v", vals)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+		}
+		o := liveOutRow{vals: vals, keys: make([]interface{}, len(s.order))}
+		for i, ord := range s.order {
+			if ord.pos > 0 {
+				if ord.pos > len(vals) {
+					return nil, errLiveUnsupported
+				}
+				o.keys[i] = vals[ord.pos-1]
+			} else if o.keys[i], err = ord.expr(env); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, o)
+	}
+
+	sort.SliceStable(out, func(a, b int) bool {
+		for i, ord := range s.order {
+			c := compareNullable(out[a].keys[i], out[b].keys[i])
+			if c == 0 {
+				continue
+			}
+			if ord.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	if out, err = s.page(out); err != nil {
+		return nil, err
+	}
+
+	res := &LiveResult{Columns: names, Rows: []map[string]interface{}{}}
+	for _, o := range out {
+		res.Rows = append(res.Rows, outputRow(names, o.vals))
+	}
+	return res, nil
+}
+
+// aggregate computes the statement's aggregates over a group.
+func (s *liveStmt) aggregate(group []map[string]interface{}) error {
+	for _, a := range s.aggs {
+		var vals []interface{}
+		seen := map[string]bool{}
+		for _, row := range group {
+			if a.arg == nil { // COUNT(*)
+				vals = append(vals, true)
+				continue
+			}
+			v, err := a.arg(row)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				continue
+			}
+			if a.distinct {
+				k := fmt.Sprint(v)
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+			}
+			vals = append(vals, v)
+		}
+		a.result = nil
+		switch a.fn {
+		case "count":
+			a.result = int64(len(vals))
+		case "sum", "avg":
+			if len(vals) == 0 {
+				break
+			}
+			if a.fn == "sum" {
+				if sum, ok := sumInts(vals); ok {
+					a.result = sum
+					break
+				}
+			}
+			var sum float64
+			for _, v := range vals {
+				n, ok := toNumber(v)
+				if !ok {
+					return errLiveUnsupported
+				}
+				sum += n
+			}
+			a.result = sum
+			if a.fn == "avg" {
+				a.result = sum / float64(len(vals))
+			}
+		case "min", "max":
+			for _, v := range vals {
+				c := 0
+				if a.result != nil {
+					c = compareValues(v, a.result)
+				}
+				if a.result == nil || a.fn == "min" && c < 0 || a.fn == "max" && c > 0 {
+					a.result = v
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// page applies OFFSET and LIMIT.
+func (s *liveStmt) page(rows []liveOutRow) ([]liveOutRow, error) {
+	count := func(e liveExpr) (int, bool, error) {
+		if e == nil {
+			return 0, false, nil
+		}
+		v, err := e(nil)
+		if err != nil || v == nil {
+			return 0, false, err
+		}
+		n, ok := toNumber(v)
+		if !ok || n < 0 {
+			return 0, false, errLiveUnsupported
+		}
+		return int(n), true, nil
+	}
+	offset, _, err := count(s.offset)
+	if err != nil {
+		return nil, err
+	}
+	limit, hasLimit, err := count(s.limit)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= len(rows) {
+		return nil, nil
+	}
+	rows = rows[offset:]
+	if hasLimit && limit < len(rows) {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+func outputRow(names []string, vals []interface{}) map[string]interface{} {
+	row := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		row[name] = vals[i]
+	}
+	return row
+}
+
+// returning adds a written row to the RETURNING result, if any.
+func (s *liveStmt) returning(t *liveTable, res *LiveResult, names []string, row map[string]interface{}) error {
+	if len(s.items) == 0 {
+		return nil
+	}
+	vals, err := s.project(t, row)
+	if err != nil {
+		return err
+	}
+	res.Rows = append(res.Rows, outputRow(names, vals))
+	return nil
+}
+
+func (s *liveStmt) writeResult(t *liveTable) (*LiveResult, []string, error) {
+	names, err := s.columns(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := &LiveResult{Columns: names}
+	if len(s.items) > 0 {
+		res.Rows = []map[string]interface{}{}
+	}
+	return res, names, nil
+}
+
+func (s *liveStmt) execInsert(t *liveTable, log *liveLog) (*LiveResult, error) {
+	res, names, err := s.writeResult(t)
+	if err != nil {
+		return nil, err
+	}
+	cols := s.cols
+	if cols == nil {
+		cols = t.columnNames()
+	}
+	var idCol *liveColumn
+	for i := range t.cols {
+		if t.cols[i].autoInc {
+			idCol = &t.cols[i]
+		}
+	}
+	for _, exprs := range s.values {
+		if len(exprs) != len(cols) {
+			return nil, errLiveUnsupported
+		}
+		vals := map[string]interface{}{}
+		for i, e := range exprs {
+			v, err := e(nil)
+			if err != nil {
+				return nil, err
+			}
+			vals[cols[i]] = v
+		}
+		row, reply := t.newRow(vals)
+		if reply != nil {
+			return nil, &liveError{reply}
+		}
+		key := t.conflict(row, nil)
+		switch {
+		case key == nil:
+			t.insert(log, row)
+			res.AffectedRows++
+			if idCol != nil && res.LastInsertID == 0 && lookupFold(vals, idCol.name) == nil {
+				res.LastInsertID, _ = row[idCol.name].(int64)
+			}
+		case s.onUpdate != nil:
+			var existing *liveRow
+			for _, r := range t.rows {
+				if sameKey(key.cols, r.vals, row) {
+					existing = r
+					break
+				}
+			}
+			s.scope.excluded = row
+			updated, reply, err := s.applySets(t, existing, s.onUpdate)
+			if err != nil {
+				return nil, err
+			}
+			if reply != nil {
+				return nil, &liveError{reply}
+			}
+			t.replace(log, existing, updated)
+			row = updated
+			// MySQL counts an updated row twice.
+			res.AffectedRows++
+			if t.protocol == ProtoMySQL {
+				res.AffectedRows++
+			}
+		case s.ignore:
+			continue
+		default:
+			return nil, &liveError{t.duplicate(key, row)}
+		}
+		if err := s.returning(t, res, names, row); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// applySets computes a row's values after SET assignments and checks them
+// against the table's constraints.
+func (s *liveStmt) applySets(t *liveTable, r *liveRow, sets []liveSet) (map[string]interface{}, *ErrorReply, error) {
+	vals := copyRow(r.vals)
+	for _, set := range sets {
+		c := t.column(set.col)
+		if c == nil {
+			return nil, t.unknownColumn(set.col), nil
+		}
+		v, err := set.expr(r.vals)
+		if err != nil {
+			return nil, nil, err
+		}
+		cv, reply := t.coerce(c, v)
+		if reply != nil {
+			return nil, reply, nil
+		}
+		if c.notNull && cv == nil {
+			return nil, t.notNull(c.name), nil
+		}
+		vals[c.name] = cv
+	}
+	if key := t.conflict(vals, r); key != nil {
+		return nil, t.duplicate(key, vals), nil
+	}
+	return vals, nil, nil
+}
+
+func (s *liveStmt) execUpdate(t *liveTable, log *liveLog) (*LiveResult, error) {
+	res, names, err := s.writeResult(t)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.matches(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		vals, reply, err := s.applySets(t, r, s.sets)
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return nil, &liveError{reply}
+		}
+		// MySQL reports changed rows, Postgres matched ones.
+		if t.protocol != ProtoMySQL || fmt.Sprintf("%#v", vals) != fmt.Sprintf("%#v", r.vals) {
+			res.AffectedRows++
+		}
+		t.replace(log, r, vals)
+		if err := s.returning(t, res, names, vals); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (s *liveStmt) execDelete(t *liveTable, log *liveLog) (*LiveResult, error) {
+	res, names, err := s.writeResult(t)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.matches(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		t.remove(log, r)
+		res.AffectedRows++
+		if err := s.returning(t, res, names, r.vals); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
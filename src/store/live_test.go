@@ -0,0 +1,289 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// liveFixture sets up a live table per dialect, seeded with two users.
+func liveFixture(t *testing.T) {
+	t.Helper()
+	schemas = map[string]*Schema{}
+	ResetLiveTables()
+	t.Cleanup(func() {
+		schemas = map[string]*Schema{}
+		ResetLiveTables()
+	})
+	fixtures := Rows{
+		{"id": int64(1), "email": "ada@example.com", "name": "Ada", "balance": int64(9007199254740993)},
+		{"id": int64(2), "email": "bob@example.com", "name": "Bob", "balance": int64(10)},
+	}
+	UpsertSchema(ProtoPostgres, "users", `CREATE TABLE users (
+		id bigserial PRIMARY KEY,
+		email text NOT NULL UNIQUE,
+		name text,
+		balance bigint DEFAULT 0
+	)`)
+	UpsertSchema(ProtoMySQL, "users", "CREATE TABLE users (\n"+
+		"  id bigint NOT NULL AUTO_INCREMENT,\n"+
+		"  email varchar(255) NOT NULL,\n"+
+		"  name varchar(255),\n"+
+		"  balance bigint DEFAULT 0,\n"+
+		"  PRIMARY KEY (id),\n"+
+		"  UNIQUE KEY uq_email (email)\n"+
+		")")
+	for _, proto := range []string{ProtoPostgres, ProtoMySQL} {
+		if err := SetSchemaLive(proto, "users", true, fixtures); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseLive(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		query    string
+		ok       bool
+	}{
+		{"select", ProtoPostgres, "SELECT id, name FROM users WHERE id = $1 ORDER BY name LIMIT 1", true},
+		{"aggregate", ProtoMySQL, "SELECT name, COUNT(*) FROM users GROUP BY name HAVING COUNT(*) > 1", true},
+		{"insert returning", ProtoPostgres, "INSERT INTO users (email) VALUES ('c@x') RETURNING id", true},
+		{"upsert", ProtoPostgres, "INSERT INTO users (email) VALUES ('c@x') ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name", true},
+		{"on duplicate key", ProtoMySQL, "INSERT INTO users (email) VALUES ('c@x') ON DUPLICATE KEY UPDATE name = VALUES(name)", true},
+		{"update", ProtoMySQL, "UPDATE users SET balance = balance + 1 WHERE id IN (1, 2)", true},
+		{"delete", ProtoPostgres, "DELETE FROM users WHERE email LIKE '%@x'", true},
+		{"join", ProtoPostgres, "SELECT * FROM users u JOIN orders o ON o.user_id = u.id", false},
+		{"comma join", ProtoMySQL, "SELECT * FROM users, orders", false},
+		{"subquery", ProtoPostgres, "SELECT * FROM users WHERE id IN (SELECT user_id FROM orders)", false},
+		{"insert select", ProtoMySQL, "INSERT INTO users (email) SELECT email FROM staff", false},
+		{"ddl", ProtoPostgres, "ALTER TABLE users ADD COLUMN age int", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseLive(tt.protocol, tt.query, nil)
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("parsed = %v, want %v (err %v)", ok, tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestExecLive(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		protocol string
+		query    string
+		params   []*string
+		rows     []map[string]interface{}
+		affected int
+		insertID int64  // checked when set
+		sqlState string // expected error
+	}{
+		{
+			name:     "select by placeholder",
+			protocol: ProtoPostgres,
+			query:    "SELECT name FROM users WHERE id = $1",
+			params:   []*string{str("2")},
+			rows:     []map[string]interface{}{{"name": "Bob"}},
+		},
+		{
+			name:     "bigint beyond 2^53 keeps every digit",
+			protocol: ProtoMySQL,
+			query:    "SELECT balance + 1 AS b FROM users WHERE id = 1",
+			rows:     []map[string]interface{}{{"b": int64(9007199254740994)}},
+		},
+		{
+			name:     "bigint compares exactly",
+			protocol: ProtoPostgres,
+			query:    "SELECT id FROM users WHERE balance = 9007199254740993",
+			rows:     []map[string]interface{}{{"id": int64(1)}},
+		},
+		{
+			name:     "aggregates stay integral",
+			protocol: ProtoPostgres,
+			query:    "SELECT COUNT(*) AS n, SUM(id) AS s FROM users",
+			rows:     []map[string]interface{}{{"n": int64(2), "s": int64(3)}},
+		},
+		{
+			name:     "integer division",
+			protocol: ProtoPostgres,
+			query:    "SELECT id / 2 AS q FROM users WHERE id = 1",
+			rows:     []map[string]interface{}{{"q": int64(0)}},
+		},
+		{
+			name:     "mysql division is decimal",
+			protocol: ProtoMySQL,
+			query:    "SELECT id / 2 AS q FROM users WHERE id = 1",
+			rows:     []map[string]interface{}{{"q": 0.5}},
+		},
+		{
+			name:     "insert takes the next id",
+			protocol: ProtoMySQL,
+			query:    "INSERT INTO users (email, name) VALUES (?, ?)",
+			params:   []*string{str("cy@example.com"), nil},
+			affected: 1,
+			insertID: 3,
+		},
+		{
+			name:     "returning",
+			protocol: ProtoPostgres,
+			query:    "INSERT INTO users (email) VALUES ('cy@example.com') RETURNING id, balance",
+			rows:     []map[string]interface{}{{"id": int64(3), "balance": int64(0)}},
+			affected: 1,
+		},
+		{
+			name:     "update",
+			protocol: ProtoPostgres,
+			query:    "UPDATE users SET name = upper(name) WHERE id > 0",
+			affected: 2,
+		},
+		{
+			name:     "delete",
+			protocol: ProtoMySQL,
+			query:    "DELETE FROM users WHERE name = 'Bob'",
+			affected: 1,
+		},
+		{
+			name:     "not null",
+			protocol: ProtoPostgres,
+			query:    "INSERT INTO users (name) VALUES ('Cy')",
+			sqlState: "23502",
+		},
+		{
+			name:     "duplicate primary key",
+			protocol: ProtoMySQL,
+			query:    "INSERT INTO users (id, email) VALUES (1, 'new@example.com')",
+			sqlState: "23000",
+		},
+		{
+			name:     "duplicate unique key",
+			protocol: ProtoPostgres,
+			query:    "UPDATE users SET email = 'ada@example.com' WHERE id = 2",
+			sqlState: "23505",
+		},
+		{
+			name:     "invalid integer",
+			protocol: ProtoPostgres,
+			query:    "UPDATE users SET balance = 'lots' WHERE id = 2",
+			sqlState: "22P02",
+		},
+		{
+			name:     "on conflict do nothing",
+			protocol: ProtoPostgres,
+			query:    "INSERT INTO users (email) VALUES ('ada@example.com') ON CONFLICT DO NOTHING",
+		},
+		{
+			name:     "on conflict do update",
+			protocol: ProtoPostgres,
+			query:    "INSERT INTO users (email, name) VALUES ('ada@example.com', 'Ada L') ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name RETURNING id, name",
+			rows:     []map[string]interface{}{{"id": int64(1), "name": "Ada L"}},
+			affected: 1,
+		},
+		{
+			name:     "insert ignore",
+			protocol: ProtoMySQL,
+			query:    "INSERT IGNORE INTO users (email) VALUES ('bob@example.com')",
+		},
+		{
+			name:     "on duplicate key update",
+			protocol: ProtoMySQL,
+			query:    "INSERT INTO users (email, name) VALUES ('bob@example.com', 'Robert') ON DUPLICATE KEY UPDATE name = VALUES(name)",
+			affected: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			liveFixture(t)
+			res, ok := ExecLive(tt.protocol, tt.query, tt.params)
+			if !ok {
+				t.Fatal("not handled by the live engine")
+			}
+			if tt.sqlState != "" {
+				if res.Error == nil || res.Error.SQLState != tt.sqlState {
+					t.Fatalf("error = %+v, want SQLSTATE %s", res.Error, tt.sqlState)
+				}
+				return
+			}
+			if res.Error != nil {
+				t.Fatalf("error = %+v", res.Error)
+			}
+			if tt.rows != nil && !reflect.DeepEqual(res.Rows, tt.rows) {
+				t.Errorf("rows = %v, want %v", res.Rows, tt.rows)
+			}
+			if res.AffectedRows != tt.affected {
+				t.Errorf("affected = %d, want %d", res.AffectedRows, tt.affected)
+			}
+			if tt.insertID != 0 && res.LastInsertID != tt.insertID {
+				t.Errorf("last insert id = %d, want %d", res.LastInsertID, tt.insertID)
+			}
+		})
+	}
+}
+
+func TestExecLiveUnsupported(t *testing.T) {
+	liveFixture(t)
+	for _, query := range []string{
+		"SELECT * FROM users u JOIN orders o ON o.user_id = u.id",
+		"SELECT * FROM users WHERE id IN (SELECT user_id FROM orders)",
+		"SELECT * FROM orders", // no live table
+	} {
+		if _, ok := ExecLive(ProtoPostgres, query, nil); ok {
+			t.Errorf("%s: handled by the live engine", query)
+		}
+	}
+}
+
+func TestLiveUndo(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"insert", "INSERT INTO users (email) VALUES ('cy@example.com')"},
+		{"update", "UPDATE users SET name = 'X', balance = balance * 2"},
+		{"delete", "DELETE FROM users WHERE id = 1"},
+		{"upsert", "INSERT INTO users (email, name) VALUES ('bob@example.com', 'B') ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			liveFixture(t)
+			before, _ := LiveRows(ProtoPostgres, "users")
+			res, ok := ExecLive(ProtoPostgres, tt.query, nil)
+			if !ok || res.Error != nil || res.Undo == nil {
+				t.Fatalf("exec: ok=%v result=%+v", ok, res)
+			}
+			if after, _ := LiveRows(ProtoPostgres, "users"); reflect.DeepEqual(after, before) {
+				t.Fatal("statement changed nothing")
+			}
+			res.Undo()
+			if after, _ := LiveRows(ProtoPostgres, "users"); !reflect.DeepEqual(after, before) {
+				t.Errorf("rows after undo = %v, want %v", after, before)
+			}
+		})
+	}
+}
+
+func TestRowsKeepBigints(t *testing.T) {
+	var rows Rows
+	if err := rows.UnmarshalJSON([]byte(`[{"id": 9007199254740993}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := asInt(rows[0]["id"]); !ok || n != 9007199254740993 {
+		t.Errorf("id = %v, want 9007199254740993", rows[0]["id"])
+	}
+}
+
+func TestResponseRowsKeepBigints(t *testing.T) {
+	var resp InteractionResponse
+	if err := json.Unmarshal([]byte(`{"rows": [{"id": 9007199254740993, "total": 12345678901234567.89}]}`), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for col, want := range map[string]string{"id": "9007199254740993", "total": "12345678901234567.89"} {
+		if got := fmt.Sprint(resp.Rows[0][col]); got != want {
+			t.Errorf("%s = %s, want %s", col, got, want)
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---- Matcher -------------------------------------------------------------
+
+// Matcher lets a configured interaction answer requests by rule instead of
+// exact key equality. Every field that is set must match; unset fields are
+// ignored. When several matchers accept a request the highest Priority wins.
+type Matcher struct {
+	Priority int `json:"priority,omitempty"`
+
+	// HTTP / DynamoDB
+	Method       string            `json:"method,omitempty"`
+	Host         string            `json:"host,omitempty"`         // glob, e.g. "*.example.com"
+	PathTemplate string            `json:"pathTemplate,omitempty"` // e.g. "/orders/{id}"
+	PathRegex    string            `json:"pathRegex,omitempty"`
+	Query        map[string]string `json:"query,omitempty"` // parameter → glob
+	Headers      []HeaderPredicate `json:"headers,omitempty"`
+	BodyJSON     []JSONPredicate   `json:"bodyJSON,omitempty"`
+	// BodyIgnore compares the JSON body against the captured request body,
+	// ignoring the listed JSONPaths (timestamps, request IDs, …).
+	BodyIgnore []string `json:"bodyIgnore,omitempty"`
+
+	// MySQL / Postgres: LIKE-style pattern where % matches any run of text.
+	QueryPattern string `json:"queryPattern,omitempty"`
+	QueryRegex   string `json:"queryRegex,omitempty"`
+
+	// Redis command, plus per-position globs for Redis args or SQL params
+	// ("*" matches any value, null only a parameter bound as SQL NULL).
+	Command string    `json:"command,omitempty"`
+	Args    []*string `json:"args,omitempty"`
+
+	// Redis scripts: the SHA1 of the script and per-position globs for its
+	// KEYS; Args then matches ARGV.
+	ScriptSHA string   `json:"scriptSha,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
+}
+
+type HeaderPredicate struct {
+	Name     string `json:"name"`
+	Equals   string `json:"equals,omitempty"`
+	Contains string `json:"contains,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+	Absent   bool   `json:"absent,omitempty"`
+}
+
+type JSONPredicate struct {
+	Path   string      `json:"path"` // e.g. "$.order.items[0].sku"
+	Equals interface{} `json:"equals"`
+}
+
+// Validate checks that the matcher has at least one predicate and that all
+// regular expressions and paths compile. A matcher without predicates would
+// answer every request of its protocol and hide anything new from capture.
+func (m *Matcher) Validate() error {
+	if m.empty() {
+		return fmt.Errorf("matcher has no predicates")
+	}
+	if m.PathRegex != "" {
+		if _, err := compileRegex(m.PathRegex); err != nil {
+			return fmt.Errorf("pathRegex: %w", err)
+		}
+	}
+	if m.QueryRegex != "" {
+		if _, err := compileRegex(m.QueryRegex); err != nil {
+			return fmt.Errorf("queryRegex: %w", err)
+		}
+	}
+	for _, h := range m.Headers {
+		if h.Name == "" {
+			return fmt.Errorf("header predicate without name")
+		}
+		if h.Regex != "" {
+			if _, err := compileRegex(h.Regex); err != nil {
+				return fmt.Errorf("header %s regex: %w", h.Name, err)
+			}
+		}
+	}
+	for _, p := range m.BodyJSON {
+		if _, err := parseJSONPath(p.Path); err != nil {
+			return err
+		}
+	}
+	for _, p := range m.BodyIgnore {
+		if _, err := parseJSONPath(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// empty reports whether no field other than Priority is set.
+func (m *Matcher) empty() bool {
+	return m.Method == "" && m.Host == "" && m.PathTemplate == "" && m.PathRegex == "" &&
+		len(m.Query) == 0 && len(m.Headers) == 0 && len(m.BodyJSON) == 0 && len(m.BodyIgnore) == 0 &&
+		m.QueryPattern == "" && m.QueryRegex == "" && m.Command == "" && len(m.Args) == 0 &&
+		m.ScriptSHA == "" && len(m.Keys) == 0
+}
+
+// Match reports whether a request of protocol satisfies the matcher.
+// captured is the request stored on the interaction, used by BodyIgnore.
+func (m *Matcher) Match(protocol string, req, captured InteractionRequest) bool {
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	if m.Host != "" {
+		if ok, _ := path.Match(m.Host, req.Host); !ok {
+			return false
+		}
+	}
+	if m.PathTemplate != "" {
+		if _, ok := MatchPathTemplate(m.PathTemplate, req.Path); !ok {
+			return false
+		}
+	}
+	if m.PathRegex != "" && !regexMatch(m.PathRegex, req.Path) {
+		return false
+	}
+	if len(m.Query) > 0 {
+		q, _ := url.ParseQuery(req.QueryString)
+		for name, pattern := range m.Query {
+			if !globAny(pattern, q[name]) {
+				return false
+			}
+		}
+	}
+	for _, h := range m.Headers {
+		if !h.match(req.Headers) {
+			return false
+		}
+	}
+	if len(m.BodyJSON) > 0 || len(m.BodyIgnore) > 0 {
+		var body interface{}
+		if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+			return false
+		}
+		for _, p := range m.BodyJSON {
+			v, ok := jsonPathGet(body, p.Path)
+			if !ok || !jsonEqual(v, p.Equals) {
+				return false
+			}
+		}
+		if len(m.BodyIgnore) > 0 {
+			var want interface{}
+			if err := json.Unmarshal([]byte(captured.Body), &want); err != nil {
+				return false
+			}
+			for _, p := range m.BodyIgnore {
+				jsonPathDelete(body, p)
+				jsonPathDelete(want, p)
+			}
+			if !reflect.DeepEqual(body, want) {
+				return false
+			}
+		}
+	}
+	if m.QueryPattern != "" || m.QueryRegex != "" {
+		// Either the statement as sent or its normalized form may match.
+		norm, _ := NormalizeSQL(protocol, req.Query)
+		if m.QueryPattern != "" && !likeMatch(m.QueryPattern, req.Query) && !likeMatch(m.QueryPattern, norm) {
+			return false
+		}
+		if m.QueryRegex != "" && !regexMatch(m.QueryRegex, req.Query) && !regexMatch(m.QueryRegex, norm) {
+			return false
+		}
+	}
+	if m.Command != "" && !strings.EqualFold(m.Command, req.Command) {
+		return false
+	}
+	if m.Args != nil {
+		values := stringPtrs(req.Args)
+		if req.Query != "" {
+			values = req.SQLParams()
+		}
+		if !argsMatch(m.Args, values) {
+			return false
+		}
+	}
+	if m.ScriptSHA != "" && !strings.EqualFold(m.ScriptSHA, req.ScriptSHA) {
+		return false
+	}
+	if m.Keys != nil && !argsMatch(stringPtrs(m.Keys), stringPtrs(req.Keys)) {
+		return false
+	}
+	return true
+}
+
+func (h HeaderPredicate) match(headers map[string]string) bool {
+	v, present := "", false
+	for k, val := range headers {
+		if strings.EqualFold(k, h.Name) {
+			v, present = val, true
+			break
+		}
+	}
+	if h.Absent {
+		return !present
+	}
+	if !present {
+		return false
+	}
+	if h.Equals != "" && v != h.Equals {
+		return false
+	}
+	if h.Contains != "" && !strings.Contains(v, h.Contains) {
+		return false
+	}
+	if h.Regex != "" && !regexMatch(h.Regex, v) {
+		return false
+	}
+	return true
+}
+
+// ---- Lookup --------------------------------------------------------------
+
+// lookupConfigured finds the configured interaction that answers a request,
+// skipping interactions whose scenario is in another state. An exact key
+// match always wins; otherwise the matching rule with the highest priority
+// is used, with ties going to the oldest interaction. Caller holds mu.
+func lookupConfigured(protocol, key string, req InteractionRequest) *Interaction {
+	var best *Interaction
+	for _, i := range interactions {
+		if i.Protocol != protocol || i.State != StateConfigured || !inScenarioState(i) {
+			continue
+		}
+		if i.Key == key {
+			return i
+		}
+		if i.Matcher == nil || !i.Matcher.Match(protocol, req, i.Request) {
+			continue
+		}
+		if best == nil ||
+			i.Matcher.Priority > best.Matcher.Priority ||
+			(i.Matcher.Priority == best.Matcher.Priority && i.CapturedAt.Before(best.CapturedAt)) {
+			best = i
+		}
+	}
+	return best
+}
+
+// LookupConfiguredQuery returns a configured interaction captured for the
+// same normalized SQL, whatever its parameters. Drivers describe a prepared
+// statement's result columns before binding, so this is the best guess.
+func LookupConfiguredQuery(protocol, query string) *Interaction {
+	mu.RLock()
+	defer mu.RUnlock()
+	norm, _ := NormalizeSQL(protocol, query)
+	var best *Interaction
+	for _, i := range interactions {
+		if i.Protocol != protocol || i.State != StateConfigured || !inScenarioState(i) {
+			continue
+		}
+		if q, _ := NormalizeSQL(protocol, i.Request.Query); q != norm {
+			continue
+		}
+		if best == nil || i.CapturedAt.Before(best.CapturedAt) {
+			best = i
+		}
+	}
+	return best
+}
+
+func SetMatcher(id string, m *Matcher) error {
+	if m != nil {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	i, ok := interactions[id]
+	if !ok {
+		return fmt.Errorf("interaction %s not found", id)
+	}
+	i.Matcher = m
+	return nil
+}
+
+// ---- Pattern helpers -----------------------------------------------------
+
+// MatchPathTemplate matches a path like "/orders/42" against "/orders/{id}"
+// and returns the captured segments. A bare "*" segment matches anything
+// without capturing, and a trailing "{name*}" captures the rest of the path.
+func MatchPathTemplate(tmpl, p string) (map[string]string, bool) {
+	ts := strings.Split(strings.Trim(tmpl, "/"), "/")
+	ps := strings.Split(strings.Trim(p, "/"), "/")
+	params := map[string]string{}
+	for idx, seg := range ts {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "*}") && idx == len(ts)-1 {
+			if idx > len(ps) {
+				return nil, false
+			}
+			params[seg[1:len(seg)-2]] = strings.Join(ps[idx:], "/")
+			return params, true
+		}
+		if idx >= len(ps) {
+			return nil, false
+		}
+		switch {
+		case seg == "*":
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			params[seg[1:len(seg)-1]] = ps[idx]
+		case seg != ps[idx]:
+			return nil, false
+		}
+	}
+	if len(ts) != len(ps) {
+		return nil, false
+	}
+	return params, true
+}
+
+var (
+	regexMu    sync.Mutex
+	regexCache = map[string]*regexp.Regexp{}
+)
+
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	regexMu.Lock()
+	defer regexMu.Unlock()
+	if re, ok := regexCache[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	regexCache[expr] = re
+	return re, nil
+}
+
+func regexMatch(expr, s string) bool {
+	re, err := compileRegex(expr)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(s)
+}
+
+func globAny(pattern string, values []string) bool {
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func argsMatch(patterns, args []*string) bool {
+	if len(patterns) != len(args) {
+		return false
+	}
+	for idx, p := range patterns {
+		switch {
+		case p == nil:
+			if args[idx] != nil {
+				return false
+			}
+		case *p == "*":
+		case args[idx] == nil:
+			return false
+		default:
+			if ok, _ := path.Match(*p, *args[idx]); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func stringPtrs(values []string) []*string {
+	if values == nil {
+		return nil
+	}
+	out := make([]*string, len(values))
+	for idx := range values {
+		out[idx] = &values[idx]
+	}
+	return out
+}
+
+// likeMatch compares SQL case-insensitively with whitespace collapsed; '%'
+// in the pattern matches any run of characters.
+func likeMatch(pattern, s string) bool {
+	norm := func(x string) string { return strings.ToLower(strings.Join(strings.Fields(x), " ")) }
+	parts := strings.Split(norm(pattern), "%")
+	for idx := range parts {
+		parts[idx] = regexp.QuoteMeta(parts[idx])
+	}
+	return regexMatch("^"+strings.Join(parts, ".*")+"$", norm(s))
+}
+
+// ---- JSONPath (subset) ---------------------------------------------------
+
+// jsonPathStep is either an object field or an array index.
+type jsonPathStep struct {
+	field string
+	index int
+	isIdx bool
+}
+
+// parseJSONPath accepts "$.a.b[0].c", "a.b[0]" and "$['a']" style paths.
+func parseJSONPath(p string) ([]jsonPathStep, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(p), "$")
+	var steps []jsonPathStep
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("jsonpath %q: unterminated [", p)
+			}
+			inner := s[1:end]
+			s = s[end+1:]
+			if n, err := strconv.Atoi(inner); err == nil {
+				steps = append(steps, jsonPathStep{index: n, isIdx: true})
+			} else {
+				steps = append(steps, jsonPathStep{field: strings.Trim(inner, `'"`)})
+			}
+		default:
+			end := strings.IndexAny(s, ".[")
+			if end == -1 {
+				end = len(s)
+			}
+			steps = append(steps, jsonPathStep{field: s[:end]})
+			s = s[end:]
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("jsonpath %q: empty path", p)
+	}
+	return steps, nil
+}
+
+func jsonPathGet(v interface{}, p string) (interface{}, bool) {
+	steps, err := parseJSONPath(p)
+	if err != nil {
+		return nil, false
+	}
+	for _, st := range steps {
+		var ok bool
+		if v, ok = jsonStep(v, st); !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func jsonStep(v interface{}, st jsonPathStep) (interface{}, bool) {
+	if st.isIdx {
+		arr, ok := v.([]interface{})
+		if !ok || st.index < 0 || st.index >= len(arr) {
+			return nil, false
+		}
+		return arr[st.index], true
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	out, ok := obj[st.field]
+	return out, ok
+}
+
+// jsonPathDelete removes the value at p (object fields only; array elements
+// are blanked to nil so indexes stay stable).
+func jsonPathDelete(v interface{}, p string) {
+	steps, err := parseJSONPath(p)
+	if err != nil {
+		return
+	}
+	for _, st := range steps[:len(steps)-1] {
+		var ok bool
+		if v, ok = jsonStep(v, st); !ok {
+			return
+		}
+	}
+	last := steps[len(steps)-1]
+	switch c := v.(type) {
+	case map[string]interface{}:
+		if !last.isIdx {
+			delete(c, last.field)
+		}
+	case []interface{}:
+		if last.isIdx && last.index >= 0 && last.index < len(c) {
+			c[last.index] = nil
+		}
+	}
+}
+
+// jsonEqual compares decoded JSON values, letting "42" match 42 so that
+// matchers typed in the UI as strings still compare against numbers. No
+// other values of different types are equal.
+func jsonEqual(got, want interface{}) bool {
+	if reflect.DeepEqual(got, want) {
+		return true
+	}
+	if n, ok := got.(float64); ok {
+		return numericString(want, n)
+	}
+	if n, ok := want.(float64); ok {
+		return numericString(got, n)
+	}
+	return false
+}
+
+// numericString reports whether v is a string holding the number n.
+func numericString(v interface{}, n float64) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return err == nil && f == n
+}
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMatcherMatch(t *testing.T) {
+	str := func(s string) *string { return &s }
+	order := InteractionRequest{
+		Method:      "POST",
+		Host:        "api.example.com",
+		Path:        "/orders/42",
+		QueryString: "expand=items&page=2",
+		Headers:     map[string]string{"X-Tenant-Id": "acme", "Accept": "application/json"},
+		Body:        `{"order": {"id": "42", "total": 9.5, "items": [{"sku": "A-1"}]}, "sentAt": "now"}`,
+	}
+	tests := []struct {
+		name     string
+		protocol string
+		matcher  Matcher
+		req      InteractionRequest
+		captured InteractionRequest
+		want     bool
+	}{
+		{"method ignores case", ProtoHTTP, Matcher{Method: "post"}, order, InteractionRequest{}, true},
+		{"method", ProtoHTTP, Matcher{Method: "GET"}, order, InteractionRequest{}, false},
+		{"host glob", ProtoHTTP, Matcher{Host: "*.example.com"}, order, InteractionRequest{}, true},
+		{"host glob elsewhere", ProtoHTTP, Matcher{Host: "*.example.org"}, order, InteractionRequest{}, false},
+		{"path template", ProtoHTTP, Matcher{PathTemplate: "/orders/{id}"}, order, InteractionRequest{}, true},
+		{"path template too short", ProtoHTTP, Matcher{PathTemplate: "/orders/{id}/items"}, order, InteractionRequest{}, false},
+		{"path regex", ProtoHTTP, Matcher{PathRegex: `^/orders/\d+$`}, order, InteractionRequest{}, true},
+		{"query glob", ProtoHTTP, Matcher{Query: map[string]string{"page": "[0-9]"}}, order, InteractionRequest{}, true},
+		{"missing query parameter", ProtoHTTP, Matcher{Query: map[string]string{"sort": "*"}}, order, InteractionRequest{}, false},
+		{"header equals, name in any case", ProtoHTTP, Matcher{Headers: []HeaderPredicate{{Name: "x-tenant-id", Equals: "acme"}}}, order, InteractionRequest{}, true},
+		{"header contains", ProtoHTTP, Matcher{Headers: []HeaderPredicate{{Name: "Accept", Contains: "json"}}}, order, InteractionRequest{}, true},
+		{"header absent", ProtoHTTP, Matcher{Headers: []HeaderPredicate{{Name: "Authorization", Absent: true}}}, order, InteractionRequest{}, true},
+		{"header present", ProtoHTTP, Matcher{Headers: []HeaderPredicate{{Name: "Accept", Absent: true}}}, order, InteractionRequest{}, false},
+		{"body string", ProtoHTTP, Matcher{BodyJSON: []JSONPredicate{{Path: "$.order.items[0].sku", Equals: "A-1"}}}, order, InteractionRequest{}, true},
+		{"body number typed as string", ProtoHTTP, Matcher{BodyJSON: []JSONPredicate{{Path: "$.order.total", Equals: "9.5"}}}, order, InteractionRequest{}, true},
+		{"body numeric string typed as number", ProtoHTTP, Matcher{BodyJSON: []JSONPredicate{{Path: "$.order.id", Equals: 42.0}}}, order, InteractionRequest{}, true},
+		{"body number differs", ProtoHTTP, Matcher{BodyJSON: []JSONPredicate{{Path: "$.order.total", Equals: "9.50001"}}}, order, InteractionRequest{}, false},
+		{"body missing path", ProtoHTTP, Matcher{BodyJSON: []JSONPredicate{{Path: "$.order.coupon", Equals: "X"}}}, order, InteractionRequest{}, false},
+		{
+			name:     "body ignoring a path",
+			protocol: ProtoHTTP,
+			matcher:  Matcher{BodyIgnore: []string{"$.sentAt"}},
+			req:      order,
+			captured: InteractionRequest{Body: `{"order": {"id": "42", "total": 9.5, "items": [{"sku": "A-1"}]}, "sentAt": "yesterday"}`},
+			want:     true,
+		},
+		{
+			name:     "body ignoring another path",
+			protocol: ProtoHTTP,
+			matcher:  Matcher{BodyIgnore: []string{"$.order.id"}},
+			req:      order,
+			captured: InteractionRequest{Body: `{"order": {"id": "7", "total": 9.5, "items": [{"sku": "A-1"}]}, "sentAt": "yesterday"}`},
+			want:     false,
+		},
+		{"every predicate must hold", ProtoHTTP, Matcher{Method: "POST", Host: "other.example.com"}, order, InteractionRequest{}, false},
+		{
+			name:     "query pattern against the normalized statement",
+			protocol: ProtoPostgres,
+			matcher:  Matcher{QueryPattern: "SELECT % FROM users WHERE id = $1"},
+			req:      InteractionRequest{Query: "select name  from users where id = $1"},
+			want:     true,
+		},
+		{
+			name:     "query regex",
+			protocol: ProtoMySQL,
+			matcher:  Matcher{QueryRegex: `(?i)^insert into audit`},
+			req:      InteractionRequest{Query: "INSERT INTO audit (msg) VALUES (?)"},
+			want:     true,
+		},
+		{
+			name:     "SQL params by position",
+			protocol: ProtoMySQL,
+			matcher:  Matcher{Args: []*string{str("*"), nil}},
+			req:      InteractionRequest{Query: "SELECT ?, ?", Params: []*string{str("1"), nil}},
+			want:     true,
+		},
+		{
+			name:     "null only matches SQL NULL",
+			protocol: ProtoMySQL,
+			matcher:  Matcher{Args: []*string{str("*"), nil}},
+			req:      InteractionRequest{Query: "SELECT ?, ?", Params: []*string{str("1"), str("NULL")}},
+			want:     false,
+		},
+		{
+			name:     "redis command and args",
+			protocol: ProtoRedis,
+			matcher:  Matcher{Command: "get", Args: []*string{str("session:*")}},
+			req:      InteractionRequest{Command: "GET", Args: []string{"session:abc"}},
+			want:     true,
+		},
+		{
+			name:     "redis arg count",
+			protocol: ProtoRedis,
+			matcher:  Matcher{Command: "GET", Args: []*string{str("*")}},
+			req:      InteractionRequest{Command: "GET", Args: []string{"a", "b"}},
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.matcher.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			if got := tt.matcher.Match(tt.protocol, tt.req, tt.captured); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"n": 42, "f": 0.1, "s": "42", "b": true, "nil": null, "list": [1], "obj": {"a": 1}}`), &doc)
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+		ok   bool
+	}{
+		{"number", doc["n"], 42.0, true},
+		{"numeric string against a number", doc["n"], "42", true},
+		{"number against a numeric string", doc["s"], 42.0, true},
+		{"exponent", doc["n"], "4.2e1", true},
+		{"fraction", doc["f"], "0.1", true},
+		{"other number", doc["n"], "43", false},
+		{"not a number", doc["n"], "forty-two", false},
+		{"padded", doc["n"], " 42", false},
+		{"bool against its text", doc["b"], "true", false},
+		{"null against its text", doc["nil"], "<nil>", false},
+		{"null against a string", doc["nil"], "", false},
+		{"array against its text", doc["list"], "[1]", false},
+		{"object against its text", doc["obj"], "map[a:1]", false},
+		{"string against a bool", doc["s"], true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jsonEqual(tt.got, tt.want); got != tt.ok {
+				t.Errorf("jsonEqual(%#v, %#v) = %v, want %v", tt.got, tt.want, got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLookupConfiguredPriority(t *testing.T) {
+	req := InteractionRequest{Method: "GET", Host: "api.example.com", Path: "/orders/42"}
+	key := "GET api.example.com/orders/42"
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	configured := func(id, key string, m *Matcher, age int) *Interaction {
+		return &Interaction{
+			ID:         id,
+			Protocol:   ProtoHTTP,
+			Key:        key,
+			Matcher:    m,
+			State:      StateConfigured,
+			CapturedAt: base.Add(time.Duration(age) * time.Minute),
+		}
+	}
+	tests := []struct {
+		name string
+		all  []*Interaction
+		want string // ID, empty for no match
+	}{
+		{
+			name: "exact key beats any matcher",
+			all: []*Interaction{
+				configured("rule", "", &Matcher{PathTemplate: "/orders/{id}", Priority: 100}, 0),
+				configured("exact", key, nil, 1),
+			},
+			want: "exact",
+		},
+		{
+			name: "highest priority",
+			all: []*Interaction{
+				configured("low", "", &Matcher{PathTemplate: "/orders/{id}"}, 0),
+				configured("high", "", &Matcher{Method: "GET", Priority: 5}, 1),
+			},
+			want: "high",
+		},
+		{
+			name: "ties go to the oldest",
+			all: []*Interaction{
+				configured("newer", "", &Matcher{Method: "GET", Priority: 1}, 2),
+				configured("older", "", &Matcher{Host: "api.*", Priority: 1}, 1),
+			},
+			want: "older",
+		},
+		{
+			name: "matchers that reject are skipped",
+			all: []*Interaction{
+				configured("post", "", &Matcher{Method: "POST", Priority: 9}, 0),
+				configured("get", "", &Matcher{Method: "GET"}, 1),
+			},
+			want: "get",
+		},
+		{
+			name: "only configured interactions of the protocol",
+			all: []*Interaction{
+				{ID: "pending", Protocol: ProtoHTTP, Key: key, State: StatePending},
+				{ID: "redis", Protocol: ProtoRedis, Matcher: &Matcher{Method: "GET"}, State: StateConfigured},
+			},
+		},
+		{
+			name: "scenario in another state",
+			all: func() []*Interaction {
+				i := configured("later", key, nil, 0)
+				i.Scenario, i.RequiredState = "checkout", "Paid"
+				return []*Interaction{i, configured("rule", "", &Matcher{Method: "GET"}, 1)}
+			}(),
+			want: "rule",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := interactions
+			interactions = map[string]*Interaction{}
+			t.Cleanup(func() { interactions = saved })
+			for _, i := range tt.all {
+				interactions[i.ID] = i
+			}
+			got := ""
+			if i := lookupConfigured(ProtoHTTP, key, req); i != nil {
+				got = i.ID
+			}
+			if got != tt.want {
+				t.Errorf("lookup = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
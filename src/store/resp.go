@@ -0,0 +1,263 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ---- Redis replies -------------------------------------------------------
+
+// RESP reply types. Map, set, double, boolean and push are RESP3 types;
+// RESP2 clients get them as a flat array, an array, a bulk string, an
+// integer and an array.
+const (
+	RESPSimple  = "simple"
+	RESPError   = "error"
+	RESPInteger = "integer"
+	RESPBulk    = "bulk"
+	RESPNull    = "null"
+	RESPArray   = "array"
+	RESPMap     = "map"
+	RESPSet     = "set"
+	RESPDouble  = "double"
+	RESPBoolean = "boolean"
+	RESPPush    = "push"
+)
+
+// RESPValue is a typed Redis reply. Value holds a string for simple, error
+// and bulk; a number for integer and double; a bool for boolean; nothing for
+// null; a list of elements for array and set; and for map an object, or a
+// list of [key, value] pairs to keep the order or use non-string keys.
+//
+// Elements are RESPValues or plain JSON, read as a bulk string, an integer
+// (a whole number), a double, a boolean, null, an array (a list) or a map
+// (an object):
+//
+//	{"type": "array", "value": ["a", 1, null, {"type": "simple", "value": "OK"}]}
+type RESPValue struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// RESPElement reads an element of an array, set or map as a RESPValue.
+func RESPElement(x interface{}) RESPValue {
+	switch v := x.(type) {
+	case nil:
+		return RESPValue{Type: RESPNull}
+	case RESPValue:
+		return v
+	case *RESPValue:
+		if v == nil {
+			return RESPValue{Type: RESPNull}
+		}
+		return *v
+	case string:
+		return RESPValue{Type: RESPBulk, Value: v}
+	case bool:
+		return RESPValue{Type: RESPBoolean, Value: v}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return RESPValue{Type: RESPInteger, Value: v}
+		}
+		return RESPValue{Type: RESPDouble, Value: v}
+	case []interface{}:
+		return RESPValue{Type: RESPArray, Value: v}
+	case map[string]interface{}:
+		if t, ok := v["type"].(string); ok && isRESPValueObject(v) {
+			return RESPValue{Type: t, Value: v["value"]}
+		}
+		return RESPValue{Type: RESPMap, Value: v}
+	}
+	return RESPValue{Type: RESPBulk, Value: fmt.Sprint(x)}
+}
+
+// isRESPValueObject tells {"type": "integer", "value": 1} from a map that
+// happens to have a "type" key.
+func isRESPValueObject(m map[string]interface{}) bool {
+	for k := range m {
+		if k != "type" && k != "value" {
+			return false
+		}
+	}
+	switch m["type"] {
+	case RESPSimple, RESPError, RESPInteger, RESPBulk, RESPNull, RESPArray, RESPMap, RESPSet, RESPDouble, RESPBoolean, RESPPush:
+		return true
+	}
+	return false
+}
+
+// Text returns the string of a simple, error or bulk reply, and the
+// decimal form of numbers.
+func (v RESPValue) Text() string {
+	switch x := v.Value.(type) {
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v.Value)
+}
+
+// Int returns the value of an integer reply, which may be given as a number
+// or, beyond 2^53, as a string.
+func (v RESPValue) Int() (int64, error) {
+	switch x := v.Value.(type) {
+	case float64:
+		if x != math.Trunc(x) {
+			return 0, fmt.Errorf("integer reply %v is not a whole number", x)
+		}
+		return int64(x), nil
+	case string:
+		return strconv.ParseInt(x, 10, 64)
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("integer reply must be a number, got %T", v.Value)
+}
+
+// Float returns the value of a double reply; "inf", "-inf" and "nan" are
+// accepted as strings.
+func (v RESPValue) Float() (float64, error) {
+	switch x := v.Value.(type) {
+	case float64:
+		return x, nil
+	case string:
+		return strconv.ParseFloat(x, 64)
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("double reply must be a number, got %T", v.Value)
+}
+
+// Elements returns the elements of an array, set or push reply.
+func (v RESPValue) Elements() ([]RESPValue, error) {
+	if v.Value == nil {
+		return nil, nil
+	}
+	list, ok := v.Value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s reply must be a list", v.Type)
+	}
+	out := make([]RESPValue, len(list))
+	for i, x := range list {
+		out[i] = RESPElement(x)
+	}
+	return out, nil
+}
+
+// Pairs returns the entries of a map reply as keys and values; object keys
+// are sorted so that replies are stable.
+func (v RESPValue) Pairs() ([][2]RESPValue, error) {
+	switch m := v.Value.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := make([][2]RESPValue, len(keys))
+		for i, k := range keys {
+			out[i] = [2]RESPValue{{Type: RESPBulk, Value: k}, RESPElement(m[k])}
+		}
+		return out, nil
+	case []interface{}:
+		out := make([][2]RESPValue, len(m))
+		for i, x := range m {
+			pair, ok := x.([]interface{})
+			if !ok || len(pair) != 2 {
+				return nil, fmt.Errorf("map entries must be [key, value] pairs")
+			}
+			out[i] = [2]RESPValue{RESPElement(pair[0]), RESPElement(pair[1])}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("map reply must be an object or a list of pairs")
+}
+
+// Validate checks the type of the reply and of every nested element.
+// Numbers given as templates are checked once rendered.
+func (v RESPValue) Validate() error {
+	if s, ok := v.Value.(string); ok && strings.Contains(s, "{{") {
+		return nil
+	}
+	switch v.Type {
+	case RESPSimple, RESPError, RESPBulk:
+		switch v.Value.(type) {
+		case string, float64, nil:
+			return nil
+		}
+		return fmt.Errorf("%s reply must be a string", v.Type)
+	case RESPNull:
+		return nil
+	case RESPInteger:
+		if _, err := v.Int(); err != nil {
+			return fmt.Errorf("invalid integer reply: %v", err)
+		}
+		return nil
+	case RESPDouble:
+		if _, err := v.Float(); err != nil {
+			return fmt.Errorf("invalid double reply: %v", err)
+		}
+		return nil
+	case RESPBoolean:
+		if _, ok := v.Value.(bool); !ok && v.Value != nil {
+			return fmt.Errorf("boolean reply must be true or false")
+		}
+		return nil
+	case RESPArray, RESPSet, RESPPush:
+		elems, err := v.Elements()
+		if err != nil {
+			return err
+		}
+		for _, e := range elems {
+			if err := e.Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case RESPMap:
+		pairs, err := v.Pairs()
+		if err != nil {
+			return err
+		}
+		for _, p := range pairs {
+			if err := p[0].Validate(); err != nil {
+				return err
+			}
+			if err := p[1].Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown RESP type %q", v.Type)
+}
+
+// renderRESP renders the strings of a reply, including nested ones, as
+// templates.
+func renderRESP(x interface{}, d TemplateData) interface{} {
+	switch v := x.(type) {
+	case string:
+		return renderTemplate(v, d)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = renderRESP(e, d)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = renderRESP(e, d)
+		}
+		return out
+	}
+	return x
+}
@@ -0,0 +1,156 @@
+package store
+
+import "fmt"
+
+// ---- Sequences & scenarios -----------------------------------------------
+
+const (
+	// What happens once every response in Interaction.Responses was played.
+	SequenceRepeatLast = "repeat_last" // keep answering with the last one (default)
+	SequenceCycle      = "cycle"       // start again from the first
+	SequenceFail       = "fail"        // answer with a protocol-level error
+
+	// ScenarioStarted is the state every scenario is in until transitioned.
+	ScenarioStarted = "Started"
+)
+
+var (
+	// Runtime state, reset with ResetScenarios and never persisted.
+	hits           = map[string]int{}    // interaction ID → responses served
+	scenarioStates = map[string]string{} // scenario name → current state
+)
+
+// ValidateSequencePolicy rejects a policy other than the Sequence ones;
+// empty means SequenceRepeatLast.
+func ValidateSequencePolicy(policy string) error {
+	switch policy {
+	case "", SequenceRepeatLast, SequenceCycle, SequenceFail:
+		return nil
+	}
+	return fmt.Errorf("unknown sequence policy %q", policy)
+}
+
+// ConfigureSequence gives an interaction an ordered list of responses.
+// An empty list reverts to the single Response.
+func ConfigureSequence(id string, responses []*InteractionResponse, policy string) error {
+	if err := ValidateSequencePolicy(policy); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	i, ok := interactions[id]
+	if !ok {
+		return fmt.Errorf("interaction %s not found", id)
+	}
+	i.Responses = responses
+	i.SequencePolicy = policy
+	delete(hits, id)
+	return nil
+}
+
+// ConfigureScenario ties an interaction to a named scenario: it only matches
+// while the scenario is in requiredState (any state when empty) and moves
+// the scenario to newState (unchanged when empty) each time it answers.
+func ConfigureScenario(id, scenario, requiredState, newState string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	i, ok := interactions[id]
+	if !ok {
+		return fmt.Errorf("interaction %s not found", id)
+	}
+	i.Scenario = scenario
+	i.RequiredState = requiredState
+	i.NewState = newState
+	return nil
+}
+
+// inScenarioState reports whether i is eligible given the current scenario
+// states. Caller holds mu.
+func inScenarioState(i *Interaction) bool {
+	if i.Scenario == "" || i.RequiredState == "" {
+		return true
+	}
+	return scenarioState(i.Scenario) == i.RequiredState
+}
+
+func scenarioState(name string) string {
+	if s, ok := scenarioStates[name]; ok {
+		return s
+	}
+	return ScenarioStarted
+}
+
+// nextResponse picks the response to serve from i's sequence and applies its
+// scenario transition. It returns nil when a "fail" sequence is exhausted.
+// Caller holds mu for writing.
+func nextResponse(i *Interaction) *InteractionResponse {
+	resp := sequenceAt(i, hits[i.ID])
+	if len(i.Responses) > 0 {
+		hits[i.ID]++
+	}
+	if resp != nil && i.Scenario != "" && i.NewState != "" {
+		scenarioStates[i.Scenario] = i.NewState
+	}
+	return resp
+}
+
+// PeekResponse returns the response ResolveResponse would serve next,
+// without advancing the sequence. Used to describe result columns ahead of
+// execution.
+func PeekResponse(i *Interaction) *InteractionResponse {
+	mu.RLock()
+	defer mu.RUnlock()
+	return sequenceAt(i, hits[i.ID])
+}
+
+// sequenceAt returns the response for the request after served earlier ones.
+func sequenceAt(i *Interaction, served int) *InteractionResponse {
+	n := len(i.Responses)
+	switch {
+	case n == 0:
+		return i.Response
+	case served < n:
+		return i.Responses[served]
+	case i.SequencePolicy == SequenceCycle:
+		return i.Responses[served%n]
+	case i.SequencePolicy == SequenceFail:
+		return nil
+	}
+	return i.Responses[n-1]
+}
+
+// GetScenarios returns the current state of every scenario referenced by an
+// interaction or explicitly set.
+func GetScenarios() map[string]string {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := map[string]string{}
+	for _, i := range interactions {
+		if i.Scenario != "" {
+			out[i.Scenario] = scenarioState(i.Scenario)
+		}
+	}
+	for name, state := range scenarioStates {
+		out[name] = state
+	}
+	return out
+}
+
+func SetScenarioState(name, state string) {
+	mu.Lock()
+	defer mu.Unlock()
+	scenarioStates[name] = state
+}
+
+// ResetScenarios rewinds every response sequence, puts all scenarios back in
+// ScenarioStarted and zeroes template counters, ready for the next test run.
+func ResetScenarios() {
+	mu.Lock()
+	hits = map[string]int{}
+	scenarioStates = map[string]string{}
+	mu.Unlock()
+
+	countersMu.Lock()
+	counters = map[string]int64{}
+	countersMu.Unlock()
+}
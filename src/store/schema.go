@@ -0,0 +1,199 @@
+package store
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ---- Schema column types -------------------------------------------------
+
+// SchemaColumn is a column parsed from a schema's CREATE TABLE statement.
+// Type is the lower-cased SQL type as written, e.g. "varchar(255)" or
+// "timestamp with time zone".
+type SchemaColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Words that end a column's type in a column definition.
+var columnConstraintWords = map[string]bool{
+	"not": true, "null": true, "default": true, "primary": true, "references": true,
+	"unique": true, "check": true, "generated": true, "collate": true, "constraint": true,
+	"auto_increment": true, "comment": true, "on": true,
+}
+
+// Words that start a table constraint rather than a column definition.
+var tableConstraintWords = map[string]bool{
+	"constraint": true, "primary": true, "unique": true, "foreign": true, "check": true,
+	"exclude": true, "key": true, "index": true, "fulltext": true, "spatial": true,
+}
+
+// Columns parses the column definitions of s.CreateStatement. Table
+// constraints are skipped; an unparsable statement yields no columns.
+func (s *Schema) Columns() []SchemaColumn {
+	stmt := s.CreateStatement
+	open := strings.Index(stmt, "(")
+	end := strings.LastIndex(stmt, ")")
+	if open == -1 || end <= open {
+		return nil
+	}
+	var cols []SchemaColumn
+	for _, def := range SplitTopLevel(stmt[open+1 : end]) {
+		if col, _, ok := parseColumnDef(def); ok {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// parseColumnDef splits a column definition into the column and the words
+// of its constraints. ok is false for table constraints.
+func parseColumnDef(def string) (col SchemaColumn, constraints []string, ok bool) {
+	fields := strings.Fields(def)
+	if len(fields) < 2 || tableConstraintWords[strings.ToLower(fields[0])] {
+		return SchemaColumn{}, nil, false
+	}
+	n := 1
+	var typ []string
+	for ; n < len(fields) && !columnConstraintWords[strings.ToLower(fields[n])]; n++ {
+		typ = append(typ, strings.ToLower(fields[n]))
+	}
+	col = SchemaColumn{Name: strings.Trim(fields[0], "\"`[]"), Type: strings.Join(typ, " ")}
+	return col, fields[n:], true
+}
+
+// SplitTopLevel splits on commas that are not inside parentheses or quotes,
+// so that "numeric(10,2)" and "'a,b'" stay in one piece.
+func SplitTopLevel(s string) []string {
+	var out []string
+	var quote rune
+	depth, start := 0, 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			out = append(out, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(out, strings.TrimSpace(s[start:]))
+}
+
+// SchemaColumns returns the columns, in table order, of every schema of
+// protocol whose table the query mentions. When tables share a column name,
+// the one whose table sorts first wins.
+func SchemaColumns(protocol, query string) []SchemaColumn {
+	mu.RLock()
+	var matched []*Schema
+	for _, s := range schemas {
+		if s.Protocol == protocol && s.TableName != "" && mentionsTable(query, s.TableName) {
+			matched = append(matched, s)
+		}
+	}
+	mu.RUnlock()
+
+	sort.Slice(matched, func(a, b int) bool { return matched[a].TableName < matched[b].TableName })
+	var out []SchemaColumn
+	seen := map[string]bool{}
+	for _, s := range matched {
+		for _, c := range s.Columns() {
+			if !seen[c.Name] {
+				seen[c.Name] = true
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+var selectListRe = regexp.MustCompile(`(?is)^\s*select\s+(?:distinct\s+)?(.*?)(?:\s+from\s.*|\s*;?\s*)$`)
+
+// SelectItem is one entry of a SELECT list.
+type SelectItem struct {
+	Expr  string // as written, e.g. "u.name" or "count(*)"
+	Alias string // "" when none was given
+}
+
+// Name is the output column name: the alias, else a column reference without
+// its table qualifier, else the expression itself.
+func (it SelectItem) Name() string {
+	if it.Alias != "" {
+		return it.Alias
+	}
+	return strings.Trim(it.Expr[strings.LastIndex(it.Expr, ".")+1:], "\"`[]")
+}
+
+var aliasRe = regexp.MustCompile("^(?:\\w+|\"[^\"]*\"|`[^`]*`|\\[[^\\]]*\\])$")
+
+var returningRe = regexp.MustCompile(`(?is)^\s*(?:insert|update|delete|merge)\s.*\sreturning\s+(.*?)\s*;?\s*$`)
+
+// SelectItems splits the SELECT list of a query, or the RETURNING list of
+// a write. It returns nil for other statements and when the list contains
+// a *.
+func SelectItems(query string) []SelectItem {
+	m := selectListRe.FindStringSubmatch(query)
+	if m == nil {
+		m = returningRe.FindStringSubmatch(query)
+	}
+	if m == nil {
+		return nil
+	}
+	var items []SelectItem
+	for _, item := range SplitTopLevel(m[1]) {
+		if item == "*" || strings.HasSuffix(item, ".*") {
+			return nil
+		}
+		fields := strings.Fields(item)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 1:
+			items = append(items, SelectItem{Expr: fields[0]})
+		default:
+			n := len(fields) - 1
+			expr := strings.Join(fields[:n], " ")
+			if !aliasRe.MatchString(fields[n]) || strings.ContainsAny(expr[len(expr)-1:], "+-*/%=<>|&,(") {
+				// e.g. "1 + 1" or "current_setting('x', true)"
+				items = append(items, SelectItem{Expr: strings.Join(fields, " ")})
+				continue
+			}
+			if strings.EqualFold(fields[n-1], "as") {
+				expr = strings.Join(fields[:n-1], " ")
+			}
+			items = append(items, SelectItem{
+				Expr:  expr,
+				Alias: strings.Trim(fields[n], "\"`[]"),
+			})
+		}
+	}
+	return items
+}
+
+// SelectList returns the output column names of a SELECT or RETURNING
+// list, in order (see SelectItem.Name).
+func SelectList(query string) []string {
+	items := SelectItems(query)
+	if items == nil {
+		return nil
+	}
+	names := make([]string, len(items))
+	for i, it := range items {
+		names[i] = it.Name()
+	}
+	return names
+}
+
+func mentionsTable(query, table string) bool {
+	re, err := compileRegex(`(?i)(^|[^\w])` + regexp.QuoteMeta(table) + `($|[^\w])`)
+	return err == nil && re.MatchString(query)
+}
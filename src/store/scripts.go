@@ -0,0 +1,158 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---- Redis scripts -------------------------------------------------------
+
+// EVAL and EVALSHA are keyed by the script's SHA1 plus its KEYS and ARGV,
+// so the Lua source never ends up in a key and both forms of a call share
+// one interaction.
+
+// redisScriptCommands maps each script command to the name its calls are
+// recorded under.
+var redisScriptCommands = map[string]string{
+	"EVAL":       "EVALSHA",
+	"EVALSHA":    "EVALSHA",
+	"EVAL_RO":    "EVALSHA_RO",
+	"EVALSHA_RO": "EVALSHA_RO",
+}
+
+var (
+	// Scripts seen through SCRIPT LOAD or EVAL, by SHA1. Runtime state;
+	// captured interactions keep their script body.
+	scriptsMu sync.Mutex
+	scripts   = map[string]string{}
+)
+
+// RedisScriptCall is an EVAL or EVALSHA call split into its parts. Source
+// is empty for EVALSHA.
+type RedisScriptCall struct {
+	Command string // EVALSHA or EVALSHA_RO
+	SHA     string
+	Source  string
+	Keys    []string
+	Argv    []string
+}
+
+// ParseRedisScript splits a script call: script-or-sha numkeys key…
+// arg…. It returns nil for other commands and an error carrying the Redis
+// message when the call is malformed.
+func ParseRedisScript(command string, args []string) (*RedisScriptCall, error) {
+	command = strings.ToUpper(command)
+	name, ok := redisScriptCommands[command]
+	if !ok {
+		return nil, nil
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+	}
+	n, err := strconv.Atoi(args[1])
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	case n < 0:
+		return nil, fmt.Errorf("ERR Number of keys can't be negative")
+	case n > len(args)-2:
+		return nil, fmt.Errorf("ERR Number of keys can't be greater than number of args")
+	}
+	call := &RedisScriptCall{
+		Command: name,
+		Keys:    args[2 : 2+n],
+		Argv:    args[2+n:],
+	}
+	if strings.HasPrefix(command, "EVALSHA") {
+		call.SHA = strings.ToLower(args[0])
+	} else {
+		call.Source = args[0]
+		call.SHA = RedisScriptSHA(args[0])
+	}
+	return call, nil
+}
+
+// Key is the routing key of the call: EVALSHA <sha> [KEYS k…] [ARGV a…].
+func (c *RedisScriptCall) Key() string {
+	parts := []string{c.Command, c.SHA}
+	if len(c.Keys) > 0 {
+		parts = append(append(parts, "KEYS"), c.Keys...)
+	}
+	if len(c.Argv) > 0 {
+		parts = append(append(parts, "ARGV"), c.Argv...)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *RedisScriptCall) request() InteractionRequest {
+	return InteractionRequest{
+		Command:   c.Command,
+		Script:    c.Source,
+		ScriptSHA: c.SHA,
+		Keys:      c.Keys,
+		Args:      c.Argv,
+	}
+}
+
+// RedisRequest builds the captured request for a Redis command. Script
+// calls record the script body, its SHA, KEYS and ARGV separately; the
+// body of an EVALSHA is filled in when the script is known.
+func RedisRequest(command string, args []string) InteractionRequest {
+	call, err := ParseRedisScript(command, args)
+	if call == nil || err != nil {
+		return InteractionRequest{Command: command, Args: args}
+	}
+	req := call.request()
+	if req.Script == "" {
+		req.Script, _ = RedisScriptSource(call.SHA)
+	}
+	return req
+}
+
+// RedisScriptSHA returns the SHA1 Redis identifies a script by.
+func RedisScriptSHA(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadRedisScript remembers a script, as SCRIPT LOAD and EVAL do, and
+// returns its SHA1.
+func LoadRedisScript(source string) string {
+	sha := RedisScriptSHA(source)
+	scriptsMu.Lock()
+	scripts[sha] = source
+	scriptsMu.Unlock()
+	return sha
+}
+
+// RedisScriptSource returns the body of a script by SHA1: one loaded since
+// startup, or one recorded on an interaction, so EVALSHA replays without a
+// prior SCRIPT LOAD.
+func RedisScriptSource(sha string) (string, bool) {
+	sha = strings.ToLower(sha)
+	scriptsMu.Lock()
+	src, ok := scripts[sha]
+	scriptsMu.Unlock()
+	if ok {
+		return src, true
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, i := range interactions {
+		if i.Protocol == ProtoRedis && i.Request.ScriptSHA == sha && i.Request.Script != "" {
+			return i.Request.Script, true
+		}
+	}
+	return "", false
+}
+
+// FlushRedisScripts forgets the loaded scripts (SCRIPT FLUSH).
+func FlushRedisScripts() {
+	scriptsMu.Lock()
+	defer scriptsMu.Unlock()
+	scripts = map[string]string{}
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ---- SQL normalization ---------------------------------------------------
+
+// Keywords upper-cased by NormalizeSQL. Identifiers keep their case.
+var sqlKeywords = map[string]bool{
+	"all": true, "and": true, "any": true, "as": true, "asc": true, "begin": true, "between": true,
+	"by": true, "case": true, "commit": true, "conflict": true, "cross": true, "default": true,
+	"delete": true, "desc": true, "distinct": true, "do": true, "duplicate": true, "else": true,
+	"end": true, "except": true, "exists": true, "false": true, "fetch": true, "first": true,
+	"for": true, "from": true, "full": true, "group": true, "having": true, "ignore": true,
+	"ilike": true, "in": true, "inner": true, "insert": true, "intersect": true, "into": true,
+	"is": true, "join": true, "key": true, "left": true, "like": true, "limit": true, "locked": true,
+	"merge": true, "natural": true, "next": true, "not": true, "nothing": true, "nowait": true,
+	"null": true, "nulls": true, "offset": true, "on": true, "only": true, "or": true, "order": true,
+	"outer": true, "over": true, "partition": true, "replace": true, "returning": true,
+	"right": true, "rollback": true, "row": true, "rows": true, "select": true, "set": true,
+	"share": true, "skip": true, "some": true, "then": true, "true": true, "union": true,
+	"update": true, "using": true, "values": true, "when": true, "where": true, "with": true,
+}
+
+type sqlTokenKind int
+
+const (
+	sqlWord    sqlTokenKind = iota // keyword or identifier, including quoted ones
+	sqlLiteral                     // string or number, replaced by ?
+	sqlPunct                       // ( ) , ; .
+	sqlOther                       // operators and placeholders
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	str  bool // a string literal, as opposed to a number
+}
+
+// NormalizeSQL returns the canonical form of a statement in the dialect of
+// protocol (ProtoMySQL or ProtoPostgres) — comments dropped, whitespace
+// collapsed, keywords upper-cased and every string or numeric literal
+// replaced by ? — and the literal values it took out, in order. Statements
+// that differ only in those respects normalize alike:
+//
+//	select *  from users where id=42 /* app:api */
+//	SELECT * FROM users WHERE id = ?          [42]
+func NormalizeSQL(protocol, query string) (string, []string) {
+	var b strings.Builder
+	var literals []string
+	var prev sqlToken
+	for i, tok := range tokenizeSQL(protocol, query) {
+		if tok.kind == sqlLiteral {
+			literals = append(literals, tok.text)
+			tok = sqlToken{kind: sqlLiteral, text: "?"}
+		}
+		if i > 0 && sqlSpaceBetween(prev, tok) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(tok.text)
+		prev = tok
+	}
+	return strings.TrimSuffix(b.String(), ";"), literals
+}
+
+// SQLPlaceholders counts the ? placeholders of a statement, leaving out
+// question marks in strings, quoted identifiers and comments.
+func SQLPlaceholders(protocol, query string) int {
+	n := 0
+	for _, tok := range tokenizeSQL(protocol, query) {
+		if tok.kind == sqlOther && tok.text == "?" {
+			n++
+		}
+	}
+	return n
+}
+
+// sqlSpaceBetween decides whether a space separates two tokens: none inside
+// parentheses, before commas, around dots and between a function name and
+// its argument list.
+func sqlSpaceBetween(prev, next sqlToken) bool {
+	switch {
+	case prev.text == "(" || prev.text == "." || prev.text == "::":
+		return false
+	case next.text == ")" || next.text == "," || next.text == ";" || next.text == "." || next.text == "::":
+		return false
+	case next.text == "(" && prev.kind == sqlWord && !sqlKeywords[strings.ToLower(prev.text)]:
+		return false
+	}
+	return true
+}
+
+// tokenizeSQL splits a statement into tokens, dropping whitespace and
+// comments. String literals are returned unquoted. Backslash escapes apply
+// to MySQL strings and Postgres E'…' strings only: Postgres takes them
+// literally in standard strings (standard_conforming_strings).
+func tokenizeSQL(protocol, s string) []sqlToken {
+	var toks []sqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+
+		case strings.HasPrefix(s[i:], "--"):
+			end := strings.IndexByte(s[i:], '\n')
+			if end == -1 {
+				return toks
+			}
+			i += end + 1
+
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end == -1 {
+				return toks
+			}
+			i += 2 + end + 2
+
+		case c == '\'':
+			val, n := scanQuoted(s[i:], '\'', protocol == ProtoMySQL)
+			toks = append(toks, sqlToken{kind: sqlLiteral, text: val, str: true})
+			i += n
+
+		case (c == 'E' || c == 'e') && protocol != ProtoMySQL && i+1 < len(s) && s[i+1] == '\'':
+			val, n := scanQuoted(s[i+1:], '\'', true)
+			toks = append(toks, sqlToken{kind: sqlLiteral, text: val, str: true})
+			i += 1 + n
+
+		case c == '"' || c == '`':
+			_, n := scanQuoted(s[i:], c, false)
+			toks = append(toks, sqlToken{kind: sqlWord, text: s[i : i+n]})
+			i += n
+
+		case c == '$' && i+1 < len(s) && isDigit(s[i+1]):
+			n := 1
+			for i+n < len(s) && isDigit(s[i+n]) {
+				n++
+			}
+			toks = append(toks, sqlToken{kind: sqlOther, text: s[i : i+n]})
+			i += n
+
+		case c == '$':
+			// Dollar-quoted string: $tag$ … $tag$
+			if end := strings.IndexByte(s[i+1:], '$'); end != -1 && isSQLIdent(s[i+1:i+1+end]) {
+				tag := s[i : i+end+2]
+				if close := strings.Index(s[i+len(tag):], tag); close != -1 {
+					toks = append(toks, sqlToken{kind: sqlLiteral, text: s[i+len(tag) : i+len(tag)+close], str: true})
+					i += len(tag) + close + len(tag)
+					continue
+				}
+			}
+			toks = append(toks, sqlToken{kind: sqlOther, text: "$"})
+			i++
+
+		case isDigit(c) || c == '.' && i+1 < len(s) && isDigit(s[i+1]):
+			n := scanNumber(s[i:])
+			toks = append(toks, sqlToken{kind: sqlLiteral, text: s[i : i+n]})
+			i += n
+
+		case isWordStart(c) || c == '@' && i+1 < len(s) && (isWordStart(s[i+1]) || s[i+1] == '@'):
+			n := 1
+			for i+n < len(s) && (isWordPart(s[i+n]) || s[i+n] == '@' && n == 1) {
+				n++
+			}
+			word := s[i : i+n]
+			if sqlKeywords[strings.ToLower(word)] {
+				word = strings.ToUpper(word)
+			}
+			toks = append(toks, sqlToken{kind: sqlWord, text: word})
+			i += n
+
+		case strings.IndexByte("(),;.", c) != -1:
+			toks = append(toks, sqlToken{kind: sqlPunct, text: string(c)})
+			i++
+
+		case c == '?':
+			toks = append(toks, sqlToken{kind: sqlOther, text: "?"})
+			i++
+
+		default:
+			// Operator: a run of symbol characters, e.g. <=, ::, ->>
+			n := 1
+			for i+n < len(s) && strings.IndexByte("+-*/<>=~!@#%^&|:", s[i+n]) != -1 &&
+				!strings.HasPrefix(s[i+n:], "--") && !strings.HasPrefix(s[i+n:], "/*") {
+				n++
+			}
+			toks = append(toks, sqlToken{kind: sqlOther, text: s[i : i+n]})
+			i += n
+		}
+	}
+	return toks
+}
+
+// scanQuoted reads a quoted string or identifier starting at s[0], where a
+// doubled quote escapes the quote and, with backslash set, a backslash
+// escapes the next character. It returns the unescaped contents and the
+// number of bytes consumed.
+func scanQuoted(s string, quote byte, backslash bool) (string, int) {
+	var b strings.Builder
+	i := 1
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\\' && backslash && i+1 < len(s):
+			b.WriteByte(unescapeSQL(s[i+1]))
+			i += 2
+		case c == quote && i+1 < len(s) && s[i+1] == quote:
+			b.WriteByte(quote)
+			i += 2
+		case c == quote:
+			return b.String(), i + 1
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), len(s)
+}
+
+// unescapeSQL returns the character a backslash escape stands for: \n,
+// \t, \r, \b, \f and \0 are control characters, anything else is itself.
+func unescapeSQL(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	case '0':
+		return 0
+	}
+	return c
+}
+
+// scanNumber returns the length of the numeric literal at the start of s:
+// integers, decimals, exponents and 0x hex.
+func scanNumber(s string) int {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		n := 2
+		for n < len(s) && strings.IndexByte("0123456789abcdefABCDEF", s[n]) != -1 {
+			n++
+		}
+		return n
+	}
+	n := 0
+	for n < len(s) && (isDigit(s[n]) || s[n] == '.') {
+		n++
+	}
+	if n < len(s) && (s[n] == 'e' || s[n] == 'E') {
+		m := n + 1
+		if m < len(s) && (s[m] == '+' || s[m] == '-') {
+			m++
+		}
+		if m < len(s) && isDigit(s[m]) {
+			for m < len(s) && isDigit(s[m]) {
+				m++
+			}
+			n = m
+		}
+	}
+	return n
+}
+
+func isDigit(c byte) bool     { return c >= '0' && c <= '9' }
+func isWordStart(c byte) bool { return c == '_' || c >= 0x80 || unicode.IsLetter(rune(c)) }
+func isWordPart(c byte) bool  { return isWordStart(c) || isDigit(c) || c == '$' }
+
+func isSQLIdent(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isWordPart(s[i]) || s[i] == '$' {
+			return false
+		}
+	}
+	return true
+}
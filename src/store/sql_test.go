@@ -0,0 +1,187 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		query    string
+		norm     string
+		literals []string
+	}{
+		{
+			name:     "whitespace, comments and keyword case",
+			protocol: ProtoPostgres,
+			query:    "select *  from users\n\twhere id=42 /* app:api */ -- trailing\n",
+			norm:     "SELECT * FROM users WHERE id = ?",
+			literals: []string{"42"},
+		},
+		{
+			name:     "identifiers keep their case",
+			protocol: ProtoMySQL,
+			query:    "SELECT `Name`, userId FROM Users",
+			norm:     "SELECT `Name`, userId FROM Users",
+		},
+		{
+			name:     "function calls and parentheses",
+			protocol: ProtoPostgres,
+			query:    "select count ( * ) from t where x in ( 1 , 2 )",
+			norm:     "SELECT count(*) FROM t WHERE x IN (?, ?)",
+			literals: []string{"1", "2"},
+		},
+		{
+			name:     "trailing semicolon",
+			protocol: ProtoMySQL,
+			query:    "DELETE FROM t WHERE id = 1;",
+			norm:     "DELETE FROM t WHERE id = ?",
+			literals: []string{"1"},
+		},
+		{
+			name:     "numbers",
+			protocol: ProtoMySQL,
+			query:    "SELECT 1.5, .25, 2e10, 0xFF",
+			norm:     "SELECT ?, ?, ?, ?",
+			literals: []string{"1.5", ".25", "2e10", "0xFF"},
+		},
+		{
+			name:     "doubled quote",
+			protocol: ProtoPostgres,
+			query:    "SELECT 'it''s'",
+			norm:     "SELECT ?",
+			literals: []string{"it's"},
+		},
+		{
+			name:     "postgres takes backslashes literally",
+			protocol: ProtoPostgres,
+			query:    `SELECT * FROM files WHERE dir = 'C:\' AND name = 'a.txt'`,
+			norm:     "SELECT * FROM files WHERE dir = ? AND name = ?",
+			literals: []string{`C:\`, "a.txt"},
+		},
+		{
+			name:     "postgres escape string",
+			protocol: ProtoPostgres,
+			query:    `SELECT E'line\nbreak', e'it\'s'`,
+			norm:     "SELECT ?, ?",
+			literals: []string{"line\nbreak", "it's"},
+		},
+		{
+			name:     "mysql backslash escapes",
+			protocol: ProtoMySQL,
+			query:    `SELECT * FROM t WHERE s = 'it\'s' AND d = 'C:\\'`,
+			norm:     "SELECT * FROM t WHERE s = ? AND d = ?",
+			literals: []string{"it's", `C:\`},
+		},
+		{
+			name:     "identifier ending in e before a string",
+			protocol: ProtoPostgres,
+			query:    "SELECT * FROM t WHERE type='x'",
+			norm:     "SELECT * FROM t WHERE type = ?",
+			literals: []string{"x"},
+		},
+		{
+			name:     "dollar quoting",
+			protocol: ProtoPostgres,
+			query:    "SELECT $fn$it's $1$fn$",
+			norm:     "SELECT ?",
+			literals: []string{"it's $1"},
+		},
+		{
+			name:     "placeholders are kept",
+			protocol: ProtoPostgres,
+			query:    "select * from t where a = $1 and b = $2::int",
+			norm:     "SELECT * FROM t WHERE a = $1 AND b = $2::int",
+		},
+		{
+			name:     "quoted identifiers are not literals",
+			protocol: ProtoPostgres,
+			query:    `SELECT "order" FROM "Orders" WHERE "id" = 7`,
+			norm:     `SELECT "order" FROM "Orders" WHERE "id" = ?`,
+			literals: []string{"7"},
+		},
+		{
+			name:     "unterminated comment",
+			protocol: ProtoMySQL,
+			query:    "SELECT 1 /* open",
+			norm:     "SELECT ?",
+			literals: []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			norm, literals := NormalizeSQL(tt.protocol, tt.query)
+			if norm != tt.norm {
+				t.Errorf("norm = %q, want %q", norm, tt.norm)
+			}
+			if !reflect.DeepEqual(literals, tt.literals) {
+				t.Errorf("literals = %q, want %q", literals, tt.literals)
+			}
+		})
+	}
+}
+
+func TestSQLPlaceholders(t *testing.T) {
+	tests := []struct {
+		query string
+		n     int
+	}{
+		{"SELECT * FROM t WHERE a = ? AND b = ?", 2},
+		{"SELECT '?' FROM t WHERE id = ?", 1},
+		{"SELECT `a?` FROM t /* ? */ WHERE id = ? -- ?\n", 1},
+		{"SELECT 'it\\'s ?' FROM t", 0},
+	}
+	for _, tt := range tests {
+		if n := SQLPlaceholders(ProtoMySQL, tt.query); n != tt.n {
+			t.Errorf("%s: %d placeholders, want %d", tt.query, n, tt.n)
+		}
+	}
+}
+
+func TestDBKey(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		protocol string
+		query    string
+		params   []*string
+		key      string
+	}{
+		{
+			name:     "no values",
+			protocol: ProtoMySQL,
+			query:    "select now()",
+			key:      "MYSQL SELECT now()",
+		},
+		{
+			name:     "bound parameters then literals",
+			protocol: ProtoPostgres,
+			query:    "SELECT * FROM t WHERE a = $1 AND b = 'x'",
+			params:   []*string{str("7")},
+			key:      "POSTGRES SELECT * FROM t WHERE a = $1 AND b = ? [7, x]",
+		},
+		{
+			name:     "NULL is apart from the text NULL",
+			protocol: ProtoMySQL,
+			query:    "SELECT ?, ?",
+			params:   []*string{nil, str("NULL")},
+			key:      "MYSQL SELECT ?, ? [NULL, 'NULL']",
+		},
+		{
+			name:     "values starting with a quote are quoted",
+			protocol: ProtoMySQL,
+			query:    "SELECT ?",
+			params:   []*string{str("'a'")},
+			key:      "MYSQL SELECT ? ['''a''']",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := DBKey(tt.protocol, tt.query, tt.params); key != tt.key {
+				t.Errorf("key = %q, want %q", key, tt.key)
+			}
+		})
+	}
+}
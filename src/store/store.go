@@ -1,11 +1,16 @@
 package store
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/textproto"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,49 +26,93 @@ const (
 
 	StatePending    = "pending"
 	StateConfigured = "configured"
+	StateLive       = "live" // answered from a live table (see SetSchemaLive)
 )
 
 // ---- Interaction ---------------------------------------------------------
 
 type InteractionRequest struct {
 	// HTTP + DynamoDB
-	Method   string            `json:"method,omitempty"`
-	Host     string            `json:"host,omitempty"`
-	Path     string            `json:"path,omitempty"`
-	Headers  map[string]string `json:"headers,omitempty"`
-	Body     string            `json:"body,omitempty"`
-	BodyHash string            `json:"bodyHash,omitempty"`
-
-	// DynamoDB-specific (parsed from body)
-	Operation string `json:"operation,omitempty"`
-	Table     string `json:"table,omitempty"`
-	KeyJSON   string `json:"keyJSON,omitempty"`
+	Method string `json:"method,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// Canonical query string (parameters sorted), without the leading '?'
+	QueryString string            `json:"queryString,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	BodyHash    string            `json:"bodyHash,omitempty"`
+
+	// DynamoDB-specific (parsed from body). KeyJSON is the Key, or the Item
+	// of a PutItem, as plain JSON; KeyCondition the Query's key condition
+	// (a Scan's filter) with names and values substituted.
+	Operation    string `json:"operation,omitempty"`
+	Table        string `json:"table,omitempty"`
+	KeyJSON      string `json:"keyJSON,omitempty"`
+	IndexName    string `json:"indexName,omitempty"`
+	KeyCondition string `json:"keyCondition,omitempty"`
+	ValuesJSON   string `json:"valuesJSON,omitempty"` // ExpressionAttributeValues
+	Limit        int    `json:"limit,omitempty"`
+	StartKeyJSON string `json:"startKeyJSON,omitempty"` // ExclusiveStartKey
+	ReturnValues string `json:"returnValues,omitempty"`
 
 	// MySQL / Postgres
-	Query string `json:"query,omitempty"`
-
-	// Redis
-	Command string   `json:"command,omitempty"`
-	Args    []string `json:"args,omitempty"`
+	Query  string    `json:"query,omitempty"`
+	Params []*string `json:"params,omitempty"` // bound parameter values, in order; null for SQL NULL
+	// Literal values NormalizeSQL lifted out of Query, in order
+	Literals []string `json:"literals,omitempty"`
+
+	// Connection the statement arrived on (MySQL); not part of the key
+	User      string            `json:"user,omitempty"`
+	Database  string            `json:"database,omitempty"`
+	ConnAttrs map[string]string `json:"connAttrs,omitempty"`
+
+	// Redis. For EVAL and EVALSHA, Args holds ARGV and the script is kept
+	// apart from its KEYS.
+	Command   string   `json:"command,omitempty"`
+	Args      []string `json:"args,omitempty"`
+	Script    string   `json:"script,omitempty"`
+	ScriptSHA string   `json:"scriptSha,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
 }
 
 type InteractionResponse struct {
 	// HTTP
 	StatusCode int               `json:"statusCode,omitempty"`
 	Headers    map[string]string `json:"headers,omitempty"`
-	Body       string            `json:"body,omitempty"`
-	LatencyMs  int               `json:"latencyMs,omitempty"`
+	// HeaderValues holds headers sent once per value, such as Set-Cookie,
+	// which cannot be joined into a single line.
+	HeaderValues map[string][]string `json:"headerValues,omitempty"`
+	Body         string              `json:"body,omitempty"`
+	LatencyMs    int                 `json:"latencyMs,omitempty"`
 
 	// MySQL / Postgres SELECT
-	Rows []map[string]interface{} `json:"rows,omitempty"`
+	Rows Rows `json:"rows,omitempty"`
 	// MySQL / Postgres INSERT/UPDATE/DELETE
-	AffectedRows int `json:"affectedRows,omitempty"`
+	AffectedRows int   `json:"affectedRows,omitempty"`
+	LastInsertID int64 `json:"lastInsertId,omitempty"` // MySQL OK packet
+	// Postgres command tag, e.g. "MERGE 3"; derived from the statement when
+	// empty.
+	CommandTag string `json:"commandTag,omitempty"`
+	// Error fails the statement with a MySQL ERR packet or a Postgres
+	// ErrorResponse instead of returning rows.
+	Error *ErrorReply `json:"error,omitempty"`
 
 	// DynamoDB
 	ItemJSON string `json:"itemJSON,omitempty"`
 
-	// Redis
-	Value string `json:"value,omitempty"`
+	// Redis: RESP is a typed reply; without one, Value is sent as a bulk
+	// string, or a null when empty.
+	Value string     `json:"value,omitempty"`
+	RESP  *RESPValue `json:"resp,omitempty"`
+
+	// Template renders Body, Headers, Value, RESP strings, ItemJSON and
+	// string Rows cells as Go templates against the incoming request (see
+	// TemplateData).
+	Template bool `json:"template,omitempty"`
+
+	// Fault makes this response misbehave (see Fault); overrides the
+	// protocol-wide fault.
+	Fault *Fault `json:"fault,omitempty"`
 }
 
 type Interaction struct {
@@ -73,9 +122,20 @@ type Interaction struct {
 	Name       string               `json:"name"`
 	Request    InteractionRequest   `json:"request"`
 	Response   *InteractionResponse `json:"response,omitempty"`
+	Matcher    *Matcher             `json:"matcher,omitempty"`
 	State      string               `json:"state"`
 	TestCaseID string               `json:"testCaseId"`
 	CapturedAt time.Time            `json:"capturedAt"`
+
+	// Ordered responses, played one per request instead of Response.
+	Responses      []*InteractionResponse `json:"responses,omitempty"`
+	SequencePolicy string                 `json:"sequencePolicy,omitempty"`
+
+	// WireMock-style scenario: match only in RequiredState, then move the
+	// scenario to NewState.
+	Scenario      string `json:"scenario,omitempty"`
+	RequiredState string `json:"requiredState,omitempty"`
+	NewState      string `json:"newState,omitempty"`
 }
 
 // ---- TestCase ------------------------------------------------------------
@@ -86,6 +146,9 @@ type TestCase struct {
 	Description    string    `json:"description,omitempty"`
 	InteractionIDs []string  `json:"interactionIds"`
 	CreatedAt      time.Time `json:"createdAt"`
+	// RedisKeyspace is the Redis cache state the test case starts from,
+	// loaded into the stateful Redis mock on replay.
+	RedisKeyspace map[string]RedisEntry `json:"redisKeyspace,omitempty"`
 }
 
 // ---- Schema (per DB table) -----------------------------------------------
@@ -94,6 +157,27 @@ type Schema struct {
 	TableName       string `json:"tableName"`
 	Protocol        string `json:"protocol"`
 	CreateStatement string `json:"createStatement"`
+
+	// Live backs the table with rows in memory that the SQL mocks read and
+	// write, seeded from Fixtures (see live.go).
+	Live     bool `json:"live,omitempty"`
+	Fixtures Rows `json:"fixtures,omitempty"`
+}
+
+// Rows are result rows or the seed rows of a live table. Their numbers
+// decode as json.Number, not float64, so that int8, bigint and numeric
+// values keep every digit until a column types them.
+type Rows []map[string]interface{}
+
+func (r *Rows) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var rows []map[string]interface{}
+	if err := dec.Decode(&rows); err != nil {
+		return err
+	}
+	*r = rows
+	return nil
 }
 
 // ---- Global store --------------------------------------------------------
@@ -103,6 +187,9 @@ var (
 	interactions = map[string]*Interaction{}
 	testCases    = map[string]*TestCase{}
 	schemas      = map[string]*Schema{}
+
+	// Request headers (canonical form) that participate in HTTP matching.
+	matchHeaders []string
 )
 
 // ---- Key builders --------------------------------------------------------
@@ -115,15 +202,122 @@ func BodyHash(body []byte) string {
 	return fmt.Sprintf("%x", h[:8])
 }
 
-func HTTPKey(method, host, path, bodyHash string) string {
-	return fmt.Sprintf("%s %s %s %s", method, host, path, bodyHash)
+// CanonicalQuery sorts query parameters (and repeated values) so that
+// ?b=2&a=1 and ?a=1&b=2 produce the same key.
+func CanonicalQuery(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return raw
+	}
+	for _, v := range values {
+		sort.Strings(v)
+	}
+	return values.Encode()
 }
 
-func DBKey(protocol, query string) string {
-	return fmt.Sprintf("%s %s", protocol, query)
+// HTTPKey builds the routing key for HTTP and DynamoDB requests. The query
+// string and any configured match headers are only included when present, so
+// keys for plain requests keep the original "METHOD host path hash" shape.
+func HTTPKey(method, host, path, query string, headers map[string]string, bodyHash string) string {
+	mu.RLock()
+	names := matchHeaders
+	mu.RUnlock()
+	return httpKey(method, host, path, query, headers, bodyHash, names)
 }
 
+func httpKey(method, host, path, query string, headers map[string]string, bodyHash string, names []string) string {
+	target := path
+	if query != "" {
+		target += "?" + query
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("%s %s %s %s", method, host, target, bodyHash)
+	}
+	parts := make([]string, 0, len(names))
+	for _, n := range names {
+		parts = append(parts, strings.ToLower(n)+"="+headerValue(headers, n))
+	}
+	return fmt.Sprintf("%s %s %s [%s] %s", method, host, target, strings.Join(parts, " "), bodyHash)
+}
+
+// headerValue looks a header up case-insensitively.
+func headerValue(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// DBKey builds the key for a SQL statement from its normalized text. Bound
+// parameters, then the literals normalization extracted, are appended so
+// that the same statement with different values is a different interaction
+// while spacing, comments and keyword case are not. A parameter bound as
+// SQL NULL (nil) is keyed as NULL; a text value that could be read as that
+// token is quoted, so the two never share a key.
+func DBKey(protocol, query string, params []*string) string {
+	norm, literals := NormalizeSQL(protocol, query)
+	if len(params)+len(literals) == 0 {
+		return fmt.Sprintf("%s %s", protocol, norm)
+	}
+	values := make([]string, 0, len(params)+len(literals))
+	for _, p := range params {
+		values = append(values, sqlParamToken(p))
+	}
+	for _, l := range literals {
+		values = append(values, sqlParamToken(&l))
+	}
+	return fmt.Sprintf("%s %s [%s]", protocol, norm, strings.Join(values, ", "))
+}
+
+// sqlParamToken renders a value for a DB key: NULL for nil, the text as it
+// is otherwise, quoted SQL-style when it is "NULL" or starts with a quote.
+func sqlParamToken(p *string) string {
+	switch {
+	case p == nil:
+		return "NULL"
+	case *p == "NULL" || strings.HasPrefix(*p, "'"):
+		return "'" + strings.ReplaceAll(*p, "'", "''") + "'"
+	}
+	return *p
+}
+
+// SQLParams returns the statement's values as matchers and templates see
+// them: bound parameters followed by extracted literals. SQL NULL is nil.
+func (r InteractionRequest) SQLParams() []*string {
+	if len(r.Literals) == 0 {
+		return r.Params
+	}
+	out := append([]*string(nil), r.Params...)
+	for idx := range r.Literals {
+		out = append(out, &r.Literals[idx])
+	}
+	return out
+}
+
+// SQLValues returns bound parameter values for log lines, with NULL
+// spelled out.
+func SQLValues(params []*string) []string {
+	out := make([]string, len(params))
+	for idx, p := range params {
+		out[idx] = sqlParamToken(p)
+	}
+	return out
+}
+
+// RedisKey is the command and its arguments; script calls are keyed by the
+// script's SHA1 with their KEYS and ARGV.
 func RedisKey(command string, args []string) string {
+	if call, err := ParseRedisScript(command, args); call != nil && err == nil {
+		return call.Key()
+	}
 	key := command
 	for _, a := range args {
 		key += " " + a
@@ -131,6 +325,99 @@ func RedisKey(command string, args []string) string {
 	return key
 }
 
+// ---- Match headers -------------------------------------------------------
+
+// SetMatchHeaders changes which request headers participate in HTTP matching
+// and re-keys the stored HTTP interactions accordingly.
+func SetMatchHeaders(names []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	matchHeaders = canonicalHeaderNames(names)
+	migrateKeys()
+}
+
+// persistedHeaders keeps only the match headers of a captured request.
+// Matchers and templates see every header of the live request, but
+// credentials like Authorization or Cookie must not end up in
+// veritaserum.json or in exported test cases.
+func persistedHeaders(headers map[string]string, names []string) map[string]string {
+	var out map[string]string
+	for _, n := range names {
+		if v := headerValue(headers, n); v != "" {
+			if out == nil {
+				out = make(map[string]string, len(names))
+			}
+			out[n] = v
+		}
+	}
+	return out
+}
+
+func GetMatchHeaders() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]string, len(matchHeaders))
+	copy(out, matchHeaders)
+	return out
+}
+
+func canonicalHeaderNames(names []string) []string {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		n = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(n))
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// migrateKeys recomputes the routing key of every interaction that still has
+// its captured request, so keys written by older versions (no query string,
+// no match headers, raw SQL, Lua source in Redis keys, DynamoDB body hashes)
+// line up with what the mocks build today. Interactions imported with a bare
+// key and no request are left alone. Caller holds mu.
+func migrateKeys() {
+	for _, i := range interactions {
+		switch i.Protocol {
+		case ProtoHTTP, ProtoDynamoDB:
+			r := i.Request
+			if r.Method == "" {
+				continue
+			}
+			if i.Protocol == ProtoDynamoDB && r.Operation != "" {
+				parseDynamoBody(&i.Request)
+				i.Key = DynamoDBKey(i.Request)
+				continue
+			}
+			i.Key = httpKey(r.Method, r.Host, r.Path, r.QueryString, r.Headers, r.BodyHash, matchHeaders)
+		case ProtoMySQL, ProtoPostgres:
+			if i.Request.Query == "" {
+				continue
+			}
+			_, i.Request.Literals = NormalizeSQL(i.Protocol, i.Request.Query)
+			i.Key = DBKey(i.Protocol, i.Request.Query, i.Request.Params)
+		case ProtoRedis:
+			// Script calls captured with the Lua source among their args
+			r := i.Request
+			if r.ScriptSHA != "" {
+				continue
+			}
+			call, err := ParseRedisScript(r.Command, r.Args)
+			if call == nil || err != nil {
+				continue
+			}
+			i.Request = call.request()
+			i.Request.Database = r.Database
+			i.Key = call.Key()
+		}
+	}
+}
+
 // ---- Interaction helpers -------------------------------------------------
 
 func RegisterInteraction(protocol, key string, req InteractionRequest) *Interaction {
@@ -141,6 +428,7 @@ func RegisterInteraction(protocol, key string, req InteractionRequest) *Interact
 			return i
 		}
 	}
+	req.Headers = persistedHeaders(req.Headers, matchHeaders)
 	now := time.Now()
 	id := fmt.Sprintf("%d", now.UnixNano())
 	i := &Interaction{
@@ -155,17 +443,6 @@ func RegisterInteraction(protocol, key string, req InteractionRequest) *Interact
 	return i
 }
 
-func LookupConfigured(protocol, key string) *Interaction {
-	mu.RLock()
-	defer mu.RUnlock()
-	for _, i := range interactions {
-		if i.Protocol == protocol && i.Key == key && i.State == StateConfigured {
-			return i
-		}
-	}
-	return nil
-}
-
 func IsPending(protocol, key string) bool {
 	mu.RLock()
 	defer mu.RUnlock()
@@ -212,6 +489,49 @@ func GetPendingInteractions() []*Interaction {
 	return out
 }
 
+// ---- Record mode ---------------------------------------------------------
+
+// Recordable lists the protocols that have a real upstream to record from.
+var Recordable = []string{ProtoHTTP, ProtoDynamoDB}
+
+var recording = map[string]bool{}
+
+func SetRecording(protocol string, enabled bool) error {
+	for _, p := range Recordable {
+		if p == protocol {
+			mu.Lock()
+			recording[protocol] = enabled
+			mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("protocol %s cannot be recorded", protocol)
+}
+
+func IsRecording(protocol string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return recording[protocol]
+}
+
+func GetRecording() map[string]bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make(map[string]bool, len(Recordable))
+	for _, p := range Recordable {
+		out[p] = recording[p]
+	}
+	return out
+}
+
+// RecordInteraction stores a response captured from the real upstream,
+// configuring the matching interaction (pending or new) in one step.
+func RecordInteraction(protocol, key, name string, req InteractionRequest, resp InteractionResponse) *Interaction {
+	i := RegisterInteraction(protocol, key, req)
+	ConfigureInteraction(i.ID, name, resp)
+	return i
+}
+
 // ---- TestCase helpers ----------------------------------------------------
 
 func CreateTestCase(name, description string) *TestCase {
@@ -274,6 +594,19 @@ func UpdateTestCase(id, name, description string, interactionIDs []string) error
 	return nil
 }
 
+// SetTestCaseRedisKeyspace stores a keyspace snapshot on a test case; nil
+// removes it.
+func SetTestCaseRedisKeyspace(id string, snapshot map[string]RedisEntry) error {
+	mu.Lock()
+	defer mu.Unlock()
+	tc, ok := testCases[id]
+	if !ok {
+		return fmt.Errorf("test case %s not found", id)
+	}
+	tc.RedisKeyspace = snapshot
+	return nil
+}
+
 func DeleteTestCase(id string) error {
 	mu.Lock()
 	defer mu.Unlock()
@@ -296,14 +629,21 @@ func schemaKey(protocol, tableName string) string {
 	return protocol + ":" + tableName
 }
 
+// UpsertSchema sets a table's CREATE statement, keeping its live settings.
 func UpsertSchema(protocol, tableName, createStatement string) {
 	mu.Lock()
-	defer mu.Unlock()
-	schemas[schemaKey(protocol, tableName)] = &Schema{
+	key := schemaKey(protocol, tableName)
+	s := &Schema{
 		TableName:       tableName,
 		Protocol:        protocol,
 		CreateStatement: createStatement,
 	}
+	if old, ok := schemas[key]; ok {
+		s.Live, s.Fixtures = old.Live, old.Fixtures
+	}
+	schemas[key] = s
+	mu.Unlock()
+	dropLiveTable(protocol, tableName)
 }
 
 func GetSchema(protocol, tableName string) (*Schema, bool) {
@@ -331,6 +671,7 @@ type stateFile struct {
 	Interactions map[string]*Interaction `json:"interactions"`
 	TestCases    map[string]*TestCase    `json:"testCases"`
 	Schemas      map[string]*Schema      `json:"schemas"`
+	MatchHeaders []string                `json:"matchHeaders,omitempty"`
 }
 
 func LoadState() {
@@ -354,6 +695,10 @@ func LoadState() {
 	if sf.Schemas != nil {
 		schemas = sf.Schemas
 	}
+	if sf.MatchHeaders != nil {
+		matchHeaders = canonicalHeaderNames(sf.MatchHeaders)
+	}
+	migrateKeys()
 }
 
 func SaveState() error {
@@ -362,6 +707,7 @@ func SaveState() error {
 		Interactions: interactions,
 		TestCases:    testCases,
 		Schemas:      schemas,
+		MatchHeaders: matchHeaders,
 	}
 	data, err := json.MarshalIndent(sf, "", "  ")
 	mu.RUnlock()
@@ -377,12 +723,16 @@ func LoadSuite(path string) error {
 		return fmt.Errorf("read suite: %w", err)
 	}
 	var suite struct {
-		TestCase     string         `json:"testCase"`
-		Interactions []*Interaction `json:"interactions"`
+		TestCase      string                `json:"testCase"`
+		Interactions  []*Interaction        `json:"interactions"`
+		RedisKeyspace map[string]RedisEntry `json:"redisKeyspace"`
 	}
 	if err := json.Unmarshal(data, &suite); err != nil {
 		return fmt.Errorf("parse suite: %w", err)
 	}
+	if err := RestoreRedis(suite.RedisKeyspace); err != nil {
+		return fmt.Errorf("redis keyspace: %w", err)
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	for _, i := range suite.Interactions {
@@ -390,5 +740,6 @@ func LoadSuite(path string) error {
 			interactions[i.ID] = i
 		}
 	}
+	migrateKeys()
 	return nil
 }
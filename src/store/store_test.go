@@ -0,0 +1,89 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMigrateKeys(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		stored   Interaction
+		key      string   // after migration
+		literals []string // after migration
+	}{
+		{
+			name: "raw SQL key",
+			stored: Interaction{
+				Protocol: ProtoMySQL,
+				Key:      "MYSQL select name from users where id = ?",
+				Request:  InteractionRequest{Query: "select name from users where id = ?", Params: []*string{str("7")}},
+			},
+			key: "MYSQL SELECT name FROM users WHERE id = ? [7]",
+		},
+		{
+			name: "literals are extracted",
+			stored: Interaction{
+				Protocol: ProtoPostgres,
+				Key:      "POSTGRES SELECT * FROM t WHERE a = $1 AND b = 'x'",
+				Request:  InteractionRequest{Query: "SELECT * FROM t WHERE a = $1 AND b = 'x'", Params: []*string{str("1")}},
+			},
+			key:      "POSTGRES SELECT * FROM t WHERE a = $1 AND b = ? [1, x]",
+			literals: []string{"x"},
+		},
+		{
+			name: "NULL and the text NULL stay apart",
+			stored: Interaction{
+				Protocol: ProtoMySQL,
+				Key:      "MYSQL SELECT ?, ? [NULL, NULL]",
+				Request:  InteractionRequest{Query: "SELECT ?, ?", Params: []*string{nil, str("NULL")}},
+			},
+			key: "MYSQL SELECT ?, ? [NULL, 'NULL']",
+		},
+		{
+			name: "bare key without a request",
+			stored: Interaction{
+				Protocol: ProtoPostgres,
+				Key:      "POSTGRES select 1",
+			},
+			key: "POSTGRES select 1",
+		},
+		{
+			name: "HTTP key gains the query string",
+			stored: Interaction{
+				Protocol: ProtoHTTP,
+				Key:      "GET api.example.com/orders",
+				Request:  InteractionRequest{Method: "GET", Host: "api.example.com", Path: "/orders", QueryString: "page=2"},
+			},
+			key: httpKey("GET", "api.example.com", "/orders", "page=2", nil, "", nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := interactions
+			t.Cleanup(func() { interactions = saved })
+			i := tt.stored
+			i.ID, i.State = "i", StateConfigured
+			interactions = map[string]*Interaction{"i": &i}
+
+			migrateKeys()
+			if i.Key != tt.key {
+				t.Fatalf("key = %q, want %q", i.Key, tt.key)
+			}
+			if !reflect.DeepEqual(i.Request.Literals, tt.literals) {
+				t.Errorf("literals = %q, want %q", i.Request.Literals, tt.literals)
+			}
+			migrateKeys()
+			if i.Key != tt.key {
+				t.Errorf("key after a second migration = %q, want %q", i.Key, tt.key)
+			}
+			// A statement sent today, with the same values, finds it.
+			if r := i.Request; r.Query != "" {
+				if got := lookupConfigured(i.Protocol, DBKey(i.Protocol, r.Query, r.Params), r); got != &i {
+					t.Errorf("lookup after migration = %v", got)
+				}
+			}
+		})
+	}
+}
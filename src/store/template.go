@@ -0,0 +1,245 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ---- Response templating -------------------------------------------------
+
+// TemplateData is the "." available to a templated response.
+//
+//	{{.PathParams.id}}  {{.Query.page}}  {{header "X-Request-Id"}}
+//	{{.JSON.orderId}}   {{jsonPath .JSON "$.items[0].sku"}}
+//	{{index .Args 0}}   {{index .Params 1}}   {{index .Keys 0}}
+type TemplateData struct {
+	Method     string
+	Host       string
+	Path       string
+	PathParams map[string]string
+	Query      map[string]string
+	Headers    map[string]string
+	Body       string
+	JSON       interface{}
+
+	// MySQL / Postgres; Params holds bound parameters then the literals
+	// normalization extracted from the statement, nil for SQL NULL:
+	// {{with index .Params 0}}{{.}}{{else}}null{{end}}.
+	Statement string
+	Params    []*string
+
+	// DynamoDB: the request's Key and ExpressionAttributeValues as plain
+	// JSON, e.g. {{.Key.orderId}} or {{index .Values ":customer"}}.
+	Key    interface{}
+	Values interface{}
+
+	// Redis; for scripts Args is ARGV and Keys is KEYS.
+	Command string
+	Args    []string
+	Keys    []string
+}
+
+var (
+	countersMu sync.Mutex
+	counters   = map[string]int64{}
+)
+
+func newTemplateData(req InteractionRequest, m *Matcher) TemplateData {
+	d := TemplateData{
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.Path,
+		PathParams: map[string]string{},
+		Query:      map[string]string{},
+		Headers:    req.Headers,
+		Body:       req.Body,
+		Statement:  req.Query,
+		Params:     req.SQLParams(),
+		Command:    req.Command,
+		Args:       req.Args,
+		Keys:       req.Keys,
+	}
+	if m != nil && m.PathTemplate != "" {
+		if params, ok := MatchPathTemplate(m.PathTemplate, req.Path); ok {
+			d.PathParams = params
+		}
+	}
+	if q, err := url.ParseQuery(req.QueryString); err == nil {
+		for k, v := range q {
+			if len(v) > 0 {
+				d.Query[k] = v[0]
+			}
+		}
+	}
+	if req.KeyJSON != "" {
+		json.Unmarshal([]byte(req.KeyJSON), &d.Key)
+	}
+	if req.ValuesJSON != "" {
+		json.Unmarshal([]byte(req.ValuesJSON), &d.Values)
+	}
+	if req.Body != "" {
+		json.Unmarshal([]byte(req.Body), &d.JSON)
+	}
+	return d
+}
+
+func templateFuncs(d TemplateData) template.FuncMap {
+	return template.FuncMap{
+		"header": func(name string) string { return headerValue(d.Headers, name) },
+		"jsonPath": func(v interface{}, p string) interface{} {
+			out, _ := jsonPathGet(v, p)
+			return out
+		},
+		"toJSON": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"default": func(def, v interface{}) interface{} {
+			if v == nil || v == "" {
+				return def
+			}
+			return v
+		},
+		"uuid":        newUUID,
+		"now":         time.Now,
+		"timestamp":   func() int64 { return time.Now().Unix() },
+		"timestampMs": func() int64 { return time.Now().UnixMilli() },
+		"counter": func(name string) int64 {
+			countersMu.Lock()
+			defer countersMu.Unlock()
+			counters[name]++
+			return counters[name]
+		},
+		"randInt":    randInt,
+		"randString": randString,
+		"randChoice": func(choices ...string) string {
+			if len(choices) == 0 {
+				return ""
+			}
+			return choices[randInt(0, len(choices)-1)]
+		},
+	}
+}
+
+// renderTemplate executes s as a Go text/template. On error the raw text is
+// returned so a typo never turns a mock into a crash.
+func renderTemplate(s string, d TemplateData) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	t, err := template.New("response").Funcs(templateFuncs(d)).Option("missingkey=zero").Parse(s)
+	if err != nil {
+		log.Printf("warn: response template: %v", err)
+		return s
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, d); err != nil {
+		log.Printf("warn: response template: %v", err)
+		return s
+	}
+	return buf.String()
+}
+
+// ResolveConfigured finds the configured interaction that answers a request
+// and returns it with the response to play back: the next one in its
+// sequence, rendered against req when it is a template. The lookup, the
+// scenario check and the sequence advance happen under one lock, so two
+// concurrent requests cannot both take a scenario's transition. i is nil
+// when no configured interaction answers; a nil response means its
+// sequence is exhausted and the caller should answer with an error. The
+// stored response is never modified.
+func ResolveConfigured(protocol, key string, req InteractionRequest) (i *Interaction, resp *InteractionResponse) {
+	mu.Lock()
+	i = lookupConfigured(protocol, key, req)
+	if i == nil {
+		mu.Unlock()
+		return nil, nil
+	}
+	resp, m := nextResponse(i), i.Matcher
+	mu.Unlock()
+	if resp == nil || !resp.Template {
+		return i, resp
+	}
+
+	d := newTemplateData(req, m)
+	out := *resp
+	out.Body = renderTemplate(resp.Body, d)
+	out.Value = renderTemplate(resp.Value, d)
+	if resp.RESP != nil {
+		r := *resp.RESP
+		r.Value = renderRESP(r.Value, d)
+		out.RESP = &r
+	}
+	out.ItemJSON = renderTemplate(resp.ItemJSON, d)
+	if resp.Headers != nil {
+		out.Headers = make(map[string]string, len(resp.Headers))
+		for k, v := range resp.Headers {
+			out.Headers[k] = renderTemplate(v, d)
+		}
+	}
+	if resp.HeaderValues != nil {
+		out.HeaderValues = make(map[string][]string, len(resp.HeaderValues))
+		for k, vs := range resp.HeaderValues {
+			for _, v := range vs {
+				out.HeaderValues[k] = append(out.HeaderValues[k], renderTemplate(v, d))
+			}
+		}
+	}
+	if resp.Error != nil {
+		e := *resp.Error
+		e.Message = renderTemplate(e.Message, d)
+		e.Detail = renderTemplate(e.Detail, d)
+		out.Error = &e
+	}
+	if resp.Rows != nil {
+		out.Rows = make([]map[string]interface{}, len(resp.Rows))
+		for idx, row := range resp.Rows {
+			r := make(map[string]interface{}, len(row))
+			for k, v := range row {
+				if s, ok := v.(string); ok {
+					v = renderTemplate(s, d)
+				}
+				r[k] = v
+			}
+			out.Rows[idx] = r
+		}
+	}
+	return i, &out
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func randInt(min, max int) int {
+	if max <= min {
+		return min
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
+	if err != nil {
+		return min
+	}
+	return min + int(n.Int64())
+}
+
+func randString(n int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	for idx := range b {
+		b[idx] = alphabet[randInt(0, len(alphabet)-1)]
+	}
+	return string(b)
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ---- Transactions --------------------------------------------------------
+
+const (
+	TxOpen       = "open"
+	TxCommitted  = "committed"
+	TxRolledBack = "rolled_back"
+	TxAborted    = "aborted" // the connection closed before COMMIT or ROLLBACK
+
+	// maxTransactions bounds the journal; the oldest entries go first.
+	maxTransactions = 1000
+)
+
+// Transaction is one BEGIN … COMMIT / ROLLBACK on a database connection,
+// with the statements that ran inside it.
+type Transaction struct {
+	ID         string        `json:"id"`
+	Protocol   string        `json:"protocol"`
+	ConnID     int64         `json:"connId"` // MySQL connection id, Postgres backend pid
+	Status     string        `json:"status"`
+	Statements []TxStatement `json:"statements"`
+	StartedAt  time.Time     `json:"startedAt"`
+	EndedAt    *time.Time    `json:"endedAt,omitempty"`
+
+	savepoints []txSavepoint
+}
+
+// TxStatement is a statement run inside a transaction. InteractionID is
+// empty for statements the mock answered itself (SAVEPOINT, SET, …).
+type TxStatement struct {
+	Query         string `json:"query"`
+	InteractionID string `json:"interactionId,omitempty"`
+	Failed        bool   `json:"failed,omitempty"`
+	// RolledBack is set when a ROLLBACK TO SAVEPOINT undid the statement.
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+type txSavepoint struct {
+	name string
+	at   int // len(Statements) when the savepoint was set
+}
+
+var (
+	// Runtime journal, cleared with ClearTransactions and never persisted.
+	txMu         sync.Mutex
+	transactions []*Transaction
+	txByID       = map[string]*Transaction{}
+)
+
+// BeginTransaction opens a journal entry and returns its ID.
+func BeginTransaction(protocol string, connID int64) string {
+	txMu.Lock()
+	defer txMu.Unlock()
+	now := time.Now()
+	tx := &Transaction{
+		ID:         fmt.Sprintf("%d", now.UnixNano()),
+		Protocol:   protocol,
+		ConnID:     connID,
+		Status:     TxOpen,
+		Statements: []TxStatement{},
+		StartedAt:  now,
+	}
+	transactions = append(transactions, tx)
+	txByID[tx.ID] = tx
+	if len(transactions) > maxTransactions {
+		delete(txByID, transactions[0].ID)
+		transactions = transactions[1:]
+	}
+	return tx.ID
+}
+
+// RecordTxStatement appends a statement to an open transaction.
+func RecordTxStatement(id, query, interactionID string, failed bool) {
+	txMu.Lock()
+	defer txMu.Unlock()
+	if tx, ok := txByID[id]; ok && tx.Status == TxOpen {
+		tx.Statements = append(tx.Statements, TxStatement{Query: query, InteractionID: interactionID, Failed: failed})
+	}
+}
+
+// Savepoint marks the current position of a transaction. A savepoint with
+// the same name as an earlier one hides it until released.
+func Savepoint(id, name string) {
+	txMu.Lock()
+	defer txMu.Unlock()
+	if tx, ok := txByID[id]; ok {
+		tx.savepoints = append(tx.savepoints, txSavepoint{name: name, at: len(tx.Statements)})
+	}
+}
+
+// ReleaseSavepoint forgets a savepoint and every one set after it.
+func ReleaseSavepoint(id, name string) bool {
+	txMu.Lock()
+	defer txMu.Unlock()
+	tx, ok := txByID[id]
+	if !ok {
+		return false
+	}
+	if n := tx.findSavepoint(name); n != -1 {
+		tx.savepoints = tx.savepoints[:n]
+		return true
+	}
+	return false
+}
+
+// RollbackToSavepoint marks the statements run since a savepoint as rolled
+// back. The savepoint itself stays; later ones are forgotten.
+func RollbackToSavepoint(id, name string) bool {
+	txMu.Lock()
+	defer txMu.Unlock()
+	tx, ok := txByID[id]
+	if !ok {
+		return false
+	}
+	n := tx.findSavepoint(name)
+	if n == -1 {
+		return false
+	}
+	for i := tx.savepoints[n].at; i < len(tx.Statements); i++ {
+		tx.Statements[i].RolledBack = true
+	}
+	tx.savepoints = tx.savepoints[:n+1]
+	return true
+}
+
+// findSavepoint returns the index of the latest savepoint called name, or
+// -1. Caller holds txMu.
+func (tx *Transaction) findSavepoint(name string) int {
+	for n := len(tx.savepoints) - 1; n >= 0; n-- {
+		if tx.savepoints[n].name == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// EndTransaction closes a transaction with TxCommitted, TxRolledBack or
+// TxAborted.
+func EndTransaction(id, status string) {
+	txMu.Lock()
+	defer txMu.Unlock()
+	if tx, ok := txByID[id]; ok && tx.Status == TxOpen {
+		now := time.Now()
+		tx.Status = status
+		tx.EndedAt = &now
+		tx.savepoints = nil
+	}
+}
+
+// GetTransactions returns the journal, oldest first, optionally limited to
+// one protocol and to transactions in which any of interactionIDs answered
+// a statement.
+func GetTransactions(protocol string, interactionIDs []string) []Transaction {
+	txMu.Lock()
+	defer txMu.Unlock()
+	want := map[string]bool{}
+	for _, id := range interactionIDs {
+		want[id] = true
+	}
+	out := []Transaction{}
+	for _, tx := range transactions {
+		if protocol != "" && tx.Protocol != protocol {
+			continue
+		}
+		if interactionIDs != nil && !tx.touches(want) {
+			continue
+		}
+		c := *tx
+		c.Statements = append([]TxStatement{}, tx.Statements...)
+		c.savepoints = nil
+		out = append(out, c)
+	}
+	return out
+}
+
+func (tx *Transaction) touches(ids map[string]bool) bool {
+	for _, s := range tx.Statements {
+		if ids[s.InteractionID] {
+			return true
+		}
+	}
+	return false
+}
+
+// ClearTransactions empties the journal. Transactions still open on a
+// connection are no longer recorded.
+func ClearTransactions() {
+	txMu.Lock()
+	defer txMu.Unlock()
+	transactions = nil
+	txByID = map[string]*Transaction{}
+}
@@ -1,4 +1,4 @@
-import type { Interaction, InteractionResponse, TestCase, Schema } from '../types'
+import type { Interaction, InteractionResponse, TestCase, Schema, RedisEntry, RedisCluster } from '../types'
 
 async function json<T>(path: string, init?: RequestInit): Promise<T> {
   const res = await fetch(path, init)
@@ -34,6 +34,8 @@ export const api = {
       }),
     delete: (id: string) => json<void>(`/api/testcases/${id}`, { method: 'DELETE' }),
     exportUrl: (id: string) => `/api/testcases/${id}/export`,
+    snapshotRedis: (id: string) => json<void>(`/api/testcases/${id}/redis-snapshot`, { method: 'POST' }),
+    restoreRedis: (id: string) => json<void>(`/api/testcases/${id}/redis-restore`, { method: 'POST' }),
   },
   schemas: {
     all: () => json<Schema[]>('/api/schemas'),
@@ -44,6 +46,34 @@ export const api = {
         body: JSON.stringify({ protocol, tableName, createStatement }),
       }),
   },
+  live: {
+    rows: (protocol: string, table: string) =>
+      json<Record<string, unknown>[]>(`/api/live/${protocol}/${encodeURIComponent(table)}`),
+    reset: () => json<void>('/api/live/reset', { method: 'POST' }),
+  },
+  redis: {
+    keyspace: () => json<Record<string, RedisEntry>>('/api/redis/keyspace'),
+    flush: () => json<void>('/api/redis/keyspace', { method: 'DELETE' }),
+    publish: (channel: string, message: string) =>
+      json<{ receivers: number }>('/api/redis/publish', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ channel, message }),
+      }),
+    addStreamEntry: (key: string, fields: Record<string, string>, id?: string) =>
+      json<{ id: string }>(`/api/redis/streams/${encodeURIComponent(key)}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id, fields }),
+      }),
+    cluster: () => json<RedisCluster>('/api/redis/cluster'),
+    moveSlot: (slot: number, action: 'migrate' | 'assign', node: number) =>
+      json<void>(`/api/redis/cluster/slots/${slot}/${action}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ node }),
+      }),
+  },
   import: (file: string) =>
     json<TestCase>('/api/import', {
       method: 'POST',
@@ -9,14 +9,27 @@ interface Props {
 export default function DynamoDbForm({ interaction: i, onSave }: Props) {
   const [name, setName]     = useState(i.name || '')
   const [itemJSON, setItem] = useState(i.response?.itemJSON ?? '{}')
+  const [errType, setErrType] = useState(i.response?.error?.type ?? '')
+  const [errMsg, setErrMsg]   = useState(i.response?.error?.message ?? '')
+
+  const r = i.request
+  const index = r.indexName ? ` (index ${r.indexName})` : ''
+  const save = () => onSave(name, errType
+    ? { itemJSON, error: { type: errType, message: errMsg } }
+    : { itemJSON })
 
   return (
     <div style={{ display: 'flex', flexDirection: 'column', gap: 12 }}>
-      <ReadOnly label="Operation" value={`${i.request.operation ?? 'Unknown'} on ${i.request.table ?? 'unknown table'}`} />
-      <ReadOnly label="Key" value={i.request.keyJSON ?? ''} />
+      <ReadOnly label="Operation" value={`${r.operation ?? 'Unknown'} on ${r.table ?? 'unknown table'}${index}`} />
+      {r.keyCondition
+        ? <ReadOnly label="Key condition" value={r.keyCondition + (r.limit ? `  limit ${r.limit}` : '')} />
+        : <ReadOnly label="Key" value={r.keyJSON ?? ''} />}
+      {r.startKeyJSON && <ReadOnly label="Exclusive start key" value={r.startKeyJSON} />}
       <Field label="Name / label" value={name} onChange={setName} />
-      <TextArea label="Item JSON to return" value={itemJSON} onChange={setItem} rows={10} />
-      <button onClick={() => onSave(name, { itemJSON })}
+      <TextArea label="Item JSON to return (plain JSON; an array of items for Query / Scan)" value={itemJSON} onChange={setItem} rows={10} />
+      <Field label="Error type (optional, e.g. ConditionalCheckFailedException)" value={errType} onChange={setErrType} />
+      {errType && <Field label="Error message" value={errMsg} onChange={setErrMsg} />}
+      <button onClick={save}
         style={{ background: '#7c3aed', color: '#fff', border: 'none', padding: '8px 16px', borderRadius: 4, cursor: 'pointer', fontWeight: 600, alignSelf: 'flex-start' }}>
         Save mock
       </button>
@@ -24,7 +24,7 @@ export default function HttpForm({ interaction: i, onSave }: Props) {
   return (
     <div style={{ display: 'flex', flexDirection: 'column', gap: 12 }}>
       <div style={{ fontFamily: 'monospace', fontSize: 13, color: '#7c3aed' }}>
-        {i.request.method} {i.request.host}{i.request.path}
+        {i.request.method} {i.request.host}{i.request.path}{i.request.queryString ? `?${i.request.queryString}` : ''}
       </div>
       <Field label="Name / label" value={name} onChange={setName} />
       <div style={{ display: 'flex', gap: 12 }}>
@@ -13,6 +13,11 @@ export default function MySqlForm({ interaction: i, existingSchema, onSave, onSa
   const [name, setName]             = useState(i.name || '')
   const [rows, setRows]             = useState(i.response?.rows ? JSON.stringify(i.response.rows, null, 2) : '[]')
   const [affectedRows, setAffected] = useState(i.response?.affectedRows ?? 1)
+  const [lastInsertId, setInsertId] = useState(i.response?.lastInsertId ?? 0)
+  const [fails, setFails]           = useState(!!i.response?.error)
+  const [errCode, setErrCode]       = useState(i.response?.error?.code ?? 1062)
+  const [sqlState, setSqlState]     = useState(i.response?.error?.sqlState ?? '23000')
+  const [errMsg, setErrMsg]         = useState(i.response?.error?.message ?? '')
   const [schema, setSchema]         = useState(existingSchema ?? '')
   const [tableName, setTableName]   = useState('')
   const needsSchema = !existingSchema
@@ -21,15 +26,26 @@ export default function MySqlForm({ interaction: i, existingSchema, onSave, onSa
     if (needsSchema && tableName && schema) {
       onSaveSchema(tableName, schema)
     }
-    const response: InteractionResponse = isSelect
-      ? { rows: JSON.parse(rows) }
-      : { affectedRows }
+    const response: InteractionResponse = fails
+      ? { error: { code: errCode, sqlState, message: errMsg } }
+      : isSelect
+        ? { rows: JSON.parse(rows) }
+        : { affectedRows, lastInsertId: lastInsertId || undefined }
     onSave(name, response)
   }
 
   return (
     <div style={{ display: 'flex', flexDirection: 'column', gap: 12 }}>
       <ReadOnly label="SQL query" value={i.request.query ?? ''} />
+      {i.request.params && i.request.params.length > 0 && (
+        <ReadOnly label="Parameters" value={i.request.params.map(p => p ?? 'NULL').join(', ')} />
+      )}
+      {i.request.literals && i.request.literals.length > 0 && (
+        <ReadOnly label="Literals" value={i.request.literals.join(', ')} />
+      )}
+      {i.request.user && (
+        <ReadOnly label="Connection" value={`${i.request.user}${i.request.database ? ` @ ${i.request.database}` : ''}${i.request.connAttrs?.program_name ? ` (${i.request.connAttrs.program_name})` : ''}`} />
+      )}
       {needsSchema && (
         <>
           <Field label="Table name" value={tableName} onChange={setTableName} />
@@ -37,10 +53,21 @@ export default function MySqlForm({ interaction: i, existingSchema, onSave, onSa
         </>
       )}
       <Field label="Name / label" value={name} onChange={setName} />
-      {isSelect
+      <Checkbox label="Fail with an ERR packet" checked={fails} onChange={setFails} />
+      {fails && (
+        <>
+          <NumberField label="Error code" value={errCode} onChange={setErrCode} />
+          <Field label="SQLSTATE" value={sqlState} onChange={setSqlState} />
+          <Field label="Message" value={errMsg} onChange={setErrMsg} />
+        </>
+      )}
+      {!fails && (isSelect
         ? <TextArea label="Rows to return (JSON array)" value={rows} onChange={setRows} rows={8} />
-        : <NumberField label="Affected rows" value={affectedRows} onChange={setAffected} />
-      }
+        : <>
+            <NumberField label="Affected rows" value={affectedRows} onChange={setAffected} />
+            <NumberField label="Last insert ID (0 = none)" value={lastInsertId} onChange={setInsertId} />
+          </>
+      )}
       <SaveButton onClick={handleSave} />
     </div>
   )
@@ -63,6 +90,9 @@ function NumberField({ label, value, onChange }: { label: string; value: number;
 function TextArea({ label, value, onChange, rows }: { label: string; value: string; onChange: (v: string) => void; rows: number }) {
   return <label style={{ display: 'flex', flexDirection: 'column', gap: 4 }}><small style={{ color: '#94a3b8' }}>{label}</small><textarea rows={rows} value={value} onChange={e => onChange(e.target.value)} style={{ background: '#1e293b', border: '1px solid #334155', color: '#e2e8f0', padding: '6px 8px', borderRadius: 4, fontFamily: 'monospace', fontSize: 12, resize: 'vertical' }} /></label>
 }
+function Checkbox({ label, checked, onChange }: { label: string; checked: boolean; onChange: (v: boolean) => void }) {
+  return <label style={{ display: 'flex', alignItems: 'center', gap: 6, color: '#e2e8f0' }}><input type="checkbox" checked={checked} onChange={e => onChange(e.target.checked)} /><small>{label}</small></label>
+}
 function SaveButton({ onClick }: { onClick: () => void }) {
   return <button onClick={onClick} style={{ background: '#7c3aed', color: '#fff', border: 'none', padding: '8px 16px', borderRadius: 4, cursor: 'pointer', fontWeight: 600, alignSelf: 'flex-start' }}>Save mock</button>
 }
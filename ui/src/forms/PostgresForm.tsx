@@ -10,9 +10,15 @@ interface Props {
 
 export default function PostgresForm({ interaction: i, existingSchema, onSave, onSaveSchema }: Props) {
   const isSelect = i.request.query?.trim().toUpperCase().startsWith('SELECT') ?? false
+  const returning = /\bRETURNING\b/i.test(i.request.query ?? '')
   const [name, setName]             = useState(i.name || '')
   const [rows, setRows]             = useState(i.response?.rows ? JSON.stringify(i.response.rows, null, 2) : '[]')
   const [affectedRows, setAffected] = useState(i.response?.affectedRows ?? 1)
+  const [fails, setFails]           = useState(!!i.response?.error)
+  const [sqlState, setSqlState]     = useState(i.response?.error?.sqlState ?? '23505')
+  const [errMsg, setErrMsg]         = useState(i.response?.error?.message ?? '')
+  const [detail, setDetail]         = useState(i.response?.error?.detail ?? '')
+  const [constraint, setConstraint] = useState(i.response?.error?.constraint ?? '')
   const [schema, setSchema]         = useState(existingSchema ?? '')
   const [tableName, setTableName]   = useState('')
   const needsSchema = !existingSchema
@@ -21,15 +27,25 @@ export default function PostgresForm({ interaction: i, existingSchema, onSave, o
     if (needsSchema && tableName && schema) {
       onSaveSchema(tableName, schema)
     }
-    const response: InteractionResponse = isSelect
-      ? { rows: JSON.parse(rows) }
-      : { affectedRows }
+    const response: InteractionResponse = fails
+      ? { error: { sqlState, message: errMsg, detail: detail || undefined, constraint: constraint || undefined } }
+      : isSelect
+        ? { rows: JSON.parse(rows) }
+        : returning
+          ? { rows: JSON.parse(rows), affectedRows }
+          : { affectedRows }
     onSave(name, response)
   }
 
   return (
     <div style={{ display: 'flex', flexDirection: 'column', gap: 12 }}>
       <ReadOnly label="SQL query" value={i.request.query ?? ''} />
+      {i.request.params && i.request.params.length > 0 && (
+        <ReadOnly label="Parameters" value={i.request.params.map(p => p ?? 'NULL').join(', ')} />
+      )}
+      {i.request.literals && i.request.literals.length > 0 && (
+        <ReadOnly label="Literals" value={i.request.literals.join(', ')} />
+      )}
       {needsSchema && (
         <>
           <Field label="Table name" value={tableName} onChange={setTableName} />
@@ -37,10 +53,19 @@ export default function PostgresForm({ interaction: i, existingSchema, onSave, o
         </>
       )}
       <Field label="Name / label" value={name} onChange={setName} />
-      {isSelect
-        ? <TextArea label="Rows to return (JSON array)" value={rows} onChange={setRows} rows={8} />
-        : <NumberField label="Affected rows" value={affectedRows} onChange={setAffected} />
-      }
+      <Checkbox label="Fail with an ErrorResponse" checked={fails} onChange={setFails} />
+      {fails && (
+        <>
+          <Field label="SQLSTATE" value={sqlState} onChange={setSqlState} />
+          <Field label="Message" value={errMsg} onChange={setErrMsg} />
+          <Field label="Detail" value={detail} onChange={setDetail} />
+          <Field label="Constraint" value={constraint} onChange={setConstraint} />
+        </>
+      )}
+      {!fails && (isSelect || returning) && (
+        <TextArea label={returning ? 'RETURNING rows (JSON array)' : 'Rows to return (JSON array)'} value={rows} onChange={setRows} rows={8} />
+      )}
+      {!fails && !isSelect && <NumberField label="Affected rows" value={affectedRows} onChange={setAffected} />}
       <SaveButton onClick={handleSave} />
     </div>
   )
@@ -58,6 +83,9 @@ function NumberField({ label, value, onChange }: { label: string; value: number;
 function TextArea({ label, value, onChange, rows }: { label: string; value: string; onChange: (v: string) => void; rows: number }) {
   return <label style={{ display: 'flex', flexDirection: 'column', gap: 4 }}><small style={{ color: '#94a3b8' }}>{label}</small><textarea rows={rows} value={value} onChange={e => onChange(e.target.value)} style={{ background: '#1e293b', border: '1px solid #334155', color: '#e2e8f0', padding: '6px 8px', borderRadius: 4, fontFamily: 'monospace', fontSize: 12, resize: 'vertical' }} /></label>
 }
+function Checkbox({ label, checked, onChange }: { label: string; checked: boolean; onChange: (v: boolean) => void }) {
+  return <label style={{ display: 'flex', alignItems: 'center', gap: 6, color: '#e2e8f0' }}><input type="checkbox" checked={checked} onChange={e => onChange(e.target.checked)} /><small>{label}</small></label>
+}
 function SaveButton({ onClick }: { onClick: () => void }) {
   return <button onClick={onClick} style={{ background: '#7c3aed', color: '#fff', border: 'none', padding: '8px 16px', borderRadius: 4, cursor: 'pointer', fontWeight: 600, alignSelf: 'flex-start' }}>Save mock</button>
 }
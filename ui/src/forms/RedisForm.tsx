@@ -1,31 +1,87 @@
 import { useState } from 'react'
-import type { Interaction, InteractionResponse } from '../types'
+import type { Interaction, InteractionResponse, RESPType } from '../types'
 
 interface Props {
   interaction: Interaction
   onSave: (name: string, response: InteractionResponse) => void
 }
 
+const RESP_TYPES: RESPType[] = ['bulk', 'simple', 'integer', 'double', 'boolean', 'null', 'error', 'array', 'set', 'map']
+
+// Types whose value is entered as JSON rather than text
+const JSON_TYPES: RESPType[] = ['array', 'set', 'map', 'boolean']
+
+function initialText(i: Interaction): string {
+  const resp = i.response?.resp
+  if (!resp) return i.response?.value ?? ''
+  if (resp.value === undefined) return ''
+  return typeof resp.value === 'string' ? resp.value : JSON.stringify(resp.value, null, 2)
+}
+
 export default function RedisForm({ interaction: i, onSave }: Props) {
   const [name, setName]   = useState(i.name || '')
-  const [value, setValue] = useState(i.response?.value ?? '')
+  const [type, setType]   = useState<RESPType>(i.response?.resp?.type ?? 'bulk')
+  const [value, setValue] = useState(initialText(i))
+  const [err, setErr]     = useState('')
+
+  const save = () => {
+    // A plain bulk string keeps the original value field
+    if (type === 'bulk' && !i.response?.resp) {
+      onSave(name, { value })
+      return
+    }
+    let v: unknown = value
+    try {
+      if (JSON_TYPES.includes(type)) v = JSON.parse(value || 'null')
+      else if (type === 'integer' || type === 'double') v = Number(value)
+      else if (type === 'null') v = undefined
+    } catch (e) {
+      setErr(`Invalid JSON: ${(e as Error).message}`)
+      return
+    }
+    setErr('')
+    onSave(name, { resp: { type, value: v } })
+  }
 
   return (
     <div style={{ display: 'flex', flexDirection: 'column', gap: 12 }}>
-      <div style={{ fontFamily: 'monospace', fontSize: 13, color: '#7c3aed' }}>
-        {i.request.command} {(i.request.args ?? []).join(' ')}
-      </div>
+      {i.request.scriptSha ? (
+        <div style={{ display: 'flex', flexDirection: 'column', gap: 6, fontFamily: 'monospace', fontSize: 13 }}>
+          <div style={{ color: '#7c3aed' }}>{i.request.command} {i.request.scriptSha}</div>
+          <div><small style={{ color: '#94a3b8' }}>KEYS</small> {(i.request.keys ?? []).join(' ')}</div>
+          <div><small style={{ color: '#94a3b8' }}>ARGV</small> {(i.request.args ?? []).join(' ')}</div>
+          <pre style={{ background: '#0f172a', border: '1px solid #334155', color: '#e2e8f0', padding: 8, borderRadius: 4, margin: 0, fontSize: 12, maxHeight: 240, overflow: 'auto' }}>
+            {i.request.script ?? '(script body unknown — loaded before capture)'}
+          </pre>
+        </div>
+      ) : (
+        <div style={{ fontFamily: 'monospace', fontSize: 13, color: '#7c3aed' }}>
+          {i.request.command} {(i.request.args ?? []).join(' ')}
+        </div>
+      )}
       <label style={{ display: 'flex', flexDirection: 'column', gap: 4 }}>
         <small style={{ color: '#94a3b8' }}>Name / label</small>
         <input value={name} onChange={e => setName(e.target.value)}
           style={{ background: '#1e293b', border: '1px solid #334155', color: '#e2e8f0', padding: '6px 8px', borderRadius: 4 }} />
       </label>
       <label style={{ display: 'flex', flexDirection: 'column', gap: 4 }}>
-        <small style={{ color: '#94a3b8' }}>Return value</small>
-        <textarea rows={4} value={value} onChange={e => setValue(e.target.value)}
-          style={{ background: '#1e293b', border: '1px solid #334155', color: '#e2e8f0', padding: '6px 8px', borderRadius: 4, fontFamily: 'monospace', fontSize: 12, resize: 'vertical' }} />
+        <small style={{ color: '#94a3b8' }}>Reply type</small>
+        <select value={type} onChange={e => setType(e.target.value as RESPType)}
+          style={{ background: '#1e293b', border: '1px solid #334155', color: '#e2e8f0', padding: '6px 8px', borderRadius: 4 }}>
+          {RESP_TYPES.map(t => <option key={t} value={t}>{t}</option>)}
+        </select>
       </label>
-      <button onClick={() => onSave(name, { value })}
+      {type !== 'null' && (
+        <label style={{ display: 'flex', flexDirection: 'column', gap: 4 }}>
+          <small style={{ color: '#94a3b8' }}>
+            {JSON_TYPES.includes(type) ? 'Return value (JSON)' : 'Return value'}
+          </small>
+          <textarea rows={4} value={value} onChange={e => setValue(e.target.value)}
+            style={{ background: '#1e293b', border: '1px solid #334155', color: '#e2e8f0', padding: '6px 8px', borderRadius: 4, fontFamily: 'monospace', fontSize: 12, resize: 'vertical' }} />
+        </label>
+      )}
+      {err && <small style={{ color: '#ef4444' }}>{err}</small>}
+      <button onClick={save}
         style={{ background: '#7c3aed', color: '#fff', border: 'none', padding: '8px 16px', borderRadius: 4, cursor: 'pointer', fontWeight: 600, alignSelf: 'flex-start' }}>
         Save mock
       </button>
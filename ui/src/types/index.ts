@@ -1,22 +1,69 @@
 export type Protocol = 'HTTP' | 'MYSQL' | 'POSTGRES' | 'REDIS' | 'DYNAMODB'
-export type InteractionState = 'pending' | 'configured'
+export type InteractionState = 'pending' | 'configured' | 'live'
 
 export interface InteractionRequest {
   method?: string
   host?: string
   path?: string
+  queryString?: string
   headers?: Record<string, string>
   body?: string
   bodyHash?: string
-  // DynamoDB
+  // DynamoDB; keyJSON and valuesJSON are plain JSON
   operation?: string
   table?: string
   keyJSON?: string
+  indexName?: string
+  keyCondition?: string
+  valuesJSON?: string
+  limit?: number
+  startKeyJSON?: string
+  returnValues?: string
   // DB
   query?: string
-  // Redis
+  // null for a parameter bound as SQL NULL
+  params?: (string | null)[]
+  literals?: string[]
+  user?: string
+  database?: string
+  connAttrs?: Record<string, string>
+  // Redis; for EVAL/EVALSHA args is ARGV
   command?: string
   args?: string[]
+  script?: string
+  scriptSha?: string
+  keys?: string[]
+}
+
+export interface ErrorReply {
+  statusCode?: number
+  code?: number
+  sqlState?: string
+  message?: string
+  // DynamoDB error type, e.g. ConditionalCheckFailedException
+  type?: string
+  // Postgres only
+  detail?: string
+  hint?: string
+  table?: string
+  constraint?: string
+}
+
+export interface Fault {
+  rate?: number
+  latency?: {
+    distribution?: 'fixed' | 'uniform' | 'normal'
+    ms?: number
+    minMs?: number
+    maxMs?: number
+    meanMs?: number
+    stdDevMs?: number
+  }
+  reset?: boolean
+  dropAfterBytes?: number
+  trickleBytes?: number
+  trickleDelayMs?: number
+  error?: ErrorReply
 }
 
 export interface InteractionResponse {
@@ -28,10 +75,54 @@ export interface InteractionResponse {
   // DB
   rows?: Record<string, unknown>[]
   affectedRows?: number
+  lastInsertId?: number
+  commandTag?: string
+  error?: ErrorReply
   // DynamoDB
   itemJSON?: string
-  // Redis
+  // Redis: a typed reply; without one, value is sent as a bulk string
   value?: string
+  resp?: RESPValue
+  // Render string fields as Go templates against the request
+  template?: boolean
+  fault?: Fault
+}
+
+export type RESPType =
+  | 'simple' | 'error' | 'integer' | 'bulk' | 'null'
+  | 'array' | 'map' | 'set' | 'double' | 'boolean' | 'push'
+
+// Elements of array, set and map values may be RESPValues or plain JSON
+export interface RESPValue {
+  type: RESPType
+  value?: unknown
+}
+
+export interface HeaderPredicate {
+  name: string
+  equals?: string
+  contains?: string
+  regex?: string
+  absent?: boolean
+}
+
+export interface Matcher {
+  priority?: number
+  method?: string
+  host?: string
+  pathTemplate?: string
+  pathRegex?: string
+  query?: Record<string, string>
+  headers?: HeaderPredicate[]
+  bodyJSON?: { path: string; equals: unknown }[]
+  bodyIgnore?: string[]
+  queryPattern?: string
+  queryRegex?: string
+  command?: string
+  // null matches only a SQL parameter bound as NULL
+  args?: (string | null)[]
+  scriptSha?: string
+  keys?: string[]
 }
 
 export interface Interaction {
@@ -41,6 +132,12 @@ export interface Interaction {
   name: string
   request: InteractionRequest
   response?: InteractionResponse
+  matcher?: Matcher
+  responses?: InteractionResponse[]
+  sequencePolicy?: 'repeat_last' | 'cycle' | 'fail'
+  scenario?: string
+  requiredState?: string
+  newState?: string
   state: InteractionState
   testCaseId: string
   capturedAt: string
@@ -52,10 +149,36 @@ export interface TestCase {
   description?: string
   interactionIds: string[]
   createdAt: string
+  // Redis keyspace the test case starts from on replay
+  redisKeyspace?: Record<string, RedisEntry>
+}
+
+export interface RedisEntry {
+  type: 'string' | 'hash' | 'list' | 'set' | 'zset' | 'stream'
+  string?: string
+  hash?: Record<string, string>
+  list?: string[]
+  set?: string[]
+  zset?: Record<string, number>
+  // Fields alternate names and values
+  stream?: { id: string; fields: string[] }[]
+  // Consumer group → last delivered ID
+  groups?: Record<string, string>
+  ttlMs?: number
+}
+
+export interface RedisCluster {
+  // Slot ranges are [first, last]
+  nodes: { id: string; port: number; slots: [number, number][] }[]
+  // Slot → node it is migrating to
+  migrating: Record<string, number>
 }
 
 export interface Schema {
   tableName: string
   protocol: 'MYSQL' | 'POSTGRES'
   createStatement: string
+  // Live mode: the mocks run statements on in-memory rows seeded from fixtures
+  live?: boolean
+  fixtures?: Record<string, unknown>[]
 }